@@ -0,0 +1,84 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+// amqpTestAcknowledger records acks and nacks per delivery tag.
+type amqpTestAcknowledger struct {
+	acked   []uint64
+	requeue []uint64
+}
+
+func (ack *amqpTestAcknowledger) Ack(tag uint64, multiple bool) error {
+	ack.acked = append(ack.acked, tag)
+	return nil
+}
+
+func (ack *amqpTestAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	if requeue {
+		ack.requeue = append(ack.requeue, tag)
+	}
+	return nil
+}
+
+func (ack *amqpTestAcknowledger) Reject(tag uint64, requeue bool) error {
+	return ack.Nack(tag, false, requeue)
+}
+
+func TestAMQPAcknowledge(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	router := newTestStreamRouter("amqpTestAcknowledge")
+
+	conf := core.NewPluginConfig("amqpTestAcknowledgeConsumer", "consumer.AMQP")
+	conf.Override("Streams", "amqpTestAcknowledge")
+	conf.Override("Address", "amqp://127.0.0.1:1/")
+	conf.Override("ReconnectDelaySec", 3600)
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+	cons := plugin.(*AMQP)
+
+	acknowledger := new(amqpTestAcknowledger)
+	newDelivery := func(tag uint64, body string) amqp.Delivery {
+		return amqp.Delivery{
+			Acknowledger: acknowledger,
+			DeliveryTag:  tag,
+			RoutingKey:   "orders",
+			Body:         []byte(body),
+		}
+	}
+
+	stop := startTestConsumer(t, cons)
+	delivery := newDelivery(1, "active")
+	cons.acknowledge(delivery, cons.enqueue(delivery))
+	stop()
+
+	// Deliveries received while the consumer is stopping are requeued
+	delivery = newDelivery(2, "stopped")
+	cons.acknowledge(delivery, cons.enqueue(delivery))
+
+	expect.Equal([]uint64{1}, acknowledger.acked)
+	expect.Equal([]uint64{2}, acknowledger.requeue)
+	expect.Equal([]string{"active"}, router.payloads())
+
+	messages := router.getMessages()
+	expect.Equal("orders", messages[0].GetMetadata().GetValueString("routing_key"))
+}
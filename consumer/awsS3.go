@@ -0,0 +1,602 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo"
+)
+
+// AwsS3 consumer
+//
+// This consumer reads objects from an AWS S3 bucket and enqueues them line by
+// line. Objects are either found by listing a bucket prefix or by receiving
+// S3 event notifications from an SQS queue. Compressed objects are
+// decompressed transparently. This consumer can be used to replay data
+// written by producer.AwsS3.
+//
+// When listing, objects are processed in the order of their modification
+// time and the processed objects are stored in "OffsetFile". S3 reports the
+// start of an upload as the modification time, so objects may appear after
+// objects with a later modification time have been processed. Such objects are
+// still read if they have been modified less than "GracePeriodMin" before the
+// last processed object. Keys do not need to increase over time, i.e. objects
+// can be partitioned by e.g. host or date. An object is marked as processed
+// after all of its lines have been enqueued. If the consumer is stopped while
+// reading an object, the object is read again from the start on the next run.
+//
+// When using SQS, a notification is deleted from the queue after all objects
+// it refers to have been read. Notifications sent via SNS are supported, too.
+//
+// Objects that could not be downloaded are read again, i.e. on the next
+// listing or after the visibility timeout of the notification. Objects that
+// can never be read completely, e.g. because they are not compressed as
+// expected or contain messages larger than MaxMessageSizeKB, are skipped with
+// an error and treated as processed.
+//
+// Metadata
+//
+// *NOTE: The metadata will only set if the parameter `SetMetadata` is active.*
+//
+// - bucket: The name of the bucket the object was read from
+//
+// - key: The key of the object
+//
+// Parameters
+//
+// - Bucket: The S3 bucket to read from. A prefix can be added after a "/",
+// e.g. "bucket/logs".
+// By default this parameter is set to "".
+//
+// - QueueURL: Defines the URL of an SQS queue receiving S3 event
+// notifications. If set, objects are read when a notification arrives
+// instead of listing the bucket. Only objects of the configured bucket and
+// prefix are read.
+// By default this parameter is set to "".
+//
+// - OffsetFile: This value defines a file to store the processed objects in
+// when listing a bucket. To disable this parameter, set it to "". If the
+// parameter is set and the file is found, objects processed before are not
+// read again.
+// By default this parameter is set to "".
+//
+// - GracePeriodMin: Defines the number of minutes an object may have been
+// modified before the last processed object and still be read. This value
+// should be larger than the longest upload to the bucket, e.g. the rotation
+// timeout of producer.AwsS3. The keys of all objects processed within this
+// period are kept in memory and in "OffsetFile".
+// By default this parameter is set to "1440".
+//
+// - PollIntervalSec: Defines the number of seconds to wait between two
+// listings of the bucket. Set this parameter to "0" to list the bucket only
+// once.
+// By default this parameter is set to "60".
+//
+// - WaitTimeSec: Defines the number of seconds to wait for SQS notifications
+// per request (long polling). The maximum value is 20.
+// By default this parameter is set to "20".
+//
+// - Compression: Defines the compression of the objects. Valid values are
+// "none", "gzip", "zstd", "lz4", "snappy" and "auto". When set to "auto" the
+// codec is chosen by the file extension, i.e. ".gz", ".zst", ".lz4" or ".sz",
+// or by a Content-Encoding of "gzip".
+// By default this parameter is set to "auto".
+//
+// - Delimiter: This value defines the delimiter sequence that marks the end of
+// a message.
+// By default this parameter is set to "\n".
+//
+// - MaxMessageSizeKB: Defines the maximum size of a message in KB. Objects
+// containing larger messages are skipped with an error.
+// By default this parameter is set to "1024".
+//
+// - PathStyle: When set to true, the bucket is addressed as part of the path
+// instead of the host name. This is required by most S3 compatible stores
+// like MinIO.
+// By default this parameter is set to "false".
+//
+// - SetMetadata: When set to true, the bucket and key are stored as metadata.
+// By default this parameter is set to "false".
+//
+// Examples
+//
+// This example replays all logs written to a bucket prefix.
+//
+//  S3In:
+//    Type: consumer.AwsS3
+//    Streams: "replay"
+//    Credential:
+//      Type: shared
+//      File: /Users/<USERNAME>/.aws/credentials
+//      Profile: default
+//    Region: eu-west-1
+//    Bucket: "logs/access"
+//    OffsetFile: /var/gollum/s3-access.offset
+//
+// This example reads new objects as soon as they are announced via SQS.
+//
+//  S3Events:
+//    Type: consumer.AwsS3
+//    Streams: "events"
+//    Region: eu-west-1
+//    Bucket: "logs"
+//    QueueURL: "https://sqs.eu-west-1.amazonaws.com/123456789012/log-events"
+//
+type AwsS3 struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+
+	// AwsMultiClient is public to make AwsMultiClient.Configure() callable
+	AwsMultiClient components.AwsMultiClient `gollumdoc:"embed_type"`
+
+	queueURL       string        `config:"QueueURL"`
+	offsetFile     string        `config:"OffsetFile"`
+	gracePeriod    time.Duration `config:"GracePeriodMin" default:"1440" metric:"min"`
+	pollInterval   time.Duration `config:"PollIntervalSec" default:"60" metric:"sec"`
+	waitTime       int64         `config:"WaitTimeSec" default:"20"`
+	delimiter      string        `config:"Delimiter" default:"\n"`
+	maxMessageSize int           `config:"MaxMessageSizeKB" default:"1024" metric:"kb"`
+	pathStyle      bool          `config:"PathStyle" default:"false"`
+	withMetadata   bool          `config:"SetMetadata" default:"false"`
+
+	bucket      string
+	prefix      string
+	compression string
+	offsets     map[string]*s3ListOffset
+	s3Client    *s3.S3
+	sqsClient   *sqs.SQS
+	stop        chan struct{}
+	cancel      context.CancelFunc
+}
+
+// s3ListOffset stores the processed objects of a bucket prefix. Objects
+// modified before Watermark minus the grace period are considered processed,
+// later ones are tracked by key.
+type s3ListOffset struct {
+	Watermark time.Time            `json:"watermark"`
+	Keys      map[string]time.Time `json:"keys"`
+}
+
+// markProcessed adds an object to the processed ones. Keys of objects
+// modified before the grace period are removed.
+func (offset *s3ListOffset) markProcessed(key string, modified time.Time, gracePeriod time.Duration) {
+	offset.Keys[key] = modified
+	if !modified.After(offset.Watermark) {
+		return // ### return, watermark unchanged ###
+	}
+
+	offset.Watermark = modified
+	threshold := modified.Add(-gracePeriod)
+	for key, modified := range offset.Keys {
+		if !modified.After(threshold) {
+			delete(offset.Keys, key)
+		}
+	}
+}
+
+// isProcessed returns true if the given object has been processed before.
+func (offset *s3ListOffset) isProcessed(key string, modified time.Time, gracePeriod time.Duration) bool {
+	if !modified.After(offset.Watermark.Add(-gracePeriod)) {
+		return true
+	}
+	_, processed := offset.Keys[key]
+	return processed
+}
+
+// s3EventNotification is the message body sent by S3 for object events
+type s3EventNotification struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+// snsNotification is the message body of notifications forwarded by SNS
+type snsNotification struct {
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+}
+
+func init() {
+	core.TypeRegistry.Register(AwsS3{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *AwsS3) Configure(conf core.PluginConfigReader) {
+	cons.offsets = make(map[string]*s3ListOffset)
+	cons.stop = make(chan struct{})
+
+	bucket := conf.GetString("Bucket", "")
+	if idx := strings.Index(bucket, "/"); idx >= 0 {
+		cons.bucket, cons.prefix = bucket[:idx], bucket[idx+1:]
+	} else {
+		cons.bucket = bucket
+	}
+
+	cons.compression = strings.ToLower(conf.GetString("Compression", "auto"))
+	switch cons.compression {
+	case "auto", "gzip", "zstd", "lz4", "snappy":
+	case "none":
+		cons.compression = ""
+	default:
+		conf.Errors.Pushf("Unknown Compression %s", cons.compression)
+	}
+
+	if cons.waitTime < 0 || cons.waitTime > 20 {
+		conf.Errors.Pushf("WaitTimeSec must be between 0 and 20")
+	}
+	if cons.delimiter == "" {
+		conf.Errors.Pushf("Delimiter must not be empty")
+	}
+
+	if cons.offsetFile != "" {
+		fileContents, err := ioutil.ReadFile(cons.offsetFile)
+		if err != nil {
+			cons.Logger.Errorf("Failed to open s3 offset file: %s", err.Error())
+		} else {
+			conf.Errors.Push(json.Unmarshal(fileContents, &cons.offsets))
+		}
+	}
+}
+
+// getOffset returns the processed objects of the configured bucket prefix.
+func (cons *AwsS3) getOffset() *s3ListOffset {
+	offsetKey := cons.bucket + "/" + cons.prefix
+	offset, exists := cons.offsets[offsetKey]
+	if !exists {
+		offset = new(s3ListOffset)
+		cons.offsets[offsetKey] = offset
+	}
+	if offset.Keys == nil {
+		offset.Keys = make(map[string]time.Time)
+	}
+	return offset
+}
+
+func (cons *AwsS3) storeOffsets() {
+	if cons.offsetFile != "" {
+		fileContents, err := json.Marshal(cons.offsets)
+		if err != nil {
+			cons.Logger.Errorf("Failed to marshal s3 offsets: %s", err.Error())
+			return
+		}
+
+		if err := ioutil.WriteFile(cons.offsetFile, fileContents, 0644); err != nil {
+			cons.Logger.Errorf("Failed to write s3 offsets: %s", err.Error())
+		}
+	}
+}
+
+func (cons *AwsS3) initClients() {
+	sess, err := cons.AwsMultiClient.NewSessionWithOptions()
+	if err != nil {
+		cons.Logger.WithError(err).Error("Can't get proper aws config")
+	}
+
+	awsConfig := cons.AwsMultiClient.GetConfig()
+
+	s3Config := awsConfig.Copy()
+	if cons.pathStyle {
+		s3Config.WithS3ForcePathStyle(true)
+	}
+
+	cons.s3Client = s3.New(sess, s3Config)
+	if cons.queueURL != "" {
+		cons.sqsClient = sqs.New(sess, awsConfig)
+	}
+}
+
+// splitDelimiter returns a bufio.SplitFunc splitting data at the configured
+// delimiter. The delimiter is removed from the message.
+func (cons *AwsS3) splitDelimiter(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if idx := bytes.Index(data, []byte(cons.delimiter)); idx >= 0 {
+		return idx + len(cons.delimiter), data[:idx], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// s3BodyReader records errors returned while reading an object body, so that
+// they can be told apart from errors of decoding the object.
+type s3BodyReader struct {
+	body io.Reader
+	err  error
+}
+
+// Read is part of the io.Reader interface
+func (r *s3BodyReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// readObject enqueues all messages of the given object. False is returned if
+// the object has to be read again because it could not be downloaded or the
+// consumer has been stopped. Objects that cannot be decoded are skipped and
+// true is returned.
+func (cons *AwsS3) readObject(bucket, key string) bool {
+	object, err := cons.s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		cons.Logger.WithError(err).Errorf("Failed to get s3://%s/%s", bucket, key)
+		return false // ### return, could not get object ###
+	}
+	defer object.Body.Close()
+
+	codec := cons.compression
+	if codec == "auto" {
+		codec = components.GetCompressionCodec(key)
+		if codec == "" && strings.EqualFold(aws.StringValue(object.ContentEncoding), "gzip") {
+			codec = "gzip"
+		}
+	}
+
+	body := &s3BodyReader{body: object.Body}
+	reader, err := components.NewDecompressionReader(codec, body)
+	if err != nil {
+		if body.err != nil {
+			cons.Logger.WithError(body.err).Errorf("Failed to read s3://%s/%s", bucket, key)
+			return false // ### return, download failed ###
+		}
+		cons.Logger.WithError(err).Errorf("Skipping s3://%s/%s, failed to decompress", bucket, key)
+		return true // ### return, cannot be read ###
+	}
+	defer reader.Close()
+
+	enqueue := cons.Enqueue
+	if cons.withMetadata {
+		metadata := core.Metadata{}
+		metadata.SetValue("bucket", []byte(bucket))
+		metadata.SetValue("key", []byte(key))
+		enqueue = func(data []byte) {
+			cons.EnqueueWithMetadata(data, metadata.Clone())
+		}
+	}
+
+	scanner := bufio.NewScanner(reader)
+	// The scanner allows tokens as large as the initial buffer
+	bufferSize := 64 * 1024
+	if cons.maxMessageSize < bufferSize {
+		bufferSize = cons.maxMessageSize
+	}
+	scanner.Buffer(make([]byte, 0, bufferSize), cons.maxMessageSize)
+	scanner.Split(cons.splitDelimiter)
+
+	for scanner.Scan() {
+		if !cons.IsActive() {
+			return false // ### return, stopped ###
+		}
+		// The scanner reuses its buffer, so data has to be copied
+		data := make([]byte, len(scanner.Bytes()))
+		copy(data, scanner.Bytes())
+		enqueue(data)
+	}
+
+	if body.err != nil {
+		cons.Logger.WithError(body.err).Errorf("Failed to read s3://%s/%s", bucket, key)
+		return false // ### return, download failed ###
+	}
+	if err := scanner.Err(); err != nil {
+		cons.Logger.WithError(err).Errorf("Skipping rest of s3://%s/%s", bucket, key)
+		return true // ### return, cannot be read ###
+	}
+
+	cons.Logger.Debugf("Read s3://%s/%s", bucket, key)
+	return true
+}
+
+// listObjects reads all objects that have not been processed yet in the
+// order of their modification time.
+func (cons *AwsS3) listObjects() {
+	offset := cons.getOffset()
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(cons.bucket),
+		Prefix: aws.String(cons.prefix),
+	}
+
+	// Keys do not increase over time, so the whole prefix has to be listed
+	objects := []*s3.Object{}
+	err := cons.s3Client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			key := aws.StringValue(object.Key)
+			if strings.HasSuffix(key, "/") {
+				continue // ### continue, folder ###
+			}
+			if !offset.isProcessed(key, aws.TimeValue(object.LastModified), cons.gracePeriod) {
+				objects = append(objects, object)
+			}
+		}
+		return cons.IsActive()
+	})
+
+	if err != nil {
+		cons.Logger.WithError(err).Errorf("Failed to list s3://%s/%s", cons.bucket, cons.prefix)
+		return // ### return, retry on next listing ###
+	}
+
+	// Objects are listed by key, which is kept as the order of objects
+	// modified at the same time.
+	sort.SliceStable(objects, func(i, j int) bool {
+		return aws.TimeValue(objects[i].LastModified).Before(aws.TimeValue(objects[j].LastModified))
+	})
+
+	for _, object := range objects {
+		key := aws.StringValue(object.Key)
+		if !cons.IsActive() || !cons.readObject(cons.bucket, key) {
+			return // ### return, retry on next listing ###
+		}
+		offset.markProcessed(key, aws.TimeValue(object.LastModified), cons.gracePeriod)
+		cons.storeOffsets()
+	}
+}
+
+func (cons *AwsS3) pollBucket() {
+	defer cons.WorkerDone()
+
+	for cons.IsActive() {
+		cons.listObjects()
+		if cons.pollInterval <= 0 {
+			return // ### return, list only once ###
+		}
+
+		select {
+		case <-cons.stop:
+			return // ### return, stopped ###
+		case <-time.After(cons.pollInterval):
+		}
+	}
+}
+
+// parseS3Notification returns the bucket and keys of all created objects of an
+// S3 event notification.
+func parseS3Notification(body string) ([][2]string, error) {
+	sns := snsNotification{}
+	if err := json.Unmarshal([]byte(body), &sns); err == nil && sns.Type == "Notification" {
+		body = sns.Message
+	}
+
+	event := s3EventNotification{}
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		return nil, err
+	}
+
+	objects := [][2]string{}
+	for _, record := range event.Records {
+		if !strings.HasPrefix(record.EventName, "ObjectCreated:") {
+			continue // ### continue, not a new object ###
+		}
+		// Keys are url encoded in notifications
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %s", record.S3.Object.Key, err.Error())
+		}
+		objects = append(objects, [2]string{record.S3.Bucket.Name, key})
+	}
+	return objects, nil
+}
+
+// processNotification reads all objects of a notification. False is returned
+// if the notification has to be received again.
+func (cons *AwsS3) processNotification(msg *sqs.Message) bool {
+	objects, err := parseS3Notification(aws.StringValue(msg.Body))
+	if err != nil {
+		cons.Logger.WithError(err).Warning("Ignoring invalid S3 event notification")
+		return true // ### return, cannot be processed ###
+	}
+
+	for _, object := range objects {
+		bucket, key := object[0], object[1]
+		if bucket != cons.bucket || !strings.HasPrefix(key, cons.prefix) {
+			continue // ### continue, filtered ###
+		}
+		if !cons.readObject(bucket, key) {
+			return false // ### return, retry after visibility timeout ###
+		}
+	}
+	return true
+}
+
+func (cons *AwsS3) receiveNotifications(ctx context.Context) {
+	defer cons.WorkerDone()
+
+	for cons.IsActive() {
+		result, err := cons.sqsClient.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(cons.queueURL),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(cons.waitTime),
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return // ### return, stopped ###
+			}
+			cons.Logger.WithError(err).Errorf("Failed to receive notifications from %s", cons.queueURL)
+			select {
+			case <-cons.stop:
+				return // ### return, stopped ###
+			case <-time.After(time.Second):
+			}
+			continue // ### continue, retry ###
+		}
+
+		for _, msg := range result.Messages {
+			if !cons.processNotification(msg) {
+				continue // ### continue, not deleted ###
+			}
+
+			if _, err := cons.sqsClient.DeleteMessage(&sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(cons.queueURL),
+				ReceiptHandle: msg.ReceiptHandle,
+			}); err != nil {
+				cons.Logger.WithError(err).Warning("Failed to delete notification")
+			}
+		}
+	}
+}
+
+func (cons *AwsS3) close() {
+	close(cons.stop)
+	if cons.cancel != nil {
+		cons.cancel()
+	}
+}
+
+// Consume reads objects from S3 until the consumer is stopped.
+func (cons *AwsS3) Consume(workers *sync.WaitGroup) {
+	cons.initClients()
+	cons.AddMainWorker(workers)
+
+	if cons.queueURL != "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		cons.cancel = cancel
+		go tgo.WithRecoverShutdown(func() { cons.receiveNotifications(ctx) })
+	} else {
+		go tgo.WithRecoverShutdown(cons.pollBucket)
+	}
+
+	cons.SetStopCallback(cons.close)
+	cons.ControlLoop()
+}
@@ -0,0 +1,259 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func newTestAwsS3(t *testing.T, streamName string, settings map[string]interface{}) (*AwsS3, *testStreamRouter) {
+	expect := ttesting.NewExpect(t)
+	router := newTestStreamRouter(streamName)
+
+	conf := core.NewPluginConfig(streamName+"Consumer", "consumer.AwsS3")
+	conf.Override("Streams", streamName)
+	conf.Override("Bucket", "logs/web")
+	for key, value := range settings {
+		conf.Override(key, value)
+	}
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+	return plugin.(*AwsS3), router
+}
+
+// awsS3TestObject is an object listed by awsS3TestListing
+type awsS3TestObject struct {
+	key      string
+	modified time.Time
+}
+
+// awsS3TestListing writes the response of listing the given objects sorted by
+// key.
+func awsS3TestListing(resp http.ResponseWriter, objects []awsS3TestObject) {
+	sorted := append([]awsS3TestObject{}, objects...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].key < sorted[j].key })
+
+	contents := ""
+	for _, object := range sorted {
+		contents += fmt.Sprintf("<Contents><Key>%s</Key><LastModified>%s</LastModified></Contents>",
+			object.key, object.modified.UTC().Format("2006-01-02T15:04:05.000Z"))
+	}
+	fmt.Fprintf(resp, "<ListBucketResult><Name>logs</Name><IsTruncated>false</IsTruncated>%s</ListBucketResult>", contents)
+}
+
+func TestAwsS3SplitDelimiter(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons, _ := newTestAwsS3(t, "awsS3TestSplit", map[string]interface{}{
+		"Delimiter": "\r\n",
+	})
+
+	scanner := bufio.NewScanner(strings.NewReader("a\r\nb\nc\r\n\r\nd"))
+	scanner.Split(cons.splitDelimiter)
+
+	lines := []string{}
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	expect.NoError(scanner.Err())
+	expect.Equal([]string{"a", "b\nc", "", "d"}, lines)
+
+	// Messages larger than the buffer cannot be split
+	scanner = bufio.NewScanner(strings.NewReader("short\r\nmuch too long\r\n"))
+	scanner.Buffer(make([]byte, 0, 8), 8)
+	scanner.Split(cons.splitDelimiter)
+
+	expect.True(scanner.Scan())
+	expect.Equal("short", scanner.Text())
+	expect.False(scanner.Scan())
+	expect.Equal(bufio.ErrTooLong, scanner.Err())
+}
+
+func TestAwsS3ParseNotification(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	event := `{"Records":[
+		{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"logs"},"object":{"key":"web/a+b%2Fc.log"}}},
+		{"eventName":"ObjectRemoved:Delete","s3":{"bucket":{"name":"logs"},"object":{"key":"web/old.log"}}},
+		{"eventName":"ObjectCreated:CompleteMultipartUpload","s3":{"bucket":{"name":"other"},"object":{"key":"d.log"}}}
+	]}`
+	expected := [][2]string{{"logs", "web/a b/c.log"}, {"other", "d.log"}}
+
+	objects, err := parseS3Notification(event)
+	expect.NoError(err)
+	expect.Equal(expected, objects)
+
+	// Notifications forwarded by SNS wrap the S3 event
+	sns, err := json.Marshal(map[string]string{"Type": "Notification", "Message": event})
+	expect.NoError(err)
+	objects, err = parseS3Notification(string(sns))
+	expect.NoError(err)
+	expect.Equal(expected, objects)
+
+	_, err = parseS3Notification(`{"Records":[{"eventName":"ObjectCreated:Put","s3":{"object":{"key":"%zz"}}}]}`)
+	expect.NotNil(err)
+	_, err = parseS3Notification("not json")
+	expect.NotNil(err)
+}
+
+func TestAwsS3ReadErrors(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	objects := map[string]string{
+		"web/1.log":     "a\nb\n",
+		"web/2.gz":      "not compressed",
+		"web/3.log":     "c\n" + strings.Repeat("x", 2048) + "\nd\n",
+		"web/4.log":     "e\n",
+		"web/5.log":     "truncated",
+		"web/6.log":     "f\n",
+		"web/missing.x": "",
+	}
+	modified := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	listing := []awsS3TestObject{}
+	for idx, key := range []string{"web/1.log", "web/2.gz", "web/3.log", "web/4.log", "web/5.log", "web/6.log"} {
+		listing = append(listing, awsS3TestObject{key, modified.Add(time.Duration(idx) * time.Minute)})
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/logs" {
+			awsS3TestListing(resp, listing)
+			return
+		}
+
+		key := strings.TrimPrefix(req.URL.Path, "/logs/")
+		switch key {
+		case "web/5.log":
+			// The connection is closed before the announced length is sent
+			resp.Header().Set("Content-Length", "100")
+			resp.Write([]byte(objects[key]))
+		case "web/missing.x":
+			resp.WriteHeader(http.StatusNotFound)
+		default:
+			resp.Write([]byte(objects[key]))
+		}
+	}))
+	defer server.Close()
+
+	cons, router := newTestAwsS3(t, "awsS3TestReadErrors", map[string]interface{}{
+		"Endpoint":         server.URL,
+		"PathStyle":        true,
+		"MaxMessageSizeKB": 1,
+	})
+	cons.initClients()
+
+	// Objects that cannot be decoded are skipped, failed downloads stop the
+	// listing so that they are read again.
+	cons.listObjects()
+	expect.Equal([]string{"a", "b", "c", "e", "truncated"}, router.payloads())
+	expect.Equal(modified.Add(3*time.Minute), cons.offsets["logs/web"].Watermark)
+	expect.Equal(4, len(cons.offsets["logs/web"].Keys))
+
+	expect.True(cons.readObject("logs", "web/2.gz"))
+	expect.False(cons.readObject("logs", "web/missing.x"))
+}
+
+func TestAwsS3ListOrder(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	guard := sync.Mutex{}
+	listing := []awsS3TestObject{
+		{"web/host=b/1.log", start},
+		{"web/host=a/1.log", start.Add(time.Minute)},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		guard.Lock()
+		defer guard.Unlock()
+		if req.URL.Path == "/logs" {
+			awsS3TestListing(resp, listing)
+			return
+		}
+		// Each object contains its key as a single line
+		resp.Write([]byte(strings.TrimPrefix(req.URL.Path, "/logs/")))
+	}))
+	defer server.Close()
+
+	addObjects := func(objects ...awsS3TestObject) {
+		guard.Lock()
+		defer guard.Unlock()
+		listing = append(listing, objects...)
+	}
+
+	dir, err := ioutil.TempDir("", "gollum-s3")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+	offsetFile := filepath.Join(dir, "s3.offset")
+
+	cons, router := newTestAwsS3(t, "awsS3TestListOrder", map[string]interface{}{
+		"Endpoint":       server.URL,
+		"PathStyle":      true,
+		"GracePeriodMin": 10,
+		"OffsetFile":     offsetFile,
+	})
+	cons.initClients()
+
+	// Objects are read by modification time, not by key
+	cons.listObjects()
+	expect.Equal([]string{"web/host=b/1.log", "web/host=a/1.log"}, router.payloads())
+
+	// Objects with lower keys that appear later are read if they are within
+	// the grace period, processed objects are not read again.
+	addObjects(
+		awsS3TestObject{"web/host=a/0.log", start.Add(-time.Minute)},
+		awsS3TestObject{"web/host=a/old.log", start.Add(-10 * time.Minute)},
+		awsS3TestObject{"web/host=c/1.log", start.Add(2 * time.Minute)},
+	)
+	cons.listObjects()
+	expect.Equal([]string{
+		"web/host=b/1.log", "web/host=a/1.log",
+		"web/host=a/0.log", "web/host=c/1.log",
+	}, router.payloads())
+
+	// Keys older than the grace period are dropped from the offsets
+	addObjects(awsS3TestObject{"web/host=b/2.log", start.Add(15 * time.Minute)})
+	cons.listObjects()
+	expect.Equal(5, len(router.payloads()))
+	expect.Equal(start.Add(15*time.Minute), cons.offsets["logs/web"].Watermark)
+	expect.Equal(map[string]time.Time{"web/host=b/2.log": start.Add(15 * time.Minute)}, cons.offsets["logs/web"].Keys)
+
+	// A restarted consumer continues with the stored offsets
+	cons, router = newTestAwsS3(t, "awsS3TestListOrderRestart", map[string]interface{}{
+		"Endpoint":       server.URL,
+		"PathStyle":      true,
+		"GracePeriodMin": 10,
+		"OffsetFile":     offsetFile,
+	})
+	cons.initClients()
+
+	addObjects(awsS3TestObject{"web/host=a/2.log", start.Add(14 * time.Minute)})
+	cons.listObjects()
+	expect.Equal([]string{"web/host=a/2.log"}, router.payloads())
+}
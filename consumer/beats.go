@@ -0,0 +1,478 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo"
+	"github.com/trivago/tgo/tnet"
+)
+
+const (
+	lumberjackVersion1 = '1'
+	lumberjackVersion2 = '2'
+
+	lumberjackFrameWindow     = 'W'
+	lumberjackFrameCompressed = 'C'
+	lumberjackFrameJSON       = 'J'
+	lumberjackFrameData       = 'D'
+	lumberjackFrameAck        = 'A'
+)
+
+// Beats consumer plugin
+//
+// This consumer implements the server side of the Lumberjack v2 protocol as
+// used by Filebeat and the other Elastic Beats (output.logstash). Windowed
+// transmission, compressed frames, JSON and key/value data frames are
+// supported. Each window of events is acknowledged after all events of the
+// window have been enqueued, so the at-least-once guarantee of the beats is
+// kept.
+//
+// Metadata
+//
+// Fields of an event are copied to metadata as defined by Metadata/Fields.
+//
+// Parameters
+//
+// - Address: Defines the host and port to bind to.
+// By default this parameter is set to ":5044".
+//
+// - ReadTimeoutSec: Defines the number of seconds to wait for data to be
+// received. This setting affects the maximum shutdown duration of this
+// consumer.
+// By default this parameter is set to "2".
+//
+// - AckTimeoutSec: Defines the number of seconds to wait for an
+// acknowledgement to be written.
+// By default this parameter is set to "5".
+//
+// - MaxFrameSizeKB: Defines the maximum size of a single (decompressed) frame.
+// Connections sending larger frames are closed.
+// By default this parameter is set to "10240".
+//
+// - Certificate: Path to an X509 formatted certificate file. If defined, turns
+// on TLS. Requires PrivateKey to be set.
+// By default this parameter is set to "".
+//
+// - PrivateKey: Path to an X509 formatted private key file. Meaningful only in
+// conjunction with Certificate.
+// By default this parameter is set to "".
+//
+// - ClientCA: Path to a PEM formatted CA bundle. If defined, beats have to
+// present a certificate signed by one of these CAs. Meaningful only in
+// conjunction with Certificate.
+// By default this parameter is set to "".
+//
+// - PayloadField: If set, the value of the given event field is used as
+// message payload instead of the whole event. Events without this field
+// are sent as JSON.
+// By default this parameter is set to "".
+//
+// - Metadata/Fields: Defines a mapping of event fields to metadata fields.
+// Nested fields are addressed by joining the keys with ".". Fields that are not
+// present in an event are not set.
+// By default this parameter is set to a mapping of "host.name", "log.file.path"
+// and "@metadata.beat" to "host.name", "log.file.path" and "beat".
+//
+// Examples
+//
+// This example receives events from Filebeat via TLS and sends the log line
+// only.
+//
+//  BeatsIn:
+//    Type: consumer.Beats
+//    Streams: "filebeat"
+//    Address: ":5044"
+//    Certificate: "/etc/gollum/beats.crt"
+//    PrivateKey: "/etc/gollum/beats.key"
+//    PayloadField: "message"
+//    Metadata:
+//      Fields:
+//        "host.name": "host"
+//        "log.file.path": "file"
+//
+type Beats struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+	address             string        `config:"Address" default:":5044"`
+	readTimeout         time.Duration `config:"ReadTimeoutSec" default:"2" metric:"sec"`
+	ackTimeout          time.Duration `config:"AckTimeoutSec" default:"5" metric:"sec"`
+	maxFrameSize        int64         `config:"MaxFrameSizeKB" default:"10240" metric:"kb"`
+	payloadField        string        `config:"PayloadField"`
+	fieldMetadata       map[string]string
+	certificate         *tls.Config
+	listener            net.Listener
+	clients             sync.Map
+}
+
+// lumberjackWindow keeps track of the events of the current window.
+// Acknowledgements are sent using the protocol version of the window.
+type lumberjackWindow struct {
+	version  byte
+	size     uint32
+	received uint32
+	lastSeq  uint32
+}
+
+func init() {
+	core.TypeRegistry.Register(Beats{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Beats) Configure(conf core.PluginConfigReader) {
+	cons.fieldMetadata = conf.GetStringMap("Metadata/Fields", map[string]string{
+		"host.name":      "host.name",
+		"log.file.path":  "log.file.path",
+		"@metadata.beat": "beat",
+	})
+
+	certificateFile := conf.GetString("Certificate", "")
+	keyFile := conf.GetString("PrivateKey", "")
+
+	if certificateFile != "" || keyFile != "" {
+		if certificateFile == "" || keyFile == "" {
+			conf.Errors.Pushf("There must always be a certificate and a private key or none of both")
+		} else {
+			cons.certificate = new(tls.Config)
+			keypair, err := tls.LoadX509KeyPair(certificateFile, keyFile)
+			if !conf.Errors.Push(err) {
+				cons.certificate.Certificates = []tls.Certificate{keypair}
+			}
+		}
+	}
+
+	if clientCAFile := conf.GetString("ClientCA", ""); clientCAFile != "" {
+		if cons.certificate == nil {
+			conf.Errors.Pushf("ClientCA requires Certificate and PrivateKey to be set")
+		} else if caCert, err := ioutil.ReadFile(clientCAFile); !conf.Errors.Push(err) {
+			caCertPool := x509.NewCertPool()
+			if !caCertPool.AppendCertsFromPEM(caCert) {
+				conf.Errors.Pushf("No certificates found in %s", clientCAFile)
+			}
+			cons.certificate.ClientCAs = caCertPool
+			cons.certificate.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+}
+
+func (cons *Beats) listen() {
+	defer cons.WorkerDone()
+
+	for cons.IsActive() {
+		conn, err := cons.listener.Accept()
+		if err != nil {
+			if !cons.IsActive() {
+				return // ### return, shutdown ###
+			}
+			cons.Logger.WithError(err).Errorf("Accept failed for %s", cons.address)
+			continue
+		}
+
+		cons.Logger.Debugf("New client connection to %s for %s", conn.RemoteAddr(), cons.address)
+		cons.AddWorker()
+		cons.clients.Store(conn, true)
+		go tgo.WithRecoverShutdown(func() { cons.handleConnection(conn) })
+	}
+}
+
+func (cons *Beats) handleConnection(conn net.Conn) {
+	defer func() {
+		cons.clients.Delete(conn)
+		conn.Close()
+		cons.Logger.Debugf("Closed client connection to %s on %s", conn.RemoteAddr(), cons.address)
+		cons.WorkerDone()
+	}()
+
+	reader := bufio.NewReader(conn)
+	window := lumberjackWindow{}
+
+	for cons.IsActive() {
+		// Time out in regular intervals so we can stop the loop on shutdown.
+		// Once data is available the whole frame is read without timeout.
+		conn.SetReadDeadline(time.Now().Add(cons.readTimeout))
+		if _, err := reader.Peek(1); err != nil {
+			if netErr, isNetErr := err.(net.Error); isNetErr && netErr.Timeout() {
+				continue
+			}
+			if err != io.EOF && !tnet.IsDisconnectedError(err) && cons.IsActive() {
+				cons.Logger.WithError(err).Errorf("Failed to read from %s", conn.RemoteAddr())
+			}
+			return // ### return, connection closed ###
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		if err := cons.readFrame(reader, &window); err != nil {
+			if cons.IsActive() {
+				cons.Logger.WithError(err).Errorf("Invalid data received from %s", conn.RemoteAddr())
+			}
+			return // ### return, invalid data ###
+		}
+
+		if window.size > 0 && window.received >= window.size {
+			if err := cons.sendAck(conn, window.version, window.lastSeq); err != nil {
+				cons.Logger.WithError(err).Errorf("Failed to send ack to %s", conn.RemoteAddr())
+				return // ### return, connection broken ###
+			}
+			window = lumberjackWindow{}
+		}
+	}
+}
+
+func (cons *Beats) sendAck(conn net.Conn, version byte, seq uint32) error {
+	ack := []byte{version, lumberjackFrameAck, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(ack[2:], seq)
+
+	conn.SetWriteDeadline(time.Now().Add(cons.ackTimeout))
+	_, err := conn.Write(ack)
+	return err
+}
+
+// readFrame reads and processes a single frame. Compressed frames are
+// processed recursively.
+func (cons *Beats) readFrame(reader io.Reader, window *lumberjackWindow) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+
+	if header[0] != lumberjackVersion2 && header[0] != lumberjackVersion1 {
+		return fmt.Errorf("unsupported protocol version %q", header[0])
+	}
+
+	switch header[1] {
+	case lumberjackFrameWindow:
+		size, err := readLumberjackUint32(reader)
+		if err != nil {
+			return err
+		}
+		*window = lumberjackWindow{version: header[0], size: size}
+		return nil
+
+	case lumberjackFrameCompressed:
+		payload, err := cons.readLumberjackPayload(reader)
+		if err != nil {
+			return err
+		}
+		zlibReader, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		defer zlibReader.Close()
+
+		inflated, err := ioutil.ReadAll(io.LimitReader(zlibReader, cons.maxFrameSize+1))
+		if err != nil {
+			return err
+		}
+		if int64(len(inflated)) > cons.maxFrameSize {
+			return fmt.Errorf("compressed frame exceeds MaxFrameSizeKB")
+		}
+
+		inner := bytes.NewReader(inflated)
+		for inner.Len() > 0 {
+			if err := cons.readFrame(inner, window); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case lumberjackFrameJSON:
+		seq, err := readLumberjackUint32(reader)
+		if err != nil {
+			return err
+		}
+		payload, err := cons.readLumberjackPayload(reader)
+		if err != nil {
+			return err
+		}
+
+		event := make(map[string]interface{})
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return err
+		}
+		cons.enqueueEvent(event, payload)
+		window.received++
+		window.lastSeq = seq
+		return nil
+
+	case lumberjackFrameData:
+		seq, err := readLumberjackUint32(reader)
+		if err != nil {
+			return err
+		}
+		event, err := cons.readLumberjackKeyValues(reader)
+		if err != nil {
+			return err
+		}
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		cons.enqueueEvent(event, payload)
+		window.received++
+		window.lastSeq = seq
+		return nil
+
+	default:
+		return fmt.Errorf("unknown frame type %q", header[1])
+	}
+}
+
+func readLumberjackUint32(reader io.Reader) (uint32, error) {
+	data := make([]byte, 4)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(data), nil
+}
+
+// readLumberjackPayload reads a length prefixed payload.
+func (cons *Beats) readLumberjackPayload(reader io.Reader) ([]byte, error) {
+	length, err := readLumberjackUint32(reader)
+	if err != nil {
+		return nil, err
+	}
+	if int64(length) > cons.maxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds MaxFrameSizeKB", length)
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	return payload, err
+}
+
+// readLumberjackKeyValues reads the key/value pairs of a version 1 data frame.
+func (cons *Beats) readLumberjackKeyValues(reader io.Reader) (map[string]interface{}, error) {
+	numPairs, err := readLumberjackUint32(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	event := make(map[string]interface{})
+	for i := uint32(0); i < numPairs; i++ {
+		key, err := cons.readLumberjackPayload(reader)
+		if err != nil {
+			return nil, err
+		}
+		value, err := cons.readLumberjackPayload(reader)
+		if err != nil {
+			return nil, err
+		}
+		event[string(key)] = string(value)
+	}
+	return event, nil
+}
+
+// getBeatsField returns the value of a (nested) event field. Nested fields
+// are addressed by joining keys with ".". Keys containing dots are supported.
+func getBeatsField(event map[string]interface{}, field string) (interface{}, bool) {
+	if value, exists := event[field]; exists {
+		return value, true
+	}
+
+	for dotIdx := strings.IndexByte(field, '.'); dotIdx > 0; {
+		if nested, isMap := event[field[:dotIdx]].(map[string]interface{}); isMap {
+			if value, exists := getBeatsField(nested, field[dotIdx+1:]); exists {
+				return value, true
+			}
+		}
+
+		nextDot := strings.IndexByte(field[dotIdx+1:], '.')
+		if nextDot < 0 {
+			break
+		}
+		dotIdx += nextDot + 1
+	}
+	return nil, false
+}
+
+func beatsValueToBytes(value interface{}) []byte {
+	switch data := value.(type) {
+	case string:
+		return []byte(data)
+	case nil:
+		return []byte{}
+	default:
+		if encoded, err := json.Marshal(data); err == nil {
+			return encoded
+		}
+		return []byte(fmt.Sprint(data))
+	}
+}
+
+func (cons *Beats) enqueueEvent(event map[string]interface{}, payload []byte) {
+	metadata := core.Metadata{}
+	for field, key := range cons.fieldMetadata {
+		if value, exists := getBeatsField(event, field); exists {
+			metadata.SetValue(key, beatsValueToBytes(value))
+		}
+	}
+
+	if cons.payloadField != "" {
+		if value, exists := getBeatsField(event, cons.payloadField); exists {
+			payload = beatsValueToBytes(value)
+		}
+	}
+
+	cons.EnqueueWithMetadata(payload, metadata)
+}
+
+func (cons *Beats) closeConnections() {
+	if cons.listener != nil {
+		cons.listener.Close()
+	}
+	cons.clients.Range(func(conn, _ interface{}) bool {
+		conn.(net.Conn).Close()
+		return true
+	})
+}
+
+// Consume listens to a given socket.
+func (cons *Beats) Consume(workers *sync.WaitGroup) {
+	var (
+		listener net.Listener
+		err      error
+	)
+
+	if cons.certificate != nil {
+		listener, err = tls.Listen("tcp", cons.address, cons.certificate)
+	} else {
+		listener, err = net.Listen("tcp", cons.address)
+	}
+	if err != nil {
+		cons.Logger.WithError(err).Errorf("Failed to listen to %s", cons.address)
+		return // ### return, could not listen ###
+	}
+
+	cons.listener = listener
+	cons.AddMainWorker(workers)
+	cons.SetStopCallback(cons.closeConnections)
+
+	go tgo.WithRecoverShutdown(cons.listen)
+	cons.ControlLoop()
+}
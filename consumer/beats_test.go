@@ -0,0 +1,159 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func newTestBeats(t *testing.T, streamName string) (*Beats, *testStreamRouter) {
+	expect := ttesting.NewExpect(t)
+	router := newTestStreamRouter(streamName)
+
+	conf := core.NewPluginConfig(streamName+"Consumer", "consumer.Beats")
+	conf.Override("Streams", streamName)
+	conf.Override("Address", "127.0.0.1:0")
+	conf.Override("MaxFrameSizeKB", 1)
+	conf.Override("Metadata/Fields", map[string]string{"host.name": "host"})
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+	return plugin.(*Beats), router
+}
+
+func lumberjackTestUint32(value uint32) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, value)
+	return data
+}
+
+func lumberjackTestWindow(version byte, size uint32) []byte {
+	return append([]byte{version, lumberjackFrameWindow}, lumberjackTestUint32(size)...)
+}
+
+func lumberjackTestJSON(seq uint32, payload string) []byte {
+	frame := append([]byte{lumberjackVersion2, lumberjackFrameJSON}, lumberjackTestUint32(seq)...)
+	frame = append(frame, lumberjackTestUint32(uint32(len(payload)))...)
+	return append(frame, payload...)
+}
+
+func lumberjackTestData(seq uint32, key, value string) []byte {
+	frame := append([]byte{lumberjackVersion1, lumberjackFrameData}, lumberjackTestUint32(seq)...)
+	frame = append(frame, lumberjackTestUint32(1)...)
+	frame = append(frame, lumberjackTestUint32(uint32(len(key)))...)
+	frame = append(frame, key...)
+	frame = append(frame, lumberjackTestUint32(uint32(len(value)))...)
+	return append(frame, value...)
+}
+
+func lumberjackTestCompressed(frames ...[]byte) []byte {
+	compressed := bytes.Buffer{}
+	writer := zlib.NewWriter(&compressed)
+	for _, frame := range frames {
+		writer.Write(frame)
+	}
+	writer.Close()
+
+	frame := append([]byte{lumberjackVersion2, lumberjackFrameCompressed}, lumberjackTestUint32(uint32(compressed.Len()))...)
+	return append(frame, compressed.Bytes()...)
+}
+
+func TestBeatsReadFrame(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons, router := newTestBeats(t, "beatsTestReadFrame")
+
+	data := bytes.Buffer{}
+	data.Write(lumberjackTestWindow(lumberjackVersion2, 3))
+	data.Write(lumberjackTestJSON(1, `{"message":"a","host":{"name":"h1"}}`))
+	data.Write(lumberjackTestCompressed(
+		lumberjackTestJSON(2, `{"message":"b"}`),
+		lumberjackTestData(3, "message", "c"),
+	))
+
+	window := lumberjackWindow{}
+	for data.Len() > 0 {
+		expect.NoError(cons.readFrame(&data, &window))
+	}
+
+	expect.Equal(lumberjackWindow{version: lumberjackVersion2, size: 3, received: 3, lastSeq: 3}, window)
+
+	messages := router.getMessages()
+	expect.Equal(3, len(messages))
+	expect.Equal(`{"message":"a","host":{"name":"h1"}}`, messages[0].String())
+	expect.Equal("h1", messages[0].GetMetadata().GetValueString("host"))
+	expect.Equal(`{"message":"b"}`, messages[1].String())
+	expect.Equal(`{"message":"c"}`, messages[2].String())
+}
+
+func TestBeatsReadInvalidFrame(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons, _ := newTestBeats(t, "beatsTestReadInvalidFrame")
+
+	largePayload := `{"message":"` + string(bytes.Repeat([]byte("x"), 1024)) + `"}`
+	testCases := map[string][]byte{
+		"unknown version":    {'3', lumberjackFrameWindow, 0, 0, 0, 1},
+		"unknown frame type": {lumberjackVersion2, 'X'},
+		"truncated frame":    lumberjackTestJSON(1, `{"message":"a"}`)[:10],
+		"invalid json":       lumberjackTestJSON(1, `{"message"`),
+		"frame too large":    lumberjackTestJSON(1, largePayload),
+		"inflated too large": lumberjackTestCompressed(lumberjackTestJSON(1, largePayload[:1000]), lumberjackTestJSON(2, largePayload[:1000])),
+	}
+
+	for name, data := range testCases {
+		window := lumberjackWindow{}
+		if !expect.NotNil(cons.readFrame(bytes.NewReader(data), &window)) {
+			t.Log(name)
+		}
+	}
+}
+
+func TestBeatsAck(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons, router := newTestBeats(t, "beatsTestAck")
+	stop := startTestConsumer(t, cons)
+	defer stop()
+
+	conn, err := net.Dial("tcp", cons.listener.Addr().String())
+	expect.NoError(err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Acknowledgements are sent once per window, using the version of the
+	// window frame.
+	ack := make([]byte, 6)
+	conn.Write(lumberjackTestWindow(lumberjackVersion1, 2))
+	conn.Write(lumberjackTestData(1, "message", "a"))
+	conn.Write(lumberjackTestData(2, "message", "b"))
+	_, err = io.ReadFull(conn, ack)
+	expect.NoError(err)
+	expect.Equal(append([]byte{lumberjackVersion1, lumberjackFrameAck}, lumberjackTestUint32(2)...), ack)
+
+	conn.Write(lumberjackTestWindow(lumberjackVersion2, 1))
+	conn.Write(lumberjackTestCompressed(lumberjackTestJSON(7, `{"message":"c"}`)))
+	_, err = io.ReadFull(conn, ack)
+	expect.NoError(err)
+	expect.Equal(append([]byte{lumberjackVersion2, lumberjackFrameAck}, lumberjackTestUint32(7)...), ack)
+
+	expect.Equal([]string{`{"message":"a"}`, `{"message":"b"}`, `{"message":"c"}`}, router.payloads())
+}
@@ -19,9 +19,94 @@ import (
 	"github.com/trivago/gollum/core"
 	_ "github.com/trivago/gollum/router"
 	"runtime/debug"
+	"sync"
 	"testing"
+	"time"
 )
 
+// testStreamRouter collects all messages routed to it. It is registered for
+// the stream a consumer sends to, to check which messages have been enqueued.
+type testStreamRouter struct {
+	core.Router
+	streamID core.MessageStreamID
+	guard    sync.Mutex
+	messages []*core.Message
+}
+
+func newTestStreamRouter(streamName string) *testStreamRouter {
+	router := &testStreamRouter{
+		streamID: core.StreamRegistry.GetStreamID(streamName),
+	}
+	core.StreamRegistry.Register(router, router.streamID)
+	return router
+}
+
+func (router *testStreamRouter) Modulate(msg *core.Message) core.ModulateResult {
+	return core.ModulateResultContinue
+}
+
+func (router *testStreamRouter) GetID() string {
+	return router.streamID.GetName()
+}
+
+func (router *testStreamRouter) GetStreamID() core.MessageStreamID {
+	return router.streamID
+}
+
+func (router *testStreamRouter) Enqueue(msg *core.Message) error {
+	router.guard.Lock()
+	defer router.guard.Unlock()
+	router.messages = append(router.messages, msg)
+	return nil
+}
+
+func (router *testStreamRouter) getMessages() []*core.Message {
+	router.guard.Lock()
+	defer router.guard.Unlock()
+	return append([]*core.Message{}, router.messages...)
+}
+
+func (router *testStreamRouter) payloads() []string {
+	messages := router.getMessages()
+	payloads := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		payloads = append(payloads, msg.String())
+	}
+	return payloads
+}
+
+// waitForPayloads waits until the router received the given number of
+// messages and returns their payloads.
+func (router *testStreamRouter) waitForPayloads(count int) []string {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		if len(router.getMessages()) >= count {
+			break
+		}
+	}
+	return router.payloads()
+}
+
+// startTestConsumer runs the given consumer until the returned function is
+// called. The consumer is active when this function returns.
+func startTestConsumer(t *testing.T, cons core.Consumer) (stop func()) {
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+
+	for start := time.Now(); cons.GetState() != core.PluginStateActive; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Consumer did not start")
+		}
+	}
+
+	return func() {
+		cons.Control() <- core.PluginControlStopConsumer
+		workers.Wait()
+		for cons.GetState() != core.PluginStateDead {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
 func TestConsumerInterface(t *testing.T) {
 	consumers := core.TypeRegistry.GetRegistered("consumer.")
 
@@ -0,0 +1,563 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo"
+	"github.com/trivago/tgo/tnet"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// Forward consumer plugin
+//
+// This consumer implements the server side of the Fluentd Forward protocol
+// (version 1) as used by fluentd and fluent-bit. It supports the Message,
+// Forward, PackedForward and CompressedPackedForward modes, acknowledgements
+// via the "chunk" option and the shared key handshake.
+// Each event is converted into a separate message containing the record,
+// encoded as JSON.
+//
+// Metadata
+//
+// - tag: The tag of the event
+//
+// - time: The time of the event, formatted as RFC3339 with nanoseconds
+//
+// Additional fields can be copied from the record by using Metadata/Fields.
+//
+// Parameters
+//
+// - Address: Defines the protocol, host and port or socket to bind to.
+// Valid protocols are "tcp" and "unix".
+// By default this parameter is set to "tcp://0.0.0.0:24224".
+//
+// - ReadTimeoutSec: Defines the number of seconds to wait for data to be
+// received. This setting affects the maximum shutdown duration of this
+// consumer.
+// By default this parameter is set to "2".
+//
+// - AckTimeoutSec: Defines the number of seconds to wait for an acknowledgement
+// or handshake response to be written.
+// By default this parameter is set to "1".
+//
+// - SharedKey: If set, clients have to authenticate by using the shared key
+// handshake (HELO/PING/PONG) of the forward protocol.
+// By default this parameter is set to "".
+//
+// - SelfHostname: Defines the hostname sent to clients during the handshake.
+// By default this parameter is set to the hostname of the machine.
+//
+// - MaxChunkSizeMB: Defines the maximum size of a decompressed
+// CompressedPackedForward chunk. Connections sending larger chunks are
+// closed. This protects against decompression bombs.
+// By default this parameter is set to "64".
+//
+// - Routes: Defines a mapping of tags to streams. Tags use the pattern syntax of
+// go's path.Match, so "app.*" matches "app.web" and "app.web.error". If more
+// than one route matches, the route with the longest pattern is used.
+// Events that do not match any route are sent to the streams set by Streams.
+// By default this parameter is set to an empty map.
+//
+// - UseTagAsStream: If set to true, events that do not match any route are
+// sent to the stream named like their tag.
+// By default this parameter is set to "false".
+//
+// - PayloadField: If set, the value of the given record field is used as
+// message payload instead of the whole record. Records without this field
+// are sent as JSON.
+// By default this parameter is set to "".
+//
+// - Metadata/Fields: Defines a mapping of record fields to metadata fields.
+// Fields that are not present in a record are not set.
+// By default this parameter is set to an empty map.
+//
+// Examples
+//
+// This example receives events from fluent-bit and routes all events tagged
+// with "kube.*" to the stream "kubernetes".
+//
+//  ForwardIn:
+//    Type: consumer.Forward
+//    Streams: "fluent"
+//    Address: ":24224"
+//    SharedKey: "secret"
+//    PayloadField: "log"
+//    Routes:
+//      "kube.*": "kubernetes"
+//    Metadata:
+//      Fields:
+//        "stream": "kube_stream"
+//
+type Forward struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+	protocol            string
+	address             string
+	readTimeout         time.Duration `config:"ReadTimeoutSec" default:"2" metric:"sec"`
+	ackTimeout          time.Duration `config:"AckTimeoutSec" default:"1" metric:"sec"`
+	sharedKey           string        `config:"SharedKey"`
+	payloadField        string        `config:"PayloadField"`
+	useTagAsStream      bool          `config:"UseTagAsStream" default:"false"`
+	maxChunkSize        int64         `config:"MaxChunkSizeMB" default:"64" metric:"mb"`
+	hostname            string
+	routes              []forwardRoute
+	fieldMetadata       map[string]string
+	listener            net.Listener
+	clients             sync.Map
+}
+
+type forwardRoute struct {
+	pattern  string
+	streamID core.MessageStreamID
+}
+
+type forwardEvent struct {
+	time   time.Time
+	record map[string]interface{}
+}
+
+func init() {
+	core.TypeRegistry.Register(Forward{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Forward) Configure(conf core.PluginConfigReader) {
+	cons.protocol, cons.address = tnet.ParseAddress(conf.GetString("Address", "tcp://0.0.0.0:24224"), "tcp")
+	switch cons.protocol {
+	case "tcp", "unix":
+	default:
+		conf.Errors.Pushf("Unsupported protocol %s", cons.protocol)
+	}
+
+	defaultHostname, _ := os.Hostname()
+	cons.hostname = conf.GetString("SelfHostname", defaultHostname)
+	cons.fieldMetadata = conf.GetStringMap("Metadata/Fields", map[string]string{})
+
+	for pattern, streamName := range conf.GetStringMap("Routes", map[string]string{}) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			conf.Errors.Pushf("Invalid route %s: %s", pattern, err.Error())
+			continue
+		}
+		cons.routes = append(cons.routes, forwardRoute{
+			pattern:  pattern,
+			streamID: core.GetStreamID(streamName),
+		})
+	}
+	sort.Slice(cons.routes, func(i, j int) bool {
+		return len(cons.routes[i].pattern) > len(cons.routes[j].pattern)
+	})
+}
+
+// getTargetStream returns the stream events with the given tag are sent to.
+// InvalidStreamID is returned if the bound streams should be used.
+func (cons *Forward) getTargetStream(tag string) core.MessageStreamID {
+	for _, route := range cons.routes {
+		if matched, _ := path.Match(route.pattern, tag); matched {
+			return route.streamID
+		}
+	}
+	if cons.useTagAsStream {
+		return core.GetStreamID(tag)
+	}
+	return core.InvalidStreamID
+}
+
+func (cons *Forward) listen() {
+	defer cons.WorkerDone()
+
+	for cons.IsActive() {
+		conn, err := cons.listener.Accept()
+		if err != nil {
+			if !cons.IsActive() {
+				return // ### return, shutdown ###
+			}
+			cons.Logger.WithError(err).Errorf("Accept failed for %s", cons.address)
+			continue
+		}
+
+		cons.Logger.Debugf("New client connection to %s for %s", conn.RemoteAddr(), cons.address)
+		cons.AddWorker()
+		cons.clients.Store(conn, true)
+		go tgo.WithRecoverShutdown(func() { cons.handleConnection(conn) })
+	}
+}
+
+func (cons *Forward) handleConnection(conn net.Conn) {
+	defer func() {
+		cons.clients.Delete(conn)
+		conn.Close()
+		cons.Logger.Debugf("Closed client connection to %s on %s", conn.RemoteAddr(), cons.address)
+		cons.WorkerDone()
+	}()
+
+	reader := bufio.NewReader(conn)
+	decoder := msgpack.NewDecoder(reader)
+	encoder := msgpack.NewEncoder(conn)
+
+	if cons.sharedKey != "" {
+		if err := cons.handshake(conn, decoder, encoder); err != nil {
+			cons.Logger.WithError(err).Warningf("Handshake with %s failed", conn.RemoteAddr())
+			return // ### return, authentication failed ###
+		}
+	}
+
+	for cons.IsActive() {
+		// Time out in regular intervals so we can stop the loop on shutdown.
+		// Once data is available the whole entry is read without timeout.
+		conn.SetReadDeadline(time.Now().Add(cons.readTimeout))
+		if _, err := reader.Peek(1); err != nil {
+			if netErr, isNetErr := err.(net.Error); isNetErr && netErr.Timeout() {
+				continue
+			}
+			if err != io.EOF && !tnet.IsDisconnectedError(err) && cons.IsActive() {
+				cons.Logger.WithError(err).Errorf("Failed to read from %s", conn.RemoteAddr())
+			}
+			return // ### return, connection closed ###
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		if err := cons.readEntry(conn, decoder, encoder); err != nil {
+			if cons.IsActive() {
+				cons.Logger.WithError(err).Errorf("Invalid data received from %s", conn.RemoteAddr())
+			}
+			return // ### return, invalid data ###
+		}
+	}
+}
+
+// handshake performs the shared key authentication.
+func (cons *Forward) handshake(conn net.Conn, decoder *msgpack.Decoder, encoder *msgpack.Encoder) error {
+	nonce := components.NewForwardNonce()
+	helo := components.ForwardHelo{
+		Type: "HELO",
+		Options: components.ForwardHeloOptions{
+			Nonce:     nonce,
+			Auth:      []byte{},
+			Keepalive: true,
+		},
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(cons.ackTimeout))
+	if err := encoder.Encode(&helo); err != nil {
+		return err
+	}
+
+	ping := components.ForwardPing{}
+	conn.SetReadDeadline(time.Now().Add(cons.readTimeout))
+	if err := decoder.Decode(&ping); err != nil {
+		return err
+	}
+	if ping.Type != "PING" {
+		return fmt.Errorf("expected PING, got %s", ping.Type)
+	}
+
+	expected := components.ForwardSharedKeyHash(ping.SharedKeySalt, ping.Hostname, nonce, cons.sharedKey)
+	pong := components.ForwardPong{
+		Type:          "PONG",
+		AuthResult:    subtle.ConstantTimeCompare([]byte(expected), []byte(ping.SharedKeyHash)) == 1,
+		Hostname:      cons.hostname,
+		SharedKeyHash: components.ForwardSharedKeyHash(ping.SharedKeySalt, cons.hostname, nonce, cons.sharedKey),
+	}
+	if !pong.AuthResult {
+		pong.Reason = "shared key mismatch"
+		pong.SharedKeyHash = ""
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(cons.ackTimeout))
+	if err := encoder.Encode(&pong); err != nil {
+		return err
+	}
+	if !pong.AuthResult {
+		return fmt.Errorf("client %s sent an invalid shared key", ping.Hostname)
+	}
+	return nil
+}
+
+// readEntry reads one forward protocol message, enqueues all events and
+// sends an acknowledgement if requested.
+func (cons *Forward) readEntry(conn net.Conn, decoder *msgpack.Decoder, encoder *msgpack.Encoder) error {
+	numFields, err := decoder.DecodeArrayLen()
+	if err != nil {
+		return err
+	}
+	if numFields < 2 {
+		return fmt.Errorf("message has %d fields, expected at least 2", numFields)
+	}
+
+	tag, err := decoder.DecodeString()
+	if err != nil {
+		return err
+	}
+
+	code, err := decoder.PeekCode()
+	if err != nil {
+		return err
+	}
+
+	var (
+		events      []forwardEvent
+		packed      []byte
+		fieldsRead  = 2
+		isPacked    = msgpcode.IsString(code) || msgpcode.IsBin(code)
+		isForward   = msgpcode.IsFixedArray(code) || code == msgpcode.Array16 || code == msgpcode.Array32
+		eventOption = components.ForwardOption{}
+	)
+
+	switch {
+	case isForward:
+		numEvents, err := decoder.DecodeArrayLen()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < numEvents; i++ {
+			event, err := decodeForwardEvent(decoder)
+			if err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+
+	case isPacked:
+		if packed, err = decoder.DecodeBytes(); err != nil {
+			return err
+		}
+
+	default:
+		// Message mode: [tag, time, record, option]
+		if numFields < 3 {
+			return fmt.Errorf("message mode requires at least 3 fields")
+		}
+		event := forwardEvent{}
+		if event.time, err = decodeForwardTime(decoder); err != nil {
+			return err
+		}
+		if event.record, err = decoder.DecodeMap(); err != nil {
+			return err
+		}
+		events = append(events, event)
+		fieldsRead = 3
+	}
+
+	if numFields > fieldsRead {
+		if err := decoder.Decode(&eventOption); err != nil {
+			return err
+		}
+		fieldsRead++
+	}
+	for ; fieldsRead < numFields; fieldsRead++ {
+		if err := decoder.Skip(); err != nil {
+			return err
+		}
+	}
+
+	if isPacked {
+		if events, err = decodePackedForwardEvents(packed, eventOption.Compressed, cons.maxChunkSize); err != nil {
+			return err
+		}
+	}
+
+	streamID := cons.getTargetStream(tag)
+	for _, event := range events {
+		cons.enqueueEvent(tag, event, streamID)
+	}
+
+	if eventOption.Chunk == "" {
+		return nil // ### return, no ack requested ###
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(cons.ackTimeout))
+	return encoder.Encode(&components.ForwardAck{Ack: eventOption.Chunk})
+}
+
+func decodeForwardTime(decoder *msgpack.Decoder) (time.Time, error) {
+	value, err := decoder.DecodeInterface()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return components.ForwardTimeToTime(value)
+}
+
+// decodeForwardEvent decodes an entry of the form [time, record].
+func decodeForwardEvent(decoder *msgpack.Decoder) (forwardEvent, error) {
+	event := forwardEvent{}
+	numFields, err := decoder.DecodeArrayLen()
+	if err != nil {
+		return event, err
+	}
+	if numFields != 2 {
+		return event, fmt.Errorf("event has %d fields, expected 2", numFields)
+	}
+	if event.time, err = decodeForwardTime(decoder); err != nil {
+		return event, err
+	}
+	event.record, err = decoder.DecodeMap()
+	return event, err
+}
+
+// decodePackedForwardEvents decodes a stream of [time, record] entries as sent
+// by the PackedForward and CompressedPackedForward modes. Decompressed data
+// is limited to maxSize bytes.
+func decodePackedForwardEvents(packed []byte, compression string, maxSize int64) ([]forwardEvent, error) {
+	var reader io.Reader = bytes.NewReader(packed)
+	switch compression {
+	case "":
+	case components.ForwardCompressionGzip:
+		// Compressed chunks may consist of multiple concatenated gzip
+		// streams which is handled by gzip.Reader's multistream mode.
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	default:
+		return nil, fmt.Errorf("unsupported compression %s", compression)
+	}
+
+	// Read one byte more than allowed to detect oversized chunks
+	limitedReader := &io.LimitedReader{R: reader, N: maxSize + 1}
+	bufferedReader := bufio.NewReader(limitedReader)
+	decoder := msgpack.NewDecoder(bufferedReader)
+	events := []forwardEvent{}
+	for {
+		if _, err := bufferedReader.Peek(1); err == io.EOF {
+			if limitedReader.N <= 0 {
+				return events, fmt.Errorf("chunk exceeds the maximum size of %d bytes", maxSize)
+			}
+			return events, nil // ### return, done ###
+		}
+		event, err := decodeForwardEvent(decoder)
+		if err != nil {
+			if limitedReader.N <= 0 {
+				return events, fmt.Errorf("chunk exceeds the maximum size of %d bytes", maxSize)
+			}
+			return events, err
+		}
+		events = append(events, event)
+	}
+}
+
+// forwardRecordToJSON converts binary values (msgpack bin and str types may
+// be mixed by clients) to strings so that they can be encoded as JSON.
+func forwardRecordToJSON(value interface{}) interface{} {
+	switch data := value.(type) {
+	case []byte:
+		return string(data)
+	case map[string]interface{}:
+		for key, item := range data {
+			data[key] = forwardRecordToJSON(item)
+		}
+		return data
+	case []interface{}:
+		for idx, item := range data {
+			data[idx] = forwardRecordToJSON(item)
+		}
+		return data
+	default:
+		return data
+	}
+}
+
+// forwardValueToBytes converts a record value to a byte slice.
+func forwardValueToBytes(value interface{}) []byte {
+	switch data := value.(type) {
+	case string:
+		return []byte(data)
+	case []byte:
+		return data
+	case nil:
+		return []byte{}
+	default:
+		if encoded, err := json.Marshal(data); err == nil {
+			return encoded
+		}
+		return []byte(fmt.Sprint(data))
+	}
+}
+
+func (cons *Forward) enqueueEvent(tag string, event forwardEvent, streamID core.MessageStreamID) {
+	metadata := core.Metadata{}
+	metadata.SetValue("tag", []byte(tag))
+	metadata.SetValue("time", []byte(event.time.UTC().Format(time.RFC3339Nano)))
+
+	for field, key := range cons.fieldMetadata {
+		if value, exists := event.record[field]; exists {
+			metadata.SetValue(key, forwardValueToBytes(value))
+		}
+	}
+
+	if cons.payloadField != "" {
+		if value, exists := event.record[cons.payloadField]; exists {
+			cons.EnqueueWithMetadataTo(forwardValueToBytes(value), metadata, streamID)
+			return // ### return, enqueued payload field ###
+		}
+	}
+
+	payload, err := json.Marshal(forwardRecordToJSON(event.record))
+	if err != nil {
+		cons.Logger.WithError(err).Warningf("Failed to encode record with tag %s", tag)
+		return // ### return, cannot encode ###
+	}
+	cons.EnqueueWithMetadataTo(payload, metadata, streamID)
+}
+
+func (cons *Forward) closeConnections() {
+	if cons.listener != nil {
+		cons.listener.Close()
+	}
+	cons.clients.Range(func(conn, _ interface{}) bool {
+		conn.(net.Conn).Close()
+		return true
+	})
+}
+
+// Consume listens to a given socket.
+func (cons *Forward) Consume(workers *sync.WaitGroup) {
+	if cons.protocol == "unix" {
+		if info, err := os.Stat(cons.address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			cons.Logger.Warningf("Found existing socket %s. Removing.", cons.address)
+			os.Remove(cons.address)
+		}
+	}
+
+	listener, err := net.Listen(cons.protocol, cons.address)
+	if err != nil {
+		cons.Logger.WithError(err).Errorf("Failed to listen to %s", cons.address)
+		return // ### return, could not listen ###
+	}
+
+	cons.listener = listener
+	cons.AddMainWorker(workers)
+	cons.SetStopCallback(cons.closeConnections)
+
+	go tgo.WithRecoverShutdown(cons.listen)
+	cons.ControlLoop()
+}
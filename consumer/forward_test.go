@@ -0,0 +1,227 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo/ttesting"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var forwardTestTime = time.Unix(1700000000, 500)
+
+func newTestForward(t *testing.T, streamName string) (*Forward, *testStreamRouter) {
+	expect := ttesting.NewExpect(t)
+	router := newTestStreamRouter(streamName)
+
+	conf := core.NewPluginConfig(streamName+"Consumer", "consumer.Forward")
+	conf.Override("Streams", streamName)
+	conf.Override("SharedKey", "secret")
+	conf.Override("SelfHostname", "server")
+	conf.Override("Metadata/Fields", map[string]string{"host": "host"})
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+	return plugin.(*Forward), router
+}
+
+// newForwardTestConnections returns both ends of a loopback tcp connection.
+// net.Pipe is not used as it blocks on the empty writes done by msgpack.
+func newForwardTestConnections(t *testing.T) (server net.Conn, client net.Conn) {
+	expect := ttesting.NewExpect(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	expect.NoError(err)
+	defer listener.Close()
+
+	client, err = net.Dial("tcp", listener.Addr().String())
+	expect.NoError(err)
+	server, err = listener.Accept()
+	expect.NoError(err)
+	return server, client
+}
+
+// sendForwardEntry writes the given entry to the consumer and returns the
+// acknowledgement sent back, if any.
+func sendForwardEntry(t *testing.T, cons *Forward, entry []interface{}) string {
+	expect := ttesting.NewExpect(t)
+	server, client := newForwardTestConnections(t)
+	defer client.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		result <- cons.readEntry(server, msgpack.NewDecoder(bufio.NewReader(server)), msgpack.NewEncoder(server))
+	}()
+
+	expect.NoError(msgpack.NewEncoder(client).Encode(entry))
+
+	ack := components.ForwardAck{}
+	if err := msgpack.NewDecoder(client).Decode(&ack); err != nil {
+		ack.Ack = ""
+	}
+	expect.NoError(<-result)
+	return ack.Ack
+}
+
+func encodeForwardTestEvents(records ...map[string]interface{}) []byte {
+	buffer := bytes.Buffer{}
+	encoder := msgpack.NewEncoder(&buffer)
+	for _, record := range records {
+		encoder.Encode([]interface{}{&components.ForwardEventTime{Time: forwardTestTime}, record})
+	}
+	return buffer.Bytes()
+}
+
+func TestForwardMessageMode(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons, router := newTestForward(t, "forwardTestMessage")
+
+	ack := sendForwardEntry(t, cons, []interface{}{
+		"app.web", forwardTestTime.Unix(), map[string]interface{}{"log": "a", "host": "h1"},
+	})
+	expect.Equal("", ack)
+
+	messages := router.getMessages()
+	expect.Equal(1, len(messages))
+	expect.Equal(`{"host":"h1","log":"a"}`, messages[0].String())
+	expect.Equal("app.web", messages[0].GetMetadata().GetValueString("tag"))
+	expect.Equal("h1", messages[0].GetMetadata().GetValueString("host"))
+	expect.Equal("2023-11-14T22:13:20Z", messages[0].GetMetadata().GetValueString("time"))
+}
+
+func TestForwardForwardMode(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons, router := newTestForward(t, "forwardTestForward")
+
+	eventTime := &components.ForwardEventTime{Time: forwardTestTime}
+	ack := sendForwardEntry(t, cons, []interface{}{
+		"app.web",
+		[]interface{}{
+			[]interface{}{eventTime, map[string]interface{}{"log": "a"}},
+			[]interface{}{eventTime, map[string]interface{}{"log": []byte("b")}},
+		},
+		map[string]interface{}{"chunk": "c1"},
+	})
+	expect.Equal("c1", ack)
+
+	messages := router.getMessages()
+	expect.Equal([]string{`{"log":"a"}`, `{"log":"b"}`}, router.payloads())
+	expect.Equal("2023-11-14T22:13:20.0000005Z", messages[0].GetMetadata().GetValueString("time"))
+}
+
+func TestForwardPackedForwardMode(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons, router := newTestForward(t, "forwardTestPacked")
+
+	ack := sendForwardEntry(t, cons, []interface{}{
+		"app.web",
+		encodeForwardTestEvents(map[string]interface{}{"log": "a"}, map[string]interface{}{"log": "b"}),
+		map[string]interface{}{"size": 2, "chunk": "c2"},
+	})
+	expect.Equal("c2", ack)
+	expect.Equal([]string{`{"log":"a"}`, `{"log":"b"}`}, router.payloads())
+}
+
+func TestForwardCompressedPackedForwardMode(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons, router := newTestForward(t, "forwardTestCompressed")
+
+	// Chunks may consist of multiple gzip streams
+	compressed := bytes.Buffer{}
+	for _, log := range []string{"a", "b"} {
+		writer := gzip.NewWriter(&compressed)
+		writer.Write(encodeForwardTestEvents(map[string]interface{}{"log": log}))
+		writer.Close()
+	}
+
+	ack := sendForwardEntry(t, cons, []interface{}{
+		"app.web",
+		compressed.Bytes(),
+		map[string]interface{}{"size": 2, "compressed": "gzip", "chunk": "c3"},
+	})
+	expect.Equal("c3", ack)
+	expect.Equal([]string{`{"log":"a"}`, `{"log":"b"}`}, router.payloads())
+}
+
+func TestForwardChunkSizeLimit(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	packed := encodeForwardTestEvents(map[string]interface{}{"log": string(make([]byte, 1024))})
+	compressed := bytes.Buffer{}
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(packed)
+	writer.Close()
+
+	events, err := decodePackedForwardEvents(compressed.Bytes(), components.ForwardCompressionGzip, int64(len(packed)))
+	expect.NoError(err)
+	expect.Equal(1, len(events))
+
+	_, err = decodePackedForwardEvents(compressed.Bytes(), components.ForwardCompressionGzip, int64(len(packed)-1))
+	expect.NotNil(err)
+
+	_, err = decodePackedForwardEvents(compressed.Bytes(), "zstd", 1024)
+	expect.NotNil(err)
+}
+
+func TestForwardHandshake(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons, _ := newTestForward(t, "forwardTestHandshake")
+
+	for _, sharedKey := range []string{"secret", "invalid"} {
+		server, client := newForwardTestConnections(t)
+		result := make(chan error, 1)
+		go func() {
+			defer server.Close()
+			result <- cons.handshake(server, msgpack.NewDecoder(server), msgpack.NewEncoder(server))
+		}()
+
+		decoder := msgpack.NewDecoder(client)
+		helo := components.ForwardHelo{}
+		expect.NoError(decoder.Decode(&helo))
+		expect.Equal("HELO", helo.Type)
+		expect.Equal(16, len(helo.Options.Nonce))
+
+		salt := components.NewForwardNonce()
+		expect.NoError(msgpack.NewEncoder(client).Encode(&components.ForwardPing{
+			Type:          "PING",
+			Hostname:      "client",
+			SharedKeySalt: salt,
+			SharedKeyHash: components.ForwardSharedKeyHash(salt, "client", helo.Options.Nonce, sharedKey),
+		}))
+
+		pong := components.ForwardPong{}
+		expect.NoError(decoder.Decode(&pong))
+		expect.Equal("PONG", pong.Type)
+		expect.Equal("server", pong.Hostname)
+
+		if sharedKey == "secret" {
+			expect.True(pong.AuthResult)
+			expect.Equal(components.ForwardSharedKeyHash(salt, "server", helo.Options.Nonce, "secret"), pong.SharedKeyHash)
+			expect.NoError(<-result)
+		} else {
+			expect.False(pong.AuthResult)
+			expect.NotNil(<-result)
+		}
+		client.Close()
+	}
+}
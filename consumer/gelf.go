@@ -0,0 +1,445 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo"
+	"github.com/trivago/tgo/tnet"
+)
+
+const (
+	gelfChunkMagic0     = 0x1e
+	gelfChunkMagic1     = 0x0f
+	gelfChunkHeaderSize = 12
+	gelfMaxChunks       = 128
+	gelfMaxPacketSize   = 65536
+)
+
+// GELF consumer plugin
+//
+// This consumer receives messages in the Graylog Extended Log Format (GELF)
+// version 1.1. UDP packets may be chunked and compressed using zlib or gzip.
+// TCP connections have to send uncompressed messages that are terminated by a
+// null byte.
+//
+// Metadata
+//
+// *NOTE: The metadata will only set if the parameter `SetMetadata` is active.*
+//
+// - host: The host field of the message
+//
+// - level: The syslog severity of the message
+//
+// - timestamp: The timestamp of the message as sent, i.e. unix seconds with an
+// optional fraction
+//
+// - full_message: The full message if set
+//
+// - short_message: The short message if PayloadField is not "short_message"
+//
+// - <field>: All additional fields, without the leading underscore
+//
+// Parameters
+//
+// - Address: Defines the protocol, host and port to bind to. Valid protocols
+// are "udp" and "tcp".
+// By default this parameter is set to "udp://0.0.0.0:12201".
+//
+// - ReadTimeoutSec: Defines the number of seconds to wait for data to be
+// received. This setting affects the maximum shutdown duration of this
+// consumer.
+// By default this parameter is set to "2".
+//
+// - ChunkTimeoutSec: Defines the number of seconds to wait for all chunks of
+// a chunked UDP message to arrive. Incomplete messages are discarded.
+// By default this parameter is set to "5".
+//
+// - MaxMessageSizeKB: Defines the maximum size of a (decompressed) message.
+// Larger messages are discarded. TCP connections sending larger messages are
+// closed.
+// By default this parameter is set to "8192".
+//
+// - MaxChunkedMessages: Defines the maximum number of incomplete chunked UDP
+// messages kept in memory. Chunks of new messages are discarded while this
+// limit is reached.
+// By default this parameter is set to "1024".
+//
+// - PayloadField: Defines the GELF field used as message payload. If set to
+// "", the whole GELF message is used as payload.
+// By default this parameter is set to "short_message".
+//
+// - SetMetadata: When set to true, all GELF fields except the payload field
+// are stored as metadata.
+// By default this parameter is set to "true".
+//
+// Examples
+//
+// This example replaces a Graylog GELF UDP input.
+//
+//  GelfIn:
+//    Type: consumer.GELF
+//    Streams: "gelf"
+//    Address: "udp://0.0.0.0:12201"
+//
+type GELF struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+	protocol            string
+	address             string
+	readTimeout         time.Duration `config:"ReadTimeoutSec" default:"2" metric:"sec"`
+	chunkTimeout        time.Duration `config:"ChunkTimeoutSec" default:"5" metric:"sec"`
+	maxMessageSize      int64         `config:"MaxMessageSizeKB" default:"8192" metric:"kb"`
+	maxChunkedMessages  int           `config:"MaxChunkedMessages" default:"1024"`
+	payloadField        string        `config:"PayloadField" default:"short_message"`
+	withMetadata        bool          `config:"SetMetadata" default:"true"`
+	listener            io.Closer
+	clients             sync.Map
+	chunks              map[string]*gelfChunkedMessage
+}
+
+// gelfChunkedMessage collects the chunks of a chunked UDP message.
+type gelfChunkedMessage struct {
+	chunks    [][]byte
+	received  int
+	size      int64
+	firstSeen time.Time
+}
+
+func init() {
+	core.TypeRegistry.Register(GELF{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *GELF) Configure(conf core.PluginConfigReader) {
+	cons.protocol, cons.address = tnet.ParseAddress(conf.GetString("Address", "udp://0.0.0.0:12201"), "udp")
+	switch cons.protocol {
+	case "udp", "tcp":
+	default:
+		conf.Errors.Pushf("Unsupported protocol %s", cons.protocol)
+	}
+
+	cons.chunks = make(map[string]*gelfChunkedMessage)
+}
+
+func (cons *GELF) readUDP(conn *net.UDPConn) {
+	defer cons.WorkerDone()
+
+	buffer := make([]byte, gelfMaxPacketSize)
+	for cons.IsActive() {
+		conn.SetReadDeadline(time.Now().Add(cons.readTimeout))
+		size, remote, err := conn.ReadFrom(buffer)
+		cons.dropExpiredChunks()
+
+		if err != nil {
+			if netErr, isNetErr := err.(net.Error); isNetErr && netErr.Timeout() {
+				continue
+			}
+			if cons.IsActive() {
+				cons.Logger.WithError(err).Errorf("Failed to read from %s", cons.address)
+			}
+			continue
+		}
+
+		packet := make([]byte, size)
+		copy(packet, buffer[:size])
+
+		data, complete, err := cons.assembleChunks(packet)
+		if err != nil {
+			cons.Logger.WithError(err).Warningf("Invalid chunk received from %s", remote)
+			continue
+		}
+		if complete {
+			cons.processMessage(data, remote)
+		}
+	}
+}
+
+// assembleChunks returns the complete message if a packet is not chunked or
+// if it is the last missing chunk of a message.
+func (cons *GELF) assembleChunks(packet []byte) ([]byte, bool, error) {
+	if len(packet) < 2 || packet[0] != gelfChunkMagic0 || packet[1] != gelfChunkMagic1 {
+		return packet, true, nil // ### return, not chunked ###
+	}
+
+	if len(packet) < gelfChunkHeaderSize {
+		return nil, false, fmt.Errorf("chunk header too short")
+	}
+
+	messageID := string(packet[2:10])
+	seqNum := int(packet[10])
+	seqCount := int(packet[11])
+
+	if seqCount == 0 || seqCount > gelfMaxChunks || seqNum >= seqCount {
+		return nil, false, fmt.Errorf("invalid chunk %d of %d", seqNum, seqCount)
+	}
+
+	message, exists := cons.chunks[messageID]
+	if !exists {
+		if len(cons.chunks) >= cons.maxChunkedMessages {
+			return nil, false, fmt.Errorf("too many incomplete chunked messages")
+		}
+		message = &gelfChunkedMessage{
+			chunks:    make([][]byte, seqCount),
+			firstSeen: time.Now(),
+		}
+		cons.chunks[messageID] = message
+	}
+
+	if len(message.chunks) != seqCount {
+		delete(cons.chunks, messageID)
+		return nil, false, fmt.Errorf("chunk count mismatch")
+	}
+
+	if message.chunks[seqNum] == nil {
+		message.chunks[seqNum] = packet[gelfChunkHeaderSize:]
+		message.received++
+		message.size += int64(len(packet) - gelfChunkHeaderSize)
+	}
+
+	if message.size > cons.maxMessageSize {
+		delete(cons.chunks, messageID)
+		return nil, false, fmt.Errorf("chunked message exceeds MaxMessageSizeKB")
+	}
+
+	if message.received < seqCount {
+		return nil, false, nil // ### return, chunks missing ###
+	}
+
+	delete(cons.chunks, messageID)
+	return bytes.Join(message.chunks, nil), true, nil
+}
+
+// dropExpiredChunks removes incomplete messages that exceeded ChunkTimeoutSec.
+func (cons *GELF) dropExpiredChunks() {
+	for messageID, message := range cons.chunks {
+		if time.Since(message.firstSeen) > cons.chunkTimeout {
+			cons.Logger.Warningf("Discarding incomplete chunked message (%d of %d chunks received)", message.received, len(message.chunks))
+			delete(cons.chunks, messageID)
+		}
+	}
+}
+
+// decompress detects and removes zlib or gzip compression.
+func (cons *GELF) decompress(data []byte) ([]byte, error) {
+	var (
+		reader io.ReadCloser
+		err    error
+	)
+
+	switch {
+	case len(data) > 1 && data[0] == 0x1f && data[1] == 0x8b:
+		reader, err = gzip.NewReader(bytes.NewReader(data))
+	case len(data) > 0 && data[0] == 0x78:
+		reader, err = zlib.NewReader(bytes.NewReader(data))
+	default:
+		if int64(len(data)) > cons.maxMessageSize {
+			return nil, fmt.Errorf("message exceeds MaxMessageSizeKB")
+		}
+		return data, nil // ### return, not compressed ###
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	inflated, err := ioutil.ReadAll(io.LimitReader(reader, cons.maxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(inflated)) > cons.maxMessageSize {
+		return nil, fmt.Errorf("message exceeds MaxMessageSizeKB")
+	}
+	return inflated, nil
+}
+
+func gelfValueToBytes(value interface{}) []byte {
+	switch data := value.(type) {
+	case string:
+		return []byte(data)
+	case json.Number:
+		return []byte(data.String())
+	case nil:
+		return []byte{}
+	default:
+		if encoded, err := json.Marshal(data); err == nil {
+			return encoded
+		}
+		return []byte(fmt.Sprint(data))
+	}
+}
+
+// processMessage parses a GELF message and enqueues it.
+func (cons *GELF) processMessage(data []byte, remote net.Addr) {
+	data, err := cons.decompress(data)
+	if err != nil {
+		cons.Logger.WithError(err).Warningf("Failed to decompress message from %s", remote)
+		return // ### return, invalid compression ###
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	fields := make(map[string]interface{})
+	if err := decoder.Decode(&fields); err != nil {
+		cons.Logger.WithError(err).Warningf("Invalid GELF message from %s", remote)
+		return // ### return, invalid message ###
+	}
+
+	payload := data
+	if cons.payloadField != "" {
+		value, exists := fields[cons.payloadField]
+		if !exists {
+			cons.Logger.Warningf("GELF message from %s has no field %s", remote, cons.payloadField)
+			return // ### return, missing payload ###
+		}
+		payload = gelfValueToBytes(value)
+	}
+
+	if !cons.withMetadata {
+		cons.Enqueue(payload)
+		return // ### return, no metadata ###
+	}
+
+	metadata := core.Metadata{}
+	for key, value := range fields {
+		if key == cons.payloadField || key == "version" {
+			continue
+		}
+		metadata.SetValue(strings.TrimPrefix(key, "_"), gelfValueToBytes(value))
+	}
+	cons.EnqueueWithMetadata(payload, metadata)
+}
+
+func (cons *GELF) listenTCP(listener net.Listener) {
+	defer cons.WorkerDone()
+
+	for cons.IsActive() {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !cons.IsActive() {
+				return // ### return, shutdown ###
+			}
+			cons.Logger.WithError(err).Errorf("Accept failed for %s", cons.address)
+			continue
+		}
+
+		cons.AddWorker()
+		cons.clients.Store(conn, true)
+		go tgo.WithRecoverShutdown(func() { cons.readTCP(conn) })
+	}
+}
+
+func (cons *GELF) readTCP(conn net.Conn) {
+	defer func() {
+		cons.clients.Delete(conn)
+		conn.Close()
+		cons.WorkerDone()
+	}()
+
+	reader := bufio.NewReader(conn)
+	message := []byte{}
+
+	for cons.IsActive() {
+		// Time out in regular intervals so we can stop the loop on shutdown.
+		// ReadSlice returns at most one buffer of data, so the size of a
+		// message can be checked while it is read.
+		conn.SetReadDeadline(time.Now().Add(cons.readTimeout))
+		data, err := reader.ReadSlice(0)
+		message = append(message, data...)
+
+		// The message may contain the terminating null byte
+		if int64(len(message)) > cons.maxMessageSize+1 {
+			cons.Logger.Warningf("Message from %s exceeds MaxMessageSizeKB", conn.RemoteAddr())
+			return // ### return, message too large ###
+		}
+
+		if err != nil {
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if netErr, isNetErr := err.(net.Error); isNetErr && netErr.Timeout() {
+				continue
+			}
+			if err != io.EOF && !tnet.IsDisconnectedError(err) && cons.IsActive() {
+				cons.Logger.WithError(err).Errorf("Failed to read from %s", conn.RemoteAddr())
+			}
+			return // ### return, connection closed ###
+		}
+
+		// Some clients send newlines after the null byte
+		message = bytes.TrimSpace(message[:len(message)-1])
+		if len(message) > 0 {
+			cons.processMessage(message, conn.RemoteAddr())
+		}
+		message = []byte{}
+	}
+}
+
+func (cons *GELF) closeConnections() {
+	if cons.listener != nil {
+		cons.listener.Close()
+	}
+	cons.clients.Range(func(conn, _ interface{}) bool {
+		conn.(net.Conn).Close()
+		return true
+	})
+}
+
+// Consume listens to a given socket.
+func (cons *GELF) Consume(workers *sync.WaitGroup) {
+	switch cons.protocol {
+	case "udp":
+		addr, err := net.ResolveUDPAddr("udp", cons.address)
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to resolve %s", cons.address)
+			return // ### return, invalid address ###
+		}
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to listen to %s", cons.address)
+			return // ### return, could not listen ###
+		}
+		cons.listener = conn
+		cons.AddMainWorker(workers)
+		go tgo.WithRecoverShutdown(func() { cons.readUDP(conn) })
+
+	case "tcp":
+		listener, err := net.Listen("tcp", cons.address)
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to listen to %s", cons.address)
+			return // ### return, could not listen ###
+		}
+		cons.listener = listener
+		cons.AddMainWorker(workers)
+		go tgo.WithRecoverShutdown(func() { cons.listenTCP(listener) })
+	}
+
+	cons.SetStopCallback(cons.closeConnections)
+	cons.ControlLoop()
+}
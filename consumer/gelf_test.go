@@ -0,0 +1,110 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func newTestGELF(t *testing.T, streamName string, address string) (*GELF, *testStreamRouter) {
+	expect := ttesting.NewExpect(t)
+	router := newTestStreamRouter(streamName)
+
+	conf := core.NewPluginConfig(streamName+"Consumer", "consumer.GELF")
+	conf.Override("Streams", streamName)
+	conf.Override("Address", address)
+	conf.Override("MaxMessageSizeKB", 1)
+	conf.Override("MaxChunkedMessages", 2)
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+	return plugin.(*GELF), router
+}
+
+func gelfTestChunk(messageID byte, seqNum, seqCount byte, data string) []byte {
+	chunk := []byte{gelfChunkMagic0, gelfChunkMagic1, messageID, 0, 0, 0, 0, 0, 0, 0, seqNum, seqCount}
+	return append(chunk, data...)
+}
+
+func TestGELFAssembleChunks(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons, _ := newTestGELF(t, "gelfTestChunks", "udp://127.0.0.1:0")
+
+	data, complete, err := cons.assembleChunks([]byte(`{"short_message":"a"}`))
+	expect.NoError(err)
+	expect.True(complete)
+	expect.Equal(`{"short_message":"a"}`, string(data))
+
+	_, complete, err = cons.assembleChunks(gelfTestChunk(1, 1, 2, `"b"}`))
+	expect.NoError(err)
+	expect.False(complete)
+
+	data, complete, err = cons.assembleChunks(gelfTestChunk(1, 0, 2, `{"short_message":`))
+	expect.NoError(err)
+	expect.True(complete)
+	expect.Equal(`{"short_message":"b"}`, string(data))
+	expect.Equal(0, len(cons.chunks))
+
+	_, _, err = cons.assembleChunks(gelfTestChunk(2, 2, 2, "x"))
+	expect.NotNil(err)
+
+	// The number of incomplete messages is limited
+	_, _, err = cons.assembleChunks(gelfTestChunk(2, 0, 2, "x"))
+	expect.NoError(err)
+	_, _, err = cons.assembleChunks(gelfTestChunk(3, 0, 2, "x"))
+	expect.NoError(err)
+	_, _, err = cons.assembleChunks(gelfTestChunk(4, 0, 2, "x"))
+	expect.NotNil(err)
+	expect.Equal(2, len(cons.chunks))
+
+	// The size of a chunked message is limited
+	large := string(bytes.Repeat([]byte("x"), 600))
+	_, complete, err = cons.assembleChunks(gelfTestChunk(2, 1, 2, large))
+	expect.NoError(err)
+	expect.True(complete)
+	_, _, err = cons.assembleChunks(gelfTestChunk(3, 1, 2, large+large))
+	expect.NotNil(err)
+	expect.Equal(0, len(cons.chunks))
+}
+
+func TestGELFReadTCP(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons, router := newTestGELF(t, "gelfTestTCP", "tcp://127.0.0.1:0")
+	stop := startTestConsumer(t, cons)
+	defer stop()
+
+	conn, err := net.Dial("tcp", cons.listener.(net.Listener).Addr().String())
+	expect.NoError(err)
+	defer conn.Close()
+
+	conn.Write([]byte("{\"short_message\":\"a\"}\x00\n{\"short_message\":\"b\"}\x00"))
+
+	// Connections sending messages larger than MaxMessageSizeKB are closed
+	// before the terminating null byte is received.
+	conn.Write(bytes.Repeat([]byte("x"), 8192))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	netErr, isNetErr := err.(net.Error)
+	expect.False(isNetErr && netErr.Timeout())
+	expect.NotNil(err)
+
+	expect.Equal([]string{"a", "b"}, router.payloads())
+}
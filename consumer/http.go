@@ -16,10 +16,17 @@ package consumer
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -28,6 +35,12 @@ import (
 	"github.com/trivago/tgo/tnet"
 )
 
+const (
+	httpBodyRaw   = "raw"
+	httpBodyLines = "lines"
+	httpBodyJSON  = "json"
+)
+
 // HTTP consumer plugin
 //
 // This consumer opens up an HTTP 1.1 server and processes the contents of any
@@ -60,6 +73,82 @@ import (
 // - PrivateKey: Path to an X509 formatted private key file. Meaningful only in
 // conjunction with Certificate.
 //
+// - ClientCA: Path to a PEM formatted CA bundle. If defined, clients have to
+// present a certificate signed by one of these CAs (mutual TLS). Meaningful
+// only in conjunction with Certificate.
+// By default this parameter is set to "".
+//
+// - TokenFile: Path to a file containing API keys. If defined, every request
+// has to pass a key either as "Authorization: Bearer <key>" or as "X-API-Key"
+// header. Each line of the file contains one key, optionally followed by a
+// comma separated list of streams this key is allowed to send to, e.g.
+// "s3cr3t logs,metrics". Keys without a stream list may send to all streams.
+// Empty lines and lines starting with "#" are ignored. If Htpasswd is set,
+// too, both checks have to succeed.
+// By default this parameter is set to "".
+//
+// - Routes: Defines a mapping of URL paths to streams. Keys can be prefixed
+// with a HTTP method separated by a space, e.g. "POST /metrics". Paths use the
+// pattern syntax of go's path.Match, so "/logs/*" matches "/logs/app" but not
+// "/logs/app/error". If more than one route matches, the route with the longest
+// path is used. Requests that do not match any route are answered with
+// StatusCodes/NotFound. If no routes are set, all requests are sent to the
+// streams set by Streams.
+// By default this parameter is set to an empty map.
+//
+// - BodyFormat: Defines how the request body is split into messages. This
+// setting is ignored if WithHeaders is set to true.
+// By default this parameter is set to "raw". The following options are available:
+//  - "raw": The whole body is sent as one message.
+//  - "lines": Each line of the body is sent as a separate message. Empty lines
+//  are ignored.
+//  - "json": If the body is a JSON array, each element of the array is sent as a
+//  separate message. Any other JSON value is sent as one message. Requests
+//  with a body that is not valid JSON are answered with StatusCodes/BadRequest.
+//
+// - Metadata/Headers: Defines a mapping of HTTP request headers to metadata
+// fields. Headers not present in a request are not set.
+// By default this parameter is set to an empty map.
+//
+// - Metadata/Query: Defines a mapping of URL query parameters to metadata
+// fields. Parameters not present in a request are not set.
+// By default this parameter is set to an empty map.
+//
+// - StatusCodes/Success: Defines the status code sent after all messages of a
+// request have been enqueued.
+// By default this parameter is set to "200".
+//
+// - StatusCodes/BadRequest: Defines the status code sent if a request body
+// cannot be read or parsed.
+// By default this parameter is set to "400".
+//
+// - StatusCodes/Unauthorized: Defines the status code sent if authentication
+// failed.
+// By default this parameter is set to "401".
+//
+// - StatusCodes/Forbidden: Defines the status code sent if an API key is not
+// allowed to send to the target stream.
+// By default this parameter is set to "403".
+//
+// - StatusCodes/NotFound: Defines the status code sent if no route matches a
+// request.
+// By default this parameter is set to "404".
+//
+// - StatusCodes/Blocked: Defines the status code sent if a producer listening
+// to the target stream is blocked, e.g. because its queue is full. No messages
+// are enqueued in this case.
+// By default this parameter is set to "429".
+//
+// - Metadata/ClientSubject: Defines the metadata field the subject of the
+// client certificate is stored to. This setting requires ClientCA to be set.
+// If set to "", the subject is not stored.
+// By default this parameter is set to "".
+//
+// - Metadata/ClientCommonName: Defines the metadata field the common name of
+// the client certificate is stored to. This setting requires ClientCA to be
+// set. If set to "", the common name is not stored.
+// By default this parameter is set to "".
+//
 // Examples
 //
 // This example listens on port 9090 and writes to the stream "http_in_00".
@@ -70,6 +159,38 @@ import (
 //     Address: "localhost:9090"
 //     WithHeaders: false
 //
+// This example serves newline delimited logs and JSON encoded metrics on the
+// same port.
+//
+//   "HttpIn01":
+//     Type: "consumer.HTTP"
+//     Streams: "http_in_01"
+//     Address: "localhost:9091"
+//     WithHeaders: false
+//     BodyFormat: "lines"
+//     Routes:
+//       "/logs/*": "logs"
+//       "POST /metrics": "metrics"
+//     Metadata:
+//       Headers:
+//         "X-Hostname": "host"
+//       Query:
+//         "tenant": "tenant"
+//
+// This example accepts requests from clients with a valid certificate and API
+// key only.
+//
+//   "HttpIn02":
+//     Type: "consumer.HTTP"
+//     Streams: "http_in_02"
+//     Address: ":443"
+//     Certificate: "/etc/gollum/server.crt"
+//     PrivateKey: "/etc/gollum/server.key"
+//     ClientCA: "/etc/gollum/agents-ca.crt"
+//     TokenFile: "/etc/gollum/api-keys"
+//     Metadata:
+//       ClientCommonName: "agent"
+//
 type HTTP struct {
 	core.SimpleConsumer `gollumdoc:"embed_type"`
 	address             string        `config:"Address" default:":80"`
@@ -77,11 +198,32 @@ type HTTP struct {
 	withHeaders         bool          `config:"WithHeaders" default:"true"`
 	htpasswd            string        `config:"Htpasswd"`
 	basicRealm          string        `config:"BasicRealm"`
+	bodyFormat          string        `config:"BodyFormat" default:"raw"`
+	headerMetadata      map[string]string
+	queryMetadata       map[string]string
+	routes              []httpRoute
+	statusSuccess       int    `config:"StatusCodes/Success" default:"200"`
+	statusBadRequest    int    `config:"StatusCodes/BadRequest" default:"400"`
+	statusUnauthorized  int    `config:"StatusCodes/Unauthorized" default:"401"`
+	statusForbidden     int    `config:"StatusCodes/Forbidden" default:"403"`
+	statusNotFound      int    `config:"StatusCodes/NotFound" default:"404"`
+	statusBlocked       int    `config:"StatusCodes/Blocked" default:"429"`
+	clientSubjectKey    string `config:"Metadata/ClientSubject"`
+	clientCNKey         string `config:"Metadata/ClientCommonName"`
+	tokenFile           string `config:"TokenFile"`
+	tokens              map[string][]core.MessageStreamID
+	boundStreams        []core.MessageStreamID
 	secrets             auth.SecretProvider
 	listen              *tnet.StopListener
 	certificate         *tls.Config
 }
 
+type httpRoute struct {
+	method   string
+	pattern  string
+	streamID core.MessageStreamID
+}
+
 func init() {
 	core.TypeRegistry.Register(HTTP{})
 }
@@ -96,6 +238,26 @@ func (cons *HTTP) Configure(conf core.PluginConfigReader) {
 		cons.secrets = auth.HtpasswdFileProvider(cons.htpasswd)
 	}
 
+	switch strings.ToLower(cons.bodyFormat) {
+	case httpBodyRaw, httpBodyLines, httpBodyJSON:
+		cons.bodyFormat = strings.ToLower(cons.bodyFormat)
+	default:
+		conf.Errors.Pushf("Unknown BodyFormat: %s", cons.bodyFormat)
+	}
+
+	cons.headerMetadata = conf.GetStringMap("Metadata/Headers", map[string]string{})
+	cons.queryMetadata = conf.GetStringMap("Metadata/Query", map[string]string{})
+
+	for route, streamName := range conf.GetStringMap("Routes", map[string]string{}) {
+		cons.routes = append(cons.routes, newHTTPRoute(route, streamName))
+	}
+	sort.Slice(cons.routes, func(i, j int) bool {
+		if len(cons.routes[i].pattern) != len(cons.routes[j].pattern) {
+			return len(cons.routes[i].pattern) > len(cons.routes[j].pattern)
+		}
+		return cons.routes[i].method > cons.routes[j].method
+	})
+
 	certificateFile := conf.GetString("Certificate", "")
 	keyFile := conf.GetString("PrivateKey", "")
 
@@ -113,6 +275,56 @@ func (cons *HTTP) Configure(conf core.PluginConfigReader) {
 			}
 		}
 	}
+
+	if clientCAFile := conf.GetString("ClientCA", ""); clientCAFile != "" {
+		if cons.certificate == nil {
+			conf.Errors.Pushf("ClientCA requires Certificate and PrivateKey to be set")
+		} else if caCert, err := ioutil.ReadFile(clientCAFile); !conf.Errors.Push(err) {
+			caCertPool := x509.NewCertPool()
+			if !caCertPool.AppendCertsFromPEM(caCert) {
+				conf.Errors.Pushf("No certificates found in %s", clientCAFile)
+			}
+			cons.certificate.ClientCAs = caCertPool
+			cons.certificate.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	if cons.tokenFile != "" {
+		cons.boundStreams = conf.GetStreamArray("Streams", []core.MessageStreamID{})
+		conf.Errors.Push(cons.readTokenFile())
+	}
+}
+
+// readTokenFile parses the API key file given by TokenFile.
+func (cons *HTTP) readTokenFile() error {
+	content, err := ioutil.ReadFile(cons.tokenFile)
+	if err != nil {
+		return err
+	}
+
+	cons.tokens = make(map[string][]core.MessageStreamID)
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue // ### continue, comment or empty line ###
+		}
+
+		fields := strings.Fields(line)
+		streams := []core.MessageStreamID{}
+		if len(fields) > 1 {
+			for _, streamName := range strings.Split(fields[1], ",") {
+				if streamName = strings.TrimSpace(streamName); streamName != "" {
+					streams = append(streams, core.GetStreamID(streamName))
+				}
+			}
+		}
+		cons.tokens[fields[0]] = streams
+	}
+
+	if len(cons.tokens) == 0 {
+		return fmt.Errorf("no API keys found in %s", cons.tokenFile)
+	}
+	return nil
 }
 
 func (cons *HTTP) checkAuth(r *http.Request) bool {
@@ -120,44 +332,239 @@ func (cons *HTTP) checkAuth(r *http.Request) bool {
 	return a.CheckAuth(r) != ""
 }
 
-// requestHandler will handle a single web request.
-func (cons *HTTP) requestHandler(resp http.ResponseWriter, req *http.Request) {
-	if cons.htpasswd != "" {
-		if !cons.checkAuth(req) {
-			resp.WriteHeader(http.StatusUnauthorized)
-			return
+func newHTTPRoute(route string, streamName string) httpRoute {
+	method := ""
+	pattern := strings.TrimSpace(route)
+	if spaceIdx := strings.IndexByte(pattern, ' '); spaceIdx > 0 {
+		method = strings.ToUpper(pattern[:spaceIdx])
+		pattern = strings.TrimSpace(pattern[spaceIdx+1:])
+	}
+
+	return httpRoute{
+		method:   method,
+		pattern:  pattern,
+		streamID: core.GetStreamID(streamName),
+	}
+}
+
+func (route httpRoute) matches(req *http.Request) bool {
+	if route.method != "" && route.method != req.Method {
+		return false
+	}
+	matched, _ := path.Match(route.pattern, req.URL.Path)
+	return matched
+}
+
+// getRequestToken returns the API key passed with a request.
+func getRequestToken(req *http.Request) string {
+	authorization := req.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+	return req.Header.Get("X-API-Key")
+}
+
+// checkToken validates the API key of a request. The streams the key is
+// allowed to send to are returned. An empty list means that all streams are
+// allowed. The second return value is false if the key is not valid.
+func (cons *HTTP) checkToken(req *http.Request) ([]core.MessageStreamID, bool) {
+	requestToken := []byte(getRequestToken(req))
+	if len(requestToken) == 0 {
+		return nil, false
+	}
+
+	for token, streams := range cons.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), requestToken) == 1 {
+			return streams, true
 		}
 	}
+	return nil, false
+}
+
+// isStreamAllowed returns true if a message may be sent to the given stream.
+// If InvalidStreamID is passed, all streams bound to this consumer have to be
+// allowed.
+func (cons *HTTP) isStreamAllowed(streamID core.MessageStreamID, allowed []core.MessageStreamID) bool {
+	if len(allowed) == 0 {
+		return true
+	}
 
+	targets := []core.MessageStreamID{streamID}
+	if streamID == core.InvalidStreamID {
+		targets = cons.boundStreams
+	}
+
+nextTarget:
+	for _, target := range targets {
+		for _, allowedID := range allowed {
+			if target == allowedID {
+				continue nextTarget
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// getTargetStream returns the stream a request should be sent to.
+// InvalidStreamID is returned if the streams bound to this consumer should be
+// used. The second return value is false if no route matches the request.
+func (cons *HTTP) getTargetStream(req *http.Request) (core.MessageStreamID, bool) {
+	if len(cons.routes) == 0 {
+		return core.InvalidStreamID, true
+	}
+
+	for _, route := range cons.routes {
+		if route.matches(req) {
+			return route.streamID, true
+		}
+	}
+	return core.InvalidStreamID, false
+}
+
+// getMetadata creates the metadata for a request or returns nil if no
+// metadata is to be set.
+func (cons *HTTP) getMetadata(req *http.Request) core.Metadata {
+	hasClientMetadata := cons.clientSubjectKey != "" || cons.clientCNKey != ""
+	if len(cons.headerMetadata) == 0 && len(cons.queryMetadata) == 0 && !hasClientMetadata {
+		return nil
+	}
+
+	metadata := core.Metadata{}
+	if hasClientMetadata && req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		subject := req.TLS.PeerCertificates[0].Subject
+		if cons.clientSubjectKey != "" {
+			metadata.SetValue(cons.clientSubjectKey, []byte(subject.String()))
+		}
+		if cons.clientCNKey != "" {
+			metadata.SetValue(cons.clientCNKey, []byte(subject.CommonName))
+		}
+	}
+
+	for header, key := range cons.headerMetadata {
+		if value := req.Header.Get(header); value != "" {
+			metadata.SetValue(key, []byte(value))
+		}
+	}
+
+	query := req.URL.Query()
+	for param, key := range cons.queryMetadata {
+		if values, isSet := query[param]; isSet && len(values) > 0 {
+			metadata.SetValue(key, []byte(values[0]))
+		}
+	}
+	return metadata
+}
+
+// readMessages returns the messages contained in a request.
+func (cons *HTTP) readMessages(req *http.Request) ([][]byte, error) {
 	if cons.withHeaders {
 		// Read the whole package
 		requestBuffer := bytes.NewBuffer(nil)
 		if err := req.Write(requestBuffer); err != nil {
-			resp.WriteHeader(http.StatusBadRequest)
-			cons.Logger.Error(err)
-			return // ### return, missing body or bad write ###
+			return nil, err
 		}
+		return [][]byte{requestBuffer.Bytes()}, nil
+	}
 
-		cons.Enqueue(requestBuffer.Bytes())
-		resp.WriteHeader(http.StatusOK)
-	} else {
-		// Read only the message body
-		if req.Body == nil {
-			resp.WriteHeader(http.StatusBadRequest)
-			return // ### return, missing body ###
+	// Read only the message body
+	if req.Body == nil {
+		return nil, fmt.Errorf("request has no body")
+	}
+	defer req.Body.Close()
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cons.bodyFormat {
+	case httpBodyLines:
+		messages := [][]byte{}
+		for _, line := range bytes.Split(body, []byte{'\n'}) {
+			line = bytes.TrimSuffix(line, []byte{'\r'})
+			if len(line) > 0 {
+				messages = append(messages, line)
+			}
 		}
+		return messages, nil
 
-		body, err := ioutil.ReadAll(req.Body)
-		if err != nil {
-			resp.WriteHeader(http.StatusBadRequest)
-			cons.Logger.Error(err)
-			return // ### return, missing body or bad write ###
+	case httpBodyJSON:
+		trimmed := bytes.TrimSpace(body)
+		if len(trimmed) == 0 || trimmed[0] != '[' {
+			if !json.Valid(trimmed) {
+				return nil, fmt.Errorf("request body is not valid JSON")
+			}
+			return [][]byte{body}, nil
 		}
-		defer req.Body.Close()
 
-		cons.Enqueue(body)
-		resp.WriteHeader(http.StatusOK)
+		elements := []json.RawMessage{}
+		if err := json.Unmarshal(trimmed, &elements); err != nil {
+			return nil, err
+		}
+
+		messages := make([][]byte, 0, len(elements))
+		for _, element := range elements {
+			messages = append(messages, element)
+		}
+		return messages, nil
+
+	default:
+		return [][]byte{body}, nil
+	}
+}
+
+// requestHandler will handle a single web request.
+func (cons *HTTP) requestHandler(resp http.ResponseWriter, req *http.Request) {
+	if cons.htpasswd != "" {
+		if !cons.checkAuth(req) {
+			resp.WriteHeader(cons.statusUnauthorized)
+			return
+		}
+	}
+
+	var allowedStreams []core.MessageStreamID
+	if cons.tokens != nil {
+		var validToken bool
+		if allowedStreams, validToken = cons.checkToken(req); !validToken {
+			resp.WriteHeader(cons.statusUnauthorized)
+			return // ### return, invalid API key ###
+		}
+	}
+
+	streamID, routeFound := cons.getTargetStream(req)
+	if !routeFound {
+		resp.WriteHeader(cons.statusNotFound)
+		return // ### return, no route ###
+	}
+
+	if !cons.isStreamAllowed(streamID, allowedStreams) {
+		resp.WriteHeader(cons.statusForbidden)
+		return // ### return, stream not allowed ###
+	}
+
+	if cons.IsStreamBlocked(streamID) {
+		resp.WriteHeader(cons.statusBlocked)
+		return // ### return, producers are blocked ###
+	}
+
+	messages, err := cons.readMessages(req)
+	if err != nil {
+		resp.WriteHeader(cons.statusBadRequest)
+		cons.Logger.Error(err)
+		return // ### return, missing body or bad write ###
 	}
+
+	metadata := cons.getMetadata(req)
+	for _, data := range messages {
+		if metadata != nil {
+			cons.EnqueueWithMetadataTo(data, metadata.Clone(), streamID)
+		} else {
+			cons.EnqueueWithMetadataTo(data, nil, streamID)
+		}
+	}
+
+	resp.WriteHeader(cons.statusSuccess)
 }
 
 func (cons *HTTP) serve() {
@@ -170,7 +577,14 @@ func (cons *HTTP) serve() {
 		TLSConfig:   cons.certificate,
 	}
 
-	err := srv.Serve(cons.listen)
+	var err error
+	if cons.certificate != nil {
+		// Certificates are already part of TLSConfig
+		err = srv.ServeTLS(cons.listen, "", "")
+	} else {
+		err = srv.Serve(cons.listen)
+	}
+
 	if _, isStopRequest := err.(tnet.StopRequestError); err != nil && !isStopRequest {
 		cons.Logger.Error(err)
 	}
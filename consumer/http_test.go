@@ -0,0 +1,316 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func newTestHTTP(t *testing.T, name string, settings map[string]interface{}) (*HTTP, error) {
+	conf := core.NewPluginConfig(name, "consumer.HTTP")
+	conf.Override("WithHeaders", false)
+	for key, value := range settings {
+		conf.Override(key, value)
+	}
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	return plugin.(*HTTP), nil
+}
+
+// writeTestFile writes content to a file in dir and returns its path.
+func writeTestFile(t *testing.T, dir, name string, content []byte) string {
+	filePath := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filePath, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+// testCertificate is a certificate and key pair in PEM format.
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCertificate creates a certificate for commonName. The certificate is
+// self-signed if parent is nil.
+func newTestCertificate(t *testing.T, commonName string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"gollum"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyRaw, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: raw}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyRaw}),
+	}
+}
+
+func TestHTTPJSONBody(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	conf := core.NewPluginConfig("httpJSONBody", "consumer.HTTP")
+	conf.Override("BodyFormat", "json")
+	conf.Override("WithHeaders", false)
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+	cons := plugin.(*HTTP)
+
+	messages, err := cons.readMessages(httptest.NewRequest("POST", "/", strings.NewReader(`[{"a":1}, 2, "b"]`)))
+	expect.NoError(err)
+	expect.Equal(3, len(messages))
+	expect.Equal(`{"a":1}`, string(messages[0]))
+	expect.Equal(`"b"`, string(messages[2]))
+
+	messages, err = cons.readMessages(httptest.NewRequest("POST", "/", strings.NewReader(`{"a":1}`)))
+	expect.NoError(err)
+	expect.Equal(1, len(messages))
+
+	_, err = cons.readMessages(httptest.NewRequest("POST", "/", strings.NewReader(`not json`)))
+	expect.NotNil(err)
+
+	_, err = cons.readMessages(httptest.NewRequest("POST", "/", strings.NewReader(`[1, 2`)))
+	expect.NotNil(err)
+}
+
+func TestHTTPTokenFile(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum-http")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	tokenFile := writeTestFile(t, dir, "tokens", []byte(
+		"# API keys\n\nall-key\n  logs-key logs  \nboth-key logs,,metrics\n"))
+
+	cons, err := newTestHTTP(t, "httpTokenFile", map[string]interface{}{
+		"TokenFile": tokenFile,
+	})
+	expect.NoError(err)
+	expect.Equal(map[string][]core.MessageStreamID{
+		"all-key":  {},
+		"logs-key": {core.GetStreamID("logs")},
+		"both-key": {core.GetStreamID("logs"), core.GetStreamID("metrics")},
+	}, cons.tokens)
+
+	// Files without keys are rejected
+	emptyFile := writeTestFile(t, dir, "empty", []byte("# no keys\n\n"))
+	_, err = newTestHTTP(t, "httpTokenFileEmpty", map[string]interface{}{
+		"TokenFile": emptyFile,
+	})
+	expect.NotNil(err)
+
+	_, err = newTestHTTP(t, "httpTokenFileMissing", map[string]interface{}{
+		"TokenFile": filepath.Join(dir, "missing"),
+	})
+	expect.NotNil(err)
+}
+
+func TestHTTPRequestToken(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	req := httptest.NewRequest("POST", "/", nil)
+	expect.Equal("", getRequestToken(req))
+
+	req.Header.Set("X-API-Key", "api-key")
+	expect.Equal("api-key", getRequestToken(req))
+
+	// Authorization takes precedence over X-API-Key
+	req.Header.Set("Authorization", "bearer  bearer-key")
+	expect.Equal("bearer-key", getRequestToken(req))
+
+	// Other authorization schemes are not API keys
+	req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	expect.Equal("api-key", getRequestToken(req))
+}
+
+func TestHTTPTokenStreams(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum-http")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	tokenFile := writeTestFile(t, dir, "tokens", []byte(
+		"all-key\nlogs-key httpTokenLogs\nboth-key httpTokenLogs,httpTokenMetrics\n"))
+
+	logs := newTestStreamRouter("httpTokenLogs")
+	metrics := newTestStreamRouter("httpTokenMetrics")
+
+	// Without routes, keys have to be allowed to send to all bound streams
+	bound, err := newTestHTTP(t, "httpTokenBound", map[string]interface{}{
+		"Streams":   []string{"httpTokenLogs", "httpTokenMetrics"},
+		"TokenFile": tokenFile,
+	})
+	expect.NoError(err)
+
+	routed, err := newTestHTTP(t, "httpTokenRouted", map[string]interface{}{
+		"Streams":   "httpTokenLogs",
+		"TokenFile": tokenFile,
+		"Routes": map[string]string{
+			"/logs":    "httpTokenLogs",
+			"/metrics": "httpTokenMetrics",
+		},
+	})
+	expect.NoError(err)
+
+	testCases := []struct {
+		cons   *HTTP
+		path   string
+		header string
+		value  string
+		status int
+	}{
+		{bound, "/", "", "", http.StatusUnauthorized},
+		{bound, "/", "X-API-Key", "invalid", http.StatusUnauthorized},
+		{bound, "/", "Authorization", "Bearer", http.StatusUnauthorized},
+		{bound, "/", "Authorization", "Bearer all-key", http.StatusOK},
+		{bound, "/", "X-API-Key", "logs-key", http.StatusForbidden},
+		{bound, "/", "X-API-Key", "both-key", http.StatusOK},
+		{routed, "/logs", "X-API-Key", "logs-key", http.StatusOK},
+		{routed, "/metrics", "Authorization", "Bearer logs-key", http.StatusForbidden},
+		{routed, "/metrics", "Authorization", "Bearer both-key", http.StatusOK},
+		{routed, "/other", "X-API-Key", "all-key", http.StatusNotFound},
+		{routed, "/other", "X-API-Key", "invalid", http.StatusUnauthorized},
+	}
+
+	for _, testCase := range testCases {
+		req := httptest.NewRequest("POST", testCase.path, strings.NewReader(testCase.value))
+		if testCase.header != "" {
+			req.Header.Set(testCase.header, testCase.value)
+		}
+		resp := httptest.NewRecorder()
+		testCase.cons.requestHandler(resp, req)
+		expect.Equal(testCase.status, resp.Code)
+	}
+
+	expect.Equal([]string{"Bearer all-key", "both-key", "logs-key"}, logs.payloads())
+	expect.Equal([]string{"Bearer all-key", "both-key", "Bearer both-key"}, metrics.payloads())
+}
+
+func TestHTTPClientCertificate(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum-http")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCertificate(t, "test-ca", nil)
+	server := newTestCertificate(t, "server", ca)
+	client := newTestCertificate(t, "agent-1", ca)
+
+	router := newTestStreamRouter("httpClientCertificate")
+	cons, err := newTestHTTP(t, "httpClientCertificate", map[string]interface{}{
+		"Streams":                   "httpClientCertificate",
+		"Certificate":               writeTestFile(t, dir, "server.crt", server.certPEM),
+		"PrivateKey":                writeTestFile(t, dir, "server.key", server.keyPEM),
+		"ClientCA":                  writeTestFile(t, dir, "ca.crt", ca.certPEM),
+		"Metadata/ClientSubject":    "client_subject",
+		"Metadata/ClientCommonName": "client_common_name",
+	})
+	expect.NoError(err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(cons.requestHandler))
+	srv.TLS = cons.certificate
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(ca.cert)
+	clientCert, err := tls.X509KeyPair(client.certPEM, client.keyPEM)
+	expect.NoError(err)
+
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      rootCAs,
+		Certificates: []tls.Certificate{clientCert},
+	}}}
+	resp, err := httpClient.Post(srv.URL, "text/plain", strings.NewReader("hello"))
+	expect.NoError(err)
+	resp.Body.Close()
+	expect.Equal(http.StatusOK, resp.StatusCode)
+
+	messages := router.getMessages()
+	expect.Equal(1, len(messages))
+	expect.Equal("hello", messages[0].String())
+	expect.Equal("CN=agent-1,O=gollum", messages[0].GetMetadata().GetValueString("client_subject"))
+	expect.Equal("agent-1", messages[0].GetMetadata().GetValueString("client_common_name"))
+
+	// Clients without a certificate are rejected during the handshake
+	httpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs: rootCAs,
+	}}}
+	_, err = httpClient.Post(srv.URL, "text/plain", strings.NewReader("anonymous"))
+	expect.NotNil(err)
+	expect.Equal(1, len(router.getMessages()))
+}
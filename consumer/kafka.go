@@ -15,6 +15,7 @@
 package consumer
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -28,7 +29,6 @@ import (
 	"time"
 
 	kafka "github.com/Shopify/sarama"
-	cluster "github.com/bsm/sarama-cluster"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/tgo/tsync"
 )
@@ -51,6 +51,13 @@ const (
 //
 // - key: Contains the key of the kafka message
 //
+// - partition: Contains the partition the message was read from
+//
+// - offset: Contains the offset of the message inside its partition
+//
+// - group: Contains the consumer group used to read the message. This field is
+// only set if GroupId is set.
+//
 // Parameters
 //
 // - Servers: Defines the list of all kafka brokers to initially connect to when
@@ -65,15 +72,22 @@ const (
 // By default this parameter is set to "gollum".
 //
 // - GroupId: Sets the consumer group of this consumer. If empty, consumer
-// groups are not used. This setting requires Kafka version >= 0.9.
+// groups are not used. This setting requires Kafka version >= 0.10.2.
 // By default this parameter is set to "".
 //
 // - Version: Defines the kafka protocol version to use. Common values are 0.8.2,
 // 0.9.0 or 0.10.0. Values of the form "A.B" are allowed as well as "A.B.C"
 // and "A.B.C.D". If the version given is not known, the closest possible
-// version is chosen. If GroupId is set to a value < "0.9", "0.9.0.1" will be used.
+// version is chosen. If GroupId is set and the version is < "0.10.2", "0.10.2.0"
+// will be used.
 // By default this parameter is set to "0.8.2".
 //
+// - CommitOffsets: When set to false, offsets of messages read via a consumer
+// group are not committed by this consumer. This is required when the offsets
+// are committed as part of a transaction by a transactional producer.Kafka.
+// This setting is only used if GroupId is set.
+// By default this parameter is set to true.
+//
 // - SetMetadata: When this value is set to "true", the fields mentioned in the metadata
 // section will be added to each message. Adding metadata will have a
 // performance impact on systems with high throughput.
@@ -200,8 +214,7 @@ type Kafka struct {
 	client              kafka.Client
 	consumer            kafka.Consumer
 	config              *kafka.Config
-	groupClient         *cluster.Client
-	groupConfig         *cluster.Config
+	groupConsumer       kafka.ConsumerGroup
 	offsets             map[int32]*int64
 	servers             []string `config:"Servers"`
 	topic               string   `config:"Topic" default:"default"`
@@ -213,6 +226,12 @@ type Kafka struct {
 	MaxPartitionID      int32
 	orderedRead         bool `config:"Ordered"`
 	hasToSetMetadata    bool `config:"SetMetadata" default:"false"`
+	commitOffsets       bool `config:"CommitOffsets" default:"true"`
+}
+
+// kafkaGroupHandler implements kafka.ConsumerGroupHandler for consumer.Kafka
+type kafkaGroupHandler struct {
+	cons *Kafka
 }
 
 func init() {
@@ -252,8 +271,12 @@ func (cons *Kafka) Configure(conf core.PluginConfigReader) {
 	case "1", "1.0", "1.0.0", "1.0.0.0":
 		cons.config.Version = kafka.V1_0_0_0
 	default:
-		cons.Logger.Warningf("Unknown kafka version given: %s. Falling back to 0.8.2", ver)
-		cons.config.Version = kafka.V0_8_2_2
+		if version, err := kafka.ParseKafkaVersion(ver); err == nil {
+			cons.config.Version = version
+		} else {
+			cons.Logger.Warningf("Unknown kafka version given: %s. Falling back to 0.8.2", ver)
+			cons.config.Version = kafka.V0_8_2_2
+		}
 	}
 
 	cons.config.Net.MaxOpenRequests = int(conf.GetInt("MaxOpenRequests", 5))
@@ -319,18 +342,6 @@ func (cons *Kafka) Configure(conf core.PluginConfigReader) {
 	cons.config.Consumer.Fetch.Default = int32(conf.GetInt("DefaultFetchSizeByte", 32768))
 	cons.config.Consumer.MaxWaitTime = time.Duration(conf.GetInt("FetchTimeoutMs", 250)) * time.Millisecond
 
-	if cons.group != "" {
-		cons.offsetFile = "" // forcibly ignore this option
-		switch cons.config.Version {
-		case kafka.V0_8_2_0, kafka.V0_8_2_1, kafka.V0_8_2_2:
-			cons.Logger.Warning("Invalid kafka version 0.8.x given, minimum is 0.9 for consumer groups, defaulting to 0.9.0.1")
-			cons.config.Version = kafka.V0_9_0_1
-		}
-
-		cons.groupConfig = cluster.NewConfig()
-		cons.groupConfig.Config = *cons.config
-	}
-
 	offsetValue := strings.ToLower(conf.GetString("DefaultOffset", kafkaOffsetNewest))
 	switch offsetValue {
 	case kafkaOffsetNewest:
@@ -343,6 +354,19 @@ func (cons *Kafka) Configure(conf core.PluginConfigReader) {
 		cons.defaultOffset, _ = strconv.ParseInt(offsetValue, 10, 64)
 	}
 
+	if cons.group != "" {
+		cons.offsetFile = "" // forcibly ignore this option
+		if !cons.config.Version.IsAtLeast(kafka.V0_10_2_0) {
+			cons.Logger.Warningf("Invalid kafka version %s given, minimum is 0.10.2 for consumer groups, defaulting to 0.10.2.0", cons.config.Version)
+			cons.config.Version = kafka.V0_10_2_0
+		}
+
+		if cons.defaultOffset == kafka.OffsetOldest {
+			cons.config.Consumer.Offsets.Initial = kafka.OffsetOldest
+		}
+		cons.config.Consumer.Offsets.AutoCommit.Enable = cons.commitOffsets
+	}
+
 	if cons.offsetFile != "" {
 		fileContents, err := ioutil.ReadFile(cons.offsetFile)
 		if err != nil {
@@ -369,49 +393,45 @@ func (cons *Kafka) Configure(conf core.PluginConfigReader) {
 	kafka.Logger = cons.Logger.WithField("Scope", "Sarama")
 }
 
-func (cons *Kafka) restartGroup() {
-	time.Sleep(cons.persistTimeout)
-	cons.readFromGroup()
-}
-
 // Main fetch loop for kafka events
 func (cons *Kafka) readFromGroup() {
-	consumer, err := cluster.NewConsumerFromClient(cons.groupClient, cons.group, []string{cons.topic})
-	if err != nil {
-		defer cons.restartGroup()
-		cons.Logger.Errorf("Restarting kafka consumer (%s:%s) - %s", cons.topic, cons.group, err.Error())
-		return // ### return, stop and retry ###
-	}
-
-	// Make sure we wait for all consumers to end
 	cons.AddWorker()
-	defer func() {
-		if !cons.groupClient.Closed() {
-			consumer.Close()
-		}
-		cons.WorkerDone()
-	}()
+	defer cons.WorkerDone()
 
-	// Loop over worker
-	spin := tsync.NewSpinner(tsync.SpinPriorityLow)
+	handler := kafkaGroupHandler{cons: cons}
+	for cons.IsActive() {
+		err := cons.groupConsumer.Consume(context.Background(), []string{cons.topic}, handler)
+		switch {
+		case err == kafka.ErrClosedConsumerGroup:
+			return // ### return, closed ###
 
-	for !cons.groupClient.Closed() {
-		select {
-		case event, ok := <-consumer.Messages():
-			if ok {
-				cons.enqueueEvent(event)
-				consumer.MarkOffset(event, "")
-			}
+		case err != nil:
+			cons.Logger.Errorf("Restarting kafka consumer (%s:%s) - %s", cons.topic, cons.group, err.Error())
+			time.Sleep(cons.persistTimeout)
+		}
+	}
+}
 
-		case err := <-consumer.Errors():
-			defer cons.restartGroup()
-			cons.Logger.Error("Kafka consumer error:", err)
-			return // ### return, try reconnect ###
+// Setup is called by sarama before a new consumer group session is started.
+func (handler kafkaGroupHandler) Setup(kafka.ConsumerGroupSession) error {
+	return nil
+}
 
-		default:
-			spin.Yield()
+// Cleanup is called by sarama after all ConsumeClaim calls have returned.
+func (handler kafkaGroupHandler) Cleanup(kafka.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim reads all messages from a partition claimed by this consumer
+// group member.
+func (handler kafkaGroupHandler) ConsumeClaim(session kafka.ConsumerGroupSession, claim kafka.ConsumerGroupClaim) error {
+	for event := range claim.Messages() {
+		handler.cons.enqueueEvent(event)
+		if handler.cons.commitOffsets {
+			session.MarkMessage(event, "")
 		}
 	}
+	return nil
 }
 
 func (cons *Kafka) startConsumerForPartition(partitionID int32) kafka.PartitionConsumer {
@@ -526,6 +546,11 @@ func (cons *Kafka) enqueueEvent(event *kafka.ConsumerMessage) {
 
 		metaData.SetValue("topic", []byte(event.Topic))
 		metaData.SetValue("key", event.Key)
+		metaData.SetValue("partition", []byte(strconv.Itoa(int(event.Partition))))
+		metaData.SetValue("offset", []byte(strconv.FormatInt(event.Offset, 10)))
+		if cons.group != "" {
+			metaData.SetValue("group", []byte(cons.group))
+		}
 
 		cons.EnqueueWithMetadata(event.Value, metaData)
 	} else {
@@ -565,7 +590,7 @@ func (cons *Kafka) startAllConsumers() error {
 	var err error
 
 	if cons.group != "" {
-		cons.groupClient, err = cluster.NewClient(cons.servers, cons.groupConfig)
+		cons.groupConsumer, err = kafka.NewConsumerGroup(cons.servers, cons.group, cons.config)
 		if err != nil {
 			return err
 		}
@@ -615,6 +640,15 @@ func (cons *Kafka) dumpIndex() {
 	}
 }
 
+func (cons *Kafka) closeClients() {
+	if cons.groupConsumer != nil {
+		cons.groupConsumer.Close()
+	}
+	if cons.client != nil {
+		cons.client.Close()
+	}
+}
+
 // Consume starts a kafka consumer per partition for this topic
 func (cons *Kafka) Consume(workers *sync.WaitGroup) {
 	cons.SetWorkerWaitGroup(workers)
@@ -626,7 +660,7 @@ func (cons *Kafka) Consume(workers *sync.WaitGroup) {
 	}
 
 	defer func() {
-		cons.client.Close()
+		cons.closeClients()
 		cons.dumpIndex()
 	}()
 
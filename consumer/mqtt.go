@@ -0,0 +1,147 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+)
+
+// MQTT consumer plugin
+//
+// This consumer subscribes to one or more topic filters of an MQTT broker.
+// Subscriptions are renewed whenever the connection is re-established.
+// Messages received with QoS 1 are acknowledged after they have been
+// enqueued.
+//
+// Metadata
+//
+// *NOTE: The metadata will only set if the parameter `SetMetadata` is active.*
+//
+// - topic: The topic the message was published to
+//
+// - qos: The QoS level the message was delivered with
+//
+// - retained: "true" if the message is a retained message, "false" otherwise
+//
+// Parameters
+//
+// - Topics: Defines the topic filters to subscribe to. Filters may contain
+// the wildcards "+" and "#".
+// By default this parameter is set to ["#"].
+//
+// - QoS: Defines the maximum QoS level to subscribe with. Valid values are 0
+// (at most once) and 1 (at least once).
+// By default this parameter is set to "0".
+//
+// - SetMetadata: When set to true, the topic, QoS and retained flag are
+// stored as metadata.
+// By default this parameter is set to "true".
+//
+// Examples
+//
+// This example reads the telemetry of all devices over TLS.
+//
+//  MqttIn:
+//    Type: consumer.MQTT
+//    Streams: "telemetry"
+//    Address: "ssl://broker:8883"
+//    ClientID: "gollum-telemetry"
+//    CleanSession: false
+//    TlsEnable: true
+//    TlsCaLocation: "/etc/ssl/broker-ca.pem"
+//    QoS: 1
+//    Topics:
+//      - "devices/+/telemetry"
+//
+type MQTT struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+	// MQTTClient is public to make MQTTClient.Configure() callable
+	MQTTClient   components.MQTTClient `gollumdoc:"embed_type"`
+	qos          int                   `config:"QoS" default:"0"`
+	withMetadata bool                  `config:"SetMetadata" default:"true"`
+	topics       []string
+	client       mqtt.Client
+}
+
+func init() {
+	core.TypeRegistry.Register(MQTT{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *MQTT) Configure(conf core.PluginConfigReader) {
+	cons.topics = conf.GetStringArray("Topics", []string{"#"})
+	if len(cons.topics) == 0 {
+		conf.Errors.Pushf("At least one topic filter is required")
+	}
+	if cons.qos < 0 || cons.qos > 1 {
+		conf.Errors.Pushf("QoS must be 0 or 1")
+	}
+}
+
+// onMessage is called for every message received. The message is
+// acknowledged by the client library after this function returns.
+func (cons *MQTT) onMessage(_ mqtt.Client, msg mqtt.Message) {
+	if !cons.withMetadata {
+		cons.Enqueue(msg.Payload())
+		return // ### return, no metadata ###
+	}
+
+	metadata := core.Metadata{}
+	metadata.SetValue("topic", []byte(msg.Topic()))
+	metadata.SetValue("qos", []byte(strconv.Itoa(int(msg.Qos()))))
+	metadata.SetValue("retained", []byte(strconv.FormatBool(msg.Retained())))
+	cons.EnqueueWithMetadata(msg.Payload(), metadata)
+}
+
+// subscribe (re)creates all subscriptions after a connect.
+func (cons *MQTT) subscribe(client mqtt.Client) {
+	filters := make(map[string]byte, len(cons.topics))
+	for _, topic := range cons.topics {
+		filters[topic] = byte(cons.qos)
+	}
+
+	token := client.SubscribeMultiple(filters, cons.onMessage)
+	go func() {
+		if err := components.WaitForToken(token, 0); err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to subscribe to %v", cons.topics)
+			return
+		}
+		cons.Logger.Debugf("Subscribed to %v", cons.topics)
+	}()
+}
+
+func (cons *MQTT) close() {
+	defer cons.WorkerDone()
+	cons.client.Disconnect(uint(cons.GetShutdownTimeout() / time.Millisecond))
+}
+
+// Consume connects to the broker and starts listening for messages.
+func (cons *MQTT) Consume(workers *sync.WaitGroup) {
+	cons.client = cons.MQTTClient.NewClient(cons.Logger, cons.subscribe)
+
+	// Connect retries until it succeeds or Disconnect is called, so we must
+	// not wait for it here.
+	cons.client.Connect()
+
+	cons.AddMainWorker(workers)
+	cons.SetStopCallback(cons.close)
+	cons.ControlLoop()
+}
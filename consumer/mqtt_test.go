@@ -0,0 +1,202 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+// mqttTestMessage implements mqtt.Message for a given topic and payload.
+type mqttTestMessage struct {
+	mqtt.Message
+	topic    string
+	payload  string
+	qos      byte
+	retained bool
+}
+
+func (msg mqttTestMessage) Topic() string {
+	return msg.topic
+}
+
+func (msg mqttTestMessage) Payload() []byte {
+	return []byte(msg.payload)
+}
+
+func (msg mqttTestMessage) Qos() byte {
+	return msg.qos
+}
+
+func (msg mqttTestMessage) Retained() bool {
+	return msg.retained
+}
+
+// mqttTestBroker accepts MQTT connections and answers CONNECT, SUBSCRIBE and
+// PINGREQ packets. Subscriptions are reported per connection.
+type mqttTestBroker struct {
+	listener      net.Listener
+	subscriptions chan mqttTestSubscription
+}
+
+type mqttTestSubscription struct {
+	conn    net.Conn
+	filters map[string]byte
+}
+
+func newMQTTTestBroker(t *testing.T) *mqttTestBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker := &mqttTestBroker{
+		listener:      listener,
+		subscriptions: make(chan mqttTestSubscription, 8),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(conn)
+		}
+	}()
+	return broker
+}
+
+func (broker *mqttTestBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+
+		switch request := packet.(type) {
+		case *packets.ConnectPacket:
+			packets.NewControlPacket(packets.Connack).Write(conn)
+
+		case *packets.SubscribePacket:
+			subscription := mqttTestSubscription{conn: conn, filters: make(map[string]byte)}
+			for idx, topic := range request.Topics {
+				subscription.filters[topic] = request.Qoss[idx]
+			}
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = request.MessageID
+			suback.ReturnCodes = request.Qoss
+			suback.Write(conn)
+			broker.subscriptions <- subscription
+
+		case *packets.PingreqPacket:
+			packets.NewControlPacket(packets.Pingresp).Write(conn)
+
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func (broker *mqttTestBroker) waitForSubscription(t *testing.T) mqttTestSubscription {
+	select {
+	case subscription := <-broker.subscriptions:
+		return subscription
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client did not subscribe")
+		return mqttTestSubscription{}
+	}
+}
+
+func (subscription mqttTestSubscription) publish(topic, payload string, qos byte, retained bool) error {
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName = topic
+	publish.Payload = []byte(payload)
+	publish.Qos = qos
+	publish.Retain = retained
+	publish.MessageID = 1
+	return publish.Write(subscription.conn)
+}
+
+func newTestMQTT(t *testing.T, streamName string, settings map[string]interface{}) (*MQTT, *testStreamRouter) {
+	expect := ttesting.NewExpect(t)
+	router := newTestStreamRouter(streamName)
+
+	conf := core.NewPluginConfig(streamName+"Consumer", "consumer.MQTT")
+	conf.Override("Streams", streamName)
+	for key, value := range settings {
+		conf.Override(key, value)
+	}
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+	return plugin.(*MQTT), router
+}
+
+func TestMQTTMetadata(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons, router := newTestMQTT(t, "mqttTestMetadata", nil)
+
+	cons.onMessage(nil, mqttTestMessage{topic: "sensors/1/temp", payload: "21.5", qos: 1, retained: true})
+	cons.withMetadata = false
+	cons.onMessage(nil, mqttTestMessage{topic: "sensors/2/temp", payload: "19.0"})
+
+	expect.Equal([]string{"21.5", "19.0"}, router.payloads())
+
+	messages := router.getMessages()
+	expect.Equal(core.Metadata{
+		"topic":    []byte("sensors/1/temp"),
+		"qos":      []byte("1"),
+		"retained": []byte("true"),
+	}, messages[0].GetMetadata())
+	expect.Nil(messages[1].TryGetMetadata())
+}
+
+func TestMQTTReconnect(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	broker := newMQTTTestBroker(t)
+	defer broker.listener.Close()
+
+	cons, router := newTestMQTT(t, "mqttTestReconnect", map[string]interface{}{
+		"Address": "tcp://" + broker.listener.Addr().String(),
+		"Topics":  []string{"sensors/+/temp", "alerts/#"},
+		"QoS":     1,
+	})
+	stop := startTestConsumer(t, cons)
+	defer stop()
+
+	subscription := broker.waitForSubscription(t)
+	expect.Equal(map[string]byte{"sensors/+/temp": 1, "alerts/#": 1}, subscription.filters)
+	expect.NoError(subscription.publish("sensors/1/temp", "a", 1, false))
+	expect.Equal([]string{"a"}, router.waitForPayloads(1))
+
+	// All topics are subscribed again after the connection has been lost
+	subscription.conn.Close()
+	subscription = broker.waitForSubscription(t)
+	expect.Equal(map[string]byte{"sensors/+/temp": 1, "alerts/#": 1}, subscription.filters)
+	expect.NoError(subscription.publish("alerts/fire", "b", 0, true))
+	expect.Equal([]string{"a", "b"}, router.waitForPayloads(2))
+
+	messages := router.getMessages()
+	expect.Equal("alerts/fire", messages[1].GetMetadata().GetValueString("topic"))
+	expect.Equal("0", messages[1].GetMetadata().GetValueString("qos"))
+	expect.Equal("true", messages[1].GetMetadata().GetValueString("retained"))
+}
@@ -0,0 +1,322 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo"
+)
+
+var natsInvalidDurableChars = regexp.MustCompile(`[.*>\s]`)
+
+// NATS consumer plugin
+//
+// This consumer subscribes to subjects of a NATS server. If JetStream is
+// enabled, messages are read from a durable JetStream consumer instead. In
+// this case messages are acknowledged after they have been passed to the
+// streams of this consumer. If these streams are blocked, messages are
+// rejected with a delay, so that they are redelivered later.
+//
+// Metadata
+//
+// *NOTE: The metadata will only set if the parameter `SetMetadata` is active.*
+//
+// - subject: The subject the message was published to
+//
+// - stream: The JetStream stream of the message (JetStream only)
+//
+// - sequence: The sequence number of the message in the JetStream stream
+// (JetStream only)
+//
+// - delivered: The number of times the message has been delivered
+// (JetStream only)
+//
+// Parameters
+//
+// - Subjects: Defines the subjects to subscribe to. Subjects may contain the
+// wildcards "*" and ">".
+// By default this parameter is set to [">"].
+//
+// - QueueGroup: Defines a queue group to join. Messages are distributed
+// between all members of a queue group instead of being sent to all of them.
+// Only used if JetStream is disabled.
+// By default this parameter is set to "".
+//
+// - JetStream: When set to true, messages are read from a durable JetStream
+// consumer.
+// By default this parameter is set to "false".
+//
+// - Stream: Defines the JetStream stream to read from. This is required if
+// more than one subject is given. If empty, the stream is looked up by
+// subject.
+// By default this parameter is set to "".
+//
+// - Durable: Defines the name of the durable JetStream consumer. It is
+// created if it does not exist. If empty, "gollum-" followed by the plugin id
+// is used.
+// By default this parameter is set to "".
+//
+// - DeliverPolicy: Defines where a newly created durable consumer starts
+// reading. Valid values are "all", "new" and "last".
+// By default this parameter is set to "all".
+//
+// - AckWaitSec: Defines the number of seconds after which JetStream
+// redelivers a message that has not been acknowledged.
+// By default this parameter is set to "30".
+//
+// - FetchCount: Defines the maximum number of JetStream messages requested
+// at once.
+// By default this parameter is set to "256".
+//
+// - ReadTimeoutSec: Defines the number of seconds to wait for JetStream
+// messages. This setting affects the maximum shutdown duration of this
+// consumer.
+// By default this parameter is set to "2".
+//
+// - SetMetadata: When set to true, the subject and JetStream information are
+// stored as metadata.
+// By default this parameter is set to "true".
+//
+// Examples
+//
+// This example reads all subjects below "logs." and distributes them
+// between all Gollum instances using this config.
+//
+//  NatsIn:
+//    Type: consumer.NATS
+//    Streams: "logs"
+//    Address: "nats://nats1:4222,nats://nats2:4222"
+//    Subjects: ["logs.>"]
+//    QueueGroup: "gollum"
+//
+// This example reads from a durable JetStream consumer.
+//
+//  JetStreamIn:
+//    Type: consumer.NATS
+//    Streams: "orders"
+//    JetStream: true
+//    Stream: "ORDERS"
+//    Durable: "gollum-orders"
+//    Subjects: ["orders.*"]
+//
+type NATS struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+	// NATSClient is public to make NATSClient.Configure() callable
+	NATSClient    components.NATSClient `gollumdoc:"embed_type"`
+	queueGroup    string                `config:"QueueGroup"`
+	jetStream     bool                  `config:"JetStream" default:"false"`
+	stream        string                `config:"Stream"`
+	durable       string                `config:"Durable"`
+	ackWait       time.Duration         `config:"AckWaitSec" default:"30" metric:"sec"`
+	fetchCount    int                   `config:"FetchCount" default:"256"`
+	readTimeout   time.Duration         `config:"ReadTimeoutSec" default:"2" metric:"sec"`
+	withMetadata  bool                  `config:"SetMetadata" default:"true"`
+	subjects      []string
+	deliverPolicy nats.SubOpt
+	connection    *nats.Conn
+	closed        chan struct{}
+	fetchDone     chan struct{}
+}
+
+func init() {
+	core.TypeRegistry.Register(NATS{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *NATS) Configure(conf core.PluginConfigReader) {
+	cons.subjects = conf.GetStringArray("Subjects", []string{">"})
+	if len(cons.subjects) == 0 {
+		conf.Errors.Pushf("At least one subject is required")
+	}
+
+	if cons.durable == "" {
+		cons.durable = natsInvalidDurableChars.ReplaceAllString("gollum-"+conf.GetID(), "_")
+	}
+
+	switch strings.ToLower(conf.GetString("DeliverPolicy", "all")) {
+	case "all":
+		cons.deliverPolicy = nats.DeliverAll()
+	case "new":
+		cons.deliverPolicy = nats.DeliverNew()
+	case "last":
+		cons.deliverPolicy = nats.DeliverLast()
+	default:
+		conf.Errors.Pushf("Unknown DeliverPolicy %s", conf.GetString("DeliverPolicy", "all"))
+	}
+
+	if cons.jetStream && len(cons.subjects) > 1 && cons.stream == "" {
+		conf.Errors.Pushf("Stream must be set when reading more than one subject from JetStream")
+	}
+	if cons.fetchCount <= 0 {
+		conf.Errors.Pushf("FetchCount must be greater than 0")
+	}
+}
+
+func (cons *NATS) getMetadata(msg *nats.Msg) core.Metadata {
+	metadata := core.Metadata{}
+	metadata.SetValue("subject", []byte(msg.Subject))
+
+	if cons.jetStream {
+		if info, err := msg.Metadata(); err == nil {
+			metadata.SetValue("stream", []byte(info.Stream))
+			metadata.SetValue("sequence", []byte(strconv.FormatUint(info.Sequence.Stream, 10)))
+			metadata.SetValue("delivered", []byte(strconv.FormatUint(info.NumDelivered, 10)))
+		}
+	}
+	return metadata
+}
+
+func (cons *NATS) enqueue(msg *nats.Msg) {
+	if cons.withMetadata {
+		cons.EnqueueWithMetadata(msg.Data, cons.getMetadata(msg))
+	} else {
+		cons.Enqueue(msg.Data)
+	}
+}
+
+// subscribe creates subscriptions for all subjects using core NATS.
+func (cons *NATS) subscribe() error {
+	for _, subject := range cons.subjects {
+		var err error
+		if cons.queueGroup != "" {
+			_, err = cons.connection.QueueSubscribe(subject, cons.queueGroup, cons.enqueue)
+		} else {
+			_, err = cons.connection.Subscribe(subject, cons.enqueue)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pullSubscribe binds to (or creates) the durable JetStream consumer.
+func (cons *NATS) pullSubscribe() (*nats.Subscription, error) {
+	jetStream, err := cons.connection.JetStream()
+	if err != nil {
+		return nil, err
+	}
+
+	options := []nats.SubOpt{
+		nats.ManualAck(),
+		nats.AckWait(cons.ackWait),
+		// Allow several fetched batches to be unacknowledged at once
+		nats.MaxAckPending(cons.fetchCount * 4),
+		cons.deliverPolicy,
+	}
+	if cons.stream != "" {
+		options = append(options, nats.BindStream(cons.stream))
+	}
+
+	if len(cons.subjects) > 1 {
+		options = append(options, nats.ConsumerFilterSubjects(cons.subjects...))
+		return jetStream.PullSubscribe("", cons.durable, options...)
+	}
+	return jetStream.PullSubscribe(cons.subjects[0], cons.durable, options...)
+}
+
+// fetch reads from a durable JetStream consumer until the consumer is
+// stopped.
+func (cons *NATS) fetch() {
+	defer close(cons.fetchDone)
+
+	var subscription *nats.Subscription
+	for cons.IsActive() {
+		if subscription == nil {
+			var err error
+			if subscription, err = cons.pullSubscribe(); err != nil {
+				cons.Logger.WithError(err).Errorf("Failed to bind to durable consumer %s", cons.durable)
+				time.Sleep(cons.readTimeout)
+				continue
+			}
+		}
+
+		messages, err := subscription.Fetch(cons.fetchCount, nats.MaxWait(cons.readTimeout))
+		if err != nil && err != nats.ErrTimeout {
+			if cons.IsActive() {
+				cons.Logger.WithError(err).Warning("Failed to fetch messages")
+				time.Sleep(cons.readTimeout)
+			}
+			continue
+		}
+
+		for _, msg := range messages {
+			if cons.IsStreamBlocked(core.InvalidStreamID) {
+				// Let JetStream redeliver the message later
+				msg.NakWithDelay(cons.readTimeout)
+				continue
+			}
+
+			cons.enqueue(msg)
+			if err := msg.Ack(); err != nil {
+				cons.Logger.WithError(err).Warning("Failed to acknowledge message")
+			}
+		}
+	}
+}
+
+func (cons *NATS) close() {
+	defer cons.WorkerDone()
+
+	if cons.jetStream {
+		// Pull subscriptions have no pending messages, so only the
+		// acknowledgements of the last fetch have to be sent.
+		<-cons.fetchDone
+		if err := cons.connection.FlushTimeout(cons.GetShutdownTimeout()); err != nil {
+			cons.Logger.WithError(err).Warning("Failed to flush acknowledgements")
+		}
+		cons.connection.Close()
+	} else if err := cons.connection.Drain(); err != nil {
+		cons.connection.Close()
+	}
+
+	// Drain processes all pending messages of core NATS subscriptions, so
+	// messages may be enqueued until the connection has been closed.
+	<-cons.closed
+}
+
+// Consume connects to NATS and starts listening for messages.
+func (cons *NATS) Consume(workers *sync.WaitGroup) {
+	cons.closed = make(chan struct{})
+	connection, err := cons.NATSClient.Connect(cons.Logger,
+		nats.DrainTimeout(cons.GetShutdownTimeout()),
+		nats.ClosedHandler(func(*nats.Conn) { close(cons.closed) }))
+	if err != nil {
+		cons.Logger.WithError(err).Errorf("Failed to connect to %s", cons.NATSClient.GetAddress())
+		return // ### return, could not connect ###
+	}
+	cons.connection = connection
+
+	if cons.jetStream {
+		cons.fetchDone = make(chan struct{})
+		go tgo.WithRecoverShutdown(cons.fetch)
+	} else if err := cons.subscribe(); err != nil {
+		cons.Logger.WithError(err).Error("Failed to subscribe")
+		connection.Close()
+		return // ### return, could not subscribe ###
+	}
+
+	cons.AddMainWorker(workers)
+	cons.SetStopCallback(cons.close)
+	cons.ControlLoop()
+}
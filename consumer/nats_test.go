@@ -0,0 +1,232 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+// newNATSTestServer starts a NATS server with JetStream enabled on a random
+// port. The returned function shuts the server down.
+func newNATSTestServer(t *testing.T) (*server.Server, func()) {
+	storeDir, err := ioutil.TempDir("", "gollum-nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = storeDir
+	srv := natsserver.RunServer(&opts)
+
+	return srv, func() {
+		srv.Shutdown()
+		os.RemoveAll(storeDir)
+	}
+}
+
+// natsTestProducer is a producer that can be marked as blocked.
+type natsTestProducer struct {
+	core.Producer
+	blocked *int32
+}
+
+func (prod natsTestProducer) IsBlocked() bool {
+	return atomic.LoadInt32(prod.blocked) != 0
+}
+
+// natsTestRouter is a testStreamRouter that reports its producer as blocked
+// if setBlocked has been called.
+type natsTestRouter struct {
+	*testStreamRouter
+	blocked int32
+}
+
+func newNATSTestRouter(streamName string) *natsTestRouter {
+	router := &natsTestRouter{
+		testStreamRouter: &testStreamRouter{streamID: core.StreamRegistry.GetStreamID(streamName)},
+	}
+	core.StreamRegistry.Register(router, router.streamID)
+	return router
+}
+
+func (router *natsTestRouter) GetProducers() []core.Producer {
+	return []core.Producer{natsTestProducer{blocked: &router.blocked}}
+}
+
+func (router *natsTestRouter) setBlocked(blocked bool) {
+	if blocked {
+		atomic.StoreInt32(&router.blocked, 1)
+	} else {
+		atomic.StoreInt32(&router.blocked, 0)
+	}
+}
+
+func newTestNATS(t *testing.T, name string, srv *server.Server, settings map[string]interface{}) *NATS {
+	expect := ttesting.NewExpect(t)
+
+	conf := core.NewPluginConfig(name, "consumer.NATS")
+	conf.Override("Address", srv.ClientURL())
+	conf.Override("ReadTimeoutSec", 1)
+	for key, value := range settings {
+		conf.Override(key, value)
+	}
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+	return plugin.(*NATS)
+}
+
+func TestNATSSubscribe(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	srv, shutdown := newNATSTestServer(t)
+	defer shutdown()
+
+	// Members of a queue group share the messages, other subscribers receive
+	// all of them.
+	all := newTestStreamRouter("natsTestSubscribeAll")
+	groupA := newTestStreamRouter("natsTestSubscribeGroupA")
+	groupB := newTestStreamRouter("natsTestSubscribeGroupB")
+
+	consumers := []*NATS{
+		newTestNATS(t, "natsTestSubscribeAll", srv, map[string]interface{}{
+			"Streams":  "natsTestSubscribeAll",
+			"Subjects": []string{"logs.>"},
+		}),
+		newTestNATS(t, "natsTestSubscribeGroupA", srv, map[string]interface{}{
+			"Streams":    "natsTestSubscribeGroupA",
+			"Subjects":   []string{"logs.*"},
+			"QueueGroup": "gollum",
+		}),
+		newTestNATS(t, "natsTestSubscribeGroupB", srv, map[string]interface{}{
+			"Streams":    "natsTestSubscribeGroupB",
+			"Subjects":   []string{"logs.*"},
+			"QueueGroup": "gollum",
+		}),
+	}
+
+	stops := []func(){}
+	for _, cons := range consumers {
+		stops = append(stops, startTestConsumer(t, cons))
+		expect.NoError(cons.connection.Flush())
+	}
+
+	client, err := nats.Connect(srv.ClientURL())
+	expect.NoError(err)
+	defer client.Close()
+
+	const numMessages = 1000
+	for i := 0; i < numMessages; i++ {
+		expect.NoError(client.Publish("logs.app", []byte(fmt.Sprint(i))))
+	}
+	expect.NoError(client.Flush())
+
+	// Stopping drains the subscriptions, so all messages sent before are
+	// enqueued once the consumers have stopped.
+	for _, stop := range stops {
+		stop()
+	}
+
+	expect.Equal(numMessages, len(all.getMessages()))
+	expect.Equal(numMessages, len(groupA.getMessages())+len(groupB.getMessages()))
+	expect.Equal("logs.app", all.getMessages()[0].GetMetadata().GetValueString("subject"))
+
+	for _, cons := range consumers {
+		expect.True(cons.connection.IsClosed())
+	}
+}
+
+func TestNATSJetStream(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	srv, shutdown := newNATSTestServer(t)
+	defer shutdown()
+
+	client, err := nats.Connect(srv.ClientURL())
+	expect.NoError(err)
+	defer client.Close()
+
+	jetStream, err := client.JetStream()
+	expect.NoError(err)
+	_, err = jetStream.AddStream(&nats.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.*"}})
+	expect.NoError(err)
+
+	for _, payload := range []string{"a", "b", "c"} {
+		_, err := jetStream.Publish("orders.new", []byte(payload))
+		expect.NoError(err)
+	}
+
+	router := newNATSTestRouter("natsTestJetStream")
+	cons := newTestNATS(t, "natsTestJetStream", srv, map[string]interface{}{
+		"Streams":    "natsTestJetStream",
+		"JetStream":  true,
+		"Stream":     "ORDERS",
+		"Durable":    "gollum-test",
+		"Subjects":   []string{"orders.*"},
+		"FetchCount": 2,
+	})
+	stop := startTestConsumer(t, cons)
+	defer stop()
+
+	expect.Equal([]string{"a", "b", "c"}, router.waitForPayloads(3))
+
+	metadata := router.getMessages()[2].GetMetadata()
+	expect.Equal("orders.new", metadata.GetValueString("subject"))
+	expect.Equal("ORDERS", metadata.GetValueString("stream"))
+	expect.Equal("3", metadata.GetValueString("sequence"))
+	expect.Equal("1", metadata.GetValueString("delivered"))
+
+	// Messages fetched while the stream is blocked are redelivered later
+	router.setBlocked(true)
+	_, err = jetStream.Publish("orders.new", []byte("d"))
+	expect.NoError(err)
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		info, err := jetStream.ConsumerInfo("ORDERS", "gollum-test")
+		expect.NoError(err)
+		if info.Delivered.Stream == 4 {
+			break
+		}
+	}
+	expect.Equal(3, len(router.getMessages()))
+
+	router.setBlocked(false)
+	expect.Equal([]string{"a", "b", "c", "d"}, router.waitForPayloads(4))
+	expect.Equal("2", router.getMessages()[3].GetMetadata().GetValueString("delivered"))
+
+	// All messages have been acknowledged
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		info, err := jetStream.ConsumerInfo("ORDERS", "gollum-test")
+		expect.NoError(err)
+		if info.AckFloor.Stream == 4 {
+			break
+		}
+	}
+	info, err := jetStream.ConsumerInfo("ORDERS", "gollum-test")
+	expect.NoError(err)
+	expect.Equal(uint64(4), info.AckFloor.Stream)
+	expect.Equal(0, info.NumAckPending)
+}
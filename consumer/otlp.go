@@ -0,0 +1,480 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/tnet"
+)
+
+const (
+	otlpLogsPath   = "/v1/logs"
+	otlpTracesPath = "/v1/traces"
+
+	otlpContentProtobuf = "application/x-protobuf"
+	otlpContentJSON     = "application/json"
+)
+
+var otlpSpanKinds = []string{
+	"SPAN_KIND_UNSPECIFIED",
+	"SPAN_KIND_INTERNAL",
+	"SPAN_KIND_SERVER",
+	"SPAN_KIND_CLIENT",
+	"SPAN_KIND_PRODUCER",
+	"SPAN_KIND_CONSUMER",
+}
+
+var otlpStatusCodes = []string{
+	"STATUS_CODE_UNSET",
+	"STATUS_CODE_OK",
+	"STATUS_CODE_ERROR",
+}
+
+// OTLP consumer plugin
+//
+// This consumer opens up an HTTP server accepting OpenTelemetry (OTLP/HTTP)
+// log and trace export requests. Requests may be encoded as protobuf or JSON
+// and may be gzip compressed. Each log record and each span is converted into
+// a separate JSON encoded message.
+//
+// Log records are converted to an object with the fields "time",
+// "observed_time", "severity", "severity_number", "body", "attributes",
+// "trace_id" and "span_id".
+// Spans are converted to an object with the fields "trace_id", "span_id",
+// "parent_span_id", "trace_state", "name", "kind", "start_time", "end_time",
+// "attributes", "events", "links" and "status".
+//
+// Metadata
+//
+// *NOTE: The metadata will only set if the parameter `SetMetadata` is active.*
+//
+// - signal: Either "logs" or "traces"
+//
+// - resource.<key>: One field per resource attribute, e.g. "resource.service.name"
+//
+// - scope.name: Name of the instrumentation scope
+//
+// - scope.version: Version of the instrumentation scope
+//
+// - scope.<key>: One field per instrumentation scope attribute
+//
+// Non-string attribute values are converted to strings. Arrays and key/value
+// lists are stored as JSON.
+//
+// Parameters
+//
+// - Address: Defines the TCP port and optional IP address to listen on.
+// By default this parameter is set to ":4318".
+//
+// - ReadTimeoutSec: Defines the maximum duration in seconds before timing out
+// the HTTP read request.
+// By default this parameter is set to "3".
+//
+// - MaxRequestSizeKB: Defines the maximum size of a (decompressed) request
+// body in KB. Larger requests are answered with "413 Request Entity Too Large".
+// By default this parameter is set to "4096".
+//
+// - Certificate: Path to an X509 formatted certificate file. If defined, turns
+// on SSL/TLS support in the HTTP server. Requires PrivateKey to be set.
+// By default this parameter is set to "".
+//
+// - PrivateKey: Path to an X509 formatted private key file. Meaningful only in
+// conjunction with Certificate.
+// By default this parameter is set to "".
+//
+// - LogStream: Defines the stream log records are sent to. If set to "", log
+// records are sent to the streams set by Streams.
+// By default this parameter is set to "".
+//
+// - TraceStream: Defines the stream spans are sent to. If set to "", spans are
+// sent to the streams set by Streams.
+// By default this parameter is set to "".
+//
+// - SetMetadata: When set to true, resource and scope attributes are attached
+// to each message as metadata.
+// By default this parameter is set to "true".
+//
+// Examples
+//
+// This example receives logs and traces from OpenTelemetry SDKs configured with
+// the default OTLP/HTTP endpoint.
+//
+//  OtelIn:
+//    Type: consumer.OTLP
+//    Streams: "otel"
+//    Address: ":4318"
+//    LogStream: "logs"
+//    TraceStream: "traces"
+//
+type OTLP struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+	address             string        `config:"Address" default:":4318"`
+	readTimeoutSec      time.Duration `config:"ReadTimeoutSec" default:"3" metric:"sec"`
+	maxRequestSize      int64         `config:"MaxRequestSizeKB" default:"4096" metric:"kb"`
+	withMetadata        bool          `config:"SetMetadata" default:"true"`
+	logStreamID         core.MessageStreamID
+	traceStreamID       core.MessageStreamID
+	listen              *tnet.StopListener
+	certificate         *tls.Config
+}
+
+type otlpLogMessage struct {
+	Time           string                 `json:"time,omitempty"`
+	ObservedTime   string                 `json:"observed_time,omitempty"`
+	Severity       string                 `json:"severity,omitempty"`
+	SeverityNumber int32                  `json:"severity_number,omitempty"`
+	Body           interface{}            `json:"body"`
+	Attributes     map[string]interface{} `json:"attributes,omitempty"`
+	TraceID        string                 `json:"trace_id,omitempty"`
+	SpanID         string                 `json:"span_id,omitempty"`
+}
+
+type otlpSpanMessage struct {
+	TraceID      string                   `json:"trace_id"`
+	SpanID       string                   `json:"span_id"`
+	ParentSpanID string                   `json:"parent_span_id,omitempty"`
+	TraceState   string                   `json:"trace_state,omitempty"`
+	Name         string                   `json:"name"`
+	Kind         string                   `json:"kind"`
+	StartTime    string                   `json:"start_time,omitempty"`
+	EndTime      string                   `json:"end_time,omitempty"`
+	Attributes   map[string]interface{}   `json:"attributes,omitempty"`
+	Events       []map[string]interface{} `json:"events,omitempty"`
+	Links        []map[string]interface{} `json:"links,omitempty"`
+	Status       map[string]string        `json:"status"`
+}
+
+func init() {
+	core.TypeRegistry.Register(OTLP{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *OTLP) Configure(conf core.PluginConfigReader) {
+	cons.logStreamID = core.InvalidStreamID
+	if logStream := conf.GetString("LogStream", ""); logStream != "" {
+		cons.logStreamID = core.GetStreamID(logStream)
+	}
+
+	cons.traceStreamID = core.InvalidStreamID
+	if traceStream := conf.GetString("TraceStream", ""); traceStream != "" {
+		cons.traceStreamID = core.GetStreamID(traceStream)
+	}
+
+	certificateFile := conf.GetString("Certificate", "")
+	keyFile := conf.GetString("PrivateKey", "")
+
+	if certificateFile != "" || keyFile != "" {
+		if certificateFile == "" || keyFile == "" {
+			conf.Errors.Pushf("There must always be a certificate and a private key or none of both")
+		} else {
+			cons.certificate = new(tls.Config)
+			cons.certificate.NextProtos = []string{"http/1.1"}
+
+			keypair, err := tls.LoadX509KeyPair(certificateFile, keyFile)
+			if !conf.Errors.Push(err) {
+				cons.certificate.Certificates = []tls.Certificate{keypair}
+			}
+		}
+	}
+}
+
+// readBody returns the (decompressed) body of a request.
+func (cons *OTLP) readBody(req *http.Request) ([]byte, error) {
+	var reader io.Reader = req.Body
+	switch strings.ToLower(req.Header.Get("Content-Encoding")) {
+	case "", "identity":
+	case "gzip":
+		gzipReader, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %s", req.Header.Get("Content-Encoding"))
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(reader, cons.maxRequestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > cons.maxRequestSize {
+		return nil, errOTLPRequestTooLarge
+	}
+	return body, nil
+}
+
+var errOTLPRequestTooLarge = fmt.Errorf("request body exceeds MaxRequestSizeKB")
+
+// decodeRequest parses a request body into the given request type.
+func decodeOTLPRequest(contentType string, body []byte, protoRequest interface {
+	decodeProto([]byte) error
+}) error {
+	switch contentType {
+	case otlpContentProtobuf:
+		return protoRequest.decodeProto(body)
+	case otlpContentJSON:
+		return json.Unmarshal(body, protoRequest)
+	default:
+		return fmt.Errorf("unsupported content type %s", contentType)
+	}
+}
+
+// getMetadata converts resource and scope information into metadata.
+func (cons *OTLP) getMetadata(signal string, resource otlpResource, scope otlpScope) core.Metadata {
+	if !cons.withMetadata {
+		return nil
+	}
+
+	metadata := core.Metadata{}
+	metadata.SetValue("signal", []byte(signal))
+	for _, attribute := range resource.Attributes {
+		metadata.SetValue("resource."+attribute.Key, []byte(attribute.Value.String()))
+	}
+	if scope.Name != "" {
+		metadata.SetValue("scope.name", []byte(scope.Name))
+	}
+	if scope.Version != "" {
+		metadata.SetValue("scope.version", []byte(scope.Version))
+	}
+	for _, attribute := range scope.Attributes {
+		metadata.SetValue("scope."+attribute.Key, []byte(attribute.Value.String()))
+	}
+	return metadata
+}
+
+func (cons *OTLP) enqueue(data []byte, metadata core.Metadata, streamID core.MessageStreamID) {
+	if metadata != nil {
+		metadata = metadata.Clone()
+	}
+	cons.EnqueueWithMetadataTo(data, metadata, streamID)
+}
+
+func formatOTLPTime(timestamp otlpUint64) string {
+	if timestamp == 0 {
+		return ""
+	}
+	return timestamp.Time().Format(time.RFC3339Nano)
+}
+
+func formatOTLPEnum(value int32, names []string) string {
+	if value >= 0 && int(value) < len(names) {
+		return names[value]
+	}
+	return strconv.Itoa(int(value))
+}
+
+func newOTLPLogMessage(record otlpLogRecord) otlpLogMessage {
+	return otlpLogMessage{
+		Time:           formatOTLPTime(record.TimeUnixNano),
+		ObservedTime:   formatOTLPTime(record.ObservedTimeUnixNano),
+		Severity:       record.SeverityText,
+		SeverityNumber: record.SeverityNumber,
+		Body:           record.Body.Interface(),
+		Attributes:     otlpAttributesToMap(record.Attributes),
+		TraceID:        record.TraceID.String(),
+		SpanID:         record.SpanID.String(),
+	}
+}
+
+func newOTLPSpanMessage(span otlpSpan) otlpSpanMessage {
+	message := otlpSpanMessage{
+		TraceID:      span.TraceID.String(),
+		SpanID:       span.SpanID.String(),
+		ParentSpanID: span.ParentSpanID.String(),
+		TraceState:   span.TraceState,
+		Name:         span.Name,
+		Kind:         formatOTLPEnum(span.Kind, otlpSpanKinds),
+		StartTime:    formatOTLPTime(span.StartTimeUnixNano),
+		EndTime:      formatOTLPTime(span.EndTimeUnixNano),
+		Attributes:   otlpAttributesToMap(span.Attributes),
+		Status: map[string]string{
+			"code":    formatOTLPEnum(span.Status.Code, otlpStatusCodes),
+			"message": span.Status.Message,
+		},
+	}
+
+	for _, event := range span.Events {
+		message.Events = append(message.Events, map[string]interface{}{
+			"time":       formatOTLPTime(event.TimeUnixNano),
+			"name":       event.Name,
+			"attributes": otlpAttributesToMap(event.Attributes),
+		})
+	}
+	for _, link := range span.Links {
+		message.Links = append(message.Links, map[string]interface{}{
+			"trace_id":   link.TraceID.String(),
+			"span_id":    link.SpanID.String(),
+			"attributes": otlpAttributesToMap(link.Attributes),
+		})
+	}
+	return message
+}
+
+// processLogs enqueues one message per log record.
+func (cons *OTLP) processLogs(contentType string, body []byte) error {
+	request := otlpLogsRequest{}
+	if err := decodeOTLPRequest(contentType, body, &request); err != nil {
+		return err
+	}
+
+	for _, resourceLogs := range request.ResourceLogs {
+		for _, scopeLogs := range resourceLogs.ScopeLogs {
+			metadata := cons.getMetadata("logs", resourceLogs.Resource, scopeLogs.Scope)
+			for _, record := range scopeLogs.LogRecords {
+				data, err := json.Marshal(newOTLPLogMessage(record))
+				if err != nil {
+					cons.Logger.Warning("Failed to encode log record: ", err)
+					continue // ### continue, skip record ###
+				}
+				cons.enqueue(data, metadata, cons.logStreamID)
+			}
+		}
+	}
+	return nil
+}
+
+// processTraces enqueues one message per span.
+func (cons *OTLP) processTraces(contentType string, body []byte) error {
+	request := otlpTracesRequest{}
+	if err := decodeOTLPRequest(contentType, body, &request); err != nil {
+		return err
+	}
+
+	for _, resourceSpans := range request.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			metadata := cons.getMetadata("traces", resourceSpans.Resource, scopeSpans.Scope)
+			for _, span := range scopeSpans.Spans {
+				data, err := json.Marshal(newOTLPSpanMessage(span))
+				if err != nil {
+					cons.Logger.Warning("Failed to encode span: ", err)
+					continue // ### continue, skip span ###
+				}
+				cons.enqueue(data, metadata, cons.traceStreamID)
+			}
+		}
+	}
+	return nil
+}
+
+// requestHandler will handle a single export request.
+func (cons *OTLP) requestHandler(resp http.ResponseWriter, req *http.Request) {
+	var (
+		streamID core.MessageStreamID
+		process  func(string, []byte) error
+	)
+
+	switch req.URL.Path {
+	case otlpLogsPath:
+		streamID, process = cons.logStreamID, cons.processLogs
+	case otlpTracesPath:
+		streamID, process = cons.traceStreamID, cons.processTraces
+	default:
+		http.NotFound(resp, req)
+		return // ### return, unknown signal ###
+	}
+
+	if req.Method != http.MethodPost {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return // ### return, only POST is allowed ###
+	}
+
+	contentType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || (contentType != otlpContentProtobuf && contentType != otlpContentJSON) {
+		resp.WriteHeader(http.StatusUnsupportedMediaType)
+		return // ### return, unknown encoding ###
+	}
+
+	if cons.IsStreamBlocked(streamID) {
+		resp.Header().Set("Retry-After", "1")
+		resp.WriteHeader(http.StatusTooManyRequests)
+		return // ### return, producers are blocked ###
+	}
+
+	body, err := cons.readBody(req)
+	if err == errOTLPRequestTooLarge {
+		resp.WriteHeader(http.StatusRequestEntityTooLarge)
+		return // ### return, body too large ###
+	}
+	if err == nil {
+		err = process(contentType, body)
+	}
+	if err != nil {
+		cons.Logger.Warning("Invalid export request: ", err)
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return // ### return, malformed request ###
+	}
+
+	// An empty response is a valid, successful export response in both
+	// encodings.
+	resp.Header().Set("Content-Type", contentType)
+	resp.WriteHeader(http.StatusOK)
+	if contentType == otlpContentJSON {
+		resp.Write([]byte("{}"))
+	}
+}
+
+func (cons *OTLP) serve() {
+	defer cons.WorkerDone()
+
+	srv := http.Server{
+		Addr:        cons.address,
+		Handler:     http.HandlerFunc(cons.requestHandler),
+		ReadTimeout: cons.readTimeoutSec,
+		TLSConfig:   cons.certificate,
+	}
+
+	var err error
+	if cons.certificate != nil {
+		// Certificates are already part of TLSConfig
+		err = srv.ServeTLS(cons.listen, "", "")
+	} else {
+		err = srv.Serve(cons.listen)
+	}
+
+	if _, isStopRequest := err.(tnet.StopRequestError); err != nil && !isStopRequest {
+		cons.Logger.Error(err)
+	}
+}
+
+// Consume opens a new http server listening on the given address
+func (cons *OTLP) Consume(workers *sync.WaitGroup) {
+	listen, err := tnet.NewStopListener(cons.address)
+	if err != nil {
+		cons.Logger.Error(err)
+		return // ### return, could not connect ###
+	}
+
+	cons.listen = listen
+	cons.AddMainWorker(workers)
+
+	go cons.serve()
+	defer cons.listen.Close()
+
+	cons.ControlLoop()
+}
@@ -0,0 +1,639 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// This file contains the subset of the OTLP data model used by consumer.OTLP
+// together with decoders for the protobuf and the JSON encoding.
+// See https://github.com/open-telemetry/opentelemetry-proto
+
+const (
+	protoWireVarint  = 0
+	protoWireFixed64 = 1
+	protoWireBytes   = 2
+	protoWireFixed32 = 5
+)
+
+type otlpLogsRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope       `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         otlpUint64     `json:"timeUnixNano"`
+	ObservedTimeUnixNano otlpUint64     `json:"observedTimeUnixNano"`
+	SeverityNumber       int32          `json:"severityNumber"`
+	SeverityText         string         `json:"severityText"`
+	Body                 otlpAnyValue   `json:"body"`
+	Attributes           []otlpKeyValue `json:"attributes"`
+	TraceID              otlpID         `json:"traceId"`
+	SpanID               otlpID         `json:"spanId"`
+}
+
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           otlpID          `json:"traceId"`
+	SpanID            otlpID          `json:"spanId"`
+	TraceState        string          `json:"traceState"`
+	ParentSpanID      otlpID          `json:"parentSpanId"`
+	Name              string          `json:"name"`
+	Kind              int32           `json:"kind"`
+	StartTimeUnixNano otlpUint64      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   otlpUint64      `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue  `json:"attributes"`
+	Events            []otlpSpanEvent `json:"events"`
+	Links             []otlpSpanLink  `json:"links"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpSpanEvent struct {
+	TimeUnixNano otlpUint64     `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes"`
+}
+
+type otlpSpanLink struct {
+	TraceID    otlpID         `json:"traceId"`
+	SpanID     otlpID         `json:"spanId"`
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpStatus struct {
+	Message string `json:"message"`
+	Code    int32  `json:"code"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name       string         `json:"name"`
+	Version    string         `json:"version"`
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string           `json:"stringValue"`
+	BoolValue   *bool             `json:"boolValue"`
+	IntValue    *otlpInt64        `json:"intValue"`
+	DoubleValue *float64          `json:"doubleValue"`
+	ArrayValue  *otlpArrayValue   `json:"arrayValue"`
+	KvlistValue *otlpKeyValueList `json:"kvlistValue"`
+	BytesValue  []byte            `json:"bytesValue"`
+	hasBytes    bool
+}
+
+type otlpArrayValue struct {
+	Values []otlpAnyValue `json:"values"`
+}
+
+type otlpKeyValueList struct {
+	Values []otlpKeyValue `json:"values"`
+}
+
+// otlpUint64 is a 64-bit unsigned integer that is encoded as a string in the
+// OTLP JSON encoding.
+type otlpUint64 uint64
+
+// otlpInt64 is a 64-bit signed integer that is encoded as a string in the
+// OTLP JSON encoding.
+type otlpInt64 int64
+
+// otlpID is a trace or span id that is encoded as a hex string in the OTLP
+// JSON encoding.
+type otlpID []byte
+
+// UnmarshalJSON accepts numbers and strings
+func (value *otlpUint64) UnmarshalJSON(data []byte) error {
+	parsed, err := strconv.ParseUint(unquoteJSONNumber(data), 10, 64)
+	*value = otlpUint64(parsed)
+	return err
+}
+
+// UnmarshalJSON accepts numbers and strings
+func (value *otlpInt64) UnmarshalJSON(data []byte) error {
+	parsed, err := strconv.ParseInt(unquoteJSONNumber(data), 10, 64)
+	*value = otlpInt64(parsed)
+	return err
+}
+
+// UnmarshalJSON decodes a hex encoded id
+func (id *otlpID) UnmarshalJSON(data []byte) error {
+	var encoded string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	decoded, err := hex.DecodeString(encoded)
+	*id = decoded
+	return err
+}
+
+// UnmarshalJSON tracks if bytesValue has been set
+func (value *otlpAnyValue) UnmarshalJSON(data []byte) error {
+	type plainAnyValue otlpAnyValue
+	var plain plainAnyValue
+	if err := json.Unmarshal(data, &plain); err != nil {
+		return err
+	}
+	*value = otlpAnyValue(plain)
+	value.hasBytes = value.BytesValue != nil
+	return nil
+}
+
+func unquoteJSONNumber(data []byte) string {
+	if len(data) >= 2 && data[0] == '"' && data[len(data)-1] == '"' {
+		return string(data[1 : len(data)-1])
+	}
+	return string(data)
+}
+
+// String returns the hex representation of an id or "" if the id is not set.
+func (id otlpID) String() string {
+	return hex.EncodeToString(id)
+}
+
+// Time converts a unix nano timestamp. Zero timestamps are returned as
+// zero time.
+func (value otlpUint64) Time() time.Time {
+	if value == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(value)).UTC()
+}
+
+// Interface converts an any value into a type that can be encoded as JSON.
+func (value otlpAnyValue) Interface() interface{} {
+	switch {
+	case value.StringValue != nil:
+		return *value.StringValue
+	case value.BoolValue != nil:
+		return *value.BoolValue
+	case value.IntValue != nil:
+		return int64(*value.IntValue)
+	case value.DoubleValue != nil:
+		return *value.DoubleValue
+	case value.ArrayValue != nil:
+		values := make([]interface{}, 0, len(value.ArrayValue.Values))
+		for _, item := range value.ArrayValue.Values {
+			values = append(values, item.Interface())
+		}
+		return values
+	case value.KvlistValue != nil:
+		return otlpAttributesToMap(value.KvlistValue.Values)
+	case value.hasBytes:
+		return base64.StdEncoding.EncodeToString(value.BytesValue)
+	default:
+		return nil
+	}
+}
+
+// String converts an any value to a string. Complex types are converted to
+// JSON.
+func (value otlpAnyValue) String() string {
+	switch data := value.Interface().(type) {
+	case nil:
+		return ""
+	case string:
+		return data
+	case bool:
+		return strconv.FormatBool(data)
+	case int64:
+		return strconv.FormatInt(data, 10)
+	case float64:
+		return strconv.FormatFloat(data, 'g', -1, 64)
+	default:
+		encoded, _ := json.Marshal(data)
+		return string(encoded)
+	}
+}
+
+func otlpAttributesToMap(attributes []otlpKeyValue) map[string]interface{} {
+	values := make(map[string]interface{}, len(attributes))
+	for _, attribute := range attributes {
+		values[attribute.Key] = attribute.Value.Interface()
+	}
+	return values
+}
+
+// protoFieldFunc is called for each known field found by readProtoFields.
+// Value holds the value of varint, fixed32 and fixed64 fields, data holds the
+// content of length delimited fields.
+type protoFieldFunc func(field int, value uint64, data []byte) error
+
+// protoWireTypes maps the field numbers of a protobuf message to their
+// expected wire type.
+type protoWireTypes map[int]int
+
+// otlpMaxValueDepth limits the nesting of array and kvlist values. Without a
+// limit a crafted request could exhaust the stack.
+const otlpMaxValueDepth = 32
+
+var (
+	otlpRequestFields      = protoWireTypes{1: protoWireBytes}
+	otlpResourceListFields = protoWireTypes{1: protoWireBytes, 2: protoWireBytes}
+	otlpScopeListFields    = protoWireTypes{1: protoWireBytes, 2: protoWireBytes}
+	otlpLogRecordFields    = protoWireTypes{
+		1:  protoWireFixed64,
+		2:  protoWireVarint,
+		3:  protoWireBytes,
+		5:  protoWireBytes,
+		6:  protoWireBytes,
+		9:  protoWireBytes,
+		10: protoWireBytes,
+		11: protoWireFixed64,
+	}
+	otlpSpanFields = protoWireTypes{
+		1:  protoWireBytes,
+		2:  protoWireBytes,
+		3:  protoWireBytes,
+		4:  protoWireBytes,
+		5:  protoWireBytes,
+		6:  protoWireVarint,
+		7:  protoWireFixed64,
+		8:  protoWireFixed64,
+		9:  protoWireBytes,
+		11: protoWireBytes,
+		13: protoWireBytes,
+		15: protoWireBytes,
+	}
+	otlpSpanEventFields = protoWireTypes{1: protoWireFixed64, 2: protoWireBytes, 3: protoWireBytes}
+	otlpSpanLinkFields  = protoWireTypes{1: protoWireBytes, 2: protoWireBytes, 4: protoWireBytes}
+	otlpStatusFields    = protoWireTypes{2: protoWireBytes, 3: protoWireVarint}
+	otlpResourceFields  = protoWireTypes{1: protoWireBytes}
+	otlpScopeFields     = protoWireTypes{1: protoWireBytes, 2: protoWireBytes, 3: protoWireBytes}
+	otlpKeyValueFields  = protoWireTypes{1: protoWireBytes, 2: protoWireBytes}
+	otlpValueListFields = protoWireTypes{1: protoWireBytes}
+	otlpAnyValueFields  = protoWireTypes{
+		1: protoWireBytes,
+		2: protoWireVarint,
+		3: protoWireVarint,
+		4: protoWireFixed64,
+		5: protoWireBytes,
+		6: protoWireBytes,
+		7: protoWireBytes,
+	}
+)
+
+// readProtoFields iterates over all fields of an encoded protobuf message.
+// Fields not listed in wireTypes are skipped, known fields with an unexpected
+// wire type are reported as an error.
+func readProtoFields(buffer []byte, wireTypes protoWireTypes, onField protoFieldFunc) error {
+	for len(buffer) > 0 {
+		key, keyLen := binary.Uvarint(buffer)
+		if keyLen <= 0 {
+			return fmt.Errorf("invalid protobuf field key")
+		}
+		buffer = buffer[keyLen:]
+
+		field := int(key >> 3)
+		wireType := int(key & 0x7)
+		var (
+			value uint64
+			data  []byte
+		)
+
+		switch wireType {
+		case protoWireVarint:
+			varint, varintLen := binary.Uvarint(buffer)
+			if varintLen <= 0 {
+				return fmt.Errorf("invalid varint in field %d", field)
+			}
+			value = varint
+			buffer = buffer[varintLen:]
+
+		case protoWireFixed64:
+			if len(buffer) < 8 {
+				return fmt.Errorf("truncated fixed64 in field %d", field)
+			}
+			value = binary.LittleEndian.Uint64(buffer)
+			buffer = buffer[8:]
+
+		case protoWireFixed32:
+			if len(buffer) < 4 {
+				return fmt.Errorf("truncated fixed32 in field %d", field)
+			}
+			value = uint64(binary.LittleEndian.Uint32(buffer))
+			buffer = buffer[4:]
+
+		case protoWireBytes:
+			length, lengthLen := binary.Uvarint(buffer)
+			if lengthLen <= 0 || uint64(len(buffer)-lengthLen) < length {
+				return fmt.Errorf("truncated data in field %d", field)
+			}
+			data = buffer[lengthLen : lengthLen+int(length)]
+			buffer = buffer[lengthLen+int(length):]
+
+		default:
+			return fmt.Errorf("unsupported wire type %d in field %d", wireType, field)
+		}
+
+		expectedType, isKnown := wireTypes[field]
+		if !isKnown {
+			continue // ### continue, unknown field ###
+		}
+		if expectedType != wireType {
+			return fmt.Errorf("unexpected wire type %d in field %d", wireType, field)
+		}
+		if err := onField(field, value, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (req *otlpLogsRequest) decodeProto(buffer []byte) error {
+	return readProtoFields(buffer, otlpRequestFields, func(field int, value uint64, data []byte) error {
+		resourceLogs := otlpResourceLogs{}
+		err := resourceLogs.decodeProto(data)
+		req.ResourceLogs = append(req.ResourceLogs, resourceLogs)
+		return err
+	})
+}
+
+func (resourceLogs *otlpResourceLogs) decodeProto(buffer []byte) error {
+	return readProtoFields(buffer, otlpResourceListFields, func(field int, value uint64, data []byte) error {
+		if field == 1 {
+			return resourceLogs.Resource.decodeProto(data)
+		}
+		scopeLogs := otlpScopeLogs{}
+		err := scopeLogs.decodeProto(data)
+		resourceLogs.ScopeLogs = append(resourceLogs.ScopeLogs, scopeLogs)
+		return err
+	})
+}
+
+func (scopeLogs *otlpScopeLogs) decodeProto(buffer []byte) error {
+	return readProtoFields(buffer, otlpScopeListFields, func(field int, value uint64, data []byte) error {
+		if field == 1 {
+			return scopeLogs.Scope.decodeProto(data)
+		}
+		record := otlpLogRecord{}
+		err := record.decodeProto(data)
+		scopeLogs.LogRecords = append(scopeLogs.LogRecords, record)
+		return err
+	})
+}
+
+func (record *otlpLogRecord) decodeProto(buffer []byte) error {
+	return readProtoFields(buffer, otlpLogRecordFields, func(field int, value uint64, data []byte) error {
+		switch field {
+		case 1:
+			record.TimeUnixNano = otlpUint64(value)
+		case 2:
+			record.SeverityNumber = int32(value)
+		case 3:
+			record.SeverityText = string(data)
+		case 5:
+			return record.Body.decodeProto(data, 0)
+		case 6:
+			return appendProtoKeyValue(&record.Attributes, data, 0)
+		case 9:
+			record.TraceID = otlpID(data)
+		case 10:
+			record.SpanID = otlpID(data)
+		case 11:
+			record.ObservedTimeUnixNano = otlpUint64(value)
+		}
+		return nil
+	})
+}
+
+func (req *otlpTracesRequest) decodeProto(buffer []byte) error {
+	return readProtoFields(buffer, otlpRequestFields, func(field int, value uint64, data []byte) error {
+		resourceSpans := otlpResourceSpans{}
+		err := resourceSpans.decodeProto(data)
+		req.ResourceSpans = append(req.ResourceSpans, resourceSpans)
+		return err
+	})
+}
+
+func (resourceSpans *otlpResourceSpans) decodeProto(buffer []byte) error {
+	return readProtoFields(buffer, otlpResourceListFields, func(field int, value uint64, data []byte) error {
+		if field == 1 {
+			return resourceSpans.Resource.decodeProto(data)
+		}
+		scopeSpans := otlpScopeSpans{}
+		err := scopeSpans.decodeProto(data)
+		resourceSpans.ScopeSpans = append(resourceSpans.ScopeSpans, scopeSpans)
+		return err
+	})
+}
+
+func (scopeSpans *otlpScopeSpans) decodeProto(buffer []byte) error {
+	return readProtoFields(buffer, otlpScopeListFields, func(field int, value uint64, data []byte) error {
+		if field == 1 {
+			return scopeSpans.Scope.decodeProto(data)
+		}
+		span := otlpSpan{}
+		err := span.decodeProto(data)
+		scopeSpans.Spans = append(scopeSpans.Spans, span)
+		return err
+	})
+}
+
+func (span *otlpSpan) decodeProto(buffer []byte) error {
+	return readProtoFields(buffer, otlpSpanFields, func(field int, value uint64, data []byte) error {
+		switch field {
+		case 1:
+			span.TraceID = otlpID(data)
+		case 2:
+			span.SpanID = otlpID(data)
+		case 3:
+			span.TraceState = string(data)
+		case 4:
+			span.ParentSpanID = otlpID(data)
+		case 5:
+			span.Name = string(data)
+		case 6:
+			span.Kind = int32(value)
+		case 7:
+			span.StartTimeUnixNano = otlpUint64(value)
+		case 8:
+			span.EndTimeUnixNano = otlpUint64(value)
+		case 9:
+			return appendProtoKeyValue(&span.Attributes, data, 0)
+		case 11:
+			event := otlpSpanEvent{}
+			err := event.decodeProto(data)
+			span.Events = append(span.Events, event)
+			return err
+		case 13:
+			link := otlpSpanLink{}
+			err := link.decodeProto(data)
+			span.Links = append(span.Links, link)
+			return err
+		case 15:
+			return span.Status.decodeProto(data)
+		}
+		return nil
+	})
+}
+
+func (event *otlpSpanEvent) decodeProto(buffer []byte) error {
+	return readProtoFields(buffer, otlpSpanEventFields, func(field int, value uint64, data []byte) error {
+		switch field {
+		case 1:
+			event.TimeUnixNano = otlpUint64(value)
+		case 2:
+			event.Name = string(data)
+		case 3:
+			return appendProtoKeyValue(&event.Attributes, data, 0)
+		}
+		return nil
+	})
+}
+
+func (link *otlpSpanLink) decodeProto(buffer []byte) error {
+	return readProtoFields(buffer, otlpSpanLinkFields, func(field int, value uint64, data []byte) error {
+		switch field {
+		case 1:
+			link.TraceID = otlpID(data)
+		case 2:
+			link.SpanID = otlpID(data)
+		case 4:
+			return appendProtoKeyValue(&link.Attributes, data, 0)
+		}
+		return nil
+	})
+}
+
+func (status *otlpStatus) decodeProto(buffer []byte) error {
+	return readProtoFields(buffer, otlpStatusFields, func(field int, value uint64, data []byte) error {
+		switch field {
+		case 2:
+			status.Message = string(data)
+		case 3:
+			status.Code = int32(value)
+		}
+		return nil
+	})
+}
+
+func (resource *otlpResource) decodeProto(buffer []byte) error {
+	return readProtoFields(buffer, otlpResourceFields, func(field int, value uint64, data []byte) error {
+		return appendProtoKeyValue(&resource.Attributes, data, 0)
+	})
+}
+
+func (scope *otlpScope) decodeProto(buffer []byte) error {
+	return readProtoFields(buffer, otlpScopeFields, func(field int, value uint64, data []byte) error {
+		switch field {
+		case 1:
+			scope.Name = string(data)
+		case 2:
+			scope.Version = string(data)
+		case 3:
+			return appendProtoKeyValue(&scope.Attributes, data, 0)
+		}
+		return nil
+	})
+}
+
+// appendProtoKeyValue decodes a KeyValue message and appends it to the given
+// list. Depth is the nesting level of the list.
+func appendProtoKeyValue(attributes *[]otlpKeyValue, buffer []byte, depth int) error {
+	attribute := otlpKeyValue{}
+	err := readProtoFields(buffer, otlpKeyValueFields, func(field int, value uint64, data []byte) error {
+		if field == 1 {
+			attribute.Key = string(data)
+			return nil
+		}
+		return attribute.Value.decodeProto(data, depth)
+	})
+	*attributes = append(*attributes, attribute)
+	return err
+}
+
+// decodeProto decodes an AnyValue message. Depth is the number of array and
+// kvlist values this value is nested in.
+func (value *otlpAnyValue) decodeProto(buffer []byte, depth int) error {
+	return readProtoFields(buffer, otlpAnyValueFields, func(field int, varint uint64, data []byte) error {
+		switch field {
+		case 1:
+			stringValue := string(data)
+			value.StringValue = &stringValue
+		case 2:
+			boolValue := varint != 0
+			value.BoolValue = &boolValue
+		case 3:
+			intValue := otlpInt64(varint)
+			value.IntValue = &intValue
+		case 4:
+			doubleValue := math.Float64frombits(varint)
+			value.DoubleValue = &doubleValue
+		case 5:
+			if depth >= otlpMaxValueDepth {
+				return fmt.Errorf("values nested deeper than %d levels", otlpMaxValueDepth)
+			}
+			value.ArrayValue = &otlpArrayValue{}
+			return readProtoFields(data, otlpValueListFields, func(field int, varint uint64, data []byte) error {
+				item := otlpAnyValue{}
+				err := item.decodeProto(data, depth+1)
+				value.ArrayValue.Values = append(value.ArrayValue.Values, item)
+				return err
+			})
+		case 6:
+			if depth >= otlpMaxValueDepth {
+				return fmt.Errorf("values nested deeper than %d levels", otlpMaxValueDepth)
+			}
+			value.KvlistValue = &otlpKeyValueList{}
+			return readProtoFields(data, otlpValueListFields, func(field int, varint uint64, data []byte) error {
+				return appendProtoKeyValue(&value.KvlistValue.Values, data, depth+1)
+			})
+		case 7:
+			value.BytesValue = data
+			value.hasBytes = true
+		}
+		return nil
+	})
+}
@@ -0,0 +1,155 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/trivago/tgo/ttesting"
+)
+
+// The protobuf payloads have been generated with go.opentelemetry.io/proto/otlp
+// v1.11.1. The JSON payloads encode the same data following the OTLP/HTTP
+// JSON mapping (hex encoded ids, integer enums).
+const (
+	otlpTestLogsProto = "0aed010a1c0a1a0a0c736572766963652e6e616d65120a0a08636865636b6f757412cc010a0a0a036c69621203312e3012bd010900002a36fe9c9717100d1a045741524e2a120a106469736b20616c6d6f73742066756c6c32130a0466726565120b18fbffffffffffffffff0132120a05726174696f120921000000000000d03f32080a026f6b1202100132140a0474616773120c2a0a0a030a01610a030a016232160a066e6573746564120c320a0a080a016b12030a0176320b0a0372617712043a02010245010000004a105b8efaf25ad07c3b00000000000000015208ebe35c100a0b0c0d590065f753fe9c9717"
+
+	otlpTestLogsJSON = `{"resourceLogs":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"checkout"}}]},
+	"scopeLogs":[{"scope":{"name":"lib","version":"1.0"},"logRecords":[{"timeUnixNano":"1700000000000000000",
+	"observedTimeUnixNano":"1700000000500000000","severityNumber":13,"severityText":"WARN","body":{"stringValue":"disk almost full"},
+	"attributes":[{"key":"free","value":{"intValue":"-5"}},{"key":"ratio","value":{"doubleValue":0.25}},{"key":"ok","value":{"boolValue":true}},
+	{"key":"tags","value":{"arrayValue":{"values":[{"stringValue":"a"},{"stringValue":"b"}]}}},
+	{"key":"nested","value":{"kvlistValue":{"values":[{"key":"k","value":{"stringValue":"v"}}]}}},
+	{"key":"raw","value":{"bytesValue":"AQI="}}],"flags":1,"traceId":"5b8efaf25ad07c3b0000000000000001","spanId":"ebe35c100a0b0c0d"}]}]}]}`
+
+	otlpTestTracesProto = "0adb010a1c0a1a0a0c736572766963652e6e616d65120a0a08636865636b6f757412ba010a0a0a036c69621203312e3012ab010a105b8efaf25ad07c3b00000000000000011208ebe35c100a0b0c0d1a03613d62220801020304050607082a09474554202f6361727430023900002a36fe9c97174180b21045fe9c97174a170a10687474702e7374617475735f636f6465120318c8015a150900e11f3cfe9c9717120a6361636865206d6973736a1c0a1001020304050607080102030405060708120801020304050607087a0b120774696d656f75741802850101010000"
+
+	otlpTestTracesJSON = `{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"checkout"}}]},
+	"scopeSpans":[{"scope":{"name":"lib","version":"1.0"},"spans":[{"traceId":"5b8efaf25ad07c3b0000000000000001","spanId":"ebe35c100a0b0c0d",
+	"traceState":"a=b","parentSpanId":"0102030405060708","flags":257,"name":"GET /cart","kind":2,
+	"startTimeUnixNano":"1700000000000000000","endTimeUnixNano":"1700000000250000000",
+	"attributes":[{"key":"http.status_code","value":{"intValue":"200"}}],
+	"events":[{"timeUnixNano":"1700000000100000000","name":"cache miss"}],
+	"links":[{"traceId":"01020304050607080102030405060708","spanId":"0102030405060708"}],
+	"status":{"message":"timeout","code":2}}]}]}]}`
+)
+
+func decodeOTLPTestPayload(t *testing.T, contentType string, payload string, request interface {
+	decodeProto([]byte) error
+}) {
+	expect := ttesting.NewExpect(t)
+	body := []byte(payload)
+	if contentType == otlpContentProtobuf {
+		var err error
+		body, err = hex.DecodeString(payload)
+		expect.NoError(err)
+	}
+	expect.NoError(decodeOTLPRequest(contentType, body, request))
+}
+
+func TestOTLPDecodeLogs(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	expected := `{"time":"2023-11-14T22:13:20Z","observed_time":"2023-11-14T22:13:20.5Z","severity":"WARN","severity_number":13,` +
+		`"body":"disk almost full","attributes":{"free":-5,"nested":{"k":"v"},"ok":true,"ratio":0.25,"raw":"AQI=","tags":["a","b"]},` +
+		`"trace_id":"5b8efaf25ad07c3b0000000000000001","span_id":"ebe35c100a0b0c0d"}`
+
+	for contentType, payload := range map[string]string{
+		otlpContentProtobuf: otlpTestLogsProto,
+		otlpContentJSON:     otlpTestLogsJSON,
+	} {
+		request := otlpLogsRequest{}
+		decodeOTLPTestPayload(t, contentType, payload, &request)
+
+		expect.Equal(1, len(request.ResourceLogs))
+		resourceLogs := request.ResourceLogs[0]
+		expect.Equal("service.name", resourceLogs.Resource.Attributes[0].Key)
+		expect.Equal("checkout", resourceLogs.Resource.Attributes[0].Value.String())
+		expect.Equal(1, len(resourceLogs.ScopeLogs))
+		expect.Equal("lib", resourceLogs.ScopeLogs[0].Scope.Name)
+		expect.Equal("1.0", resourceLogs.ScopeLogs[0].Scope.Version)
+		expect.Equal(1, len(resourceLogs.ScopeLogs[0].LogRecords))
+
+		message, err := json.Marshal(newOTLPLogMessage(resourceLogs.ScopeLogs[0].LogRecords[0]))
+		expect.NoError(err)
+		expect.Equal(expected, string(message))
+	}
+}
+
+func TestOTLPDecodeTraces(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	expected := `{"trace_id":"5b8efaf25ad07c3b0000000000000001","span_id":"ebe35c100a0b0c0d","parent_span_id":"0102030405060708",` +
+		`"trace_state":"a=b","name":"GET /cart","kind":"SPAN_KIND_SERVER","start_time":"2023-11-14T22:13:20Z","end_time":"2023-11-14T22:13:20.25Z",` +
+		`"attributes":{"http.status_code":200},"events":[{"attributes":{},"name":"cache miss","time":"2023-11-14T22:13:20.1Z"}],` +
+		`"links":[{"attributes":{},"span_id":"0102030405060708","trace_id":"01020304050607080102030405060708"}],` +
+		`"status":{"code":"STATUS_CODE_ERROR","message":"timeout"}}`
+
+	for contentType, payload := range map[string]string{
+		otlpContentProtobuf: otlpTestTracesProto,
+		otlpContentJSON:     otlpTestTracesJSON,
+	} {
+		request := otlpTracesRequest{}
+		decodeOTLPTestPayload(t, contentType, payload, &request)
+
+		expect.Equal(1, len(request.ResourceSpans))
+		expect.Equal(1, len(request.ResourceSpans[0].ScopeSpans))
+		expect.Equal(1, len(request.ResourceSpans[0].ScopeSpans[0].Spans))
+
+		message, err := json.Marshal(newOTLPSpanMessage(request.ResourceSpans[0].ScopeSpans[0].Spans[0]))
+		expect.NoError(err)
+		expect.Equal(expected, string(message))
+	}
+}
+
+func TestOTLPDecodeInvalidProto(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	// resource_logs (field 1) sent as varint instead of a message
+	request := otlpLogsRequest{}
+	expect.NotNil(request.decodeProto([]byte{0x08, 0x01}))
+
+	// severity_text (field 3) sent as varint instead of a string
+	record := otlpLogRecord{}
+	expect.NotNil(record.decodeProto([]byte{0x18, 0x01}))
+
+	// truncated string
+	expect.NotNil(record.decodeProto([]byte{0x1a, 0x05, 'W', 'A'}))
+
+	// Unknown fields are skipped
+	expect.NoError(record.decodeProto([]byte{0xa0, 0x06, 0x01, 0x1a, 0x01, 'W'}))
+	expect.Equal("W", record.SeverityText)
+}
+
+func TestOTLPDecodeNestingLimit(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	// Build an AnyValue with the given number of nested array values
+	nested := func(depth int) []byte {
+		value := []byte{0x0a, 0x01, 'x'}
+		for i := 0; i < depth; i++ {
+			item := append(binary.AppendUvarint([]byte{0x0a}, uint64(len(value))), value...)
+			value = append(binary.AppendUvarint([]byte{0x2a}, uint64(len(item))), item...)
+		}
+		return value
+	}
+
+	value := otlpAnyValue{}
+	expect.NoError(value.decodeProto(nested(otlpMaxValueDepth), 0))
+
+	value = otlpAnyValue{}
+	expect.NotNil(value.decodeProto(nested(otlpMaxValueDepth+1), 0))
+}
@@ -0,0 +1,550 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/tnet"
+)
+
+const (
+	prometheusModeRemoteWrite = "remotewrite"
+	prometheusModeScrape      = "scrape"
+	prometheusAcceptHeader    = `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3`
+
+	// prometheusStaleNaN is the NaN value used by Prometheus to mark a
+	// series as stale.
+	prometheusStaleNaN = 0x7ff0000000000002
+)
+
+// Prometheus consumer plugin
+//
+// This consumer reads metrics in one of two modes. In "remotewrite" mode it
+// accepts the Prometheus remote_write protocol (snappy compressed protobuf)
+// over HTTP. In "scrape" mode it polls a list of /metrics endpoints in the
+// Prometheus exposition format. Histograms and summaries are expanded into
+// the "_bucket", "_sum" and "_count" series known from Prometheus.
+//
+// Messages are JSON objects with the fields "name", "labels", "value" and
+// "timestamp" (milliseconds since epoch). If MessagePerSeries is enabled in
+// remotewrite mode, "value" and "timestamp" are replaced by a list of
+// "samples". Values are encoded as strings, as they may be NaN or infinite.
+// Stale markers are not forwarded.
+//
+// Metadata
+//
+// *NOTE: The metadata will only set if the parameter `SetMetadata` is active.*
+//
+// - __name__: The name of the metric
+//
+// - <label>: All labels of the series
+//
+// Parameters
+//
+// - Mode: Defines how metrics are received. Can be "remotewrite" or "scrape".
+// By default this parameter is set to "remotewrite".
+//
+// - Address: Defines the host and port to bind to in remotewrite mode.
+// By default this parameter is set to ":9201".
+//
+// - Path: Defines the URL path accepting remote_write requests.
+// By default this parameter is set to "/api/v1/write".
+//
+// - ReadTimeoutSec: Defines the maximum duration in seconds before timing out
+// a remote_write request.
+// By default this parameter is set to "3".
+//
+// - MaxRequestSizeKB: Defines the maximum size of a decompressed
+// remote_write request.
+// By default this parameter is set to "32768".
+//
+// - Certificate: Defines the path to a PEM certificate file to enable HTTPS
+// in remotewrite mode.
+// By default this parameter is set to "".
+//
+// - PrivateKey: Defines the path to the private key file for Certificate.
+// By default this parameter is set to "".
+//
+// - MessagePerSeries: When set to true, one message per series instead of
+// one message per sample is generated in remotewrite mode.
+// By default this parameter is set to "false".
+//
+// - Targets: Defines the URLs to scrape in scrape mode.
+// By default this parameter is set to an empty list.
+//
+// - Job: Defines the value of the "job" label added to scraped metrics. If
+// empty, no job label is added.
+// By default this parameter is set to "".
+//
+// - ScrapeIntervalSec: Defines the number of seconds between two scrapes.
+// By default this parameter is set to "15".
+//
+// - ScrapeTimeoutSec: Defines the maximum number of seconds a scrape may take.
+// By default this parameter is set to "10".
+//
+// - SetMetadata: When set to true, the labels of a series are stored as
+// metadata.
+// By default this parameter is set to "true".
+//
+// Examples
+//
+// This example receives remote_write requests from Prometheus and writes them
+// to Kafka.
+//
+//  PrometheusIn:
+//    Type: consumer.Prometheus
+//    Streams: "metrics"
+//    Address: ":9201"
+//
+// This example scrapes two exporters every 30 seconds.
+//
+//  NodeExporter:
+//    Type: consumer.Prometheus
+//    Streams: "metrics"
+//    Mode: "scrape"
+//    Job: "node"
+//    ScrapeIntervalSec: 30
+//    Targets:
+//      - "http://host1:9100/metrics"
+//      - "http://host2:9100/metrics"
+//
+type Prometheus struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+	mode                string
+	address             string        `config:"Address" default:":9201"`
+	path                string        `config:"Path" default:"/api/v1/write"`
+	readTimeout         time.Duration `config:"ReadTimeoutSec" default:"3" metric:"sec"`
+	maxRequestSize      int64         `config:"MaxRequestSizeKB" default:"32768" metric:"kb"`
+	messagePerSeries    bool          `config:"MessagePerSeries" default:"false"`
+	job                 string        `config:"Job"`
+	scrapeInterval      time.Duration `config:"ScrapeIntervalSec" default:"15" metric:"sec"`
+	scrapeTimeout       time.Duration `config:"ScrapeTimeoutSec" default:"10" metric:"sec"`
+	withMetadata        bool          `config:"SetMetadata" default:"true"`
+	targets             []*url.URL
+	client              *http.Client
+	listen              *tnet.StopListener
+	certificate         *tls.Config
+}
+
+// prometheusSample is a single value of a series.
+type prometheusSample struct {
+	Value     string `json:"value"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// prometheusMessage is the JSON representation of a sample or a series.
+type prometheusMessage struct {
+	Name      string             `json:"name"`
+	Labels    map[string]string  `json:"labels"`
+	Value     string             `json:"value,omitempty"`
+	Timestamp int64              `json:"timestamp,omitempty"`
+	Samples   []prometheusSample `json:"samples,omitempty"`
+}
+
+// prometheusTimeSeries holds a decoded remote_write time series.
+type prometheusTimeSeries struct {
+	labels map[string]string
+	values []float64
+	times  []int64
+}
+
+func init() {
+	core.TypeRegistry.Register(Prometheus{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Prometheus) Configure(conf core.PluginConfigReader) {
+	cons.mode = strings.ToLower(conf.GetString("Mode", prometheusModeRemoteWrite))
+
+	switch cons.mode {
+	case prometheusModeRemoteWrite:
+		certificateFile := conf.GetString("Certificate", "")
+		keyFile := conf.GetString("PrivateKey", "")
+
+		if certificateFile != "" || keyFile != "" {
+			if certificateFile == "" || keyFile == "" {
+				conf.Errors.Pushf("There must always be a certificate and a private key or none of both")
+			} else {
+				cons.certificate = new(tls.Config)
+				cons.certificate.NextProtos = []string{"http/1.1"}
+
+				keypair, err := tls.LoadX509KeyPair(certificateFile, keyFile)
+				if !conf.Errors.Push(err) {
+					cons.certificate.Certificates = []tls.Certificate{keypair}
+				}
+			}
+		}
+
+	case prometheusModeScrape:
+		for _, target := range conf.GetStringArray("Targets", []string{}) {
+			targetURL, err := url.Parse(target)
+			if err != nil {
+				conf.Errors.Pushf("Invalid target %s: %s", target, err)
+				continue
+			}
+			cons.targets = append(cons.targets, targetURL)
+		}
+		if len(cons.targets) == 0 {
+			conf.Errors.Pushf("Scrape mode requires at least one target")
+		}
+		cons.client = &http.Client{Timeout: cons.scrapeTimeout}
+
+	default:
+		conf.Errors.Pushf("Unknown mode %s", cons.mode)
+	}
+}
+
+// isStaleMarker returns true if a value marks a series as stale.
+func isStaleMarker(value float64) bool {
+	return math.Float64bits(value) == prometheusStaleNaN
+}
+
+func formatPrometheusValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (cons *Prometheus) enqueue(message prometheusMessage) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		cons.Logger.Warning("Failed to encode metric: ", err)
+		return // ### return, skip metric ###
+	}
+
+	if !cons.withMetadata {
+		cons.Enqueue(data)
+		return // ### return, no metadata ###
+	}
+
+	metadata := core.Metadata{}
+	metadata.SetValue(model.MetricNameLabel, []byte(message.Name))
+	for name, value := range message.Labels {
+		metadata.SetValue(name, []byte(value))
+	}
+	cons.EnqueueWithMetadata(data, metadata)
+}
+
+// enqueueSeries generates messages for a series. The metric name is removed
+// from the given labels.
+func (cons *Prometheus) enqueueSeries(labels map[string]string, values []float64, times []int64) {
+	name := labels[model.MetricNameLabel]
+	delete(labels, model.MetricNameLabel)
+
+	if cons.messagePerSeries {
+		message := prometheusMessage{
+			Name:   name,
+			Labels: labels,
+		}
+		for i, value := range values {
+			if !isStaleMarker(value) {
+				message.Samples = append(message.Samples, prometheusSample{
+					Value:     formatPrometheusValue(value),
+					Timestamp: times[i],
+				})
+			}
+		}
+		if len(message.Samples) > 0 {
+			cons.enqueue(message)
+		}
+		return // ### return, series sent ###
+	}
+
+	for i, value := range values {
+		if !isStaleMarker(value) {
+			cons.enqueue(prometheusMessage{
+				Name:      name,
+				Labels:    labels,
+				Value:     formatPrometheusValue(value),
+				Timestamp: times[i],
+			})
+		}
+	}
+}
+
+// Wire types of the remote_write protobuf messages
+var (
+	prometheusWriteRequestFields = protoWireTypes{1: protoWireBytes}
+	prometheusTimeSeriesFields   = protoWireTypes{1: protoWireBytes, 2: protoWireBytes}
+	prometheusLabelFields        = protoWireTypes{1: protoWireBytes, 2: protoWireBytes}
+	prometheusSampleFields       = protoWireTypes{1: protoWireFixed64, 2: protoWireVarint}
+)
+
+// decodeLabel decodes a remote_write Label message.
+func (series *prometheusTimeSeries) decodeLabel(buffer []byte) error {
+	var name, value string
+	err := readProtoFields(buffer, prometheusLabelFields, func(field int, _ uint64, data []byte) error {
+		switch field {
+		case 1:
+			name = string(data)
+		case 2:
+			value = string(data)
+		}
+		return nil
+	})
+	series.labels[name] = value
+	return err
+}
+
+// decodeSample decodes a remote_write Sample message.
+func (series *prometheusTimeSeries) decodeSample(buffer []byte) error {
+	var (
+		value     float64
+		timestamp int64
+	)
+	err := readProtoFields(buffer, prometheusSampleFields, func(field int, data uint64, _ []byte) error {
+		switch field {
+		case 1:
+			value = math.Float64frombits(data)
+		case 2:
+			timestamp = int64(data)
+		}
+		return nil
+	})
+	series.values = append(series.values, value)
+	series.times = append(series.times, timestamp)
+	return err
+}
+
+// decodeProto decodes a remote_write TimeSeries message. Exemplars and
+// native histograms are ignored.
+func (series *prometheusTimeSeries) decodeProto(buffer []byte) error {
+	series.labels = make(map[string]string)
+	return readProtoFields(buffer, prometheusTimeSeriesFields, func(field int, _ uint64, data []byte) error {
+		if field == 1 {
+			return series.decodeLabel(data)
+		}
+		return series.decodeSample(data)
+	})
+}
+
+// processWriteRequest decodes a remote_write WriteRequest and enqueues all
+// contained samples.
+func (cons *Prometheus) processWriteRequest(body []byte) error {
+	series := []prometheusTimeSeries{}
+	// Metadata (field 3) is not part of the known fields and thus skipped
+	err := readProtoFields(body, prometheusWriteRequestFields, func(_ int, _ uint64, data []byte) error {
+		timeSeries := prometheusTimeSeries{}
+		if err := timeSeries.decodeProto(data); err != nil {
+			return err
+		}
+		series = append(series, timeSeries)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Only enqueue if the whole request could be decoded, so that retries by
+	// Prometheus do not generate duplicates.
+	for _, timeSeries := range series {
+		cons.enqueueSeries(timeSeries.labels, timeSeries.values, timeSeries.times)
+	}
+	return nil
+}
+
+// readBody returns the decompressed body of a remote_write request.
+func (cons *Prometheus) readBody(req *http.Request) ([]byte, error) {
+	if encoding := strings.ToLower(req.Header.Get("Content-Encoding")); encoding != "snappy" {
+		return nil, fmt.Errorf("unsupported content encoding %s", encoding)
+	}
+
+	compressed, err := ioutil.ReadAll(io.LimitReader(req.Body, cons.maxRequestSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(compressed)) > cons.maxRequestSize || int64(size) > cons.maxRequestSize {
+		return nil, errPrometheusRequestTooLarge
+	}
+	return snappy.Decode(nil, compressed)
+}
+
+var errPrometheusRequestTooLarge = fmt.Errorf("request body exceeds MaxRequestSizeKB")
+
+// requestHandler will handle a single remote_write request.
+func (cons *Prometheus) requestHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != cons.path {
+		http.NotFound(resp, req)
+		return // ### return, unknown path ###
+	}
+
+	if req.Method != http.MethodPost {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return // ### return, only POST is allowed ###
+	}
+
+	// Prometheus retries requests answered with 429 or 5xx
+	if cons.IsStreamBlocked(core.InvalidStreamID) {
+		resp.Header().Set("Retry-After", "1")
+		resp.WriteHeader(http.StatusTooManyRequests)
+		return // ### return, producers are blocked ###
+	}
+
+	body, err := cons.readBody(req)
+	if err == errPrometheusRequestTooLarge {
+		resp.WriteHeader(http.StatusRequestEntityTooLarge)
+		return // ### return, body too large ###
+	}
+	if err == nil {
+		err = cons.processWriteRequest(body)
+	}
+	if err != nil {
+		cons.Logger.Warning("Invalid remote_write request: ", err)
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return // ### return, malformed request ###
+	}
+
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func (cons *Prometheus) serve() {
+	defer cons.WorkerDone()
+
+	srv := http.Server{
+		Addr:        cons.address,
+		Handler:     http.HandlerFunc(cons.requestHandler),
+		ReadTimeout: cons.readTimeout,
+		TLSConfig:   cons.certificate,
+	}
+
+	var err error
+	if cons.certificate != nil {
+		// Certificates are already part of TLSConfig
+		err = srv.ServeTLS(cons.listen, "", "")
+	} else {
+		err = srv.Serve(cons.listen)
+	}
+
+	if _, isStopRequest := err.(tnet.StopRequestError); err != nil && !isStopRequest {
+		cons.Logger.Error(err)
+	}
+}
+
+// scrapeTarget reads all metrics from a given target and enqueues them.
+func (cons *Prometheus) scrapeTarget(target *url.URL) error {
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", prometheusAcceptHeader)
+
+	resp, err := cons.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+
+	decoder := expfmt.NewDecoder(resp.Body, expfmt.ResponseFormat(resp.Header))
+	families := []*dto.MetricFamily{}
+	for {
+		family := new(dto.MetricFamily)
+		if err := decoder.Decode(family); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		families = append(families, family)
+	}
+
+	samples, err := expfmt.ExtractSamples(&expfmt.DecodeOptions{Timestamp: model.Now()}, families...)
+	if err != nil {
+		return err
+	}
+
+	for _, sample := range samples {
+		labels := make(map[string]string, len(sample.Metric)+2)
+		for name, value := range sample.Metric {
+			labels[string(name)] = string(value)
+		}
+		if _, exists := labels[model.InstanceLabel]; !exists {
+			labels[model.InstanceLabel] = target.Host
+		}
+		if _, exists := labels[model.JobLabel]; !exists && cons.job != "" {
+			labels[model.JobLabel] = cons.job
+		}
+		cons.enqueueSeries(labels, []float64{float64(sample.Value)}, []int64{int64(sample.Timestamp)})
+	}
+	return nil
+}
+
+// scrape polls all targets in parallel.
+func (cons *Prometheus) scrape() {
+	if cons.IsStreamBlocked(core.InvalidStreamID) {
+		cons.Logger.Warning("Skipping scrape as producers are blocked")
+		return // ### return, producers are blocked ###
+	}
+
+	waitGroup := new(sync.WaitGroup)
+	for _, target := range cons.targets {
+		waitGroup.Add(1)
+		go func(target *url.URL) {
+			defer waitGroup.Done()
+			if err := cons.scrapeTarget(target); err != nil {
+				cons.Logger.WithError(err).Warningf("Failed to scrape %s", target)
+			}
+		}(target)
+	}
+	waitGroup.Wait()
+}
+
+// Consume starts the remote_write server or the scrape loop.
+func (cons *Prometheus) Consume(workers *sync.WaitGroup) {
+	if cons.mode == prometheusModeScrape {
+		// The scrape loop is the main worker
+		cons.AddMainWorker(workers)
+		defer cons.WorkerDone()
+		cons.TickerControlLoop(cons.scrapeInterval, cons.scrape)
+		return // ### return, scrape mode ###
+	}
+
+	listen, err := tnet.NewStopListener(cons.address)
+	if err != nil {
+		cons.Logger.Error(err)
+		return // ### return, could not connect ###
+	}
+
+	cons.listen = listen
+	cons.AddMainWorker(workers)
+
+	go cons.serve()
+	defer cons.listen.Close()
+
+	cons.ControlLoop()
+}
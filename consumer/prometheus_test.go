@@ -0,0 +1,224 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func newTestPrometheus(t *testing.T, streamName string, settings map[string]interface{}) (*Prometheus, *testStreamRouter) {
+	expect := ttesting.NewExpect(t)
+	router := newTestStreamRouter(streamName)
+
+	conf := core.NewPluginConfig(streamName+"Consumer", "consumer.Prometheus")
+	conf.Override("Streams", streamName)
+	for key, value := range settings {
+		conf.Override(key, value)
+	}
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+	return plugin.(*Prometheus), router
+}
+
+func appendTestProtoBytes(buffer []byte, field int, data []byte) []byte {
+	buffer = binary.AppendUvarint(buffer, uint64(field<<3|protoWireBytes))
+	buffer = binary.AppendUvarint(buffer, uint64(len(data)))
+	return append(buffer, data...)
+}
+
+func newTestRemoteWriteSeries(labels []string, values []float64, timestamp int64) []byte {
+	series := []byte{}
+	for i := 0; i < len(labels); i += 2 {
+		label := appendTestProtoBytes(nil, 1, []byte(labels[i]))
+		label = appendTestProtoBytes(label, 2, []byte(labels[i+1]))
+		series = appendTestProtoBytes(series, 1, label)
+	}
+	for i, value := range values {
+		sample := binary.AppendUvarint(nil, 1<<3|protoWireFixed64)
+		sample = binary.LittleEndian.AppendUint64(sample, math.Float64bits(value))
+		sample = binary.AppendUvarint(sample, 2<<3|protoWireVarint)
+		sample = binary.AppendUvarint(sample, uint64(timestamp+int64(i)))
+		series = appendTestProtoBytes(series, 2, sample)
+	}
+	return series
+}
+
+func newTestRemoteWriteRequest(series ...[]byte) []byte {
+	request := []byte{}
+	for _, data := range series {
+		request = appendTestProtoBytes(request, 1, data)
+	}
+	// Metadata is ignored
+	return appendTestProtoBytes(request, 3, []byte{0x08, 0x01})
+}
+
+func postTestRemoteWrite(cons *Prometheus, body []byte) int {
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(snappy.Encode(nil, body)))
+	req.Header.Set("Content-Encoding", "snappy")
+	resp := httptest.NewRecorder()
+	cons.requestHandler(resp, req)
+	return resp.Code
+}
+
+func TestPrometheusRemoteWrite(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons, router := newTestPrometheus(t, "prometheusTestRemoteWrite", nil)
+
+	body := newTestRemoteWriteRequest(
+		newTestRemoteWriteSeries([]string{"__name__", "up", "job", "node"}, []float64{1, math.Float64frombits(prometheusStaleNaN)}, 1700000000000),
+		newTestRemoteWriteSeries([]string{"__name__", "temp", "room", "a"}, []float64{math.Inf(1), 21.5}, 1700000000000),
+	)
+	expect.Equal(http.StatusNoContent, postTestRemoteWrite(cons, body))
+
+	expect.Equal([]string{
+		`{"name":"up","labels":{"job":"node"},"value":"1","timestamp":1700000000000}`,
+		`{"name":"temp","labels":{"room":"a"},"value":"+Inf","timestamp":1700000000000}`,
+		`{"name":"temp","labels":{"room":"a"},"value":"21.5","timestamp":1700000000001}`,
+	}, router.payloads())
+
+	messages := router.getMessages()
+	expect.Equal("up", messages[0].GetMetadata().GetValueString("__name__"))
+	expect.Equal("node", messages[0].GetMetadata().GetValueString("job"))
+}
+
+func TestPrometheusRemoteWritePerSeries(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons, router := newTestPrometheus(t, "prometheusTestPerSeries", map[string]interface{}{"MessagePerSeries": true})
+
+	body := newTestRemoteWriteRequest(newTestRemoteWriteSeries([]string{"__name__", "up"}, []float64{1, 0}, 1000))
+	expect.Equal(http.StatusNoContent, postTestRemoteWrite(cons, body))
+	expect.Equal([]string{
+		`{"name":"up","labels":{},"samples":[{"value":"1","timestamp":1000},{"value":"0","timestamp":1001}]}`,
+	}, router.payloads())
+}
+
+func TestPrometheusRemoteWriteInvalid(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons, router := newTestPrometheus(t, "prometheusTestInvalid", map[string]interface{}{"MaxRequestSizeKB": 1})
+
+	// Nothing is enqueued if a request cannot be decoded completely
+	valid := newTestRemoteWriteSeries([]string{"__name__", "up"}, []float64{1}, 1000)
+	invalid := []byte{1<<3 | protoWireVarint, 1}
+	expect.Equal(http.StatusBadRequest, postTestRemoteWrite(cons, newTestRemoteWriteRequest(valid, invalid)))
+	expect.Equal(http.StatusBadRequest, postTestRemoteWrite(cons, valid[:len(valid)-2]))
+	expect.Equal(http.StatusRequestEntityTooLarge, postTestRemoteWrite(cons, make([]byte, 2048)))
+	expect.Equal(0, len(router.payloads()))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(valid))
+	resp := httptest.NewRecorder()
+	cons.requestHandler(resp, req)
+	expect.Equal(http.StatusBadRequest, resp.Code)
+
+	resp = httptest.NewRecorder()
+	cons.requestHandler(resp, httptest.NewRequest(http.MethodGet, "/api/v1/write", nil))
+	expect.Equal(http.StatusMethodNotAllowed, resp.Code)
+}
+
+const prometheusTestExposition = `# HELP http_requests_total Number of requests.
+# TYPE http_requests_total counter
+http_requests_total{code="200",method="get"} 1027 1700000000000
+http_requests_total{code="500",method="get",instance="other"} 3 1700000000000
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 5 1700000000000
+latency_seconds_bucket{le="+Inf"} 7 1700000000000
+latency_seconds_sum 1.5 1700000000000
+latency_seconds_count 7 1700000000000
+`
+
+func TestPrometheusScrapeTextFormat(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/metrics" {
+			http.NotFound(resp, req)
+			return
+		}
+		resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		resp.Write([]byte(prometheusTestExposition))
+	}))
+	defer server.Close()
+
+	cons, router := newTestPrometheus(t, "prometheusTestScrape", map[string]interface{}{
+		"Mode":    "scrape",
+		"Job":     "test",
+		"Targets": []string{server.URL + "/metrics"},
+	})
+
+	target, _ := url.Parse(server.URL + "/metrics")
+	expect.NoError(cons.scrapeTarget(target))
+
+	payloads := router.payloads()
+	sort.Strings(payloads)
+	expect.Equal([]string{
+		`{"name":"http_requests_total","labels":{"code":"200","instance":"` + target.Host + `","job":"test","method":"get"},"value":"1027","timestamp":1700000000000}`,
+		`{"name":"http_requests_total","labels":{"code":"500","instance":"other","job":"test","method":"get"},"value":"3","timestamp":1700000000000}`,
+		`{"name":"latency_seconds_bucket","labels":{"instance":"` + target.Host + `","job":"test","le":"+Inf"},"value":"7","timestamp":1700000000000}`,
+		`{"name":"latency_seconds_bucket","labels":{"instance":"` + target.Host + `","job":"test","le":"0.1"},"value":"5","timestamp":1700000000000}`,
+		`{"name":"latency_seconds_count","labels":{"instance":"` + target.Host + `","job":"test"},"value":"7","timestamp":1700000000000}`,
+		`{"name":"latency_seconds_sum","labels":{"instance":"` + target.Host + `","job":"test"},"value":"1.5","timestamp":1700000000000}`,
+	}, payloads)
+
+	target, _ = url.Parse(server.URL + "/missing")
+	expect.NotNil(cons.scrapeTarget(target))
+}
+
+func TestPrometheusScrapeWorker(t *testing.T) {
+	cons, _ := newTestPrometheus(t, "prometheusTestScrapeWorker", map[string]interface{}{
+		"Mode":              "scrape",
+		"Targets":           []string{"http://127.0.0.1:1/metrics"},
+		"ScrapeIntervalSec": 3600,
+	})
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+	for cons.GetState() != core.PluginStateActive {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The scrape loop has to be registered as worker so that a shutdown waits
+	// for it to finish.
+	stopped := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		t.Error("Scrape mode did not register a worker")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cons.Control() <- core.PluginControlStopConsumer
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Error("Scrape worker did not stop")
+	}
+}
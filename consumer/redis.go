@@ -0,0 +1,456 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo"
+	"github.com/trivago/tgo/tnet"
+)
+
+// Redis consumer plugin
+//
+// This consumer reads messages from a redis server. Lists are read with
+// BLPOP, or with BRPOPLPUSH if a processing list is configured. Channels are
+// read with SUBSCRIBE or PSUBSCRIBE and streams are read by a consumer group
+// with XREADGROUP. Stream entries are acknowledged with XACK after they have
+// been passed to the streams of this consumer. As producers work
+// asynchronously, entries may be acknowledged before they have been written,
+// so entries are delivered at most once if Gollum fails.
+//
+// Metadata
+//
+// *NOTE: The metadata will only set if the parameter `SetMetadata` is active.*
+//
+// - key: The list key the message was read from (list only)
+//
+// - channel: The channel the message was published to (pubsub only)
+//
+// - pattern: The pattern that matched the channel (pubsub with UsePatterns
+// only)
+//
+// - stream: The stream key the entry was read from (stream only)
+//
+// - id: The id of the stream entry (stream only)
+//
+// All fields of a stream entry except StreamField are stored as metadata,
+// too.
+//
+// Parameters
+//
+// - Address: Stores the identifier to connect to.
+// This can either be any ip address and port like "localhost:6379" or a file
+// like "unix:///var/redis.socket".
+// By default this parameter is set to ":6379".
+//
+// - Password: Defines the password used for authentication.
+// By default this parameter is set to "".
+//
+// - Database: Defines the redis database to connect to.
+// By default this parameter is set to "0".
+//
+// - Storage: Defines the type of storage to read from. Valid values are
+// "list", "pubsub" and "stream".
+// By default this parameter is set to "list".
+//
+// - Keys: Defines the list keys, channels or stream keys to read from.
+// By default this parameter is set to ["default"].
+//
+// - ProcessingList: Defines a list that messages are atomically moved to
+// while they are processed (list only). Messages are removed from this list
+// after they have been passed to the streams of this consumer. Messages left
+// in this list, e.g. after a crash, are read first on startup. If set, only
+// one key can be read. Note that BRPOPLPUSH reads from the tail of a list, so
+// writers should use LPUSH to keep the order of messages.
+// By default this parameter is set to "".
+//
+// - UsePatterns: When set to true, Keys are treated as patterns and
+// PSUBSCRIBE is used (pubsub only).
+// By default this parameter is set to "false".
+//
+// - Group: Defines the consumer group used to read streams. The group is
+// created if it does not exist.
+// By default this parameter is set to "gollum".
+//
+// - Consumer: Defines the name of this consumer within the consumer group.
+// If empty, "gollum-" followed by the plugin id is used.
+// By default this parameter is set to "".
+//
+// - GroupStartID: Defines the stream id a newly created consumer group starts
+// reading from. Use "$" to only read new entries.
+// By default this parameter is set to "0".
+//
+// - StreamField: Defines the field of a stream entry that is used as payload.
+// By default this parameter is set to "message".
+//
+// - BatchSize: Defines the maximum number of stream entries read at once.
+// By default this parameter is set to "256".
+//
+// - ReadTimeoutSec: Defines the number of seconds to block while waiting for
+// data. This setting affects the maximum shutdown duration of this consumer.
+// By default this parameter is set to "2".
+//
+// - SetMetadata: When set to true, keys, channels and stream information are
+// stored as metadata.
+// By default this parameter is set to "true".
+//
+// Examples
+//
+// This example reads a reliable queue written with LPUSH.
+//
+//  RedisQueue:
+//    Type: consumer.Redis
+//    Streams: "jobs"
+//    Address: "redis:6379"
+//    Keys: ["jobs"]
+//    ProcessingList: "jobs:processing"
+//
+// This example reads all channels starting with "logs.".
+//
+//  RedisPubSub:
+//    Type: consumer.Redis
+//    Streams: "logs"
+//    Storage: "pubsub"
+//    Keys: ["logs.*"]
+//    UsePatterns: true
+//
+// This example reads a stream as member of the consumer group "gollum".
+//
+//  RedisStream:
+//    Type: consumer.Redis
+//    Streams: "events"
+//    Storage: "stream"
+//    Keys: ["events"]
+//    Group: "gollum"
+//
+type Redis struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+	password            string        `config:"Password"`
+	database            int           `config:"Database" default:"0"`
+	processingList      string        `config:"ProcessingList"`
+	usePatterns         bool          `config:"UsePatterns" default:"false"`
+	group               string        `config:"Group" default:"gollum"`
+	consumer            string        `config:"Consumer"`
+	groupStartID        string        `config:"GroupStartID" default:"0"`
+	streamField         string        `config:"StreamField" default:"message"`
+	batchSize           int           `config:"BatchSize" default:"256"`
+	readTimeout         time.Duration `config:"ReadTimeoutSec" default:"2" metric:"sec"`
+	withMetadata        bool          `config:"SetMetadata" default:"true"`
+	address             string
+	protocol            string
+	keys                []string
+	client              *redis.Client
+	read                func()
+}
+
+func init() {
+	core.TypeRegistry.Register(Redis{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Redis) Configure(conf core.PluginConfigReader) {
+	cons.protocol, cons.address = tnet.ParseAddress(conf.GetString("Address", ":6379"), "tcp")
+	cons.keys = conf.GetStringArray("Keys", []string{"default"})
+	if len(cons.keys) == 0 {
+		conf.Errors.Pushf("At least one key is required")
+	}
+
+	if cons.consumer == "" {
+		cons.consumer = "gollum-" + conf.GetID()
+	}
+	if cons.batchSize <= 0 {
+		conf.Errors.Pushf("BatchSize must be greater than 0")
+	}
+
+	switch strings.ToLower(conf.GetString("Storage", "list")) {
+	case "list":
+		if cons.processingList != "" {
+			if len(cons.keys) > 1 {
+				conf.Errors.Pushf("Only one key can be read when ProcessingList is set")
+			}
+			cons.read = cons.readReliableList
+		} else {
+			cons.read = cons.readList
+		}
+	case "pubsub":
+		cons.read = cons.readPubSub
+	case "stream":
+		cons.read = cons.readStreams
+	default:
+		conf.Errors.Pushf("Unknown Storage %s", conf.GetString("Storage", "list"))
+	}
+}
+
+// waitWhileBlocked pauses reading as long as all streams are blocked. It
+// returns false if the consumer has been stopped while waiting.
+func (cons *Redis) waitWhileBlocked() bool {
+	for cons.IsStreamBlocked(core.InvalidStreamID) {
+		if !cons.IsActive() {
+			return false // ### return, stopped ###
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return cons.IsActive()
+}
+
+// handleError logs a redis error and waits before the next request.
+func (cons *Redis) handleError(err error, context string) {
+	if !cons.IsActive() {
+		return // ### return, errors during shutdown are expected ###
+	}
+	cons.Logger.WithError(err).Error(context)
+	time.Sleep(cons.readTimeout)
+}
+
+func (cons *Redis) enqueueListItem(key, value string) {
+	if !cons.withMetadata {
+		cons.Enqueue([]byte(value))
+		return // ### return, no metadata ###
+	}
+
+	metadata := core.Metadata{}
+	metadata.SetValue("key", []byte(key))
+	cons.EnqueueWithMetadata([]byte(value), metadata)
+}
+
+// readList reads from all lists using BLPOP.
+func (cons *Redis) readList() {
+	for cons.waitWhileBlocked() {
+		result, err := cons.client.BLPop(cons.readTimeout, cons.keys...).Result()
+		switch {
+		case err == redis.Nil:
+			continue // ### continue, timeout ###
+		case err != nil:
+			cons.handleError(err, "Failed to read from list")
+		default:
+			cons.enqueueListItem(result[0], result[1])
+		}
+	}
+}
+
+// processItem passes an item of the processing list to the streams and
+// removes it from the processing list afterwards.
+func (cons *Redis) processItem(value string) {
+	cons.enqueueListItem(cons.keys[0], value)
+	if err := cons.client.LRem(cons.processingList, -1, value).Err(); err != nil {
+		cons.Logger.WithError(err).Warningf("Failed to remove message from %s", cons.processingList)
+	}
+}
+
+// readReliableList moves items to the processing list using BRPOPLPUSH.
+func (cons *Redis) readReliableList() {
+	// Items left from a previous run have not been processed
+	pending, err := cons.client.LRange(cons.processingList, 0, -1).Result()
+	if err != nil {
+		cons.Logger.WithError(err).Errorf("Failed to read %s", cons.processingList)
+	}
+	for idx := len(pending) - 1; idx >= 0 && cons.waitWhileBlocked(); idx-- {
+		cons.processItem(pending[idx])
+	}
+
+	for cons.waitWhileBlocked() {
+		value, err := cons.client.BRPopLPush(cons.keys[0], cons.processingList, cons.readTimeout).Result()
+		switch {
+		case err == redis.Nil:
+			continue // ### continue, timeout ###
+		case err != nil:
+			cons.handleError(err, "Failed to read from list")
+		default:
+			cons.processItem(value)
+		}
+	}
+}
+
+// readPubSub subscribes to all channels or patterns.
+func (cons *Redis) readPubSub() {
+	var pubSub *redis.PubSub
+	if cons.usePatterns {
+		pubSub = cons.client.PSubscribe(cons.keys...)
+	} else {
+		pubSub = cons.client.Subscribe(cons.keys...)
+	}
+	defer pubSub.Close()
+
+	for cons.IsActive() {
+		message, err := pubSub.ReceiveTimeout(cons.readTimeout)
+		if err != nil {
+			if netErr, isNetErr := err.(net.Error); !isNetErr || !netErr.Timeout() {
+				cons.handleError(err, "Failed to receive from channel")
+			}
+			continue
+		}
+
+		switch msg := message.(type) {
+		case *redis.Message:
+			if !cons.withMetadata {
+				cons.Enqueue([]byte(msg.Payload))
+				continue
+			}
+
+			metadata := core.Metadata{}
+			metadata.SetValue("channel", []byte(msg.Channel))
+			if msg.Pattern != "" {
+				metadata.SetValue("pattern", []byte(msg.Pattern))
+			}
+			cons.EnqueueWithMetadata([]byte(msg.Payload), metadata)
+
+		case *redis.Subscription:
+			cons.Logger.Debugf("%s %s", msg.Kind, msg.Channel)
+		}
+	}
+}
+
+// createGroups creates the consumer group on all streams. Streams that do
+// not exist are created, too.
+func (cons *Redis) createGroups() error {
+	for _, stream := range cons.keys {
+		err := cons.client.Do("xgroup", "create", stream, cons.group, cons.groupStartID, "mkstream").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return fmt.Errorf("failed to create group %s on %s: %s", cons.group, stream, err.Error())
+		}
+	}
+	return nil
+}
+
+func (cons *Redis) enqueueStreamEntry(stream string, entry redis.XMessage) {
+	payload := []byte(fmt.Sprint(entry.Values[cons.streamField]))
+	if !cons.withMetadata {
+		cons.Enqueue(payload)
+		return // ### return, no metadata ###
+	}
+
+	metadata := core.Metadata{}
+	for field, value := range entry.Values {
+		if field != cons.streamField {
+			metadata.SetValue(field, []byte(fmt.Sprint(value)))
+		}
+	}
+	metadata.SetValue("stream", []byte(stream))
+	metadata.SetValue("id", []byte(entry.ID))
+	cons.EnqueueWithMetadata(payload, metadata)
+}
+
+// readStreamGroup reads all streams starting at the given id and acknowledges
+// all entries read. Entries are acknowledged as soon as they have been
+// enqueued, not when a producer has written them. Entries that are lost
+// after this point are not redelivered, i.e. delivery is at-most-once.
+// It returns the number of entries read.
+func (cons *Redis) readStreamGroup(id string) (int, error) {
+	streams := make([]string, 0, len(cons.keys)*2)
+	streams = append(streams, cons.keys...)
+	for range cons.keys {
+		streams = append(streams, id)
+	}
+
+	results, err := cons.client.XReadGroup(&redis.XReadGroupArgs{
+		Group:    cons.group,
+		Consumer: cons.consumer,
+		Streams:  streams,
+		Count:    int64(cons.batchSize),
+		Block:    cons.readTimeout,
+	}).Result()
+
+	if err == redis.Nil {
+		return 0, nil // ### return, timeout ###
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	numRead := 0
+	for _, result := range results {
+		if len(result.Messages) == 0 {
+			continue
+		}
+
+		ids := make([]string, 0, len(result.Messages))
+		for _, entry := range result.Messages {
+			cons.enqueueStreamEntry(result.Stream, entry)
+			ids = append(ids, entry.ID)
+		}
+		if err := cons.client.XAck(result.Stream, cons.group, ids...).Err(); err != nil {
+			cons.Logger.WithError(err).Warningf("Failed to acknowledge entries of %s", result.Stream)
+		}
+		numRead += len(ids)
+	}
+	return numRead, nil
+}
+
+// readStreams reads all streams using a consumer group.
+func (cons *Redis) readStreams() {
+	for cons.IsActive() {
+		if err := cons.createGroups(); err == nil {
+			break
+		} else {
+			cons.handleError(err, "Failed to prepare streams")
+		}
+	}
+
+	// Entries delivered to this consumer but not acknowledged are read first
+	for cons.waitWhileBlocked() {
+		numRead, err := cons.readStreamGroup("0")
+		if err != nil {
+			cons.handleError(err, "Failed to read pending entries")
+			continue
+		}
+		if numRead == 0 {
+			break
+		}
+	}
+
+	for cons.waitWhileBlocked() {
+		if _, err := cons.readStreamGroup(">"); err != nil {
+			cons.handleError(err, "Failed to read from stream")
+		}
+	}
+}
+
+func (cons *Redis) consume() {
+	defer cons.WorkerDone()
+	cons.read()
+}
+
+func (cons *Redis) close() {
+	cons.client.Close()
+}
+
+// Consume connects to redis and starts reading.
+func (cons *Redis) Consume(workers *sync.WaitGroup) {
+	cons.client = redis.NewClient(&redis.Options{
+		Addr:     cons.address,
+		Network:  cons.protocol,
+		Password: cons.password,
+		DB:       cons.database,
+		// Blocking reads must not run into the socket timeout
+		ReadTimeout: cons.readTimeout + 3*time.Second,
+	})
+
+	if _, err := cons.client.Ping().Result(); err != nil {
+		cons.Logger.Error("Redis: ", err)
+	}
+
+	cons.AddMainWorker(workers)
+	go tgo.WithRecoverShutdown(cons.consume)
+
+	cons.SetStopCallback(cons.close)
+	cons.ControlLoop()
+}
@@ -0,0 +1,319 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+// redisTestServer is a minimal RESP server. Each command is answered by the
+// handler registered for it, unknown commands return an error.
+type redisTestServer struct {
+	listener net.Listener
+	guard    sync.Mutex
+	handlers map[string]func(args []string) string
+	commands []string
+}
+
+func newRedisTestServer(t *testing.T, handlers map[string]func(args []string) string) *redisTestServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &redisTestServer{
+		listener: listener,
+		handlers: handlers,
+	}
+	go server.accept()
+	return server
+}
+
+func (server *redisTestServer) accept() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		go server.serve(conn)
+	}
+}
+
+func (server *redisTestServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readRedisTestCommand(reader)
+		if err != nil {
+			return
+		}
+
+		command := strings.ToUpper(args[0])
+		args[0] = command
+		server.guard.Lock()
+		server.commands = append(server.commands, strings.Join(args, " "))
+		handler, exists := server.handlers[command]
+		server.guard.Unlock()
+
+		reply := "-ERR unknown command " + command + "\r\n"
+		if exists {
+			reply = handler(args[1:])
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (server *redisTestServer) getCommands(prefix string) []string {
+	server.guard.Lock()
+	defer server.guard.Unlock()
+
+	commands := []string{}
+	for _, command := range server.commands {
+		if strings.HasPrefix(command, prefix) {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+// waitForCommands waits until the given number of commands starting with
+// prefix has been received and returns them.
+func (server *redisTestServer) waitForCommands(prefix string, count int) []string {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		if len(server.getCommands(prefix)) >= count {
+			break
+		}
+	}
+	return server.getCommands(prefix)
+}
+
+func readRedisTestCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, count)
+	for i := range args {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(line, "\r\n")
+	}
+	return args, nil
+}
+
+func redisTestBulk(value string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+}
+
+func redisTestArray(values ...string) string {
+	return fmt.Sprintf("*%d\r\n%s", len(values), strings.Join(values, ""))
+}
+
+func redisTestBulkArray(values ...string) string {
+	bulks := make([]string, len(values))
+	for i, value := range values {
+		bulks[i] = redisTestBulk(value)
+	}
+	return redisTestArray(bulks...)
+}
+
+// redisTestPop returns the next value of the given list or "" while blocking
+// for a short time, as a blocking command would time out.
+func redisTestPop(guard *sync.Mutex, values *[]string) string {
+	guard.Lock()
+	defer guard.Unlock()
+	if len(*values) == 0 {
+		time.Sleep(10 * time.Millisecond)
+		return ""
+	}
+	value := (*values)[0]
+	*values = (*values)[1:]
+	return value
+}
+
+func newTestRedis(t *testing.T, streamName string, server *redisTestServer, settings map[string]interface{}) (*Redis, *testStreamRouter) {
+	expect := ttesting.NewExpect(t)
+	router := newTestStreamRouter(streamName)
+
+	conf := core.NewPluginConfig(streamName+"Consumer", "consumer.Redis")
+	conf.Override("Streams", streamName)
+	conf.Override("Address", server.listener.Addr().String())
+	conf.Override("ReadTimeoutSec", 1)
+	for key, value := range settings {
+		conf.Override(key, value)
+	}
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+	return plugin.(*Redis), router
+}
+
+func TestRedisList(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	guard := new(sync.Mutex)
+	items := []string{"a", "b"}
+	server := newRedisTestServer(t, map[string]func([]string) string{
+		"PING": func([]string) string { return "+PONG\r\n" },
+		"BLPOP": func(args []string) string {
+			if item := redisTestPop(guard, &items); item != "" {
+				return redisTestBulkArray(args[0], item)
+			}
+			return "*-1\r\n"
+		},
+	})
+	defer server.listener.Close()
+
+	cons, router := newTestRedis(t, "redisTestList", server, map[string]interface{}{
+		"Keys": []string{"jobs", "other"},
+	})
+	stop := startTestConsumer(t, cons)
+	payloads := router.waitForPayloads(2)
+	stop()
+
+	expect.Equal([]string{"a", "b"}, payloads)
+	expect.Equal("jobs", router.getMessages()[0].GetMetadata().GetValueString("key"))
+	expect.True(len(server.getCommands("BLPOP jobs other 1")) >= 2)
+}
+
+func TestRedisReliableList(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	guard := new(sync.Mutex)
+	items := []string{"new"}
+	server := newRedisTestServer(t, map[string]func([]string) string{
+		"PING":   func([]string) string { return "+PONG\r\n" },
+		"LRANGE": func([]string) string { return redisTestBulkArray("pending2", "pending1") },
+		"LREM":   func([]string) string { return ":1\r\n" },
+		"BRPOPLPUSH": func([]string) string {
+			if item := redisTestPop(guard, &items); item != "" {
+				return redisTestBulk(item)
+			}
+			return "$-1\r\n"
+		},
+	})
+	defer server.listener.Close()
+
+	cons, router := newTestRedis(t, "redisTestReliableList", server, map[string]interface{}{
+		"Keys":           []string{"jobs"},
+		"ProcessingList": "jobs:processing",
+	})
+	stop := startTestConsumer(t, cons)
+	payloads := router.waitForPayloads(3)
+	removed := server.waitForCommands("LREM", 3)
+	stop()
+
+	// Items left in the processing list are read first, oldest first
+	expect.Equal([]string{"pending1", "pending2", "new"}, payloads)
+	expect.Equal([]string{
+		"LREM jobs:processing -1 pending1",
+		"LREM jobs:processing -1 pending2",
+		"LREM jobs:processing -1 new",
+	}, removed)
+}
+
+func TestRedisPubSub(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	server := newRedisTestServer(t, map[string]func([]string) string{
+		"PING": func([]string) string { return "+PONG\r\n" },
+		"PSUBSCRIBE": func(args []string) string {
+			return redisTestArray(redisTestBulk("psubscribe"), redisTestBulk(args[0]), ":1\r\n") +
+				redisTestBulkArray("pmessage", args[0], "logs.web", "hello")
+		},
+	})
+	defer server.listener.Close()
+
+	cons, router := newTestRedis(t, "redisTestPubSub", server, map[string]interface{}{
+		"Storage":     "pubsub",
+		"Keys":        []string{"logs.*"},
+		"UsePatterns": true,
+	})
+	stop := startTestConsumer(t, cons)
+	payloads := router.waitForPayloads(1)
+	stop()
+
+	expect.Equal([]string{"hello"}, payloads)
+	metadata := router.getMessages()[0].GetMetadata()
+	expect.Equal("logs.web", metadata.GetValueString("channel"))
+	expect.Equal("logs.*", metadata.GetValueString("pattern"))
+}
+
+func TestRedisStream(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	guard := new(sync.Mutex)
+	entries := []string{"1-0", "2-0"}
+	server := newRedisTestServer(t, map[string]func([]string) string{
+		"PING":   func([]string) string { return "+PONG\r\n" },
+		"XGROUP": func([]string) string { return "-BUSYGROUP Consumer Group name already exists\r\n" },
+		"XACK":   func(args []string) string { return fmt.Sprintf(":%d\r\n", len(args)-2) },
+		"XREADGROUP": func(args []string) string {
+			if args[len(args)-1] == "0" {
+				// No pending entries
+				return redisTestArray(redisTestArray(redisTestBulk("events"), "*0\r\n"))
+			}
+			id := redisTestPop(guard, &entries)
+			if id == "" {
+				return "*-1\r\n"
+			}
+			entry := redisTestArray(redisTestBulk(id), redisTestBulkArray("message", "payload "+id, "host", "web01"))
+			return redisTestArray(redisTestArray(redisTestBulk("events"), redisTestArray(entry)))
+		},
+	})
+	defer server.listener.Close()
+
+	cons, router := newTestRedis(t, "redisTestStream", server, map[string]interface{}{
+		"Storage":  "stream",
+		"Keys":     []string{"events"},
+		"Consumer": "test",
+	})
+	stop := startTestConsumer(t, cons)
+	payloads := router.waitForPayloads(2)
+	acked := server.waitForCommands("XACK", 2)
+	stop()
+
+	expect.Equal([]string{"payload 1-0", "payload 2-0"}, payloads)
+	metadata := router.getMessages()[0].GetMetadata()
+	expect.Equal("events", metadata.GetValueString("stream"))
+	expect.Equal("1-0", metadata.GetValueString("id"))
+	expect.Equal("web01", metadata.GetValueString("host"))
+
+	expect.Equal([]string{"XACK events gollum 1-0", "XACK events gollum 2-0"}, acked)
+	expect.Equal(1, len(server.getCommands("XREADGROUP group gollum test count 256 block 1000 streams events 0")))
+}
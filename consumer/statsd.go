@@ -0,0 +1,617 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo"
+	"github.com/trivago/tgo/tnet"
+)
+
+const (
+	statsdMaxPacketSize = 65536
+	statsdCounter       = "counter"
+	statsdGauge         = "gauge"
+	statsdTimer         = "timer"
+	statsdHistogram     = "histogram"
+	statsdDistribution  = "distribution"
+	statsdSet           = "set"
+)
+
+// Statsd consumer plugin
+//
+// This consumer receives metrics using the statsd line protocol, including
+// the DogStatsD extensions for tags. Counters, gauges, timers, histograms,
+// distributions and sets are aggregated over a flush interval. After each
+// interval one message is generated per metric and tag combination. The
+// message is a JSON object containing only string values, so that it can be
+// passed to format.JSONToInflux10 directly.
+//
+// Each message contains the fields defined by MeasurementField and TimeField,
+// a field "type" and the aggregated values:
+//
+// - counter: "value" (sum of all increments, corrected by sample rate) and
+// "rate" (value per second)
+//
+// - gauge: "value" (last value). Values prefixed by "+" or "-" modify the
+// last known value of the gauge.
+//
+// - timer, histogram, distribution: "count", "sum", "min", "max", "mean",
+// "median", "stddev" and one field per percentile, e.g. "p90" or "p99_9"
+//
+// - set: "value" (number of unique values)
+//
+// DogStatsD tags are added as fields, too. Tags without a value are set to
+// "true". Tags named like one of the fields above are prefixed with "tag_".
+// Only metrics that were received during a flush interval are sent.
+// DogStatsD events and service checks are ignored.
+//
+// Metadata
+//
+// *NOTE: The metadata will only set if the parameter `SetMetadata` is active.*
+//
+// - metric: The name of the metric
+//
+// - type: The type of the metric, e.g. "counter"
+//
+// - <tag>: All DogStatsD tags of the metric
+//
+// Parameters
+//
+// - Address: Defines the protocol, host and port to bind to. Valid protocols
+// are "udp" and "tcp". TCP connections have to send newline separated lines.
+// By default this parameter is set to "udp://0.0.0.0:8125".
+//
+// - ReadTimeoutSec: Defines the number of seconds to wait for data to be
+// received. This setting affects the maximum shutdown duration of this
+// consumer.
+// By default this parameter is set to "2".
+//
+// - FlushIntervalSec: Defines the number of seconds over which metrics are
+// aggregated.
+// By default this parameter is set to "10".
+//
+// - GaugeTimeoutSec: Defines the number of seconds after which the last known
+// value of a gauge is discarded if the gauge has not been updated. Relative
+// updates of a discarded gauge start at 0. If set to 0, values are never
+// discarded.
+// By default this parameter is set to "3600".
+//
+// - Percentiles: Defines the percentiles to calculate for timers, histograms
+// and distributions.
+// By default this parameter is set to ["90"].
+//
+// - MeasurementField: Defines the field holding the name of the metric.
+// By default this parameter is set to "measurement".
+//
+// - TimeField: Defines the field holding the end of the flush interval as unix
+// timestamp in seconds.
+// By default this parameter is set to "time".
+//
+// - SetMetadata: When set to true, the metric name, type and tags are stored
+// as metadata.
+// By default this parameter is set to "false".
+//
+// Examples
+//
+// This example replaces a statsd daemon that writes to InfluxDB. All tags
+// that should become InfluxDB tags have to be listed in the formatter.
+//
+//  StatsdIn:
+//    Type: consumer.Statsd
+//    Streams: "metrics"
+//    Address: "udp://0.0.0.0:8125"
+//    FlushIntervalSec: 10
+//    Percentiles: [90, 99]
+//    Modulators:
+//      - format.JSONToInflux10:
+//        Tags: ["type", "host", "env"]
+//
+//  InfluxOut:
+//    Type: producer.InfluxDB
+//    Streams: "metrics"
+//    Host: "influxdb:8086"
+//    Database: "statsd"
+//
+type Statsd struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+	protocol            string
+	address             string
+	readTimeout         time.Duration `config:"ReadTimeoutSec" default:"2" metric:"sec"`
+	flushInterval       time.Duration `config:"FlushIntervalSec" default:"10" metric:"sec"`
+	gaugeTimeout        time.Duration `config:"GaugeTimeoutSec" default:"3600" metric:"sec"`
+	measurementField    string        `config:"MeasurementField" default:"measurement"`
+	timeField           string        `config:"TimeField" default:"time"`
+	withMetadata        bool          `config:"SetMetadata" default:"false"`
+	percentiles         []float64
+	listener            io.Closer
+	clients             sync.Map
+	metricsGuard        *sync.Mutex
+	metrics             map[string]*statsdMetric
+	gauges              map[string]*statsdGaugeValue
+	lastFlush           time.Time
+}
+
+// statsdMetric holds the aggregated values of one metric and tag combination
+// for the current flush interval.
+type statsdMetric struct {
+	name   string
+	kind   string
+	tags   []string
+	count  float64
+	sum    float64
+	values []float64
+	set    map[string]struct{}
+}
+
+// statsdGaugeValue holds the last known value of a gauge.
+type statsdGaugeValue struct {
+	value      float64
+	lastUpdate time.Time
+}
+
+func init() {
+	core.TypeRegistry.Register(Statsd{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Statsd) Configure(conf core.PluginConfigReader) {
+	cons.protocol, cons.address = tnet.ParseAddress(conf.GetString("Address", "udp://0.0.0.0:8125"), "udp")
+	switch cons.protocol {
+	case "udp", "tcp":
+	default:
+		conf.Errors.Pushf("Unsupported protocol %s", cons.protocol)
+	}
+
+	for _, percentile := range conf.GetArray("Percentiles", []interface{}{90}) {
+		value, err := strconv.ParseFloat(fmt.Sprint(percentile), 64)
+		if err != nil || value <= 0 || value > 100 {
+			conf.Errors.Pushf("Invalid percentile %v", percentile)
+			continue
+		}
+		cons.percentiles = append(cons.percentiles, value)
+	}
+
+	if cons.flushInterval <= 0 {
+		conf.Errors.Pushf("FlushIntervalSec must be greater than 0")
+	}
+
+	cons.metricsGuard = new(sync.Mutex)
+	cons.metrics = make(map[string]*statsdMetric)
+	cons.gauges = make(map[string]*statsdGaugeValue)
+	cons.lastFlush = time.Now()
+}
+
+// parseStatsdTags converts DogStatsD tags into a sorted list of "key:value"
+// pairs.
+func parseStatsdTags(tagList string) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(tagList, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if !strings.Contains(tag, ":") {
+			tag += ":true"
+		}
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// processLine parses a single statsd line and adds it to the current
+// aggregation interval.
+func (cons *Statsd) processLine(line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "_e{") || strings.HasPrefix(line, "_sc|") {
+		return nil // ### return, empty line, event or service check ###
+	}
+
+	nameEnd := strings.IndexByte(line, ':')
+	if nameEnd <= 0 {
+		return fmt.Errorf("missing metric name")
+	}
+	name := line[:nameEnd]
+	parts := strings.Split(line[nameEnd+1:], "|")
+	if len(parts) < 2 || parts[0] == "" {
+		return fmt.Errorf("missing value or type")
+	}
+
+	var kind string
+	switch parts[1] {
+	case "c":
+		kind = statsdCounter
+	case "g":
+		kind = statsdGauge
+	case "ms":
+		kind = statsdTimer
+	case "h":
+		kind = statsdHistogram
+	case "d":
+		kind = statsdDistribution
+	case "s":
+		kind = statsdSet
+	default:
+		return fmt.Errorf("unknown metric type %s", parts[1])
+	}
+
+	sampleRate := 1.0
+	tags := []string{}
+	for _, option := range parts[2:] {
+		switch {
+		case strings.HasPrefix(option, "@"):
+			rate, err := strconv.ParseFloat(option[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return fmt.Errorf("invalid sample rate %s", option)
+			}
+			sampleRate = rate
+		case strings.HasPrefix(option, "#"):
+			tags = parseStatsdTags(option[1:])
+		}
+	}
+
+	// Set members are strings and may contain colons, all other types may
+	// send multiple values separated by colons.
+	values := []string{parts[0]}
+	if kind != statsdSet {
+		values = strings.Split(parts[0], ":")
+	}
+
+	numbers := make([]float64, 0, len(values))
+	if kind != statsdSet {
+		for _, value := range values {
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+				return fmt.Errorf("invalid value %s", value)
+			}
+			numbers = append(numbers, number)
+		}
+	}
+
+	key := kind + "|" + name + "|" + strings.Join(tags, ",")
+
+	cons.metricsGuard.Lock()
+	defer cons.metricsGuard.Unlock()
+
+	metric, exists := cons.metrics[key]
+	if !exists {
+		metric = &statsdMetric{
+			name: name,
+			kind: kind,
+			tags: tags,
+		}
+		cons.metrics[key] = metric
+	}
+
+	switch kind {
+	case statsdCounter:
+		for _, number := range numbers {
+			metric.sum += number / sampleRate
+		}
+
+	case statsdGauge:
+		gauge, exists := cons.gauges[key]
+		if !exists {
+			gauge = &statsdGaugeValue{}
+			cons.gauges[key] = gauge
+		}
+		for i, number := range numbers {
+			if values[i][0] == '+' || values[i][0] == '-' {
+				gauge.value += number
+			} else {
+				gauge.value = number
+			}
+		}
+		gauge.lastUpdate = time.Now()
+
+	case statsdSet:
+		if metric.set == nil {
+			metric.set = make(map[string]struct{})
+		}
+		metric.set[values[0]] = struct{}{}
+
+	default:
+		for _, number := range numbers {
+			metric.count += 1 / sampleRate
+			metric.sum += number
+			metric.values = append(metric.values, number)
+		}
+	}
+	return nil
+}
+
+func formatStatsdValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// percentileFieldName returns the field name for a given percentile, e.g.
+// "p99_9" for 99.9.
+func percentileFieldName(percentile float64) string {
+	return "p" + strings.Replace(formatStatsdValue(percentile), ".", "_", 1)
+}
+
+// getFields returns the aggregated values of a metric.
+func (cons *Statsd) getFields(metric *statsdMetric, gauge float64, interval time.Duration) map[string]string {
+	fields := make(map[string]string)
+
+	switch metric.kind {
+	case statsdCounter:
+		fields["value"] = formatStatsdValue(metric.sum)
+		fields["rate"] = formatStatsdValue(metric.sum / interval.Seconds())
+
+	case statsdGauge:
+		fields["value"] = formatStatsdValue(gauge)
+
+	case statsdSet:
+		fields["value"] = strconv.Itoa(len(metric.set))
+
+	default:
+		values := metric.values
+		sort.Float64s(values)
+		numValues := len(values)
+		mean := metric.sum / float64(numValues)
+
+		variance := 0.0
+		for _, value := range values {
+			variance += (value - mean) * (value - mean)
+		}
+
+		median := values[numValues/2]
+		if numValues%2 == 0 {
+			median = (values[numValues/2-1] + values[numValues/2]) / 2
+		}
+
+		fields["count"] = formatStatsdValue(metric.count)
+		fields["sum"] = formatStatsdValue(metric.sum)
+		fields["min"] = formatStatsdValue(values[0])
+		fields["max"] = formatStatsdValue(values[numValues-1])
+		fields["mean"] = formatStatsdValue(mean)
+		fields["median"] = formatStatsdValue(median)
+		fields["stddev"] = formatStatsdValue(math.Sqrt(variance / float64(numValues)))
+
+		// Nearest rank method
+		for _, percentile := range cons.percentiles {
+			rank := int(math.Ceil(percentile/100*float64(numValues))) - 1
+			if rank < 0 {
+				rank = 0
+			}
+			fields[percentileFieldName(percentile)] = formatStatsdValue(values[rank])
+		}
+	}
+	return fields
+}
+
+// flush sends all metrics aggregated since the last call and starts a new
+// aggregation interval.
+func (cons *Statsd) flush() {
+	cons.metricsGuard.Lock()
+	metrics := cons.metrics
+	gauges := make(map[string]float64, len(metrics))
+	for key, metric := range metrics {
+		if metric.kind == statsdGauge {
+			gauges[key] = cons.gauges[key].value
+		}
+	}
+	cons.metrics = make(map[string]*statsdMetric)
+
+	now := time.Now()
+	if cons.gaugeTimeout > 0 {
+		for key, gauge := range cons.gauges {
+			if now.Sub(gauge.lastUpdate) > cons.gaugeTimeout {
+				delete(cons.gauges, key)
+			}
+		}
+	}
+
+	interval := now.Sub(cons.lastFlush)
+	cons.lastFlush = now
+	cons.metricsGuard.Unlock()
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	keys := make([]string, 0, len(metrics))
+	for key := range metrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		metric := metrics[key]
+		fields := cons.getFields(metric, gauges[key], interval)
+		fields["type"] = metric.kind
+
+		var metadata core.Metadata
+		if cons.withMetadata {
+			metadata = core.Metadata{}
+			metadata.SetValue("metric", []byte(metric.name))
+			metadata.SetValue("type", []byte(metric.kind))
+		}
+
+		for _, tag := range metric.tags {
+			keyValue := strings.SplitN(tag, ":", 2)
+			if metadata != nil {
+				metadata.SetValue(keyValue[0], []byte(keyValue[1]))
+			}
+
+			tagName := keyValue[0]
+			if _, exists := fields[tagName]; exists || tagName == cons.measurementField || tagName == cons.timeField {
+				tagName = "tag_" + tagName
+			}
+			fields[tagName] = keyValue[1]
+		}
+
+		fields[cons.measurementField] = metric.name
+		fields[cons.timeField] = timestamp
+
+		data, err := json.Marshal(fields)
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to encode metric %s", metric.name)
+			continue
+		}
+
+		if metadata != nil {
+			cons.EnqueueWithMetadata(data, metadata)
+		} else {
+			cons.Enqueue(data)
+		}
+	}
+}
+
+func (cons *Statsd) processPacket(data []byte, remote net.Addr) {
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if err := cons.processLine(string(line)); err != nil {
+			cons.Logger.WithError(err).Warningf("Invalid statsd line from %s: %s", remote, line)
+		}
+	}
+}
+
+func (cons *Statsd) readUDP(conn *net.UDPConn) {
+	defer cons.WorkerDone()
+
+	buffer := make([]byte, statsdMaxPacketSize)
+	for cons.IsActive() {
+		conn.SetReadDeadline(time.Now().Add(cons.readTimeout))
+		size, remote, err := conn.ReadFrom(buffer)
+
+		if err != nil {
+			if netErr, isNetErr := err.(net.Error); isNetErr && netErr.Timeout() {
+				continue
+			}
+			if cons.IsActive() {
+				cons.Logger.WithError(err).Errorf("Failed to read from %s", cons.address)
+			}
+			continue
+		}
+
+		cons.processPacket(buffer[:size], remote)
+	}
+}
+
+func (cons *Statsd) listenTCP(listener net.Listener) {
+	defer cons.WorkerDone()
+
+	for cons.IsActive() {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !cons.IsActive() {
+				return // ### return, shutdown ###
+			}
+			cons.Logger.WithError(err).Errorf("Accept failed for %s", cons.address)
+			continue
+		}
+
+		cons.AddWorker()
+		cons.clients.Store(conn, true)
+		go tgo.WithRecoverShutdown(func() { cons.readTCP(conn) })
+	}
+}
+
+func (cons *Statsd) readTCP(conn net.Conn) {
+	defer func() {
+		cons.clients.Delete(conn)
+		conn.Close()
+		cons.WorkerDone()
+	}()
+
+	reader := bufio.NewReader(conn)
+	line := []byte{}
+
+	for cons.IsActive() {
+		// Time out in regular intervals so we can stop the loop on shutdown
+		conn.SetReadDeadline(time.Now().Add(cons.readTimeout))
+		data, err := reader.ReadBytes('\n')
+		line = append(line, data...)
+
+		if err != nil {
+			if netErr, isNetErr := err.(net.Error); isNetErr && netErr.Timeout() {
+				if len(line) > statsdMaxPacketSize {
+					cons.Logger.Warningf("Line from %s exceeds %d bytes", conn.RemoteAddr(), statsdMaxPacketSize)
+					return // ### return, line too long ###
+				}
+				continue
+			}
+			if len(line) > 0 {
+				cons.processPacket(line, conn.RemoteAddr())
+			}
+			if err != io.EOF && !tnet.IsDisconnectedError(err) && cons.IsActive() {
+				cons.Logger.WithError(err).Errorf("Failed to read from %s", conn.RemoteAddr())
+			}
+			return // ### return, connection closed ###
+		}
+
+		cons.processPacket(line, conn.RemoteAddr())
+		line = []byte{}
+	}
+}
+
+func (cons *Statsd) close() {
+	if cons.listener != nil {
+		cons.listener.Close()
+	}
+	cons.clients.Range(func(conn, _ interface{}) bool {
+		conn.(net.Conn).Close()
+		return true
+	})
+
+	// Send the values of the last, incomplete interval
+	cons.flush()
+}
+
+// Consume listens to a given socket.
+func (cons *Statsd) Consume(workers *sync.WaitGroup) {
+	switch cons.protocol {
+	case "udp":
+		addr, err := net.ResolveUDPAddr("udp", cons.address)
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to resolve %s", cons.address)
+			return // ### return, invalid address ###
+		}
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to listen to %s", cons.address)
+			return // ### return, could not listen ###
+		}
+		cons.listener = conn
+		cons.AddMainWorker(workers)
+		go tgo.WithRecoverShutdown(func() { cons.readUDP(conn) })
+
+	case "tcp":
+		listener, err := net.Listen("tcp", cons.address)
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to listen to %s", cons.address)
+			return // ### return, could not listen ###
+		}
+		cons.listener = listener
+		cons.AddMainWorker(workers)
+		go tgo.WithRecoverShutdown(func() { cons.listenTCP(listener) })
+	}
+
+	cons.SetStopCallback(cons.close)
+	cons.TickerControlLoop(cons.flushInterval, cons.flush)
+}
@@ -0,0 +1,162 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func newTestStatsd(t *testing.T, streamName string) (*Statsd, *testStreamRouter) {
+	expect := ttesting.NewExpect(t)
+	router := newTestStreamRouter(streamName)
+
+	conf := core.NewPluginConfig(streamName+"Consumer", "consumer.Statsd")
+	conf.Override("Streams", streamName)
+	conf.Override("Percentiles", []interface{}{50, 99.9})
+	conf.Override("SetMetadata", true)
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+	return plugin.(*Statsd), router
+}
+
+// flushTestStatsd flushes the consumer and returns the generated messages
+// as decoded JSON objects, indexed by measurement name.
+func flushTestStatsd(t *testing.T, cons *Statsd, router *testStreamRouter) map[string]map[string]string {
+	expect := ttesting.NewExpect(t)
+	cons.flush()
+
+	messages := router.getMessages()
+	router.messages = nil
+
+	metrics := make(map[string]map[string]string)
+	for _, msg := range messages {
+		fields := make(map[string]string)
+		expect.NoError(json.Unmarshal(msg.GetPayload(), &fields))
+		metrics[fields["measurement"]] = fields
+	}
+	return metrics
+}
+
+func TestStatsdProcessLine(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons, _ := newTestStatsd(t, "statsdTestProcessLine")
+
+	valid := []string{
+		"requests:1|c",
+		"requests:1|c|@0.5|#env:prod,canary",
+		"latency:10:20|ms",
+		"users:alice|s",
+		"temperature:-1.5|g",
+		"",
+		"_e{5,4}:title|text",
+		"_sc|service|0",
+	}
+	for _, line := range valid {
+		if !expect.NoError(cons.processLine(line)) {
+			t.Log(line)
+		}
+	}
+
+	invalid := []string{
+		"requests",
+		":1|c",
+		"requests:1",
+		"requests:|c",
+		"requests:1|x",
+		"requests:abc|c",
+		"requests:NaN|g",
+		"requests:1|c|@0",
+		"requests:1|c|@2",
+	}
+	for _, line := range invalid {
+		if !expect.NotNil(cons.processLine(line)) {
+			t.Log(line)
+		}
+	}
+
+	// Tags are sorted, so the order sent does not matter
+	expect.Equal([]string{"canary:true", "env:prod"}, parseStatsdTags(" env:prod, canary,"))
+	expect.NotNil(cons.metrics["counter|requests|canary:true,env:prod"])
+}
+
+func TestStatsdAggregation(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons, router := newTestStatsd(t, "statsdTestAggregation")
+
+	lines := "requests:1|c\nrequests:2|c|@0.5\n" +
+		"latency:10:40|ms\nlatency:20|ms\nlatency:30|ms|@0.5\n" +
+		"users:alice|s\nusers:bob|s\nusers:alice|s\n" +
+		"temperature:20|g\ntemperature:+5|g\ntemperature:-2|g\n" +
+		"dogs:1|c|#env:prod,value:x,measurement:y\n"
+	cons.processPacket([]byte(lines), nil)
+
+	metrics := flushTestStatsd(t, cons, router)
+	expect.Equal(5, len(metrics))
+
+	expect.Equal("counter", metrics["requests"]["type"])
+	expect.Equal("5", metrics["requests"]["value"])
+
+	latency := metrics["latency"]
+	expect.Equal("timer", latency["type"])
+	expect.Equal("5", latency["count"])
+	expect.Equal("100", latency["sum"])
+	expect.Equal("10", latency["min"])
+	expect.Equal("40", latency["max"])
+	expect.Equal("25", latency["mean"])
+	expect.Equal("25", latency["median"])
+	expect.Equal("20", latency["p50"])
+	expect.Equal("40", latency["p99_9"])
+
+	expect.Equal("2", metrics["users"]["value"])
+	expect.Equal("23", metrics["temperature"]["value"])
+
+	// DogStatsD tags are added as fields, reserved names are prefixed
+	expect.Equal("prod", metrics["dogs"]["env"])
+	expect.Equal("1", metrics["dogs"]["value"])
+	expect.Equal("x", metrics["dogs"]["tag_value"])
+	expect.Equal("y", metrics["dogs"]["tag_measurement"])
+
+	// Only metrics received during the interval are sent, gauges keep their
+	// last value for relative updates.
+	cons.processLine("temperature:+1|g")
+	metrics = flushTestStatsd(t, cons, router)
+	expect.Equal(1, len(metrics))
+	expect.Equal("24", metrics["temperature"]["value"])
+}
+
+func TestStatsdGaugeTimeout(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons, router := newTestStatsd(t, "statsdTestGaugeTimeout")
+
+	cons.processLine("temperature:20|g")
+	cons.processLine("pressure:1000|g")
+	flushTestStatsd(t, cons, router)
+	expect.Equal(2, len(cons.gauges))
+
+	// Gauges that have not been updated within GaugeTimeoutSec are removed
+	cons.gauges["gauge|temperature|"].lastUpdate = time.Now().Add(-2 * cons.gaugeTimeout)
+	flushTestStatsd(t, cons, router)
+	expect.Equal(1, len(cons.gauges))
+
+	cons.processLine("temperature:+1|g")
+	metrics := flushTestStatsd(t, cons, router)
+	expect.Equal("1", metrics["temperature"]["value"])
+}
@@ -15,8 +15,15 @@
 package consumer
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -29,40 +36,65 @@ import (
 // Syslogd consumer plugin
 //
 // The syslogd consumer creates a syslogd-compatible log server and
-// receives messages on a TCP or UDP port or a UNIX filesystem socket.
+// receives messages on a TCP, TLS or UDP port or a UNIX filesystem socket.
 //
 // Parameters
 //
 // - Address: Defines the IP address or UNIX socket to listen to.
-// This can take one of the four forms below, to listen on a TCP, UDP
+// This can take one of the five forms below, to listen on a TCP, TLS, UDP
 // or UNIX domain socket. However, see the "Format" option for details on
 // transport support by different formats.
 // * [hostname|ip]:<tcp-port>
 // * tcp://<hostname|ip>:<tcp-port>
+// * tls://<hostname|ip>:<tcp-port>
 // * udp://<hostname|ip>:<udp-port>
 // * unix://<filesystem-path>
 // By default this parameter is set to "udp://0.0.0.0:514"
 //
 // - Format: Defines which syslog standard the server will support.
-// Three standards, listed below, are currently available.  All
+// Four standards, listed below, are currently available.  All
 // standards support listening to UDP and UNIX domain sockets.
-// RFC6587 additionally supports TCP sockets. Default: "RFC6587".
+// RFC6587 additionally supports TCP sockets, RFC5425 TLS sockets.
+// RFC6587 and RFC5425 accept octet-counting framing as well as newline
+// delimited messages on stream sockets.
 // * RFC3164 (https://tools.ietf.org/html/rfc3164) - unix, udp
 // * RFC5424 (https://tools.ietf.org/html/rfc5424) - unix, udp
+// * RFC5425 (https://tools.ietf.org/html/rfc5425) - tls
 // * RFC6587 (https://tools.ietf.org/html/rfc6587) - unix, upd, tcp
 // By default this parameter is set to "RFC6587".
 //
 // - SetMetadata: When set to true, syslog based metadata will be attached to
 // the message. The metadata fields added depend on the protocol version used.
 // RFC3164 supports: tag, timestamp, hostname, priority, facility, severity.
-// RFC5424 and RFC6587 support: app_name, version, proc_id , msg_id, timestamp,
-// hostname, priority, facility, severity.
+// RFC5424, RFC5425 and RFC6587 support: app_name, version, proc_id , msg_id,
+// timestamp, hostname, priority, facility, severity. In addition each
+// parameter of the STRUCTURED-DATA part is stored as "sd.<SD-ID>.<PARAM-NAME>",
+// e.g. [origin ip="10.0.0.1"] is stored as "sd.origin.ip". If a client
+// certificate has been verified, its common name is stored as "tls_peer".
 // By default this parameter is set to "false".
 //
 // - TimestampFormat: When using SetMetadata this string denotes the go time
 // format used to convert syslog timestamps into strings.
 // By default this parameter is set to "2006-01-02T15:04:05.000 MST".
 //
+// - FallbackStream: Defines a stream to send messages to that could not be
+// parsed. The message is sent unchanged, i.e. including the syslog header.
+// If set to "", malformed messages are logged and dropped.
+// By default this parameter is set to "".
+//
+// - Certificate: Path to an X509 formatted certificate file. Required when
+// using a tls:// address.
+// By default this parameter is set to "".
+//
+// - PrivateKey: Path to an X509 formatted private key file. Required when
+// using a tls:// address.
+// By default this parameter is set to "".
+//
+// - ClientCA: Path to a PEM formatted CA bundle. If defined, clients have to
+// present a certificate signed by one of these CAs. Meaningful only in
+// conjunction with a tls:// address.
+// By default this parameter is set to "".
+//
 // Examples
 //
 // Replace the system's standard syslogd with Gollum
@@ -81,13 +113,41 @@ import (
 //    Address: "tcp://0.0.0.0:5599"
 //    Format: "RFC6587"
 //
+// Listen on a TLS socket and route malformed messages to a separate stream
+//
+//  SyslogdTLSSocketConsumer:
+//    Type: consumer.Syslogd
+//    Streams: "tls_syslog"
+//    Address: "tls://0.0.0.0:6514"
+//    Format: "RFC5425"
+//    Certificate: "/etc/gollum/syslog.crt"
+//    PrivateKey: "/etc/gollum/syslog.key"
+//    SetMetadata: true
+//    FallbackStream: "syslog_malformed"
+//
 type Syslogd struct {
 	core.SimpleConsumer `gollumdoc:"embed_type"`
 	format              format.Format // RFC3164, RFC5424 or RFC6587?
+	splitFunc           bufio.SplitFunc
 	protocol            string
 	address             string
 	withMetadata        bool   `config:"SetMetadata" default:"false"`
 	timestampFormat     string `config:"TimestampFormat" default:"2006-01-02T15:04:05.000 MST"`
+	fallbackStreamID    core.MessageStreamID
+	certificate         *tls.Config
+}
+
+// syslogFraming wraps a syslog format to replace the split function used for
+// stream sockets and to keep the raw message for error handling.
+type syslogFraming struct {
+	format.Format
+	splitFunc bufio.SplitFunc
+}
+
+// syslogRawParser adds the unparsed message as "raw" to the parsed parts.
+type syslogRawParser struct {
+	format.LogParser
+	raw []byte
 }
 
 func init() {
@@ -102,7 +162,7 @@ func (cons *Syslogd) Configure(conf core.PluginConfigReader) {
 	syslogFormat := conf.GetString("Format", "RFC6587")
 
 	switch cons.protocol {
-	case "udp", "tcp", "unix":
+	case "udp", "tcp", "tls", "unix":
 	default:
 		conf.Errors.Pushf("Unknown protocol type %s", cons.protocol) // ### return, unknown protocol ###
 	}
@@ -122,17 +182,200 @@ func (cons *Syslogd) Configure(conf core.PluginConfigReader) {
 			cons.Logger.Infof("Using '%s' instead of 'udp' for RFC5424 violates the standard", cons.protocol)
 		}
 
+	// https://tools.ietf.org/html/rfc5425
+	case "RFC5425":
+		cons.format = syslog.RFC5424
+		cons.splitFunc = splitSyslogFrames
+		if cons.protocol != "tls" {
+			cons.Logger.Infof("Using '%s' instead of 'tls' for RFC5425 violates the standard", cons.protocol)
+		}
+
 	// https://tools.ietf.org/html/rfc6587
 	case "RFC6587":
 		cons.format = syslog.RFC6587
+		cons.splitFunc = splitSyslogFrames
 
 	default:
 		conf.Errors.Pushf("Format %s is not supported", syslogFormat)
 	}
+
+	cons.fallbackStreamID = core.InvalidStreamID
+	if fallbackStream := conf.GetString("FallbackStream", ""); fallbackStream != "" {
+		cons.fallbackStreamID = core.GetStreamID(fallbackStream)
+	}
+
+	if cons.protocol == "tls" {
+		cons.configureTLS(conf)
+	}
+}
+
+func (cons *Syslogd) configureTLS(conf core.PluginConfigReader) {
+	certificateFile := conf.GetString("Certificate", "")
+	keyFile := conf.GetString("PrivateKey", "")
+
+	if certificateFile == "" || keyFile == "" {
+		conf.Errors.Pushf("Listening on tls:// requires Certificate and PrivateKey to be set")
+		return // ### return, missing certificate ###
+	}
+
+	cons.certificate = new(tls.Config)
+	keypair, err := tls.LoadX509KeyPair(certificateFile, keyFile)
+	if !conf.Errors.Push(err) {
+		cons.certificate.Certificates = []tls.Certificate{keypair}
+	}
+
+	if clientCAFile := conf.GetString("ClientCA", ""); clientCAFile != "" {
+		if caCert, err := ioutil.ReadFile(clientCAFile); !conf.Errors.Push(err) {
+			caCertPool := x509.NewCertPool()
+			if !caCertPool.AppendCertsFromPEM(caCert) {
+				conf.Errors.Pushf("No certificates found in %s", clientCAFile)
+			}
+			cons.certificate.ClientCAs = caCertPool
+			cons.certificate.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+}
+
+// GetSplitFunc returns the split function used for stream sockets.
+func (framing syslogFraming) GetSplitFunc() bufio.SplitFunc {
+	if framing.splitFunc != nil {
+		return framing.splitFunc
+	}
+	return framing.Format.GetSplitFunc()
+}
+
+// GetParser returns a parser that keeps the unparsed message.
+func (framing syslogFraming) GetParser(line []byte) format.LogParser {
+	return syslogRawParser{
+		LogParser: framing.Format.GetParser(line),
+		raw:       line,
+	}
+}
+
+// Dump returns the parsed message parts and the unparsed message as "raw".
+func (parser syslogRawParser) Dump() format.LogParts {
+	parts := parser.LogParser.Dump()
+	parts["raw"] = parser.raw
+	return parts
+}
+
+// splitSyslogFrames splits a TCP stream into syslog messages. Messages may
+// either use octet-counting ("<length> <message>") or non-transparent framing
+// (messages separated by newline) as described by RFC6587.
+func splitSyslogFrames(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	// Skip newlines between octet-counted frames
+	start := 0
+	for start < len(data) && (data[start] == '\n' || data[start] == '\r') {
+		start++
+	}
+	if start == len(data) {
+		return len(data), nil, nil
+	}
+
+	if data[start] >= '1' && data[start] <= '9' {
+		spaceIdx := bytes.IndexByte(data[start:], ' ')
+		if spaceIdx < 0 {
+			if atEOF || len(data)-start > 10 {
+				return 0, nil, fmt.Errorf("invalid octet count")
+			}
+			return start, nil, nil // ### return, request more data ###
+		}
+
+		length, err := strconv.Atoi(string(data[start : start+spaceIdx]))
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid octet count: %s", err.Error())
+		}
+
+		end := start + spaceIdx + 1 + length
+		if len(data) < end {
+			if atEOF {
+				return 0, nil, fmt.Errorf("incomplete syslog frame")
+			}
+			return start, nil, nil // ### return, request more data ###
+		}
+		return end, data[start+spaceIdx+1 : end], nil
+	}
+
+	if lfIdx := bytes.IndexByte(data[start:], '\n'); lfIdx >= 0 {
+		return start + lfIdx + 1, bytes.TrimRight(data[start:start+lfIdx], "\r"), nil
+	}
+	if atEOF {
+		return len(data), data[start:], nil
+	}
+	return start, nil, nil // ### return, request more data ###
+}
+
+// addStructuredData parses an RFC5424 STRUCTURED-DATA string and stores each
+// parameter as "sd.<SD-ID>.<PARAM-NAME>".
+func addStructuredData(metaData core.Metadata, structuredData string) {
+	const (
+		sdStateElement = iota
+		sdStateID
+		sdStateName
+		sdStateValue
+	)
+
+	var (
+		state = sdStateElement
+		sdID  string
+		start int
+		name  string
+		value []byte
+	)
+
+	for i := 0; i < len(structuredData); i++ {
+		char := structuredData[i]
+		switch state {
+		case sdStateElement:
+			if char == '[' {
+				state, start = sdStateID, i+1
+			}
+
+		case sdStateID:
+			switch char {
+			case ' ':
+				sdID, state, start = structuredData[start:i], sdStateName, i+1
+			case ']':
+				state = sdStateElement
+			}
+
+		case sdStateName:
+			switch char {
+			case ' ':
+				start = i + 1
+			case ']':
+				state = sdStateElement
+			case '=':
+				name = structuredData[start:i]
+				if i+1 >= len(structuredData) || structuredData[i+1] != '"' {
+					return // ### return, malformed parameter ###
+				}
+				state, value = sdStateValue, value[:0]
+				i++
+			}
+
+		case sdStateValue:
+			switch {
+			case char == '\\' && i+1 < len(structuredData) && strings.IndexByte("\"\\]", structuredData[i+1]) >= 0:
+				i++
+				value = append(value, structuredData[i])
+			case char == '"':
+				metaData.SetValue("sd."+sdID+"."+name, append([]byte{}, value...))
+				state, start = sdStateName, i+1
+			default:
+				value = append(value, char)
+			}
+		}
+	}
 }
 
 // Handle implements the syslog handle interface
 func (cons *Syslogd) Handle(parts format.LogParts, code int64, err error) {
+	if err != nil {
+		cons.handleMalformed(parts, err)
+		return // ### return, message could not be parsed ###
+	}
+
 	content := ""
 	isString := false
 	metaData := core.Metadata{}
@@ -182,6 +425,10 @@ func (cons *Syslogd) Handle(parts format.LogParts, code int64, err error) {
 			metaData.SetValue("priority", []byte(strconv.Itoa(priority)))
 			metaData.SetValue("facility", []byte(strconv.Itoa(facility)))
 			metaData.SetValue("severity", []byte(strconv.Itoa(severity)))
+
+			if structuredData, _ := parts["structured_data"].(string); structuredData != "-" {
+				addStructuredData(metaData, structuredData)
+			}
 		}
 
 	default:
@@ -193,6 +440,10 @@ func (cons *Syslogd) Handle(parts format.LogParts, code int64, err error) {
 		return
 	}
 
+	if tlsPeer, _ := parts["tls_peer"].(string); cons.withMetadata && tlsPeer != "" {
+		metaData.SetValue("tls_peer", []byte(tlsPeer))
+	}
+
 	if cons.withMetadata {
 		cons.EnqueueWithMetadata([]byte(content), metaData)
 	} else {
@@ -200,12 +451,36 @@ func (cons *Syslogd) Handle(parts format.LogParts, code int64, err error) {
 	}
 }
 
+// handleMalformed sends messages that could not be parsed to the fallback
+// stream. If no fallback stream is set, the message is dropped.
+func (cons *Syslogd) handleMalformed(parts format.LogParts, err error) {
+	raw, _ := parts["raw"].([]byte)
+	if cons.fallbackStreamID == core.InvalidStreamID {
+		cons.Logger.WithError(err).Warningf("Dropping malformed message: %s", string(raw))
+		return // ### return, no fallback ###
+	}
+
+	cons.Logger.WithError(err).Debug("Sending malformed message to fallback")
+	cons.EnqueueWithMetadataTo(append([]byte{}, raw...), nil, cons.fallbackStreamID)
+}
+
+// tlsPeerName returns the common name of a verified client certificate.
+// Connections without a client certificate are accepted, too.
+func tlsPeerName(tlsConn *tls.Conn) (string, bool) {
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return "", true
+	}
+	return state.PeerCertificates[0].Subject.CommonName, true
+}
+
 // Consume opens a new syslog socket.
 // Messages are expected to be separated by \n.
 func (cons *Syslogd) Consume(workers *sync.WaitGroup) {
 	server := syslog.NewServer()
-	server.SetFormat(cons.format)
+	server.SetFormat(syslogFraming{Format: cons.format, splitFunc: cons.splitFunc})
 	server.SetHandler(cons)
+	server.SetTlsPeerNameFunc(tlsPeerName)
 
 	switch cons.protocol {
 	case "unix":
@@ -229,6 +504,10 @@ func (cons *Syslogd) Consume(workers *sync.WaitGroup) {
 		if err := server.ListenTCP(cons.address); err != nil {
 			cons.Logger.Error("Failed to open tcp://", cons.address)
 		}
+	case "tls":
+		if err := server.ListenTCPTLS(cons.address, cons.certificate); err != nil {
+			cons.Logger.WithError(err).Error("Failed to open tls://", cons.address)
+		}
 	}
 
 	server.Boot()
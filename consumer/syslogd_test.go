@@ -0,0 +1,125 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestSyslogdSplitFrames(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	testCases := []struct {
+		name    string
+		data    string
+		frames  []string
+		invalid bool
+	}{
+		{"non-transparent", "<13>1 a\n<13>1 b\r\n", []string{"<13>1 a", "<13>1 b"}, false},
+		{"non-transparent at EOF", "<13>1 a\n<13>1 b", []string{"<13>1 a", "<13>1 b"}, false},
+		{"octet-counting", "7 <13>1 a7 <13>1 b", []string{"<13>1 a", "<13>1 b"}, false},
+		{"octet-counting with newlines", "8 <13>1 a\n\n7 <13>1 b\n", []string{"<13>1 a\n", "<13>1 b"}, false},
+		{"mixed framing", "7 <13>1 a<13>1 b\n", []string{"<13>1 a", "<13>1 b"}, false},
+		{"empty lines", "\n\r\n<13>1 a\n\n", []string{"<13>1 a"}, false},
+		{"incomplete frame", "20 <13>1 a", nil, true},
+		{"missing octet count separator", "12345678901<13>", nil, true},
+	}
+
+	for _, testCase := range testCases {
+		scanner := bufio.NewScanner(strings.NewReader(testCase.data))
+		scanner.Split(splitSyslogFrames)
+
+		frames := []string{}
+		for scanner.Scan() {
+			frames = append(frames, scanner.Text())
+		}
+
+		if testCase.invalid {
+			expect.NotNil(scanner.Err())
+			continue
+		}
+		expect.NoError(scanner.Err())
+		if !expect.Equal(testCase.frames, frames) {
+			t.Log(testCase.name)
+		}
+	}
+}
+
+func TestSyslogdSplitFramesPartial(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	// Incomplete frames request more data if not at EOF
+	advance, token, err := splitSyslogFrames([]byte("10 <13>1"), false)
+	expect.NoError(err)
+	expect.Equal(0, advance)
+	expect.Nil(token)
+
+	advance, token, err = splitSyslogFrames([]byte("\n<13>1 a"), false)
+	expect.NoError(err)
+	expect.Equal(1, advance)
+	expect.Nil(token)
+
+	advance, token, err = splitSyslogFrames([]byte("12"), false)
+	expect.NoError(err)
+	expect.Equal(0, advance)
+	expect.Nil(token)
+}
+
+func TestSyslogdStructuredData(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	testCases := []struct {
+		data     string
+		metadata map[string]string
+	}{
+		{`-`, map[string]string{}},
+		{`[exampleSDID@32473 iut="3" eventSource="Application"]`, map[string]string{
+			"sd.exampleSDID@32473.iut":         "3",
+			"sd.exampleSDID@32473.eventSource": "Application",
+		}},
+		{`[a x="1"][b y="2"]`, map[string]string{
+			"sd.a.x": "1",
+			"sd.b.y": "2",
+		}},
+		{`[a x="quote \" backslash \\ bracket \] other \n"]`, map[string]string{
+			"sd.a.x": `quote " backslash \ bracket ] other \n`,
+		}},
+		{`[a x="with ] and [ inside" y=""]`, map[string]string{
+			"sd.a.x": "with ] and [ inside",
+			"sd.a.y": "",
+		}},
+		{`[empty]`, map[string]string{}},
+		{`[a x="1" y=2]`, map[string]string{
+			"sd.a.x": "1",
+		}},
+	}
+
+	for _, testCase := range testCases {
+		metadata := core.Metadata{}
+		addStructuredData(metadata, testCase.data)
+
+		expect.Equal(len(testCase.metadata), len(metadata))
+		for key, value := range testCase.metadata {
+			if !expect.Equal(value, metadata.GetValueString(key)) {
+				t.Log(testCase.data)
+			}
+		}
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo"
+	"github.com/trivago/tgo/tmath"
+	"github.com/trivago/tgo/tnet"
+)
+
+// Websocket consumer plugin
+//
+// This consumer reads text and binary frames from websocket connections.
+// It can either serve an endpoint that clients push messages into, or
+// connect to a remote websocket URL as a client. Client connections are
+// re-established with an exponential backoff if they are lost. Pings are
+// sent periodically to detect broken connections.
+//
+// Metadata
+//
+// *NOTE: The metadata will only set if the parameter `SetMetadata` is active.*
+//
+// - frame: The type of the websocket frame, i.e. "text" or "binary"
+//
+// - remote_addr: The address of the client (server mode only)
+//
+// - url: The URL connected to (client mode only)
+//
+// Parameters
+//
+// - Mode: Defines whether to serve an endpoint ("server") or to connect to
+// a remote endpoint ("client").
+// By default this parameter is set to "server".
+//
+// - Address: Defines the host and port to listen on in server mode.
+// By default this parameter is set to ":81".
+//
+// - Path: Defines the url path to listen for in server mode.
+// By default this parameter is set to "/".
+//
+// - IgnoreOrigin: When set to true, the origin of clients is not checked in
+// server mode.
+// By default this parameter is set to "false".
+//
+// - URL: Defines the websocket URL to connect to in client mode. Use the
+// "wss" scheme to connect via TLS.
+// By default this parameter is set to "".
+//
+// - Headers: Defines additional HTTP headers sent when connecting in client
+// mode.
+// By default this parameter is set to an empty map.
+//
+// - ReadTimeoutSec: Defines the maximum number of seconds to wait for the
+// websocket handshake.
+// By default this parameter is set to "3".
+//
+// - PingIntervalSec: Defines the number of seconds between two pings. A
+// connection is closed if no frame or pong arrives within two intervals.
+// Set to 0 to disable pings.
+// By default this parameter is set to "30".
+//
+// - ReconnectDelaySec: Defines the number of seconds to wait before the first
+// reconnect attempt in client mode. The delay is doubled after each failed
+// attempt.
+// By default this parameter is set to "1".
+//
+// - MaxReconnectDelaySec: Defines the maximum number of seconds to wait
+// between two reconnect attempts in client mode.
+// By default this parameter is set to "60".
+//
+// - MaxMessageSizeKB: Defines the maximum size of a message in KB. Connections
+// sending larger messages are closed.
+// By default this parameter is set to "1024".
+//
+// - SetMetadata: When set to true, frame and connection information are stored
+// as metadata.
+// By default this parameter is set to "false".
+//
+// Examples
+//
+// This example accepts websocket clients on port 8080.
+//
+//  WebsocketIn:
+//    Type: consumer.Websocket
+//    Streams: "events"
+//    Address: ":8080"
+//    Path: "/events"
+//
+// This example connects to a remote websocket feed.
+//
+//  WebsocketFeed:
+//    Type: consumer.Websocket
+//    Streams: "feed"
+//    Mode: "client"
+//    URL: "wss://feed.example.com/stream"
+//    Headers:
+//      Authorization: "Bearer secret"
+//
+type Websocket struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+	address             string        `config:"Address" default:":81"`
+	path                string        `config:"Path" default:"/"`
+	ignoreOrigin        bool          `config:"IgnoreOrigin" default:"false"`
+	url                 string        `config:"URL"`
+	readTimeout         time.Duration `config:"ReadTimeoutSec" default:"3" metric:"sec"`
+	pingInterval        time.Duration `config:"PingIntervalSec" default:"30" metric:"sec"`
+	reconnectDelay      time.Duration `config:"ReconnectDelaySec" default:"1" metric:"sec"`
+	maxReconnectDelay   time.Duration `config:"MaxReconnectDelaySec" default:"60" metric:"sec"`
+	maxMessageSize      int64         `config:"MaxMessageSizeKB" default:"1024" metric:"kb"`
+	withMetadata        bool          `config:"SetMetadata" default:"false"`
+	headers             http.Header
+	upgrader            websocket.Upgrader
+	listen              *tnet.StopListener
+	clients             *sync.Map
+	stop                chan struct{}
+	clientMode          bool
+}
+
+func init() {
+	core.TypeRegistry.Register(Websocket{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Websocket) Configure(conf core.PluginConfigReader) {
+	switch strings.ToLower(conf.GetString("Mode", "server")) {
+	case "server":
+	case "client":
+		cons.clientMode = true
+		if cons.url == "" {
+			conf.Errors.Pushf("URL is required in client mode")
+		}
+	default:
+		conf.Errors.Pushf("Unknown Mode %s", conf.GetString("Mode", "server"))
+	}
+
+	cons.headers = http.Header{}
+	for key, value := range conf.GetStringMap("Headers", map[string]string{}) {
+		cons.headers.Set(key, value)
+	}
+
+	cons.upgrader = websocket.Upgrader{
+		HandshakeTimeout: cons.readTimeout,
+	}
+	if cons.ignoreOrigin {
+		cons.upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+	}
+
+	cons.clients = new(sync.Map)
+	cons.stop = make(chan struct{})
+}
+
+// keepAlive sends pings until the connection is closed or done is closed.
+// Every frame received extends the read deadline of the connection.
+func (cons *Websocket) keepAlive(conn *websocket.Conn, done chan struct{}) {
+	if cons.pingInterval <= 0 {
+		// Make sure no deadline set by the http server is left on hijacked
+		// connections, as there are no pongs to extend it.
+		conn.SetReadDeadline(time.Time{})
+		return // ### return, pings disabled ###
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * cons.pingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * cons.pingInterval))
+	})
+
+	go tgo.WithRecoverShutdown(func() {
+		ticker := time.NewTicker(cons.pingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				deadline := time.Now().Add(cons.pingInterval)
+				if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+					return
+				}
+			}
+		}
+	})
+}
+
+// read enqueues all messages of a connection until it is closed.
+func (cons *Websocket) read(conn *websocket.Conn, metadata core.Metadata) error {
+	done := make(chan struct{})
+	defer close(done)
+
+	conn.SetReadLimit(cons.maxMessageSize)
+	cons.keepAlive(conn, done)
+
+	for {
+		frameType, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if cons.pingInterval > 0 {
+			conn.SetReadDeadline(time.Now().Add(2 * cons.pingInterval))
+		}
+
+		if !cons.withMetadata {
+			cons.Enqueue(data)
+			continue
+		}
+
+		msgMetadata := metadata.Clone()
+		if frameType == websocket.BinaryMessage {
+			msgMetadata.SetValue("frame", []byte("binary"))
+		} else {
+			msgMetadata.SetValue("frame", []byte("text"))
+		}
+		cons.EnqueueWithMetadata(data, msgMetadata)
+	}
+}
+
+func (cons *Websocket) isExpectedClose(err error) bool {
+	return !cons.IsActive() || websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
+}
+
+// upgrade handles incoming client connections in server mode.
+func (cons *Websocket) upgrade(w http.ResponseWriter, r *http.Request) {
+	conn, err := cons.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		cons.Logger.WithError(err).Warning("Failed to upgrade connection")
+		return // ### return, not a websocket ###
+	}
+
+	cons.clients.Store(conn, true)
+	defer func() {
+		cons.clients.Delete(conn)
+		conn.Close()
+	}()
+
+	metadata := core.Metadata{}
+	metadata.SetValue("remote_addr", []byte(conn.RemoteAddr().String()))
+
+	if err := cons.read(conn, metadata); !cons.isExpectedClose(err) {
+		cons.Logger.WithError(err).Debugf("Connection to %s closed", conn.RemoteAddr())
+	}
+}
+
+func (cons *Websocket) serve() {
+	defer cons.WorkerDone()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(cons.path, cons.upgrade)
+
+	srv := http.Server{
+		Handler:     mux,
+		ReadTimeout: cons.readTimeout,
+	}
+
+	err := srv.Serve(cons.listen)
+	if _, isStopRequest := err.(tnet.StopRequestError); err != nil && !isStopRequest {
+		cons.Logger.Error(err)
+	}
+}
+
+// dial connects to the remote endpoint in client mode until the consumer is
+// stopped.
+func (cons *Websocket) dial() {
+	defer cons.WorkerDone()
+
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: cons.readTimeout,
+	}
+
+	metadata := core.Metadata{}
+	metadata.SetValue("url", []byte(cons.url))
+	delay := cons.reconnectDelay
+
+	for cons.IsActive() {
+		conn, _, err := dialer.Dial(cons.url, cons.headers)
+		if err == nil {
+			cons.Logger.Infof("Connected to %s", cons.url)
+			delay = cons.reconnectDelay
+
+			cons.clients.Store(conn, true)
+			err = cons.read(conn, metadata)
+			cons.clients.Delete(conn)
+			conn.Close()
+
+			if cons.isExpectedClose(err) {
+				err = nil
+			}
+		}
+
+		if !cons.IsActive() {
+			return // ### return, stopped ###
+		}
+		if err != nil {
+			cons.Logger.WithError(err).Warningf("Connection to %s failed, retrying in %s", cons.url, delay)
+		}
+
+		select {
+		case <-cons.stop:
+			return // ### return, stopped ###
+		case <-time.After(delay):
+		}
+		delay = time.Duration(tmath.MinI(int(2*delay), int(cons.maxReconnectDelay)))
+	}
+}
+
+func (cons *Websocket) close() {
+	close(cons.stop)
+	if cons.listen != nil {
+		cons.listen.Close()
+	}
+
+	cons.clients.Range(func(key, _ interface{}) bool {
+		conn := key.(*websocket.Conn)
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+			time.Now().Add(time.Second))
+		conn.Close()
+		return true
+	})
+}
+
+// Consume starts the websocket server or connects to the remote endpoint.
+func (cons *Websocket) Consume(workers *sync.WaitGroup) {
+	if cons.clientMode {
+		cons.AddMainWorker(workers)
+		go tgo.WithRecoverShutdown(cons.dial)
+	} else {
+		listen, err := tnet.NewStopListener(cons.address)
+		if err != nil {
+			cons.Logger.Error(err)
+			return // ### return, could not listen ###
+		}
+
+		cons.listen = listen
+		cons.AddMainWorker(workers)
+		go tgo.WithRecoverShutdown(cons.serve)
+	}
+
+	cons.SetStopCallback(cons.close)
+	cons.ControlLoop()
+}
@@ -0,0 +1,110 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func newTestWebsocket(t *testing.T, streamName string, settings map[string]interface{}) (*Websocket, *testStreamRouter) {
+	expect := ttesting.NewExpect(t)
+	router := newTestStreamRouter(streamName)
+
+	conf := core.NewPluginConfig(streamName+"Consumer", "consumer.Websocket")
+	conf.Override("Streams", streamName)
+	conf.Override("ReadTimeoutSec", 1)
+	conf.Override("SetMetadata", true)
+	for key, value := range settings {
+		conf.Override(key, value)
+	}
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+	return plugin.(*Websocket), router
+}
+
+func TestWebsocketServer(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons, router := newTestWebsocket(t, "websocketTestServer", map[string]interface{}{
+		"Address":         "127.0.0.1:0",
+		"Path":            "/events",
+		"PingIntervalSec": 0,
+	})
+	stop := startTestConsumer(t, cons)
+	defer stop()
+
+	url := "ws://" + cons.listen.Addr().String() + "/events"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	expect.NoError(err)
+	defer conn.Close()
+
+	expect.NoError(conn.WriteMessage(websocket.TextMessage, []byte("a")))
+
+	// Without pings the connection must stay open longer than the
+	// ReadTimeout of the http server.
+	time.Sleep(1500 * time.Millisecond)
+	expect.NoError(conn.WriteMessage(websocket.BinaryMessage, []byte("b")))
+
+	expect.Equal([]string{"a", "b"}, router.waitForPayloads(2))
+
+	messages := router.getMessages()
+	expect.Equal("text", messages[0].GetMetadata().GetValueString("frame"))
+	expect.Equal("binary", messages[1].GetMetadata().GetValueString("frame"))
+	expect.Equal(conn.LocalAddr().String(), messages[0].GetMetadata().GetValueString("remote_addr"))
+}
+
+func TestWebsocketClient(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	headers := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		headers <- req.Header.Get("Authorization")
+
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(resp, req, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		conn.ReadMessage()
+	}))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/feed"
+	cons, router := newTestWebsocket(t, "websocketTestClient", map[string]interface{}{
+		"Mode":              "client",
+		"URL":               url,
+		"Headers":           map[string]string{"Authorization": "Bearer secret"},
+		"ReconnectDelaySec": 3600,
+	})
+	stop := startTestConsumer(t, cons)
+	payloads := router.waitForPayloads(1)
+	stop()
+
+	expect.Equal([]string{"hello"}, payloads)
+	expect.Equal("Bearer secret", <-headers)
+	expect.Equal(url, router.getMessages()[0].GetMetadata().GetValueString("url"))
+}
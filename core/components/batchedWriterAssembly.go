@@ -76,6 +76,14 @@ type BatchedWriter interface {
 	IsAccessible() bool
 }
 
+// BatchedMessageWriter is an optional extension of BatchedWriter for writers
+// that store messages as records instead of a byte stream, e.g. columnar
+// file formats.
+type BatchedMessageWriter interface {
+	BatchedWriter
+	WriteMessages(messages []*core.Message) error
+}
+
 // NewBatchedWriterAssembly returns a new BatchedWriterAssembly instance
 func NewBatchedWriterAssembly(config BatchedWriterConfig, modulator core.Modulator, tryFallback func(*core.Message), logger logrus.FieldLogger) *BatchedWriterAssembly {
 	return &BatchedWriterAssembly{
@@ -114,11 +122,26 @@ func (bwa *BatchedWriterAssembly) GetWriter() BatchedWriter {
 	return bwa.writer
 }
 
+// getAssemblyFunc returns the function used to write a batch to the current
+// writer
+func (bwa *BatchedWriterAssembly) getAssemblyFunc() core.AssemblyFunc {
+	if messageWriter, isMessageWriter := bwa.writer.(BatchedMessageWriter); isMessageWriter {
+		return func(messages []*core.Message) {
+			if err := messageWriter.WriteMessages(messages); err != nil {
+				bwa.logger.WithError(err).Error("Failed to write to ", messageWriter.Name())
+				bwa.assembly.Flush(messages)
+			}
+		}
+	}
+
+	bwa.assembly.SetWriter(bwa.writer)
+	return bwa.assembly.Write
+}
+
 // Flush flush the batch
 func (bwa *BatchedWriterAssembly) Flush() {
 	if bwa.writer != nil {
-		bwa.assembly.SetWriter(bwa.writer)
-		bwa.Batch.Flush(bwa.assembly.Write)
+		bwa.Batch.Flush(bwa.getAssemblyFunc())
 	} else {
 		bwa.Batch.Flush(bwa.assembly.Flush)
 	}
@@ -127,8 +150,7 @@ func (bwa *BatchedWriterAssembly) Flush() {
 // Close closes batch and writer
 func (bwa *BatchedWriterAssembly) Close() {
 	if bwa.writer != nil {
-		bwa.assembly.SetWriter(bwa.writer)
-		bwa.Batch.Close(bwa.assembly.Write, bwa.config.BatchFlushTimeout)
+		bwa.Batch.Close(bwa.getAssemblyFunc(), bwa.config.BatchFlushTimeout)
 	} else {
 		bwa.Batch.Close(bwa.assembly.Flush, bwa.config.BatchFlushTimeout)
 	}
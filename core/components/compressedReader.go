@@ -0,0 +1,112 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// GetCompressionCodec returns the codec matching the extension of the given
+// file name, e.g. "gzip" for "events.log.gz". An empty string is returned if
+// the file is not compressed.
+func GetCompressionCodec(fileName string) string {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	for codec, codecExt := range compressionExtensions {
+		if ext == codecExt {
+			return codec
+		}
+	}
+	return ""
+}
+
+// NewDecompressionReader returns a reader decompressing data of the given
+// codec. Valid codecs are the ones supported by CompressedWriter. Data
+// consisting of multiple compressed streams, e.g. files that have been
+// appended to, is read completely. An empty codec returns the input as is.
+func NewDecompressionReader(codec string, input io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case "":
+		return ioutil.NopCloser(input), nil
+
+	case "gzip":
+		return gzip.NewReader(input)
+
+	case "zstd":
+		decoder, err := zstd.NewReader(input)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+
+	case "lz4":
+		return newLZ4FramesReader(input), nil
+
+	case "snappy":
+		return ioutil.NopCloser(snappy.NewReader(input)), nil
+
+	default:
+		return nil, fmt.Errorf("unknown compression codec %s", codec)
+	}
+}
+
+// lz4FramesReader reads all lz4 frames of a stream. Files are appended to
+// when they are reopened, so a file can contain multiple frames, which is
+// not supported by lz4.Reader.
+type lz4FramesReader struct {
+	input  *bufio.Reader
+	reader *lz4.Reader
+}
+
+func newLZ4FramesReader(input io.Reader) *lz4FramesReader {
+	bufferedInput := bufio.NewReader(input)
+	return &lz4FramesReader{
+		input:  bufferedInput,
+		reader: lz4.NewReader(bufferedInput),
+	}
+}
+
+// Read is part of the io.Reader interface
+func (r *lz4FramesReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.reader.Read(p)
+		if err != io.EOF {
+			return n, err // ### return, data or error ###
+		}
+		if _, peekErr := r.input.Peek(1); peekErr != nil {
+			return n, io.EOF // ### return, end of stream ###
+		}
+
+		// Another frame follows
+		r.reader.Reset(r.input)
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Close is part of the io.Closer interface
+func (r *lz4FramesReader) Close() error {
+	return nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// compressionEncoder is implemented by all streaming compression writers
+type compressionEncoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressionExtensions maps codec names to file extensions
+var compressionExtensions = map[string]string{
+	"gzip":   ".gz",
+	"zstd":   ".zst",
+	"lz4":    ".lz4",
+	"snappy": ".sz",
+}
+
+// newCompressionEncoder returns a streaming encoder for the given codec.
+// A level of 0 selects the default level of the codec.
+func newCompressionEncoder(codec string, level int, output io.Writer) (compressionEncoder, error) {
+	switch codec {
+	case "gzip":
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(output, level)
+
+	case "zstd":
+		options := []zstd.EOption{}
+		if level != 0 {
+			options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(output, options...)
+
+	case "lz4":
+		writer := lz4.NewWriter(output)
+		if level != 0 {
+			if level < 1 || level > 9 {
+				return nil, fmt.Errorf("lz4: invalid compression level: %d", level)
+			}
+			// Level1 to Level9 are defined as 1 << (8+n)
+			if err := writer.Apply(lz4.CompressionLevelOption(lz4.CompressionLevel(1 << uint(8+level)))); err != nil {
+				return nil, err
+			}
+		}
+		return writer, nil
+
+	case "snappy":
+		return snappy.NewBufferedWriter(output), nil
+
+	default:
+		return nil, fmt.Errorf("unknown compression codec %s", codec)
+	}
+}
+
+// CompressedWriter is a BatchedWriter implementation that compresses all data
+// while writing it to another BatchedWriter. Every write is flushed to the
+// underlying writer so that data is not held back between batches.
+type CompressedWriter struct {
+	output  BatchedWriter
+	encoder compressionEncoder
+}
+
+// NewCompressedWriter returns a CompressedWriter using the given codec and
+// compression level
+func NewCompressedWriter(output BatchedWriter, codec string, level int) (*CompressedWriter, error) {
+	encoder, err := newCompressionEncoder(codec, level, output)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CompressedWriter{
+		output:  output,
+		encoder: encoder,
+	}, nil
+}
+
+// Write is part of the BatchedWriter interface and compresses the given data
+func (w *CompressedWriter) Write(p []byte) (int, error) {
+	n, err := w.encoder.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, w.encoder.Flush()
+}
+
+// Name is part of the BatchedWriter interface and returns the name of the
+// underlying writer
+func (w *CompressedWriter) Name() string {
+	return w.output.Name()
+}
+
+// Size is part of the BatchedWriter interface and returns the number of
+// compressed bytes written to the underlying writer
+func (w *CompressedWriter) Size() int64 {
+	return w.output.Size()
+}
+
+// IsAccessible is part of the BatchedWriter interface and checks the
+// underlying writer
+func (w *CompressedWriter) IsAccessible() bool {
+	return w.output.IsAccessible()
+}
+
+// GetOutput returns the underlying writer
+func (w *CompressedWriter) GetOutput() BatchedWriter {
+	return w.output
+}
+
+// Close finishes the compressed stream and closes the underlying writer
+func (w *CompressedWriter) Close() error {
+	err := w.encoder.Close()
+	if closeErr := w.output.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
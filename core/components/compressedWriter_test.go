@@ -0,0 +1,118 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestCompressedWriterRoundTrip(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	data := strings.Repeat("gollum compressed writer test\n", 100)
+
+	testCases := []struct {
+		codec string
+		level int
+	}{
+		{"gzip", 0},
+		{"gzip", 9},
+		{"zstd", 0},
+		{"zstd", 19},
+		{"lz4", 0},
+		{"lz4", 9},
+		{"snappy", 0},
+	}
+
+	for _, test := range testCases {
+		output := new(bufferWriter)
+
+		// Every write must be readable without closing the writer
+		writer, err := NewCompressedWriter(output, test.codec, test.level)
+		expect.NoError(err)
+		_, err = writer.Write([]byte(data))
+		expect.NoError(err)
+
+		reader, err := NewDecompressionReader(test.codec, bytes.NewReader(output.Bytes()))
+		expect.NoError(err)
+		buffer := make([]byte, len(data))
+		_, err = reader.Read(buffer[:1])
+		expect.NoError(err)
+
+		_, err = writer.Write([]byte(data))
+		expect.NoError(err)
+		expect.NoError(writer.Close())
+		expect.True(output.closed)
+
+		// Files are appended to when reopened, i.e. a second stream follows
+		writer, err = NewCompressedWriter(output, test.codec, test.level)
+		expect.NoError(err)
+		_, err = writer.Write([]byte(data))
+		expect.NoError(err)
+		expect.NoError(writer.Close())
+
+		reader, err = NewDecompressionReader(test.codec, bytes.NewReader(output.Bytes()))
+		expect.NoError(err)
+		decompressed, err := ioutil.ReadAll(reader)
+		expect.NoError(err)
+		expect.NoError(reader.Close())
+
+		if !expect.Equal(strings.Repeat(data, 3), string(decompressed)) {
+			t.Logf("%s level %d", test.codec, test.level)
+		}
+		expect.True(int(output.Size()) < len(decompressed))
+	}
+}
+
+func TestCompressedWriterErrors(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	_, err := NewCompressedWriter(new(bufferWriter), "brotli", 0)
+	expect.NotNil(err)
+	_, err = NewCompressedWriter(new(bufferWriter), "gzip", 10)
+	expect.NotNil(err)
+	_, err = NewCompressedWriter(new(bufferWriter), "lz4", 10)
+	expect.NotNil(err)
+
+	_, err = NewDecompressionReader("brotli", bytes.NewReader(nil))
+	expect.NotNil(err)
+
+	// Data that is not compressed cannot be read
+	reader, err := NewDecompressionReader("zstd", strings.NewReader("plain text"))
+	expect.NoError(err)
+	_, err = ioutil.ReadAll(reader)
+	expect.NotNil(err)
+}
+
+func TestGetCompressionCodec(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	expect.Equal("gzip", GetCompressionCodec("logs/events.log.GZ"))
+	expect.Equal("zstd", GetCompressionCodec("events.zst"))
+	expect.Equal("lz4", GetCompressionCodec("events.lz4"))
+	expect.Equal("snappy", GetCompressionCodec("events.sz"))
+	expect.Equal("", GetCompressionCodec("events.log"))
+	expect.Equal("", GetCompressionCodec("gz"))
+
+	reader, err := NewDecompressionReader("", strings.NewReader("plain"))
+	expect.NoError(err)
+	data, err := ioutil.ReadAll(reader)
+	expect.NoError(err)
+	expect.Equal("plain", string(data))
+}
@@ -0,0 +1,172 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// This file contains the types shared by consumer.Forward and
+// producer.Forward to implement the Fluentd Forward protocol.
+// See https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1
+
+const (
+	// ForwardEventTimeExtID is the msgpack extension type used for EventTime
+	ForwardEventTimeExtID = 0
+	// ForwardCompressionGzip is the only compression supported by the
+	// forward protocol (CompressedPackedForward mode)
+	ForwardCompressionGzip = "gzip"
+)
+
+// ForwardEventTime is the nanosecond precision timestamp of the forward
+// protocol. It is encoded as msgpack extension type 0.
+type ForwardEventTime struct {
+	time.Time
+}
+
+// ForwardOption holds the options that can be attached to each forward
+// protocol message.
+type ForwardOption struct {
+	Size       int    `msgpack:"size,omitempty"`
+	Chunk      string `msgpack:"chunk,omitempty"`
+	Compressed string `msgpack:"compressed,omitempty"`
+}
+
+// ForwardAck is sent by a server if a message contained the chunk option.
+type ForwardAck struct {
+	Ack string `msgpack:"ack"`
+}
+
+// ForwardHelo is sent by a server to start the shared key handshake.
+type ForwardHelo struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Type     string
+	Options  ForwardHeloOptions
+}
+
+// ForwardHeloOptions holds the options sent with a HELO message.
+type ForwardHeloOptions struct {
+	Nonce     []byte `msgpack:"nonce"`
+	Auth      []byte `msgpack:"auth"`
+	Keepalive bool   `msgpack:"keepalive"`
+}
+
+// ForwardPing is sent by a client in response to a HELO message.
+type ForwardPing struct {
+	_msgpack       struct{} `msgpack:",as_array"`
+	Type           string
+	Hostname       string
+	SharedKeySalt  []byte
+	SharedKeyHash  string
+	Username       string
+	PasswordDigest string
+}
+
+// ForwardPong is sent by a server in response to a PING message.
+type ForwardPong struct {
+	_msgpack      struct{} `msgpack:",as_array"`
+	Type          string
+	AuthResult    bool
+	Reason        string
+	Hostname      string
+	SharedKeyHash string
+}
+
+func init() {
+	msgpack.RegisterExt(ForwardEventTimeExtID, (*ForwardEventTime)(nil))
+}
+
+// MarshalMsgpack encodes the time as 32-bit seconds and nanoseconds.
+func (eventTime *ForwardEventTime) MarshalMsgpack() ([]byte, error) {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, uint32(eventTime.Unix()))
+	binary.BigEndian.PutUint32(data[4:], uint32(eventTime.Nanosecond()))
+	return data, nil
+}
+
+// UnmarshalMsgpack decodes 32-bit seconds and nanoseconds.
+func (eventTime *ForwardEventTime) UnmarshalMsgpack(data []byte) error {
+	if len(data) != 8 {
+		return fmt.Errorf("invalid EventTime length %d", len(data))
+	}
+	seconds := binary.BigEndian.Uint32(data)
+	nanoseconds := binary.BigEndian.Uint32(data[4:])
+	eventTime.Time = time.Unix(int64(seconds), int64(nanoseconds))
+	return nil
+}
+
+// ForwardTimeToTime converts a forward protocol timestamp to time.Time.
+// Timestamps are either an EventTime or an integer holding unix seconds.
+func ForwardTimeToTime(value interface{}) (time.Time, error) {
+	switch timestamp := value.(type) {
+	case *ForwardEventTime:
+		return timestamp.Time, nil
+	case ForwardEventTime:
+		return timestamp.Time, nil
+	case int8:
+		return time.Unix(int64(timestamp), 0), nil
+	case int16:
+		return time.Unix(int64(timestamp), 0), nil
+	case int32:
+		return time.Unix(int64(timestamp), 0), nil
+	case int64:
+		return time.Unix(timestamp, 0), nil
+	case uint8:
+		return time.Unix(int64(timestamp), 0), nil
+	case uint16:
+		return time.Unix(int64(timestamp), 0), nil
+	case uint32:
+		return time.Unix(int64(timestamp), 0), nil
+	case uint64:
+		return time.Unix(int64(timestamp), 0), nil
+	case float32:
+		return time.Unix(0, int64(float64(timestamp)*float64(time.Second))), nil
+	case float64:
+		return time.Unix(0, int64(timestamp*float64(time.Second))), nil
+	default:
+		return time.Time{}, fmt.Errorf("unsupported timestamp type %T", value)
+	}
+}
+
+// ForwardSharedKeyHash calculates the hex encoded SHA512 digest used by the
+// shared key handshake.
+func ForwardSharedKeyHash(salt []byte, hostname string, nonce []byte, sharedKey string) string {
+	hash := sha512.New()
+	hash.Write(salt)
+	hash.Write([]byte(hostname))
+	hash.Write(nonce)
+	hash.Write([]byte(sharedKey))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// NewForwardNonce returns a random value usable as nonce, salt or chunk id.
+func NewForwardNonce() []byte {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return nonce
+}
+
+// NewForwardChunkID returns a random, base64 encoded chunk id.
+func NewForwardChunkID() string {
+	return base64.StdEncoding.EncodeToString(NewForwardNonce())
+}
@@ -0,0 +1,137 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/trivago/gollum/core"
+)
+
+// IdleTracker tracks the last use of a resource like an open file so that
+// it can be closed once it has not been used for a given time. A resource
+// cannot be closed while it is in use, and cannot be used after it has been
+// closed. IdleTracker is safe for concurrent use.
+type IdleTracker struct {
+	guard   sync.RWMutex
+	lastUse int64
+	closed  bool
+}
+
+// NewIdleTracker returns a tracker for a resource that is used right now.
+func NewIdleTracker() *IdleTracker {
+	return &IdleTracker{
+		lastUse: time.Now().UnixNano(),
+	}
+}
+
+// Acquire marks the resource as used. The resource cannot be closed until
+// Release is called. If the resource has been closed already false is
+// returned and Release must not be called.
+func (tracker *IdleTracker) Acquire() bool {
+	tracker.guard.RLock()
+	if tracker.closed {
+		tracker.guard.RUnlock()
+		return false // ### return, closed ###
+	}
+	atomic.StoreInt64(&tracker.lastUse, time.Now().UnixNano())
+	return true
+}
+
+// Release has to be called after the resource acquired by Acquire is not
+// used anymore.
+func (tracker *IdleTracker) Release() {
+	tracker.guard.RUnlock()
+}
+
+// IsIdle returns true if the resource has not been used for the given
+// duration.
+func (tracker *IdleTracker) IsIdle(timeout time.Duration) bool {
+	lastUse := time.Unix(0, atomic.LoadInt64(&tracker.lastUse))
+	return time.Since(lastUse) >= timeout
+}
+
+// CloseIfIdle marks the resource as closed if it has not been used for the
+// given duration. It waits for all current users to call Release and returns
+// true if the caller has to close the resource.
+func (tracker *IdleTracker) CloseIfIdle(timeout time.Duration) bool {
+	if !tracker.IsIdle(timeout) {
+		return false // ### return, don't wait for active users ###
+	}
+
+	tracker.guard.Lock()
+	defer tracker.guard.Unlock()
+
+	if tracker.closed || !tracker.IsIdle(timeout) {
+		return false // ### return, in use ###
+	}
+	tracker.closed = true
+	return true
+}
+
+// IdleBatchedWriter is a BatchedWriterAssembly that is closed once it did not
+// receive messages for a given time, e.g. a file of a path resolved from a
+// PathTemplate.
+type IdleBatchedWriter struct {
+	*BatchedWriterAssembly
+	idle *IdleTracker
+}
+
+// NewIdleBatchedWriter returns a new IdleBatchedWriter for the given assembly.
+func NewIdleBatchedWriter(assembly *BatchedWriterAssembly) *IdleBatchedWriter {
+	return &IdleBatchedWriter{
+		BatchedWriterAssembly: assembly,
+		idle:                  NewIdleTracker(),
+	}
+}
+
+// CloseIfIdle closes the writer in the background if it did not receive
+// messages for the given duration. If true is returned the writer has been
+// closed and must not be used anymore.
+func (writer *IdleBatchedWriter) CloseIfIdle(timeout time.Duration) bool {
+	if !writer.idle.CloseIfIdle(timeout) {
+		return false // ### return, in use ###
+	}
+
+	if writer.HasWriter() {
+		go writer.Close() // close in subroutine for eventually compression or uploads in the background
+	} else {
+		writer.Flush()
+	}
+	return true
+}
+
+// AppendToIdleBatchedWriter appends a message to the batch of the writer
+// returned by getWriter. If that writer is closed for being idle in the
+// meantime, getWriter is called again to open a new one. Errors returned by
+// getWriter are passed to the caller.
+func AppendToIdleBatchedWriter(msg *core.Message, getWriter func() (*IdleBatchedWriter, error), canBlock func() bool, tryFallback func(*core.Message)) error {
+	for {
+		writer, err := getWriter()
+		if err != nil {
+			return err // ### return, cannot open ###
+		}
+
+		if !writer.idle.Acquire() {
+			continue // ### continue, closed for being idle ###
+		}
+
+		writer.Batch.AppendOrFlush(msg, writer.Flush, canBlock, tryFallback)
+		writer.idle.Release()
+		return nil
+	}
+}
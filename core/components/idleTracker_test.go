@@ -0,0 +1,91 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestIdleTracker(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	tracker := NewIdleTracker()
+
+	expect.False(tracker.IsIdle(time.Hour))
+	expect.False(tracker.CloseIfIdle(time.Hour))
+
+	time.Sleep(10 * time.Millisecond)
+	expect.True(tracker.IsIdle(5 * time.Millisecond))
+
+	// A resource in use is not closed
+	expect.True(tracker.Acquire())
+	closed := make(chan bool)
+	go func() {
+		closed <- tracker.CloseIfIdle(0)
+	}()
+
+	select {
+	case <-closed:
+		t.Error("Resource was closed while in use")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	tracker.Release()
+	expect.True(<-closed)
+
+	// A closed resource cannot be used or closed again
+	expect.False(tracker.Acquire())
+	expect.False(tracker.CloseIfIdle(0))
+}
+
+func TestAppendToIdleBatchedWriter(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := BatchedWriterConfig{BatchMaxCount: 8, BatchFlushCount: 4}
+	newWriter := func() *IdleBatchedWriter {
+		return NewIdleBatchedWriter(NewBatchedWriterAssembly(config, nil, nil, logrus.StandardLogger()))
+	}
+	canBlock := func() bool { return false }
+	fallback := func(*core.Message) { t.Error("Message was passed to the fallback") }
+	msg := core.NewMessage(nil, []byte("test"), nil, core.InvalidStreamID)
+
+	closed, open := newWriter(), newWriter()
+	expect.False(closed.CloseIfIdle(time.Hour))
+	expect.True(closed.CloseIfIdle(0))
+
+	// Writers closed for being idle are replaced
+	writers := []*IdleBatchedWriter{closed, open}
+	getWriter := func() (*IdleBatchedWriter, error) {
+		writer := writers[0]
+		writers = writers[1:]
+		return writer, nil
+	}
+
+	expect.NoError(AppendToIdleBatchedWriter(msg, getWriter, canBlock, fallback))
+	expect.Equal(0, len(writers))
+	expect.True(closed.Batch.IsEmpty())
+	expect.False(open.Batch.IsEmpty())
+
+	// Errors are passed to the caller
+	err := AppendToIdleBatchedWriter(msg, func() (*IdleBatchedWriter, error) {
+		return nil, errors.New("cannot open")
+	}, canBlock, fallback)
+	expect.NotNil(err)
+}
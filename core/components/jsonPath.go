@@ -0,0 +1,28 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+// GetJSONPath returns the value of a decoded JSON document at the given path
+// of field names. Nil is returned if the path does not exist.
+func GetJSONPath(document interface{}, path []string) interface{} {
+	for _, key := range path {
+		object, isObject := document.(map[string]interface{})
+		if !isObject {
+			return nil
+		}
+		document = object[key]
+	}
+	return document
+}
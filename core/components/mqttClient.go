@@ -0,0 +1,196 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/sirupsen/logrus"
+	"github.com/trivago/gollum/core"
+)
+
+// MQTTClient component
+//
+// The MQTTClient is a helper component to configure connections to an MQTT
+// broker. Connections are automatically re-established if they are lost.
+//
+// Parameters
+//
+// - Address: Defines the broker URL to connect to. Valid schemes are "tcp",
+// "ssl", "ws" and "wss".
+// By default this is set to "tcp://localhost:1883".
+//
+// - ClientID: Defines the client id used when connecting to the broker. If
+// empty, "gollum-" followed by the plugin id is used.
+// By default this is set to "".
+//
+// - Username: Defines the username used for authentication.
+// By default this is set to "".
+//
+// - Password: Defines the password used for authentication.
+// By default this is set to "".
+//
+// - CleanSession: When set to false, the broker keeps subscriptions and
+// queued QoS 1 messages of this client while it is disconnected. This
+// requires a fixed ClientID.
+// By default this is set to true.
+//
+// - KeepAliveSec: Defines the interval in seconds in which keepalive pings
+// are sent to the broker.
+// By default this is set to 30.
+//
+// - ConnectTimeoutSec: Defines the number of seconds to wait for a
+// connection to be established.
+// By default this is set to 10.
+//
+// - MaxReconnectIntervalSec: Defines the maximum number of seconds to wait
+// between two reconnect attempts. The interval starts at 1 second and is
+// doubled after each failed attempt.
+// By default this is set to 60.
+//
+// - TlsEnable: Enables TLS communication with the broker. This is implicitly
+// enabled for the "ssl" and "wss" schemes.
+// By default this is set to false.
+//
+// - TlsKeyLocation: Defines the path to the client's private key (PEM) used
+// for certificate based authentication.
+// By default this is set to "".
+//
+// - TlsCertificateLocation: Defines the path to the client's certificate (PEM)
+// used for certificate based authentication.
+// By default this is set to "".
+//
+// - TlsCaLocation: Defines the path to the CA certificate(s) used to verify
+// the broker's certificate. If empty, the system's CAs are used.
+// By default this is set to "".
+//
+// - TlsServerName: Defines the hostname to verify the broker's certificate
+// against. If empty, the hostname of Address is used.
+// By default this is set to "".
+//
+// - TlsInsecureSkipVerify: Disables the verification of the broker's
+// certificate chain and host name.
+// By default this is set to false.
+//
+type MQTTClient struct {
+	address              string        `config:"Address" default:"tcp://localhost:1883"`
+	clientID             string        `config:"ClientID" default:""`
+	username             string        `config:"Username" default:""`
+	password             string        `config:"Password" default:""`
+	cleanSession         bool          `config:"CleanSession" default:"true"`
+	keepAlive            time.Duration `config:"KeepAliveSec" default:"30" metric:"sec"`
+	connectTimeout       time.Duration `config:"ConnectTimeoutSec" default:"10" metric:"sec"`
+	maxReconnectInterval time.Duration `config:"MaxReconnectIntervalSec" default:"60" metric:"sec"`
+	tlsEnable            bool          `config:"TlsEnable" default:"false"`
+	tlsKeyFile           string        `config:"TlsKeyLocation" default:""`
+	tlsCertFile          string        `config:"TlsCertificateLocation" default:""`
+	tlsCaFile            string        `config:"TlsCaLocation" default:""`
+	tlsServerName        string        `config:"TlsServerName" default:""`
+	tlsInsecure          bool          `config:"TlsInsecureSkipVerify" default:"false"`
+	tlsConfig            *tls.Config
+}
+
+// Configure method
+func (client *MQTTClient) Configure(conf core.PluginConfigReader) {
+	if client.clientID == "" {
+		client.clientID = "gollum-" + conf.GetID()
+	}
+
+	if !client.tlsEnable {
+		return // ### return, no TLS config ###
+	}
+
+	client.tlsConfig = &tls.Config{
+		ServerName:         client.tlsServerName,
+		InsecureSkipVerify: client.tlsInsecure,
+	}
+
+	switch {
+	case client.tlsKeyFile != "" && client.tlsCertFile != "":
+		cert, err := tls.LoadX509KeyPair(client.tlsCertFile, client.tlsKeyFile)
+		if !conf.Errors.Push(err) {
+			client.tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+	case client.tlsKeyFile != "":
+		conf.Errors.Pushf("Cannot specify TlsKeyLocation without TlsCertificateLocation")
+	case client.tlsCertFile != "":
+		conf.Errors.Pushf("Cannot specify TlsCertificateLocation without TlsKeyLocation")
+	}
+
+	if client.tlsCaFile != "" {
+		caCert, err := ioutil.ReadFile(client.tlsCaFile)
+		if !conf.Errors.Push(err) {
+			caCertPool := x509.NewCertPool()
+			if !caCertPool.AppendCertsFromPEM(caCert) {
+				conf.Errors.Pushf("No certificates found in %s", client.tlsCaFile)
+			}
+			client.tlsConfig.RootCAs = caCertPool
+		}
+	}
+}
+
+// GetAddress returns the broker URL
+func (client *MQTTClient) GetAddress() string {
+	return client.address
+}
+
+// NewClient returns a client that is not yet connected. The onConnect
+// callback is called after each successful (re)connect and may be nil.
+func (client *MQTTClient) NewClient(logger logrus.FieldLogger, onConnect func(mqtt.Client)) mqtt.Client {
+	options := mqtt.NewClientOptions().
+		AddBroker(client.address).
+		SetClientID(client.clientID).
+		SetUsername(client.username).
+		SetPassword(client.password).
+		SetCleanSession(client.cleanSession).
+		SetKeepAlive(client.keepAlive).
+		SetConnectTimeout(client.connectTimeout).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(client.maxReconnectInterval).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(time.Second)
+
+	if client.tlsConfig != nil {
+		options.SetTLSConfig(client.tlsConfig)
+	}
+
+	options.SetOnConnectHandler(func(c mqtt.Client) {
+		logger.Infof("Connected to %s", client.address)
+		if onConnect != nil {
+			onConnect(c)
+		}
+	})
+	options.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		logger.WithError(err).Warningf("Lost connection to %s", client.address)
+	})
+
+	return mqtt.NewClient(options)
+}
+
+// WaitForToken waits for an operation to complete and returns its error.
+// A timeout of 0 waits forever.
+func WaitForToken(token mqtt.Token, timeout time.Duration) error {
+	if timeout <= 0 {
+		token.Wait()
+	} else if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("operation timed out after %s", timeout)
+	}
+	return token.Error()
+}
@@ -0,0 +1,129 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"github.com/trivago/gollum/core"
+)
+
+// NATSClient component
+//
+// The NATSClient is a helper component to configure connections to a NATS
+// server or cluster. Connections are automatically re-established if they
+// are lost.
+//
+// Parameters
+//
+// - Address: Defines a comma separated list of server URLs to connect to.
+// Use the "tls" scheme to enforce TLS.
+// By default this is set to "nats://localhost:4222".
+//
+// - Username: Defines the username used for authentication.
+// By default this is set to "".
+//
+// - Password: Defines the password used for authentication.
+// By default this is set to "".
+//
+// - Token: Defines the token used for authentication.
+// By default this is set to "".
+//
+// - CredentialsFile: Defines the path to a credentials file containing a
+// user JWT and NKey seed.
+// By default this is set to "".
+//
+// - ReconnectDelaySec: Defines the number of seconds to wait between two
+// reconnect attempts.
+// By default this is set to 2.
+//
+// - TlsCaLocation: Defines the path to the CA certificate(s) used to verify
+// the server's certificate.
+// By default this is set to "".
+//
+// - TlsCertificateLocation: Defines the path to the client's certificate
+// (PEM) used for certificate based authentication.
+// By default this is set to "".
+//
+// - TlsKeyLocation: Defines the path to the client's private key (PEM) used
+// for certificate based authentication.
+// By default this is set to "".
+//
+type NATSClient struct {
+	address         string        `config:"Address" default:"nats://localhost:4222"`
+	username        string        `config:"Username" default:""`
+	password        string        `config:"Password" default:""`
+	token           string        `config:"Token" default:""`
+	credentialsFile string        `config:"CredentialsFile" default:""`
+	reconnectDelay  time.Duration `config:"ReconnectDelaySec" default:"2" metric:"sec"`
+	tlsCaFile       string        `config:"TlsCaLocation" default:""`
+	tlsCertFile     string        `config:"TlsCertificateLocation" default:""`
+	tlsKeyFile      string        `config:"TlsKeyLocation" default:""`
+	name            string
+}
+
+// Configure method
+func (client *NATSClient) Configure(conf core.PluginConfigReader) {
+	client.name = "gollum-" + conf.GetID()
+
+	if (client.tlsCertFile == "") != (client.tlsKeyFile == "") {
+		conf.Errors.Pushf("TlsCertificateLocation and TlsKeyLocation must be set together")
+	}
+}
+
+// GetAddress returns the configured server URLs
+func (client *NATSClient) GetAddress() string {
+	return client.address
+}
+
+// Connect establishes a connection to the configured servers. The connection
+// is re-established automatically until it is closed. Additional options are
+// applied after the configured ones.
+func (client *NATSClient) Connect(logger logrus.FieldLogger, additional ...nats.Option) (*nats.Conn, error) {
+	options := []nats.Option{
+		nats.Name(client.name),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(client.reconnectDelay),
+		nats.RetryOnFailedConnect(true),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				logger.WithError(err).Warningf("Lost connection to %s", client.address)
+			}
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			logger.Infof("Reconnected to %s", conn.ConnectedUrl())
+		}),
+	}
+
+	if client.username != "" {
+		options = append(options, nats.UserInfo(client.username, client.password))
+	}
+	if client.token != "" {
+		options = append(options, nats.Token(client.token))
+	}
+	if client.credentialsFile != "" {
+		options = append(options, nats.UserCredentials(client.credentialsFile))
+	}
+	if client.tlsCaFile != "" {
+		options = append(options, nats.RootCAs(client.tlsCaFile))
+	}
+	if client.tlsCertFile != "" {
+		options = append(options, nats.ClientCert(client.tlsCertFile, client.tlsKeyFile))
+	}
+
+	return nats.Connect(client.address, append(options, additional...)...)
+}
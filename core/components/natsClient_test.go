@@ -0,0 +1,88 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func newTestNATSClient(settings map[string]interface{}) (*NATSClient, error) {
+	conf := core.NewPluginConfig("natsTest", "consumer.NATS")
+	for key, value := range settings {
+		conf.Override(key, value)
+	}
+
+	client := new(NATSClient)
+	reader := core.NewPluginConfigReader(&conf)
+	return client, reader.Configure(client)
+}
+
+func TestNATSClientConfigErrors(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	_, err := newTestNATSClient(map[string]interface{}{"TlsCertificateLocation": "client.crt"})
+	expect.NotNil(err)
+	_, err = newTestNATSClient(map[string]interface{}{"TlsKeyLocation": "client.key"})
+	expect.NotNil(err)
+}
+
+func TestNATSClientConnect(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.Authorization = "s3cr3t"
+	srv := natsserver.RunServer(&opts)
+	defer srv.Shutdown()
+
+	client, err := newTestNATSClient(map[string]interface{}{
+		"Address": srv.ClientURL(),
+		"Token":   "s3cr3t",
+	})
+	expect.NoError(err)
+
+	// Additional options are applied to the connection
+	closed := make(chan struct{})
+	conn, err := client.Connect(logrus.StandardLogger(), nats.ClosedHandler(func(*nats.Conn) { close(closed) }))
+	expect.NoError(err)
+	expect.True(conn.IsConnected())
+	expect.Equal("gollum-natsTest", conn.Opts.Name)
+
+	conn.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("ClosedHandler was not called")
+	}
+
+	// Connections are retried until the credentials are accepted
+	client, err = newTestNATSClient(map[string]interface{}{
+		"Address": srv.ClientURL(),
+		"Token":   "invalid",
+	})
+	expect.NoError(err)
+
+	conn, err = client.Connect(logrus.StandardLogger())
+	expect.NoError(err)
+	defer conn.Close()
+	expect.False(conn.IsConnected())
+}
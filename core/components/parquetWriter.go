@@ -0,0 +1,384 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+	"github.com/trivago/gollum/core"
+)
+
+type parquetColumn struct {
+	name     string
+	dataType string
+	source   string // "json", "meta", "time" or "payload"
+	path     []string
+}
+
+// ParquetConfig defines settings for parquet output
+//
+// Parameters
+//
+// - Parquet/Enable: If this value is set to "true" messages are written as
+// rows of a parquet file instead of being appended as plain data. A row group
+// is written whenever a batch is flushed. The file footer is written when the
+// file is rotated or closed. As parquet files cannot be appended to,
+// producer.File requires "Rotation/Enable" to be set.
+// By default this parameter is set to "false".
+//
+// - Parquet/Schema: This value defines the columns of the parquet file as a
+// map of column name to type. Valid types are "string", "int32", "int64",
+// "float", "double", "bool" and "timestamp". Timestamps are stored as
+// milliseconds since epoch (UTC). Source values of timestamp columns can be
+// RFC3339 strings or numbers, which are read as seconds since epoch and may
+// contain fractions of a second. All columns are optional, i.e. a value that
+// is missing or cannot be converted is stored as null.
+// By default this parameter is set to an empty map.
+//
+// - Parquet/Sources: This value defines where the value of a column is read
+// from as a map of column name to source. Valid sources are "json:<path>" for
+// a field of the JSON encoded message (nested fields are separated by "."),
+// "meta:<key>" for a metadata field, "payload" for the whole message and
+// "time" for the creation time of the message. Columns without source are
+// read from the JSON field of the same name.
+// By default this parameter is set to an empty map.
+//
+// - Parquet/Compression: This value defines the compression codec used for
+// column chunks. Valid values are "none", "snappy", "gzip", "zstd" and
+// "lz4".
+// By default this parameter is set to "snappy".
+//
+type ParquetConfig struct {
+	Enabled bool `config:"Parquet/Enable" default:"false"`
+	schema  *parquet.Schema
+	columns []parquetColumn
+	codec   compress.Codec
+}
+
+// Configure method for interface implementation
+func (config *ParquetConfig) Configure(conf core.PluginConfigReader) {
+	if !config.Enabled {
+		return // ### return, parquet not used ###
+	}
+
+	schema := conf.GetMap("Parquet/Schema", nil)
+	sources := conf.GetStringMap("Parquet/Sources", map[string]string{})
+	if len(schema) == 0 {
+		conf.Errors.Pushf("Parquet/Schema must define at least one column")
+		return // ### return, no schema ###
+	}
+
+	group := parquet.Group{}
+	columns := make(map[string]parquetColumn, len(schema))
+	for name, dataType := range schema {
+		column := parquetColumn{
+			name:     name,
+			dataType: strings.ToLower(fmt.Sprint(dataType)),
+		}
+
+		node, err := newParquetNode(column.dataType)
+		if err != nil {
+			conf.Errors.Pushf("Column %s: %s", name, err.Error())
+			continue
+		}
+		group[name] = parquet.Optional(node)
+
+		source, hasSource := sources[name]
+		if !hasSource {
+			source = "json:" + name
+		}
+		switch {
+		case source == "payload" || source == "time":
+			column.source = source
+		case strings.HasPrefix(source, "json:"):
+			column.source = "json"
+			column.path = strings.Split(source[len("json:"):], ".")
+		case strings.HasPrefix(source, "meta:"):
+			column.source = "meta"
+			column.path = []string{source[len("meta:"):]}
+		default:
+			conf.Errors.Pushf("Column %s: unknown source %s", name, source)
+		}
+		columns[name] = column
+	}
+
+	for name := range sources {
+		if _, isColumn := schema[name]; !isColumn {
+			conf.Errors.Pushf("Parquet/Sources: %s is not part of Parquet/Schema", name)
+		}
+	}
+
+	config.schema = parquet.NewSchema("gollum", group)
+
+	// Rows have to follow the column order of the schema
+	config.columns = make([]parquetColumn, 0, len(columns))
+	for _, path := range config.schema.Columns() {
+		config.columns = append(config.columns, columns[path[0]])
+	}
+
+	switch strings.ToLower(conf.GetString("Parquet/Compression", "snappy")) {
+	case "none":
+		config.codec = &parquet.Uncompressed
+	case "snappy":
+		config.codec = &parquet.Snappy
+	case "gzip":
+		config.codec = &parquet.Gzip
+	case "zstd":
+		config.codec = &parquet.Zstd
+	case "lz4":
+		config.codec = &parquet.Lz4Raw
+	default:
+		conf.Errors.Pushf("Unknown Parquet/Compression %s", conf.GetString("Parquet/Compression", "snappy"))
+	}
+}
+
+func newParquetNode(dataType string) (parquet.Node, error) {
+	switch dataType {
+	case "string":
+		return parquet.String(), nil
+	case "int32":
+		return parquet.Int(32), nil
+	case "int64":
+		return parquet.Int(64), nil
+	case "float":
+		return parquet.Leaf(parquet.FloatType), nil
+	case "double":
+		return parquet.Leaf(parquet.DoubleType), nil
+	case "bool":
+		return parquet.Leaf(parquet.BooleanType), nil
+	case "timestamp":
+		return parquet.Timestamp(parquet.Millisecond), nil
+	default:
+		return nil, fmt.Errorf("unknown type %s", dataType)
+	}
+}
+
+// NewWriter returns a ParquetWriter writing to the given BatchedWriter
+func (config *ParquetConfig) NewWriter(output BatchedWriter) *ParquetWriter {
+	return &ParquetWriter{
+		output:  output,
+		columns: config.columns,
+		writer:  parquet.NewWriter(output, config.schema, parquet.Compression(config.codec)),
+	}
+}
+
+// ParquetWriter is a BatchedMessageWriter implementation that stores
+// messages as rows of a parquet file. The file is written to another
+// BatchedWriter, e.g. a file on disk or an S3 object.
+type ParquetWriter struct {
+	output  BatchedWriter
+	columns []parquetColumn
+	writer  *parquet.Writer
+}
+
+// Write is part of the BatchedWriter interface. Parquet files can only be
+// written by WriteMessages.
+func (w *ParquetWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("parquet writer does not support plain writes")
+}
+
+// WriteMessages is part of the BatchedMessageWriter interface and writes
+// all messages as one row group
+func (w *ParquetWriter) WriteMessages(messages []*core.Message) error {
+	rows := make([]parquet.Row, 0, len(messages))
+	for _, msg := range messages {
+		rows = append(rows, w.newRow(msg))
+	}
+
+	if _, err := w.writer.WriteRows(rows); err != nil {
+		return err
+	}
+	return w.writer.Flush()
+}
+
+// Name is part of the BatchedWriter interface and returns the name of the
+// underlying writer
+func (w *ParquetWriter) Name() string {
+	return w.output.Name()
+}
+
+// Size is part of the BatchedWriter interface and returns the number of
+// bytes written to the underlying writer
+func (w *ParquetWriter) Size() int64 {
+	return w.output.Size()
+}
+
+// IsAccessible is part of the BatchedWriter interface and checks the
+// underlying writer
+func (w *ParquetWriter) IsAccessible() bool {
+	return w.output.IsAccessible()
+}
+
+// GetOutput returns the underlying writer
+func (w *ParquetWriter) GetOutput() BatchedWriter {
+	return w.output
+}
+
+// Close writes the parquet footer and closes the underlying writer
+func (w *ParquetWriter) Close() error {
+	err := w.writer.Close()
+	if closeErr := w.output.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (w *ParquetWriter) newRow(msg *core.Message) parquet.Row {
+	var fields map[string]interface{}
+	row := make(parquet.Row, len(w.columns))
+
+	for idx, column := range w.columns {
+		var value interface{}
+		switch column.source {
+		case "payload":
+			value = string(msg.GetPayload())
+		case "time":
+			value = msg.GetCreationTime()
+		case "meta":
+			if metaValue, isSet := msg.TryGetMetadata().TryGetValue(column.path[0]); isSet {
+				value = string(metaValue)
+			}
+		case "json":
+			if fields == nil {
+				decoder := json.NewDecoder(bytes.NewReader(msg.GetPayload()))
+				decoder.UseNumber()
+				if err := decoder.Decode(&fields); err != nil {
+					fields = map[string]interface{}{}
+				}
+			}
+			value = GetJSONPath(fields, column.path)
+		}
+
+		if parquetValue, ok := convertParquetValue(value, column.dataType); ok {
+			row[idx] = parquetValue.Level(0, 1, idx)
+		} else {
+			row[idx] = parquet.NullValue().Level(0, 0, idx)
+		}
+	}
+	return row
+}
+
+// convertParquetValue converts a JSON, metadata or time value to the given
+// column type
+func convertParquetValue(value interface{}, dataType string) (parquet.Value, bool) {
+	if value == nil {
+		return parquet.Value{}, false // ### return, null ###
+	}
+
+	switch dataType {
+	case "string":
+		switch v := value.(type) {
+		case string:
+			return parquet.ByteArrayValue([]byte(v)), true
+		case json.Number:
+			return parquet.ByteArrayValue([]byte(v)), true
+		case time.Time:
+			return parquet.ByteArrayValue([]byte(v.Format(time.RFC3339Nano))), true
+		case map[string]interface{}, []interface{}:
+			data, err := json.Marshal(v)
+			return parquet.ByteArrayValue(data), err == nil
+		default:
+			return parquet.ByteArrayValue([]byte(fmt.Sprint(v))), true
+		}
+
+	case "int32", "int64":
+		number, ok := toFloat(value)
+		if !ok || number != math.Trunc(number) {
+			return parquet.Value{}, false
+		}
+		if dataType == "int32" {
+			if number < math.MinInt32 || number > math.MaxInt32 {
+				return parquet.Value{}, false
+			}
+			return parquet.Int32Value(int32(number)), true
+		}
+		if intValue, err := toInt64(value); err == nil {
+			return parquet.Int64Value(intValue), true
+		}
+		return parquet.Int64Value(int64(number)), true
+
+	case "float", "double":
+		number, ok := toFloat(value)
+		if !ok {
+			return parquet.Value{}, false
+		}
+		if dataType == "float" {
+			return parquet.FloatValue(float32(number)), true
+		}
+		return parquet.DoubleValue(number), true
+
+	case "bool":
+		switch v := value.(type) {
+		case bool:
+			return parquet.BooleanValue(v), true
+		case string:
+			boolValue, err := strconv.ParseBool(v)
+			return parquet.BooleanValue(boolValue), err == nil
+		}
+
+	case "timestamp":
+		switch v := value.(type) {
+		case time.Time:
+			return parquet.Int64Value(v.UnixNano() / int64(time.Millisecond)), true
+		case string:
+			if timestamp, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				return parquet.Int64Value(timestamp.UnixNano() / int64(time.Millisecond)), true
+			}
+		}
+		// Numbers are treated as unix timestamps in seconds, see Parquet/Schema
+		if seconds, ok := toFloat(value); ok {
+			return parquet.Int64Value(int64(seconds * 1000)), true
+		}
+	}
+	return parquet.Value{}, false
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		number, err := v.Float64()
+		return number, err == nil
+	case string:
+		number, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return number, err == nil
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func toInt64(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return v.Int64()
+	case string:
+		return strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	}
+	return 0, errors.New("not an integer")
+}
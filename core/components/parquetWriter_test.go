@@ -0,0 +1,244 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+// bufferWriter is a BatchedWriter writing to memory
+type bufferWriter struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (w *bufferWriter) Name() string {
+	return "buffer"
+}
+
+func (w *bufferWriter) Size() int64 {
+	return int64(w.Len())
+}
+
+func (w *bufferWriter) IsAccessible() bool {
+	return !w.closed
+}
+
+func (w *bufferWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func newTestParquetConfig(t *testing.T, schema map[string]interface{}, sources map[string]string) *ParquetConfig {
+	expect := ttesting.NewExpect(t)
+
+	conf := core.NewPluginConfig("parquetTest", "producer.File")
+	conf.Override("Parquet/Enable", true)
+	conf.Override("Parquet/Schema", schema)
+	conf.Override("Parquet/Sources", sources)
+
+	config := new(ParquetConfig)
+	reader := core.NewPluginConfigReader(&conf)
+	expect.NoError(reader.Configure(config))
+	return config
+}
+
+func TestParquetConfigErrors(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	testCases := []map[string]interface{}{
+		{"Parquet/Schema": map[string]interface{}{}},
+		{"Parquet/Schema": map[string]interface{}{"a": "uint8"}},
+		{"Parquet/Schema": map[string]interface{}{"a": "string"}, "Parquet/Sources": map[string]string{"a": "header:x"}},
+		{"Parquet/Schema": map[string]interface{}{"a": "string"}, "Parquet/Sources": map[string]string{"b": "payload"}},
+		{"Parquet/Schema": map[string]interface{}{"a": "string"}, "Parquet/Compression": "brotli"},
+	}
+
+	for _, settings := range testCases {
+		conf := core.NewPluginConfig("parquetTest", "producer.File")
+		conf.Override("Parquet/Enable", true)
+		for key, value := range settings {
+			conf.Override(key, value)
+		}
+
+		reader := core.NewPluginConfigReader(&conf)
+		if !expect.NotNil(reader.Configure(new(ParquetConfig))) {
+			t.Log(settings)
+		}
+	}
+}
+
+func TestConvertParquetValue(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	timestamp := time.Date(2024, 5, 1, 12, 30, 0, 500000000, time.UTC)
+	timestampMs := timestamp.UnixNano() / int64(time.Millisecond)
+
+	value, ok := convertParquetValue(json.Number("42"), "string")
+	expect.True(ok)
+	expect.Equal("42", string(value.ByteArray()))
+
+	value, ok = convertParquetValue(map[string]interface{}{"a": json.Number("1")}, "string")
+	expect.True(ok)
+	expect.Equal(`{"a":1}`, string(value.ByteArray()))
+
+	value, ok = convertParquetValue(json.Number("2147483647"), "int32")
+	expect.True(ok)
+	expect.Equal(int32(2147483647), value.Int32())
+
+	_, ok = convertParquetValue(json.Number("2147483648"), "int32")
+	expect.False(ok)
+	_, ok = convertParquetValue(json.Number("1.5"), "int32")
+	expect.False(ok)
+
+	// Large integers must not lose precision
+	value, ok = convertParquetValue(json.Number("9007199254740993"), "int64")
+	expect.True(ok)
+	expect.Equal(int64(9007199254740993), value.Int64())
+
+	value, ok = convertParquetValue(" 12 ", "int64")
+	expect.True(ok)
+	expect.Equal(int64(12), value.Int64())
+
+	value, ok = convertParquetValue(json.Number("0.25"), "float")
+	expect.True(ok)
+	expect.Equal(float32(0.25), value.Float())
+
+	value, ok = convertParquetValue("0.25", "double")
+	expect.True(ok)
+	expect.Equal(0.25, value.Double())
+
+	value, ok = convertParquetValue("true", "bool")
+	expect.True(ok)
+	expect.True(value.Boolean())
+
+	_, ok = convertParquetValue("yes", "bool")
+	expect.False(ok)
+
+	// Timestamps are stored in milliseconds, numbers are read as seconds
+	value, ok = convertParquetValue(timestamp, "timestamp")
+	expect.True(ok)
+	expect.Equal(timestampMs, value.Int64())
+
+	value, ok = convertParquetValue(timestamp.Format(time.RFC3339Nano), "timestamp")
+	expect.True(ok)
+	expect.Equal(timestampMs, value.Int64())
+
+	value, ok = convertParquetValue(json.Number("1714566600.5"), "timestamp")
+	expect.True(ok)
+	expect.Equal(timestampMs, value.Int64())
+
+	_, ok = convertParquetValue("yesterday", "timestamp")
+	expect.False(ok)
+
+	_, ok = convertParquetValue(nil, "string")
+	expect.False(ok)
+}
+
+func TestParquetWriterNewRow(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	config := newTestParquetConfig(t,
+		map[string]interface{}{"user": "int64", "path": "string", "host": "string", "raw": "string", "missing": "double"},
+		map[string]string{"path": "json:request.path", "host": "meta:host", "raw": "payload"},
+	)
+	writer := config.NewWriter(new(bufferWriter))
+
+	payload := `{"user":7,"request":{"path":"/index.html"}}`
+	msg := core.NewMessage(nil, []byte(payload), core.Metadata{"host": []byte("web01")}, core.InvalidStreamID)
+	row := writer.newRow(msg)
+
+	// Columns are sorted by name
+	expect.Equal(5, len(row))
+	expect.Equal("web01", string(row[0].ByteArray()))
+	expect.True(row[1].IsNull())
+	expect.Equal("/index.html", string(row[2].ByteArray()))
+	expect.Equal(payload, string(row[3].ByteArray()))
+	expect.Equal(int64(7), row[4].Int64())
+
+	for idx, value := range row {
+		expect.Equal(idx, value.Column())
+	}
+
+	// Invalid JSON results in null values
+	row = writer.newRow(core.NewMessage(nil, []byte("not json"), nil, core.InvalidStreamID))
+	expect.True(row[0].IsNull())
+	expect.True(row[2].IsNull())
+	expect.Equal("not json", string(row[3].ByteArray()))
+	expect.True(row[4].IsNull())
+}
+
+func TestParquetWriterRoundTrip(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	config := newTestParquetConfig(t,
+		map[string]interface{}{"time": "timestamp", "status": "int32", "path": "string"},
+		map[string]string{"time": "time"},
+	)
+
+	output := new(bufferWriter)
+	writer := config.NewWriter(output)
+
+	messages := []*core.Message{
+		core.NewMessage(nil, []byte(`{"status":200,"path":"/a"}`), nil, core.InvalidStreamID),
+		core.NewMessage(nil, []byte(`{"status":"404","path":"/b"}`), nil, core.InvalidStreamID),
+		core.NewMessage(nil, []byte(`{"path":"/c"}`), nil, core.InvalidStreamID),
+	}
+
+	// Each call writes a row group
+	expect.NoError(writer.WriteMessages(messages[:2]))
+	expect.NoError(writer.WriteMessages(messages[2:]))
+	_, err := writer.Write([]byte("plain"))
+	expect.NotNil(err)
+	expect.NoError(writer.Close())
+	expect.True(output.closed)
+
+	data := output.Bytes()
+	file, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+	expect.NoError(err)
+	expect.Equal(2, len(file.RowGroups()))
+	expect.Equal(int64(3), file.NumRows())
+
+	reader := parquet.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+
+	rows := make([]parquet.Row, 4)
+	numRows := 0
+	for err == nil && numRows < len(rows) {
+		var n int
+		n, err = reader.ReadRows(rows[numRows:])
+		// Values reference buffers of the reader that are reused
+		for idx := numRows; idx < numRows+n; idx++ {
+			rows[idx] = rows[idx].Clone()
+		}
+		numRows += n
+	}
+	expect.Equal(io.EOF, err)
+	expect.Equal(3, numRows)
+
+	// Columns are sorted by name: path, status, time
+	for idx, expected := range []string{"/a", "/b", "/c"} {
+		expect.Equal(expected, string(rows[idx][0].ByteArray()))
+		expect.Equal(messages[idx].GetCreationTime().UnixNano()/int64(time.Millisecond), rows[idx][2].Int64())
+	}
+	expect.Equal(int32(200), rows[0][1].Int32())
+	expect.Equal(int32(404), rows[1][1].Int32())
+	expect.True(rows[2][1].IsNull())
+}
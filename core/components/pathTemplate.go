@@ -0,0 +1,165 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/trivago/gollum/core"
+)
+
+const (
+	pathPartText = pathPartType(iota)
+	pathPartStream
+	pathPartMetadata
+	pathPartTime
+)
+
+// defaultPathTimeLayout is used for "{time}" placeholders without layout
+const defaultPathTimeLayout = "2006-01-02"
+
+type pathPartType int
+
+type pathPart struct {
+	kind  pathPartType
+	value string
+}
+
+// PathTemplate is a "/" separated path, e.g. a file path or an MQTT topic,
+// containing placeholders that are resolved for each message. Supported
+// placeholders are "*" and "{stream}" for the stream name, "{meta.<key>}" for
+// metadata values and "{time:<layout>}" for the creation time of a message
+// formatted as a go time layout.
+type PathTemplate struct {
+	parts  []pathPart
+	escape func(string) string
+}
+
+// pathValueReplacer removes characters that would change the directory
+// structure from resolved values
+var pathValueReplacer = strings.NewReplacer("/", "_", "\\", "_", "..", "_")
+
+// escapePathValue strips path separators from a metadata value. Missing
+// values are replaced by "_".
+func escapePathValue(value string) string {
+	if value == "" {
+		return "_"
+	}
+	return pathValueReplacer.Replace(value)
+}
+
+// NewPathTemplate parses the given path and returns a new PathTemplate
+func NewPathTemplate(path string) (PathTemplate, error) {
+	return parseTemplate(path, true, escapePathValue)
+}
+
+// NewTemplate parses a template for strings that are not paths, e.g. URLs or
+// HTTP headers. It supports the same placeholders as a PathTemplate except
+// for "*". Metadata values are passed to escape, missing values are passed as
+// empty strings.
+func NewTemplate(text string, escape func(string) string) (PathTemplate, error) {
+	return parseTemplate(text, false, escape)
+}
+
+func parseTemplate(path string, useWildcard bool, escape func(string) string) (PathTemplate, error) {
+	template := PathTemplate{escape: escape}
+	text := ""
+
+	addPart := func(kind pathPartType, value string) {
+		if text != "" {
+			template.parts = append(template.parts, pathPart{pathPartText, text})
+			text = ""
+		}
+		template.parts = append(template.parts, pathPart{kind, value})
+	}
+
+	for idx := 0; idx < len(path); idx++ {
+		switch {
+		case path[idx] == '*' && useWildcard:
+			addPart(pathPartStream, "")
+
+		case path[idx] == '{':
+			end := strings.IndexByte(path[idx:], '}')
+			if end == -1 {
+				return template, fmt.Errorf("Unclosed placeholder in %s", path)
+			}
+			placeholder := path[idx+1 : idx+end]
+			idx += end
+
+			switch {
+			case placeholder == "stream":
+				addPart(pathPartStream, "")
+			case strings.HasPrefix(placeholder, "meta."):
+				addPart(pathPartMetadata, placeholder[len("meta."):])
+			case placeholder == "time":
+				addPart(pathPartTime, defaultPathTimeLayout)
+			case strings.HasPrefix(placeholder, "time:"):
+				addPart(pathPartTime, placeholder[len("time:"):])
+			default:
+				return template, fmt.Errorf("Unknown placeholder {%s} in %s", placeholder, path)
+			}
+
+		default:
+			text += path[idx : idx+1]
+		}
+	}
+
+	if text != "" {
+		template.parts = append(template.parts, pathPart{pathPartText, text})
+	}
+	return template, nil
+}
+
+// IsUnbounded returns true if the template contains metadata or time
+// placeholders. In contrast to stream placeholders the number of paths
+// resolved from such a template grows with the messages processed.
+func (template *PathTemplate) IsUnbounded() bool {
+	for _, part := range template.parts {
+		if part.kind == pathPartMetadata || part.kind == pathPartTime {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the path for the given message. Metadata values of path
+// templates are stripped of path separators, missing metadata values are
+// replaced by "_".
+func (template *PathTemplate) Resolve(msg *core.Message) string {
+	path := make([]byte, 0, 64)
+	for _, part := range template.parts {
+		switch part.kind {
+		case pathPartText:
+			path = append(path, part.value...)
+
+		case pathPartStream:
+			// The wildcard stream is written to "ALL"
+			if msg.GetStreamID() == core.WildcardStreamID {
+				path = append(path, "ALL"...)
+			} else {
+				path = append(path, core.StreamRegistry.GetStreamName(msg.GetStreamID())...)
+			}
+
+		case pathPartMetadata:
+			value := msg.TryGetMetadata().GetValueString(part.value)
+			path = append(path, template.escape(value)...)
+
+		case pathPartTime:
+			path = msg.GetCreationTime().AppendFormat(path, part.value)
+		}
+	}
+	return string(path)
+}
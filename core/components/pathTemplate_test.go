@@ -0,0 +1,123 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestPathTemplateParseErrors(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	for _, path := range []string{
+		"logs/{meta.host",
+		"logs/{host}",
+		"logs/{}",
+		"{stream}/{time:2006}/{unknown}.log",
+	} {
+		_, err := NewPathTemplate(path)
+		if !expect.NotNil(err) {
+			t.Log(path)
+		}
+	}
+}
+
+func TestPathTemplateResolve(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	msg := core.NewMessage(nil, []byte("test"), core.Metadata{
+		"host": []byte("web01"),
+		"app":  []byte("shop"),
+	}, core.GetStreamID("pathTemplateTest"))
+
+	testCases := map[string]string{
+		"/var/log/static.log":                "/var/log/static.log",
+		"/var/log/*.log":                     "/var/log/pathTemplateTest.log",
+		"/var/log/{stream}/{meta.host}.log":  "/var/log/pathTemplateTest/web01.log",
+		"{meta.app}-{meta.host}":             "shop-web01",
+		"logs/{time}/a.log":                  "logs/" + msg.GetCreationTime().Format("2006-01-02") + "/a.log",
+		"logs/{time:2006/01}/{meta.app}.log": "logs/" + msg.GetCreationTime().Format("2006/01") + "/shop.log",
+	}
+
+	for path, expected := range testCases {
+		template, err := NewPathTemplate(path)
+		expect.NoError(err)
+		if !expect.Equal(expected, template.Resolve(msg)) {
+			t.Log(path)
+		}
+	}
+}
+
+func TestPathTemplateSanitize(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	template, err := NewPathTemplate("/var/log/{meta.host}/{meta.app}.log")
+	expect.NoError(err)
+
+	// Values must not change the directory structure
+	msg := core.NewMessage(nil, []byte("test"), core.Metadata{
+		"host": []byte("../../etc"),
+		"app":  []byte("a/b\\c"),
+	}, core.GetStreamID("pathTemplateTest"))
+	expect.Equal("/var/log/____etc/a_b_c.log", template.Resolve(msg))
+
+	// Missing values are replaced by "_"
+	msg = core.NewMessage(nil, []byte("test"), nil, core.GetStreamID("pathTemplateTest"))
+	expect.Equal("/var/log/_/_.log", template.Resolve(msg))
+
+	// The wildcard stream is resolved to "ALL"
+	template, err = NewPathTemplate("/var/log/*.log")
+	expect.NoError(err)
+	msg = core.NewMessage(nil, []byte("test"), nil, core.WildcardStreamID)
+	expect.Equal("/var/log/ALL.log", template.Resolve(msg))
+}
+
+func TestTemplateEscape(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	template, err := NewTemplate("*/*; {meta.host}/{meta.app}", func(value string) string {
+		return "<" + value + ">"
+	})
+	expect.NoError(err)
+
+	// "*" is not a placeholder and values are passed to escape
+	msg := core.NewMessage(nil, []byte("test"), core.Metadata{
+		"host": []byte("../web01"),
+	}, core.GetStreamID("pathTemplateTest"))
+	expect.Equal("*/*; <../web01>/<>", template.Resolve(msg))
+}
+
+func TestPathTemplateIsUnbounded(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	testCases := map[string]bool{
+		"/var/log/static.log":            false,
+		"/var/log/*/{stream}.log":        false,
+		"/var/log/{meta.host}.log":       true,
+		"/var/log/{time:2006/01}/*.log":  true,
+		"/var/log/{stream}/{time}/a.log": true,
+	}
+
+	for path, expected := range testCases {
+		template, err := NewPathTemplate(path)
+		expect.NoError(err)
+		if !expect.Equal(expected, template.IsUnbounded()) {
+			t.Log(path)
+		}
+	}
+}
@@ -15,6 +15,7 @@
 package components
 
 import (
+	"io/ioutil"
 	"strconv"
 	"strings"
 	"time"
@@ -49,6 +50,18 @@ import (
 // - Rotation/Compress: This value defines if a rotated logfile is to be gzip compressed or not.
 // By default this parameter is set to "false".
 //
+// - Rotation/Compression: This value defines a codec used to compress data
+// while it is written. Valid values are "gzip", "zstd", "lz4" and "snappy"
+// (framing format). The extension of the codec (".gz", ".zst", ".lz4" or
+// ".sz") is appended to the file name. This setting cannot be combined with
+// "Rotation/Compress". Set this parameter to "" to disable streaming compression.
+// By default this parameter is set to "".
+//
+// - Rotation/CompressionLevel: This value defines the compression level
+// passed to the codec, i.e. 1-9 for gzip, 1-22 for zstd and 1-9 for lz4.
+// Set this parameter to "0" to use the default level of the codec.
+// By default this parameter is set to "0".
+//
 // - Rotation/At: This value defines a specific time for rotation in hh:mm format.
 // By default this parameter is set to "".
 //
@@ -61,6 +74,9 @@ type RotateConfig struct {
 	AtMinute  int           `config:"Rotation/AtMin" default:"-1"`
 	Compress  bool          `config:"Rotation/Compress" default:"false"`
 	Enabled   bool          `config:"Rotation/Enable" default:"false"`
+
+	Compression      string `config:"Rotation/Compression" default:""`
+	CompressionLevel int    `config:"Rotation/CompressionLevel" default:"0"`
 }
 
 // NewRotateConfig create and returns a RotateConfig with default settings
@@ -88,4 +104,31 @@ func (rotate *RotateConfig) Configure(conf core.PluginConfigReader) {
 		rotate.AtHour = int(rotateAtHour)
 		rotate.AtMinute = int(rotateAtMin)
 	}
+
+	rotate.Compression = strings.ToLower(rotate.Compression)
+	if rotate.Compression != "" {
+		if _, isKnown := compressionExtensions[rotate.Compression]; !isKnown {
+			conf.Errors.Pushf("Unknown Rotation/Compression %s", rotate.Compression)
+		} else if _, err := newCompressionEncoder(rotate.Compression, rotate.CompressionLevel, ioutil.Discard); err != nil {
+			conf.Errors.Pushf("Invalid Rotation/CompressionLevel: %s", err.Error())
+		}
+		if rotate.Compress {
+			conf.Errors.Pushf("Rotation/Compress cannot be combined with Rotation/Compression")
+		}
+	}
+}
+
+// GetCompressionExtension returns the file extension of the configured
+// compression codec or an empty string if no codec is set.
+func (rotate *RotateConfig) GetCompressionExtension() string {
+	return compressionExtensions[rotate.Compression]
+}
+
+// NewWriter wraps the given writer into a CompressedWriter if a compression
+// codec is configured. Otherwise the writer is returned as is.
+func (rotate *RotateConfig) NewWriter(output BatchedWriter) (BatchedWriter, error) {
+	if rotate.Compression == "" {
+		return output, nil
+	}
+	return NewCompressedWriter(output, rotate.Compression, rotate.CompressionLevel)
 }
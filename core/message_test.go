@@ -159,6 +159,15 @@ func TestMessageCloneOriginalMetadata(t *testing.T) {
 	msg.CloneOriginal()
 
 	expect.Equal("bar", msg.GetMetadata().GetValueString("foo"))
+
+	// The original metadata is restored
+	msg = NewMessage(nil, []byte(msgString), Metadata{"foo": []byte("orig")}, 1)
+	msg.FreezeOriginal()
+	msg.GetMetadata().SetValue("foo", []byte("bar"))
+
+	msgClone := msg.CloneOriginal()
+	expect.Equal("orig", msgClone.GetMetadata().GetValueString("foo"))
+	expect.Equal("bar", msg.GetMetadata().GetValueString("foo"))
 }
 
 func TestMessageMetadata(t *testing.T) {
@@ -45,6 +45,29 @@ type Router interface {
 	Start() error
 }
 
+// producerRouter is implemented by routers that expose their producers, e.g.
+// routers derived from SimpleRouter.
+type producerRouter interface {
+	GetProducers() []Producer
+}
+
+// IsRouterBlocked returns true if at least one producer bound to the given
+// router is blocked, e.g. because its queue is full.
+func IsRouterBlocked(router Router) bool {
+	if router == nil {
+		return false
+	}
+
+	if routerWithProducers, hasProducers := router.(producerRouter); hasProducers {
+		for _, prod := range routerWithProducers.GetProducers() {
+			if prod.IsBlocked() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Route tries to enqueue a message to the given stream. This function also
 // handles redirections enforced by formatters.
 func Route(msg *Message, router Router) error {
@@ -205,10 +205,33 @@ func (cons *SimpleConsumer) Enqueue(data []byte) {
 
 // EnqueueWithMetadata works like EnqueueWithSequence and allows to set meta data directly
 func (cons *SimpleConsumer) EnqueueWithMetadata(data []byte, metaData Metadata) {
-	msg := NewMessage(cons, data, metaData, InvalidStreamID)
+	cons.EnqueueWithMetadataTo(data, metaData, InvalidStreamID)
+}
+
+// EnqueueWithMetadataTo works like EnqueueWithMetadata but sends the message
+// to the given stream instead of the streams bound to this consumer.
+// If InvalidStreamID is passed, the streams bound to this consumer are used.
+func (cons *SimpleConsumer) EnqueueWithMetadataTo(data []byte, metaData Metadata, streamID MessageStreamID) {
+	msg := NewMessage(cons, data, metaData, streamID)
 	cons.enqueueMessage(msg)
 }
 
+// IsStreamBlocked returns true if a producer listening to the given stream is
+// blocked, e.g. because its queue is full. If InvalidStreamID is passed, all
+// streams bound to this consumer are checked.
+func (cons *SimpleConsumer) IsStreamBlocked(streamID MessageStreamID) bool {
+	if streamID != InvalidStreamID {
+		return IsRouterBlocked(StreamRegistry.GetRouterOrFallback(streamID))
+	}
+
+	for _, router := range cons.routers {
+		if IsRouterBlocked(router) {
+			return true
+		}
+	}
+	return false
+}
+
 func (cons *SimpleConsumer) parallelEnqueue(msg *Message) {
 	cons.modulatorQueue.Push(msg, 0)
 }
@@ -222,6 +245,9 @@ loop:
 }
 
 func (cons *SimpleConsumer) directEnqueue(msg *Message) {
+	// Messages created for a specific stream bypass the bound streams
+	targetStreamID := msg.GetStreamID()
+
 	// Execute configured modulators
 	switch cons.modulators.Modulate(msg) {
 	case ModulateResultDiscard:
@@ -238,6 +264,14 @@ func (cons *SimpleConsumer) directEnqueue(msg *Message) {
 	MetricMessagesEnqued.Inc(1)
 	MessageTrace(msg, cons.GetID(), "Enqueued by consumer")
 
+	if targetStreamID != InvalidStreamID {
+		msg.SetlStreamIDAsOriginal(targetStreamID)
+		if err := Route(msg, StreamRegistry.GetRouterOrFallback(targetStreamID)); err != nil {
+			cons.Logger.Error(err)
+		}
+		return // ### return, sent to target stream ###
+	}
+
 	// Send message to all routers registered to this consumer
 	// Last message will not be cloned.
 	numRouters := len(cons.routers)
@@ -135,3 +135,51 @@ func TestSimpleConsumerStateMethods(t *testing.T) {
 	expect.True(mockSimpleConsumer.IsActiveOrStopping())
 	expect.True(mockSimpleConsumer.IsStopping())
 }
+
+func TestSimpleConsumerEnqueueWithMetadataTo(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	mockConf := NewPluginConfig("mockSimpleConsumerEnqueueWithMetadataTo", "mockSimpleConsumer")
+	mockConf.Override("Streams", []string{"testBoundStream"})
+
+	// Router needs to be configured to avoid unknown class errors
+	registerMockRouter("testBoundStream")
+
+	targetRouter := getMockRouterMessageHelper("testTargetStream")
+	StreamRegistry.Register(&targetRouter, targetRouter.GetStreamID())
+
+	mockSimpleConsumer, err := getSimpleConsumer(mockConf)
+	expect.NoError(err)
+
+	metadata := Metadata{"key": []byte("value")}
+	mockSimpleConsumer.EnqueueWithMetadataTo([]byte("target payload"), metadata, targetRouter.GetStreamID())
+
+	expect.True(targetRouter.messageEnqued)
+	expect.Equal("target payload", targetRouter.lastMessageData)
+}
+
+func TestSimpleConsumerIsStreamBlocked(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	mockConf := NewPluginConfig("mockSimpleConsumerIsStreamBlocked", "mockSimpleConsumer")
+	mockConf.Override("Streams", []string{"testBoundStream"})
+
+	// Router needs to be configured to avoid unknown class errors
+	registerMockRouter("testBoundStream")
+
+	blockedRouter := getMockRouterMessageHelper("testBlockedStream")
+	StreamRegistry.Register(&blockedRouter, blockedRouter.GetStreamID())
+
+	mockSimpleConsumer, err := getSimpleConsumer(mockConf)
+	expect.NoError(err)
+
+	mockProducer := getMockBufferedProducer()
+	blockedRouter.AddProducer(&mockProducer)
+
+	mockProducer.setState(PluginStateActive)
+	expect.False(mockSimpleConsumer.IsStreamBlocked(blockedRouter.GetStreamID()))
+
+	mockProducer.setState(PluginStateWaiting)
+	expect.True(mockSimpleConsumer.IsStreamBlocked(blockedRouter.GetStreamID()))
+	expect.False(mockSimpleConsumer.IsStreamBlocked(InvalidStreamID))
+}
@@ -228,6 +228,17 @@ func (prod *SimpleProducer) TryFallback(msg *Message) {
 	}
 }
 
+// TryFallbackWithError routes the message to the configured fallback stream
+// like TryFallback and stores the reason it could not be sent in the metadata
+// field "error" of the routed message.
+func (prod *SimpleProducer) TryFallbackWithError(msg *Message, reason string) {
+	original := msg.CloneOriginal()
+	original.GetMetadata().SetValue("error", []byte(reason))
+	if err := Route(original, prod.fallbackStream); err != nil {
+		prod.Logger.WithError(err).Error("Failed to route to fallback")
+	}
+}
+
 // ControlLoop listens to the control channel and triggers callbacks for these
 // messags. Upon stop control message doExit will be set to true.
 func (prod *SimpleProducer) ControlLoop() {
@@ -0,0 +1,191 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/trivago/gollum/core"
+)
+
+var gelfInvalidFieldChars = regexp.MustCompile(`[^\w\.\-]`)
+
+// ToGELF formatter
+//
+// This formatter converts a message into a GELF 1.1 message as accepted by
+// Graylog. The message content is used as "short_message", all other fields
+// are taken from metadata. Metadata fields that are not used by one of the
+// standard GELF fields are added as additional fields, i.e. prefixed with an
+// underscore. Together with consumer.GELF this allows to forward GELF messages
+// without loss.
+//
+// Parameters
+//
+// - Host: Defines the value of the "host" field if the metadata field defined
+// by HostField is not set.
+// By default this parameter is set to the hostname of the machine.
+//
+// - HostField: Defines the metadata field holding the "host" field.
+// By default this parameter is set to "host".
+//
+// - Level: Defines the value of the "level" field if the metadata field
+// defined by LevelField is not set or not a number.
+// By default this parameter is set to "6" (informational).
+//
+// - LevelField: Defines the metadata field holding the "level" field.
+// By default this parameter is set to "level".
+//
+// - TimestampField: Defines the metadata field holding the "timestamp" field
+// as unix seconds with an optional fraction. If the field is not set or not a
+// number, the creation time of the message is used.
+// By default this parameter is set to "timestamp".
+//
+// - FullMessageField: Defines the metadata field holding the "full_message"
+// field.
+// By default this parameter is set to "full_message".
+//
+// - AdditionalFields: Defines a list of metadata fields to send as additional
+// fields. If empty, all metadata fields not used by a standard field are
+// sent. Characters not allowed in GELF field names are replaced by "_".
+// By default this parameter is set to an empty list.
+//
+// - NullTerminate: If set to true, a null byte is appended to the message as
+// required by GELF over TCP.
+// By default this parameter is set to "false".
+//
+// Examples
+//
+// This example sends messages to a Graylog GELF TCP input.
+//
+//  GraylogOut:
+//    Type: producer.Socket
+//    Streams: "gelf"
+//    Address: "tcp://graylog:12201"
+//    Modulators:
+//      - format.ToGELF:
+//        NullTerminate: true
+//
+type ToGELF struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	host                 string
+	hostField            string `config:"HostField" default:"host"`
+	level                int    `config:"Level" default:"6"`
+	levelField           string `config:"LevelField" default:"level"`
+	timestampField       string `config:"TimestampField" default:"timestamp"`
+	fullMessageField     string `config:"FullMessageField" default:"full_message"`
+	nullTerminate        bool   `config:"NullTerminate" default:"false"`
+	additionalFields     []string
+}
+
+func init() {
+	core.TypeRegistry.Register(ToGELF{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *ToGELF) Configure(conf core.PluginConfigReader) {
+	hostname, _ := os.Hostname()
+	format.host = conf.GetString("Host", hostname)
+	format.additionalFields = conf.GetStringArray("AdditionalFields", []string{})
+}
+
+func (format *ToGELF) isStandardField(key string) bool {
+	switch key {
+	case format.hostField, format.levelField, format.timestampField, format.fullMessageField:
+		return true
+	default:
+		return false
+	}
+}
+
+func (format *ToGELF) addAdditionalField(gelf map[string]interface{}, key string, value []byte) {
+	name := "_" + gelfInvalidFieldChars.ReplaceAllString(key, "_")
+	if name == "_id" || name == "_" {
+		return // ### return, reserved field ###
+	}
+
+	// Keep numbers as numbers so that Graylog can use them in statistics
+	if number, isNumber := parseGELFNumber(value); isNumber {
+		gelf[name] = number
+	} else {
+		gelf[name] = string(value)
+	}
+}
+
+// parseGELFNumber returns the value as number if it can be encoded as JSON
+// number. NaN and infinity are not valid JSON numbers.
+func parseGELFNumber(value []byte) (float64, bool) {
+	number, err := strconv.ParseFloat(string(value), 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+		return 0, false
+	}
+	return number, true
+}
+
+// ApplyFormatter update message payload
+func (format *ToGELF) ApplyFormatter(msg *core.Message) error {
+	metadata := msg.TryGetMetadata()
+
+	gelf := map[string]interface{}{
+		"version":       "1.1",
+		"host":          format.host,
+		"short_message": string(format.GetAppliedContent(msg)),
+		"level":         format.level,
+		"timestamp":     float64(msg.GetCreationTime().UnixNano()) / 1e9,
+	}
+
+	if metadata != nil {
+		if host := metadata.GetValueString(format.hostField); host != "" {
+			gelf["host"] = host
+		}
+		if level, err := strconv.Atoi(metadata.GetValueString(format.levelField)); err == nil {
+			gelf["level"] = level
+		}
+		if timestamp, isNumber := parseGELFNumber(metadata.GetValue(format.timestampField)); isNumber {
+			gelf["timestamp"] = timestamp
+		}
+		if fullMessage := metadata.GetValueString(format.fullMessageField); fullMessage != "" {
+			gelf["full_message"] = fullMessage
+		}
+
+		if len(format.additionalFields) > 0 {
+			for _, key := range format.additionalFields {
+				if value, exists := metadata.TryGetValue(key); exists {
+					format.addAdditionalField(gelf, key, value)
+				}
+			}
+		} else {
+			for key, value := range metadata {
+				if !format.isStandardField(key) {
+					format.addAdditionalField(gelf, key, value)
+				}
+			}
+		}
+	}
+
+	payload, err := json.Marshal(gelf)
+	if err != nil {
+		return err
+	}
+	if format.nullTerminate {
+		payload = append(payload, 0)
+	}
+
+	format.SetAppliedContent(msg, payload)
+	return nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestToGELF(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.ToGELF")
+	config.Override("Host", "gollum")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*ToGELF)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("test"), core.Metadata{
+		"level":     []byte("3"),
+		"timestamp": []byte("1385053862.3072"),
+		"app":       []byte("web"),
+		"id":        []byte("reserved"),
+		"user id":   []byte("42"),
+	}, core.InvalidStreamID)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+
+	gelf := make(map[string]interface{})
+	expect.NoError(json.Unmarshal(msg.GetPayload(), &gelf))
+
+	expect.Equal("1.1", gelf["version"])
+	expect.Equal("gollum", gelf["host"])
+	expect.Equal("test", gelf["short_message"])
+	expect.Equal(float64(3), gelf["level"])
+	expect.Equal(1385053862.3072, gelf["timestamp"])
+	expect.Equal("web", gelf["_app"])
+	expect.Equal(float64(42), gelf["_user_id"])
+	_, hasID := gelf["_id"]
+	expect.False(hasID)
+	_, hasFullMessage := gelf["full_message"]
+	expect.False(hasFullMessage)
+}
+
+func TestToGELFAdditionalFields(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.ToGELF")
+	config.Override("AdditionalFields", []string{"app"})
+	config.Override("NullTerminate", true)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*ToGELF)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("test"), core.Metadata{
+		"host":  []byte("web01"),
+		"app":   []byte("web"),
+		"other": []byte("ignored"),
+	}, core.InvalidStreamID)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+
+	payload := msg.GetPayload()
+	expect.Equal(byte(0), payload[len(payload)-1])
+
+	gelf := make(map[string]interface{})
+	expect.NoError(json.Unmarshal(payload[:len(payload)-1], &gelf))
+
+	expect.Equal("web01", gelf["host"])
+	expect.Equal(float64(6), gelf["level"])
+	expect.Equal("web", gelf["_app"])
+	_, hasOther := gelf["_other"]
+	expect.False(hasOther)
+}
+
+func TestToGELFNonFiniteNumbers(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.ToGELF")
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter := plugin.(*ToGELF)
+
+	msg := core.NewMessage(nil, []byte("test"), core.Metadata{
+		"timestamp": []byte("NaN"),
+		"ratio":     []byte("0.5"),
+		"nan":       []byte("NaN"),
+		"inf":       []byte("+Inf"),
+		"neginf":    []byte("-infinity"),
+	}, core.InvalidStreamID)
+
+	// NaN and Inf cannot be encoded as JSON numbers, so they are kept as strings
+	expect.NoError(formatter.ApplyFormatter(msg))
+
+	gelf := make(map[string]interface{})
+	expect.NoError(json.Unmarshal(msg.GetPayload(), &gelf))
+
+	expect.Equal(0.5, gelf["_ratio"])
+	expect.Equal("NaN", gelf["_nan"])
+	expect.Equal("+Inf", gelf["_inf"])
+	expect.Equal("-infinity", gelf["_neginf"])
+	_, isNumber := gelf["timestamp"].(float64)
+	expect.True(isNumber)
+}
@@ -0,0 +1,139 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+type amqpTestConnection struct {
+	closed bool
+}
+
+func (conn *amqpTestConnection) IsClosed() bool {
+	return conn.closed
+}
+
+func (conn *amqpTestConnection) Close() error {
+	conn.closed = true
+	return nil
+}
+
+// amqpTestConfirmation is never confirmed if acked is nil.
+type amqpTestConfirmation struct {
+	acked *bool
+}
+
+func (confirm amqpTestConfirmation) WaitContext(ctx context.Context) (bool, error) {
+	if confirm.acked == nil {
+		<-ctx.Done()
+		return false, ctx.Err()
+	}
+	return *confirm.acked, nil
+}
+
+// amqpTestChannel confirms all messages except those registered in nacked,
+// lost or failed by payload.
+type amqpTestChannel struct {
+	nacked      map[string]bool
+	lost        map[string]bool
+	failed      map[string]bool
+	routingKeys []string
+}
+
+func (channel *amqpTestChannel) publish(ctx context.Context, exchange, routingKey string, publishing amqp.Publishing) (amqpConfirmation, error) {
+	payload := string(publishing.Body)
+	if channel.failed[payload] {
+		return nil, errors.New("channel closed")
+	}
+	channel.routingKeys = append(channel.routingKeys, routingKey)
+
+	if channel.lost[payload] {
+		return amqpTestConfirmation{}, nil
+	}
+	acked := !channel.nacked[payload]
+	return amqpTestConfirmation{acked: &acked}, nil
+}
+
+func newTestAMQP(t *testing.T, settings map[string]interface{}) (*AMQP, *amqpTestChannel, *amqpTestConnection) {
+	prod := newTestProducer(t, "producer.AMQP", settings).(*AMQP)
+	channel := &amqpTestChannel{}
+	connection := &amqpTestConnection{}
+	prod.channel = channel
+	prod.connection = connection
+	return prod, channel, connection
+}
+
+func TestAMQPNack(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	fallback := newTestFallbackRouter("amqpTestNackFallback")
+	prod, channel, connection := newTestAMQP(t, map[string]interface{}{
+		"RoutingKeyFrom": "key",
+		"RoutingKeys":    map[string]string{"access": "logs.access"},
+		"FallbackStream": "amqpTestNackFallback",
+	})
+	channel.nacked = map[string]bool{"b": true}
+
+	prod.assemble([]*core.Message{
+		newTestMessage("a", nil),
+		newTestMessage("b", nil),
+		newTestMessage("c", map[string]string{"key": "orders"}),
+	})
+
+	// Only the rejected message is passed to the fallback
+	expect.Equal([]string{"b"}, fallback.payloads())
+	expect.Equal([]string{"logs.access", "logs.access", "orders"}, channel.routingKeys)
+	expect.False(connection.closed)
+}
+
+func TestAMQPConfirmTimeout(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	fallback := newTestFallbackRouter("amqpTestTimeoutFallback")
+	prod, channel, connection := newTestAMQP(t, map[string]interface{}{
+		"ConfirmTimeoutMs": 10,
+		"FallbackStream":   "amqpTestTimeoutFallback",
+	})
+	channel.lost = map[string]bool{"b": true}
+
+	prod.assemble([]*core.Message{newTestMessage("a", nil), newTestMessage("b", nil)})
+
+	// Confirms of a timed out channel cannot be matched, so it is reopened
+	expect.Equal([]string{"b"}, fallback.payloads())
+	expect.True(connection.closed)
+	expect.Nil(prod.connection)
+	expect.Nil(prod.channel)
+}
+
+func TestAMQPPublishError(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	fallback := newTestFallbackRouter("amqpTestPublishErrorFallback")
+	prod, channel, connection := newTestAMQP(t, map[string]interface{}{
+		"FallbackStream": "amqpTestPublishErrorFallback",
+	})
+	channel.failed = map[string]bool{"b": true}
+
+	prod.assemble([]*core.Message{newTestMessage("a", nil), newTestMessage("b", nil), newTestMessage("c", nil)})
+
+	// Messages published before the error are still confirmed
+	expect.Equal([]string{"b", "c"}, fallback.payloads())
+	expect.Equal([]string{"access"}, channel.routingKeys)
+	expect.True(connection.closed)
+}
@@ -17,7 +17,6 @@ package producer
 import (
 	"fmt"
 	"path/filepath"
-	"strings"
 	"sync"
 	"time"
 
@@ -41,12 +40,45 @@ const defaultAwsEndpoint = "s3.amazonaws.com"
 //
 // Parameters
 //
-// - Bucket: The S3 bucket to upload to
+// - Bucket: The S3 bucket to upload to. A prefix can be added after a "/",
+// e.g. "bucket/logs".
 //
-// - File: This value is used as a template for final file names. The string
-// " * " will replaced with the active stream name.
+// - File: This value is used as a template for the object keys. The key may
+// contain the following placeholders which are resolved for each message:
+// "*" or "{stream}" for the stream name, "{meta.<key>}" for the value of a
+// metadata field and "{time:<layout>}" for the creation time of the message
+// formatted as a go time layout. This allows Hive style partitions like
+// "dt={time:2006-01-02}/host={meta.host}/events.log". The rotation timestamp is
+// added in front of the file extension.
 // By default this parameter is set to "gollum_*.log"
 //
+// - PathStyle: When set to true, the bucket is addressed as part of the path
+// instead of the host name. This is required by most S3 compatible stores
+// like MinIO. Use "Endpoint" to set the URL of such a store, e.g.
+// "http://localhost:9000".
+// By default this parameter is set to "false".
+//
+// - ServerSideEncryption: Defines the server side encryption used for all
+// objects. Valid values are "", "AES256" and "aws:kms".
+// By default this parameter is set to "".
+//
+// - KMSKeyID: Defines the KMS key used if ServerSideEncryption is set to
+// "aws:kms". If empty, the default key of the account is used.
+// By default this parameter is set to "".
+//
+// - StorageClass: Defines the storage class of all objects, e.g.
+// "STANDARD_IA" or "GLACIER_IR". If empty, the default of the bucket is used.
+// By default this parameter is set to "".
+//
+// - ContentType: Defines the content type of all objects.
+// By default this parameter is set to "".
+//
+// - IdleTimeoutSec: Defines the number of seconds after which an object that
+// did not receive any messages is completed. This is useful when using time
+// based placeholders in "File". Set this parameter to "0" to complete objects
+// only when they are rotated.
+// By default this parameter is set to "0".
+//
 // Examples
 //
 // This example sends all received messages from all streams to S3, creating
@@ -74,24 +106,63 @@ const defaultAwsEndpoint = "s3.amazonaws.com"
 //      - format.Envelope:
 //        Postfix: "\n"
 //
+// This example uploads JSON messages as hourly parquet files, e.g. to be
+// queried by Athena.
+//
+//  S3ParquetOut:
+//    Type: producer.AwsS3
+//    Streams: "events"
+//    Region: eu-west-1
+//    Bucket: gollum-s3-test/events
+//    File: "events.parquet"
+//    Rotation:
+//      TimeoutMin: 60
+//      SizeMB: 256
+//    Parquet:
+//      Enable: true
+//      Schema:
+//        time: "timestamp"
+//        event: "string"
+//        user_id: "int64"
+//      Sources:
+//        time: "time"
+//
+// This example writes partitioned objects to a local MinIO server.
+//
+//  MinioOut:
+//    Type: producer.AwsS3
+//    Streams: "logs"
+//    Endpoint: "http://localhost:9000"
+//    PathStyle: true
+//    Credential:
+//      Type: static
+//      Id: minioadmin
+//      Secret: minioadmin
+//    Bucket: logs
+//    File: "dt={time:2006-01-02}/host={meta.host}/{stream}.log"
+//    IdleTimeoutSec: 600
+//
 type AwsS3 struct {
 	core.DirectProducer `gollumdoc:"embed_type"`
 
 	// Rotate is public to make Pruner.Configure() callable (bug in treflect package)
 	// AwsMultiClient is public to make AwsMultiClient.Configure() callable (bug in treflect package)
 	// BatchConfig is public to make BatchedWriterConfig.Configure() callable (bug in treflect package)
+	// Parquet is public to make ParquetConfig.Configure() callable (bug in treflect package)
 	Rotate         components.RotateConfig        `gollumdoc:"embed_type"`
 	AwsMultiClient components.AwsMultiClient      `gollumdoc:"embed_type"`
 	BatchConfig    components.BatchedWriterConfig `gollumdoc:"embed_type"`
+	Parquet        components.ParquetConfig       `gollumdoc:"embed_type"`
 
 	// configurations
-	bucket          string `config:"Bucket" default:""`
-	fileNamePattern string `config:"File" default:"gollum_*.log"`
+	bucket      string        `config:"Bucket" default:""`
+	pathStyle   bool          `config:"PathStyle" default:"false"`
+	idleTimeout time.Duration `config:"IdleTimeoutSec" default:"0" metric:"sec"`
 
 	// properties
-	filesByStream    map[core.MessageStreamID]*components.BatchedWriterAssembly
-	files            map[string]*components.BatchedWriterAssembly
-	hasWildcard      bool
+	keyTemplate      components.PathTemplate
+	uploadOptions    awss3.UploadOptions
+	files            map[string]*components.IdleBatchedWriter
 	batchedFileGuard *sync.RWMutex
 	s3Client         *s3.S3
 }
@@ -105,12 +176,30 @@ func (prod *AwsS3) Configure(conf core.PluginConfigReader) {
 	prod.SetRollCallback(prod.rotateTargetFiles)
 	prod.SetStopCallback(prod.close)
 
-	prod.filesByStream = make(map[core.MessageStreamID]*components.BatchedWriterAssembly)
-	prod.files = make(map[string]*components.BatchedWriterAssembly)
+	prod.files = make(map[string]*components.IdleBatchedWriter)
+
+	var err error
+	prod.keyTemplate, err = components.NewPathTemplate(conf.GetString("File", "gollum_*.log"))
+	conf.Errors.Push(err)
+
+	prod.uploadOptions = awss3.UploadOptions{
+		ServerSideEncryption: conf.GetString("ServerSideEncryption", ""),
+		KMSKeyID:             conf.GetString("KMSKeyID", ""),
+		StorageClass:         conf.GetString("StorageClass", ""),
+		ContentType:          conf.GetString("ContentType", ""),
+	}
+	switch prod.uploadOptions.ServerSideEncryption {
+	case "", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms:
+	default:
+		conf.Errors.Pushf("Unknown ServerSideEncryption %s", prod.uploadOptions.ServerSideEncryption)
+	}
 
-	prod.hasWildcard = strings.IndexByte(prod.fileNamePattern, '*') != -1
 	prod.Rotate.Enabled = true // force rotation
 
+	if prod.Parquet.Enabled && prod.Rotate.Compression != "" {
+		conf.Errors.Pushf("Rotation/Compression cannot be used with parquet output, use Parquet/Compression instead")
+	}
+
 	prod.batchedFileGuard = new(sync.RWMutex)
 }
 
@@ -139,16 +228,20 @@ func (prod *AwsS3) initS3Client() {
 		}
 	}
 
+	if prod.pathStyle {
+		awsConfig.WithS3ForcePathStyle(true)
+	}
+
 	prod.s3Client = s3.New(sess, awsConfig)
 }
 
-func (prod *AwsS3) getBatchedFile(streamID core.MessageStreamID, forceRotate bool) (*components.BatchedWriterAssembly, error) {
-	// get batchedFile from filesByStream[streamID] map
+func (prod *AwsS3) getBatchedFile(baseFileName string, forceRotate bool) (*components.IdleBatchedWriter, error) {
+	// get batchedFile from files[baseFileName] map
 	prod.batchedFileGuard.RLock()
-	batchedFile, fileExists := prod.filesByStream[streamID]
+	batchedFile, fileExists := prod.files[baseFileName]
 	prod.batchedFileGuard.RUnlock()
 	if fileExists {
-		if rotate, err := prod.needsRotate(batchedFile, forceRotate); !rotate {
+		if rotate, err := prod.needsRotate(batchedFile.BatchedWriterAssembly, forceRotate); !rotate {
 			return batchedFile, err // ### return, already open or error ###
 		}
 	}
@@ -157,25 +250,17 @@ func (prod *AwsS3) getBatchedFile(streamID core.MessageStreamID, forceRotate boo
 	defer prod.batchedFileGuard.Unlock()
 
 	// check again to avoid race conditions
-	if batchedFile, fileExists = prod.filesByStream[streamID]; fileExists {
-		if rotate, err := prod.needsRotate(batchedFile, forceRotate); !rotate {
+	if batchedFile, fileExists = prod.files[baseFileName]; fileExists {
+		if rotate, err := prod.needsRotate(batchedFile.BatchedWriterAssembly, forceRotate); !rotate {
 			return batchedFile, err // ### return, already open or error ###
 		}
-	}
-
-	baseFileName := prod.getBaseFileName(streamID)
-
-	// get batchedFile from files[path] and assure the file is correctly mapped
-	batchedFile, fileExists = prod.files[baseFileName]
-	if !fileExists {
-		batchedFile = components.NewBatchedWriterAssembly(
+	} else {
+		batchedFile = components.NewIdleBatchedWriter(components.NewBatchedWriterAssembly(
 			prod.BatchConfig,
 			prod,
 			prod.TryFallback,
 			prod.Logger,
-		)
-
-		prod.filesByStream[streamID] = batchedFile
+		))
 		prod.files[baseFileName] = batchedFile
 	}
 
@@ -188,8 +273,16 @@ func (prod *AwsS3) getBatchedFile(streamID core.MessageStreamID, forceRotate boo
 	}
 
 	// Update BatchedWriterAssembly writer
-	writer := awss3.NewBatchedFileWriter(prod.s3Client, prod.bucket, prod.getFinalFileName(baseFileName), prod.Logger)
-	batchedFile.SetWriter(&writer)
+	writer := awss3.NewBatchedFileWriter(prod.s3Client, prod.bucket, prod.getFinalFileName(baseFileName), prod.uploadOptions, prod.Logger)
+	if prod.Parquet.Enabled {
+		batchedFile.SetWriter(prod.Parquet.NewWriter(&writer))
+	} else {
+		compressedWriter, err := prod.Rotate.NewWriter(&writer)
+		if err != nil {
+			return batchedFile, err // ### return, invalid compression ###
+		}
+		batchedFile.SetWriter(compressedWriter)
+	}
 
 	return batchedFile, nil
 }
@@ -203,8 +296,18 @@ func (prod *AwsS3) needsRotate(batchedFile *components.BatchedWriterAssembly, fo
 	// check if max multipart uploads of 1000 reached
 	// @see: http://docs.aws.amazon.com/AmazonS3/latest/dev/mpuoverview.html
 	// we use 995 to have a small buffer to the limit and need at least +1 upload part for the last flush
-	writer, ok := batchedFile.GetWriter().(awss3.BatchedFileWriterInterface)
-	if ok && writer.GetUploadCount() > 995 {
+	writer := batchedFile.GetWriter()
+	for {
+		// Parquet and compressed writers wrap the s3 writer
+		wrapper, isWrapper := writer.(interface {
+			GetOutput() components.BatchedWriter
+		})
+		if !isWrapper {
+			break
+		}
+		writer = wrapper.GetOutput()
+	}
+	if s3Writer, ok := writer.(awss3.BatchedFileWriterInterface); ok && s3Writer.GetUploadCount() > 995 {
 		prod.Logger.Debug("Rotate true: ", "upload count reached limit of 1000")
 		return true, nil
 	}
@@ -212,15 +315,6 @@ func (prod *AwsS3) needsRotate(batchedFile *components.BatchedWriterAssembly, fo
 	return false, nil
 }
 
-func (prod *AwsS3) getBaseFileName(streamID core.MessageStreamID) string {
-	if prod.hasWildcard {
-		streamName := core.StreamRegistry.GetStreamName(streamID)
-		return strings.Replace(prod.fileNamePattern, "*", streamName, -1)
-	}
-
-	return prod.fileNamePattern
-}
-
 //todo: introduce padding functionality (get list from aws)
 func (prod *AwsS3) getFinalFileName(baseFileName string) string {
 	fileExt := filepath.Ext(baseFileName)
@@ -229,30 +323,60 @@ func (prod *AwsS3) getFinalFileName(baseFileName string) string {
 	timestamp := time.Now().Format(prod.Rotate.Timestamp)
 	signature := fmt.Sprintf("%s_%s", fileName, timestamp)
 
-	return fmt.Sprintf("%s%s", signature, fileExt)
+	return fmt.Sprintf("%s%s%s", signature, fileExt, prod.Rotate.GetCompressionExtension())
 
 }
 
 func (prod *AwsS3) writeMessage(msg *core.Message) {
-	batchedFile, err := prod.getBatchedFile(msg.GetStreamID(), false)
-	if err != nil {
+	// Objects completed for being idle are removed and started again by
+	// getBatchedFile
+	baseFileName := prod.keyTemplate.Resolve(msg)
+	getWriter := func() (*components.IdleBatchedWriter, error) {
+		return prod.getBatchedFile(baseFileName, false)
+	}
+
+	if err := components.AppendToIdleBatchedWriter(msg, getWriter, prod.IsActiveOrStopping, prod.TryFallback); err != nil {
 		prod.Logger.Error("Write error: ", err)
 		prod.TryFallback(msg)
-		return // ### return, fallback ###
 	}
-
-	batchedFile.Batch.AppendOrFlush(msg, batchedFile.Flush, prod.IsActiveOrStopping, prod.TryFallback)
 }
 
 func (prod *AwsS3) writeBatchOnTimeOut() {
+	prod.batchedFileGuard.RLock()
 	for _, batchedFile := range prod.files {
 		batchedFile.FlushOnTimeOut()
 	}
+	prod.batchedFileGuard.RUnlock()
+
+	if prod.idleTimeout > 0 {
+		prod.closeIdleFiles()
+	}
+}
+
+// closeIdleFiles completes all objects that did not receive messages for
+// longer than the idle timeout.
+func (prod *AwsS3) closeIdleFiles() {
+	prod.batchedFileGuard.Lock()
+	defer prod.batchedFileGuard.Unlock()
+
+	for baseFileName, batchedFile := range prod.files {
+		if batchedFile.CloseIfIdle(prod.idleTimeout) {
+			prod.Logger.Debug("Completed idle object ", baseFileName)
+			delete(prod.files, baseFileName)
+		}
+	}
 }
 
 func (prod *AwsS3) rotateTargetFiles() {
-	for streamID := range prod.filesByStream {
-		if _, err := prod.getBatchedFile(streamID, true); err != nil {
+	prod.batchedFileGuard.RLock()
+	baseFileNames := make([]string, 0, len(prod.files))
+	for baseFileName := range prod.files {
+		baseFileNames = append(baseFileNames, baseFileName)
+	}
+	prod.batchedFileGuard.RUnlock()
+
+	for _, baseFileName := range baseFileNames {
+		if _, err := prod.getBatchedFile(baseFileName, true); err != nil {
 			prod.Logger.Error("Rotate error: ", err)
 		}
 	}
@@ -261,6 +385,9 @@ func (prod *AwsS3) rotateTargetFiles() {
 func (prod *AwsS3) close() {
 	defer prod.WorkerDone()
 
+	prod.batchedFileGuard.RLock()
+	defer prod.batchedFileGuard.RUnlock()
+
 	for _, batchedFile := range prod.files {
 		batchedFile.Close()
 	}
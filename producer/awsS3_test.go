@@ -0,0 +1,75 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func newTestAwsS3(t *testing.T, settings map[string]interface{}) *AwsS3 {
+	settings["Bucket"] = "gollum-test"
+	return newTestProducer(t, "producer.AwsS3", settings).(*AwsS3)
+}
+
+func TestAwsS3HiveKeys(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	prod := newTestAwsS3(t, map[string]interface{}{
+		"File":                 "dt={time:2006-01-02}/hour={time:15}/host={meta.host}/{stream}.log",
+		"Rotation/Timestamp":   "2006",
+		"Rotation/Compression": "gzip",
+	})
+
+	msg := core.NewMessage(nil, []byte("test"), core.Metadata{"host": []byte("web/01")}, core.GetStreamID("access"))
+	created := msg.GetCreationTime()
+	partition := "dt=" + created.Format("2006-01-02") + "/hour=" + created.Format("15")
+
+	// Partition values must not create additional prefixes
+	key := prod.keyTemplate.Resolve(msg)
+	expect.Equal(partition+"/host=web_01/access.log", key)
+
+	// The rotation timestamp and the codec extension are added to the key
+	year := time.Now().Format("2006")
+	expect.Equal(partition+"/host=web_01/access_"+year+".log.gz", prod.getFinalFileName(key))
+
+	msg = core.NewMessage(nil, []byte("test"), nil, core.GetStreamID("access"))
+	expect.Equal(partition+"/host=_/access.log", prod.keyTemplate.Resolve(msg))
+}
+
+func TestAwsS3ConfigErrors(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	testCases := []map[string]interface{}{
+		{"File": "dt={time:2006-01-02}/{host}.log"},
+		{"ServerSideEncryption": "aws:unknown"},
+		{"Rotation/Compression": "gzip", "Parquet/Enable": true, "Parquet/Schema": map[string]interface{}{"a": "string"}},
+	}
+
+	for idx, settings := range testCases {
+		conf := core.NewPluginConfig(fmt.Sprintf("awsS3TestConfigErrors%d", idx), "producer.AwsS3")
+		conf.Override("Bucket", "gollum-test")
+		for key, value := range settings {
+			conf.Override(key, value)
+		}
+
+		if _, err := core.NewPluginWithConfig(conf); !expect.NotNil(err) {
+			t.Log(idx)
+		}
+	}
+}
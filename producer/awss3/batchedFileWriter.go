@@ -32,12 +32,21 @@ type BatchedFileWriterInterface interface {
 	GetUploadCount() int
 }
 
+// UploadOptions defines object settings applied to all uploads
+type UploadOptions struct {
+	ServerSideEncryption string // "AES256" or "aws:kms"
+	KMSKeyID             string // only used with "aws:kms"
+	StorageClass         string
+	ContentType          string
+}
+
 // BatchedFileWriter is the file producer core.BatchedWriter implementation for the core.BatchedWriterAssembly
 type BatchedFileWriter struct {
 	s3Client    *s3.S3
 	s3Bucket    string
 	s3SubFolder string
 	fileName    string
+	options     UploadOptions
 	logger      logrus.FieldLogger
 
 	currentMultiPart int64               // current multipart count
@@ -51,7 +60,7 @@ type BatchedFileWriter struct {
 }
 
 // NewBatchedFileWriter returns a BatchedFileWriter instance
-func NewBatchedFileWriter(s3Client *s3.S3, bucket string, fileName string, logger logrus.FieldLogger) BatchedFileWriter {
+func NewBatchedFileWriter(s3Client *s3.S3, bucket string, fileName string, options UploadOptions, logger logrus.FieldLogger) BatchedFileWriter {
 	var s3Bucket, s3SubFolder string
 
 	if strings.Contains(bucket, "/") {
@@ -67,6 +76,7 @@ func NewBatchedFileWriter(s3Client *s3.S3, bucket string, fileName string, logge
 		s3Bucket:    s3Bucket,
 		s3SubFolder: s3SubFolder,
 		fileName:    fileName,
+		options:     options,
 		logger:      logger,
 	}
 
@@ -185,6 +195,18 @@ func (w *BatchedFileWriter) createMultipartUpload() {
 		Bucket: aws.String(w.s3Bucket),
 		Key:    aws.String(w.getS3Path()),
 	}
+	if w.options.ServerSideEncryption != "" {
+		input.SetServerSideEncryption(w.options.ServerSideEncryption)
+		if w.options.KMSKeyID != "" {
+			input.SetSSEKMSKeyId(w.options.KMSKeyID)
+		}
+	}
+	if w.options.StorageClass != "" {
+		input.SetStorageClass(w.options.StorageClass)
+	}
+	if w.options.ContentType != "" {
+		input.SetContentType(w.options.ContentType)
+	}
 
 	result, err := w.s3Client.CreateMultipartUpload(input)
 	if err != nil {
@@ -16,7 +16,10 @@ package producer
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -33,6 +36,10 @@ import (
 //
 // The ElasticSearch producer sends messages to elastic search using the bulk
 // http API. The producer expects a json payload.
+// The bulk action as well as the document id, routing and ingest pipeline can
+// be set per message using metadata fields. Items rejected by Elasticsearch are
+// passed to the fallback stream one by one. The error reason is stored in the
+// metadata field "error" of these messages.
 //
 // Parameters
 //
@@ -57,6 +64,25 @@ import (
 // - Password: This value used as the password for the elasticsearch server.
 // By default this parameter is set to "".
 //
+// - ActionFrom: Defines the metadata field that contains the bulk action of a
+// message. Valid actions are "index", "create", "update", "upsert" and
+// "delete". If the field is not set or empty, the action of the stream is used.
+// By default this parameter is set to "".
+//
+// - IDFrom: Defines the metadata field that contains the document id. If the
+// field is not set or empty, Elasticsearch generates an id. The actions
+// "update", "upsert" and "delete" require an id.
+// By default this parameter is set to "".
+//
+// - RoutingFrom: Defines the metadata field that contains the routing value of
+// a document. If the field is not set or empty, no routing is used.
+// By default this parameter is set to "".
+//
+// - PipelineFrom: Defines the metadata field that contains the ingest pipeline
+// of a document. If the field is not set or empty, the pipeline of the stream
+// is used.
+// By default this parameter is set to "".
+//
 // - StreamProperties: This value defines the mapping and settings for each stream.
 // As index use the stream name here.
 //
@@ -64,7 +90,29 @@ import (
 // index used for the stream.
 //
 // - StreamProperties/<streamName>/Type: This value defines the document type
-// used for the stream.
+// used for the stream. Leave this value empty to use the typeless APIs of
+// Elasticsearch 7.x and newer.
+// By default this parameter is set to "".
+//
+// - StreamProperties/<streamName>/Action: This value defines the bulk action
+// used for the stream. Valid actions are "index", "create", "update", "upsert"
+// and "delete".
+// By default this parameter is set to "index".
+//
+// - StreamProperties/<streamName>/Pipeline: This value defines the ingest
+// pipeline used for the stream.
+// By default this parameter is set to "".
+//
+// - StreamProperties/<streamName>/DataStream: This value can be set to "true"
+// if Index names a data stream (Elasticsearch 7.9 and newer). Data streams only
+// support the "create" action and are not created by this producer, so an
+// index template matching the data stream has to exist. See Template.
+// By default this parameter is set to "false".
+//
+// - StreamProperties/<streamName>/Template: This value is a map which is used
+// as the body of a composable index template named like the index. The
+// template is created or updated when the producer starts. See
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.9/index-templates.html
 //
 // - StreamProperties/<streamName>/TimeBasedIndex: This value can be set to "true"
 // to append the date of the message to the index as in "<index>_<TimeBasedFormat>".
@@ -107,22 +155,51 @@ import (
 //        Settings:
 //          number_of_shards: 1
 //          number_of_replicas: 1
+//
+// This example writes logs to a data stream of Elasticsearch 7.9 or newer and
+// uses the id and pipeline set by the consumer:
+//
+//  producerDataStream:
+//    Type: producer.ElasticSearch
+//    Streams: logs
+//    IDFrom: "id"
+//    PipelineFrom: "pipeline"
+//    Servers:
+//      - http://127.0.0.1:9200
+//    StreamProperties:
+//      logs:
+//        Index: logs-gollum-default
+//        DataStream: true
+//        Template:
+//          index_patterns: ["logs-gollum-*"]
+//          data_stream: {}
+//          priority: 200
 type ElasticSearch struct {
 	core.BatchedProducer `gollumdoc:"embed_type"`
+	actionFrom           string `config:"ActionFrom"`
+	idFrom               string `config:"IDFrom"`
+	routingFrom          string `config:"RoutingFrom"`
+	pipelineFrom         string `config:"PipelineFrom"`
 	connection           elasticConnection
 	indexMap             map[core.MessageStreamID]*indexMapItem
+	knownIndexes         *sync.Map
 }
 
 type indexMapItem struct {
 	name         string
 	typeName     string
+	action       string
+	pipeline     string
 	settings     *elasticIndex
+	template     tcontainer.MarshalMap
 	useTimeIndex bool
+	dataStream   bool
 	timeFormat   string
 }
 
 func newIndexMapItem() *indexMapItem {
 	return &indexMapItem{
+		action:     "index",
 		timeFormat: "2006-01-02",
 	}
 }
@@ -184,6 +261,7 @@ func (prod *ElasticSearch) Configure(conf core.PluginConfigReader) {
 	prod.connection.password = conf.GetString("Password", "")
 	prod.connection.setGzip = conf.GetBool("SetGzip", false)
 	prod.connection.isConnectedStatus = false
+	prod.knownIndexes = new(sync.Map)
 
 	prod.configureIndexSettings(conf.GetMap("StreamProperties", tcontainer.NewMarshalMap()), conf.Errors)
 	prod.configureRetrySettings(conf.GetInt("Retry/Count", 3), conf.GetInt("Retry/TimeToWaitSec", 3))
@@ -230,9 +308,29 @@ func (prod *ElasticSearch) configureIndexSettings(properties tcontainer.MarshalM
 		}
 		indexMapItem.timeFormat = "_" + timeFormat
 
-		indexMapItem.typeName, err = property.String("Type")
-		if err != nil {
-			prod.Logger.Errorf("no data type configured for stream '%s'. Please check your config.", streamName)
+		indexMapItem.typeName, _ = property.String("Type")
+		indexMapItem.pipeline, _ = property.String("Pipeline")
+		indexMapItem.dataStream, _ = property.Bool("DataStream")
+
+		if action, _ := property.String("Action"); action != "" {
+			indexMapItem.action = strings.ToLower(action)
+		}
+		if !isValidElasticAction(indexMapItem.action) {
+			errors.Pushf("Unknown action '%s' for stream '%s'", indexMapItem.action, streamName)
+		}
+
+		if indexMapItem.dataStream {
+			if indexMapItem.useTimeIndex {
+				errors.Pushf("TimeBasedIndex cannot be used with data streams (stream '%s')", streamName)
+			}
+			if action, _ := property.String("Action"); action != "" && indexMapItem.action != "create" {
+				errors.Pushf("Data streams only support the action 'create' (stream '%s')", streamName)
+			}
+			indexMapItem.action = "create"
+		}
+
+		if template, err := property.MarshalMap("Template"); err == nil {
+			indexMapItem.template = template
 		}
 
 		indexMapItem.settings = newElasticIndex(property)
@@ -263,6 +361,10 @@ func (prod *ElasticSearch) indexExists(client *elastic.Client, indexName string)
 }
 
 func (prod *ElasticSearch) createIndexIfRequired(indexName string, settings *elasticIndex) bool {
+	if _, isKnown := prod.knownIndexes.Load(indexName); isKnown {
+		return true // ### return, already checked ###
+	}
+
 	client := prod.getClient()
 	if client == nil {
 		return false
@@ -278,10 +380,22 @@ func (prod *ElasticSearch) createIndexIfRequired(indexName string, settings *ela
 
 	if settings == nil {
 		prod.Logger.Debugf("No settings for index %s", indexName)
+		prod.knownIndexes.Store(indexName, true)
 		return true
 	}
 
+	// The index is checked again with the next batch until all mappings have
+	// been created.
 	for typeName, properties := range settings.Mappings {
+		if typeName == "" {
+			// Typeless mapping API of Elasticsearch 7.x and newer
+			if _, err := client.PerformRequest(context.Background(), "PUT", "/"+indexName+"/_mapping", nil, properties); err != nil {
+				prod.Logger.WithError(err).Errorf("Error creating mapping for %s", indexName)
+				return false // ### return, retry with the next batch ###
+			}
+			continue
+		}
+
 		mapping := client.PutMapping()
 		mapping.Index(indexName)
 		mapping.Type(typeName)
@@ -292,16 +406,104 @@ func (prod *ElasticSearch) createIndexIfRequired(indexName string, settings *ela
 		_, err := mapping.Do(context.Background())
 		if err != nil {
 			prod.Logger.WithError(err).Errorf("Error creating mapping for type %s.%s", indexName, typeName)
+			return false // ### return, retry with the next batch ###
 		}
 	}
 
+	prod.knownIndexes.Store(indexName, true)
 	return true
 }
 
+func (prod *ElasticSearch) putIndexTemplate(name string, template tcontainer.MarshalMap) {
+	client := prod.getClient()
+	if client == nil {
+		return
+	}
+
+	if _, err := client.PerformRequest(context.Background(), "PUT", "/_index_template/"+name, nil, template); err != nil {
+		prod.Logger.WithError(err).Errorf("Failed to put index template %s", name)
+		return
+	}
+	prod.Logger.Debugf("Updated index template %s", name)
+}
+
+// newBulkRequest creates the bulk action of a message
+func (prod *ElasticSearch) newBulkRequest(msg *core.Message, item *indexMapItem) (elastic.BulkableRequest, error) {
+	action := item.action
+	if value := getMetadataString(msg, prod.actionFrom); value != "" {
+		action = strings.ToLower(value)
+	}
+	pipeline := item.pipeline
+	if value := getMetadataString(msg, prod.pipelineFrom); value != "" {
+		pipeline = value
+	}
+	id := getMetadataString(msg, prod.idFrom)
+	routing := getMetadataString(msg, prod.routingFrom)
+	index := item.GetIndexName(msg.GetCreationTime())
+
+	if item.dataStream && action != "create" {
+		return nil, fmt.Errorf("data stream %s does not support action %s", item.name, action)
+	}
+
+	switch action {
+	case "index", "create":
+		request := elastic.NewBulkIndexRequest().
+			OpType(action).
+			Index(index).
+			Type(item.typeName).
+			Doc(msg.String())
+		if id != "" {
+			request.Id(id)
+		}
+		if routing != "" {
+			request.Routing(routing)
+		}
+		if pipeline != "" {
+			request.Pipeline(pipeline)
+		}
+		return request, nil
+
+	case "update", "upsert":
+		if id == "" {
+			return nil, fmt.Errorf("action %s requires a document id", action)
+		}
+		request := elastic.NewBulkUpdateRequest().
+			Index(index).
+			Type(item.typeName).
+			Id(id).
+			Doc(json.RawMessage(msg.GetPayload())).
+			DocAsUpsert(action == "upsert")
+		if routing != "" {
+			request.Routing(routing)
+		}
+		return request, nil
+
+	case "delete":
+		if id == "" {
+			return nil, fmt.Errorf("action %s requires a document id", action)
+		}
+		request := elastic.NewBulkDeleteRequest().
+			Index(index).
+			Type(item.typeName).
+			Id(id)
+		if routing != "" {
+			request.Routing(routing)
+		}
+		return request, nil
+
+	default:
+		return nil, fmt.Errorf("unknown action %s", action)
+	}
+}
+
 func (prod *ElasticSearch) submitMessages(messages []*core.Message) {
 	client := prod.getClient()
 	if client == nil {
 		prod.Logger.Error("Failed to get client. Cannot send messages")
+		for _, msg := range messages {
+			prod.TryFallback(msg)
+		}
+		return // ### return, no connection ###
 	}
 
 	// Handle time based index creation
@@ -316,8 +518,10 @@ func (prod *ElasticSearch) submitMessages(messages []*core.Message) {
 		prod.createIndexIfRequired(indexName, settings)
 	}
 
-	// Send messages
+	// Send messages. Requests are stored in the same order as the messages
+	// they were created from so that responses can be mapped back.
 	bulkRequest := client.Bulk()
+	pending := make([]*core.Message, 0, len(messages))
 	for _, msg := range messages {
 		indexMapItem, isSet := prod.indexMap[msg.GetStreamID()]
 		if !isSet {
@@ -325,12 +529,19 @@ func (prod *ElasticSearch) submitMessages(messages []*core.Message) {
 			continue
 		}
 
-		bulkIndexRequest := elastic.NewBulkIndexRequest()
-		bulkIndexRequest.Index(indexMapItem.GetIndexName(msg.GetCreationTime())).
-			Type(indexMapItem.typeName).
-			Doc(msg.String())
+		request, err := prod.newBulkRequest(msg, indexMapItem)
+		if err != nil {
+			prod.Logger.WithError(err).Warning("Invalid bulk request")
+			prod.TryFallbackWithError(msg, err.Error())
+			continue
+		}
 
-		bulkRequest.Add(bulkIndexRequest)
+		bulkRequest.Add(request)
+		pending = append(pending, msg)
+	}
+
+	if len(pending) == 0 {
+		return // ### return, nothing to send ###
 	}
 
 	// NumberOfActions contains the number of requests in a bulk
@@ -338,24 +549,32 @@ func (prod *ElasticSearch) submitMessages(messages []*core.Message) {
 
 	// Do sends the bulk requests to Elasticsearch
 	bulkResponse, err := bulkRequest.Do(context.Background())
+	if err == nil && len(bulkResponse.Items) != len(pending) {
+		// Items cannot be mapped back to the messages
+		err = fmt.Errorf("Elasticsearch returned %d items for %d actions", len(bulkResponse.Items), len(pending))
+	}
 	if err != nil {
-		prod.Logger.Error(err)
+		prod.Logger.WithError(err).Errorf("Could not send '%d' messages to Elasticsearch", len(pending))
+		for _, msg := range pending {
+			prod.TryFallbackWithError(msg, err.Error())
+		}
+		return // ### return, request failed ###
 	}
 
-	// Bulk request actions get cleared
-	numberOfActionsAfter := bulkRequest.NumberOfActions()
-	if numberOfActionsAfter != 0 {
-		prod.Logger.Errorf("Could not send '%d' messages to Elasticsearch", numberOfActionsAfter)
+	// Items are returned in the order of the requests
+	numFailed := 0
+	for idx, item := range bulkResponse.Items {
+		for _, result := range item {
+			if result.Error != nil {
+				numFailed++
+				prod.TryFallbackWithError(pending[idx], fmt.Sprintf("%s: %s", result.Error.Type, result.Error.Reason))
+			}
+		}
 	}
 
-	if bulkResponse != nil {
-		// Indexed returns information abount indexed documents
-		indexed := bulkResponse.Indexed()
-		prod.Logger.Debugf("%d messages indexed successfully in Elasticsearch", len(indexed))
-
-		// Created returns information about created documents
-		created := bulkResponse.Created()
-		prod.Logger.Debugf("%d messages created successfully in Elasticsearch", len(created))
+	prod.Logger.Debugf("%d messages sent successfully to Elasticsearch", len(pending)-numFailed)
+	if numFailed > 0 {
+		prod.Logger.Errorf("%d messages were rejected by Elasticsearch", numFailed)
 	}
 }
 
@@ -363,9 +582,12 @@ func (prod *ElasticSearch) submitMessages(messages []*core.Message) {
 func (prod *ElasticSearch) Produce(workers *sync.WaitGroup) {
 	defer prod.WorkerDone()
 
-	// create all indexes that are not time based
+	// create all templates and all indexes that are not time based
 	for _, item := range prod.indexMap {
-		if !item.useTimeIndex {
+		if item.template != nil {
+			prod.putIndexTemplate(item.name, item.template)
+		}
+		if !item.useTimeIndex && !item.dataStream {
 			prod.createIndexIfRequired(item.name, item.settings)
 		}
 	}
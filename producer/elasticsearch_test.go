@@ -0,0 +1,215 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func newTestElasticSearch(t *testing.T, settings map[string]interface{}) *ElasticSearch {
+	settings["ActionFrom"] = "action"
+	settings["IDFrom"] = "id"
+	settings["RoutingFrom"] = "routing"
+	settings["PipelineFrom"] = "pipeline"
+	settings["Retry/Count"] = 0
+	settings["StreamProperties"] = map[string]interface{}{
+		"logs":    map[string]interface{}{"Index": "logs", "Pipeline": "default"},
+		"metrics": map[string]interface{}{"Index": "metrics-gollum", "DataStream": true},
+	}
+	return newTestProducer(t, "producer.ElasticSearch", settings).(*ElasticSearch)
+}
+
+func TestElasticSearchBulkRequest(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	prod := newTestElasticSearch(t, map[string]interface{}{})
+
+	logs := prod.indexMap[core.GetStreamID("logs")]
+	metrics := prod.indexMap[core.GetStreamID("metrics")]
+	payload := []byte(`{"a":1}`)
+
+	testCases := []struct {
+		item     *indexMapItem
+		metadata core.Metadata
+		expected []string
+	}{
+		{logs, nil, []string{`{"index":{"_index":"logs","pipeline":"default"}}`, `{"a":1}`}},
+		{logs, core.Metadata{"action": []byte("CREATE"), "id": []byte("1"), "routing": []byte("r"), "pipeline": []byte("p")},
+			[]string{`{"create":{"_id":"1","_index":"logs","_routing":"r","pipeline":"p"}}`, `{"a":1}`}},
+		{logs, core.Metadata{"action": []byte("update"), "id": []byte("1")},
+			[]string{`{"update":{"_id":"1","_index":"logs"}}`, `{"doc":{"a":1},"doc_as_upsert":false}`}},
+		{logs, core.Metadata{"action": []byte("upsert"), "id": []byte("1")},
+			[]string{`{"update":{"_id":"1","_index":"logs"}}`, `{"doc":{"a":1},"doc_as_upsert":true}`}},
+		{logs, core.Metadata{"action": []byte("delete"), "id": []byte("1"), "routing": []byte("r")},
+			[]string{`{"delete":{"_id":"1","_index":"logs","_routing":"r"}}`}},
+		{metrics, nil, []string{`{"create":{"_index":"metrics-gollum"}}`, `{"a":1}`}},
+	}
+
+	for _, testCase := range testCases {
+		msg := core.NewMessage(nil, payload, testCase.metadata, core.InvalidStreamID)
+		request, err := prod.newBulkRequest(msg, testCase.item)
+		expect.NoError(err)
+
+		source, err := request.Source()
+		expect.NoError(err)
+		expect.Equal(testCase.expected, source)
+	}
+
+	invalid := []struct {
+		item     *indexMapItem
+		metadata core.Metadata
+	}{
+		{logs, core.Metadata{"action": []byte("update")}},
+		{logs, core.Metadata{"action": []byte("delete")}},
+		{logs, core.Metadata{"action": []byte("merge"), "id": []byte("1")}},
+		{metrics, core.Metadata{"action": []byte("index")}},
+	}
+
+	for _, testCase := range invalid {
+		msg := core.NewMessage(nil, payload, testCase.metadata, core.InvalidStreamID)
+		_, err := prod.newBulkRequest(msg, testCase.item)
+		expect.NotNil(err)
+	}
+}
+
+func TestElasticSearchItemErrors(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	fallback := newTestFallbackRouter("elasticTestItemErrorsFallback")
+
+	requests := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/_bulk" {
+			return // ### return, health check ###
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		requests <- string(body)
+
+		// The second document is rejected
+		resp.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(resp, `{"took":1,"errors":true,"items":[
+			{"index":{"_index":"logs","status":201}},
+			{"index":{"_index":"logs","status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}},
+			{"index":{"_index":"logs","status":201}}
+		]}`)
+	}))
+	defer server.Close()
+
+	prod := newTestElasticSearch(t, map[string]interface{}{
+		"Servers":        []string{server.URL},
+		"FallbackStream": "elasticTestItemErrorsFallback",
+	})
+
+	logs := core.GetStreamID("logs")
+	prod.submitMessages([]*core.Message{
+		core.NewMessage(nil, []byte(`{"a":1}`), nil, logs),
+		core.NewMessage(nil, []byte(`{"a":"x"}`), nil, logs),
+		core.NewMessage(nil, []byte(`{"a":"invalid action"}`), core.Metadata{"action": []byte("delete")}, logs),
+		core.NewMessage(nil, []byte(`{"a":3}`), nil, logs),
+	})
+
+	// Invalid requests are not sent
+	expect.Equal(6, len(strings.Split(strings.TrimSpace(<-requests), "\n")))
+
+	// Rejected items are mapped back to the messages they were created from
+	expect.Equal([]string{`{"a":"invalid action"}`, `{"a":"x"}`}, fallback.payloads())
+
+	fallback.guard.Lock()
+	defer fallback.guard.Unlock()
+	expect.Equal("action delete requires a document id", fallback.messages[0].GetMetadata().GetValueString("error"))
+	expect.Equal("mapper_parsing_exception: failed to parse", fallback.messages[1].GetMetadata().GetValueString("error"))
+}
+
+func TestElasticSearchItemCountMismatch(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	fallback := newTestFallbackRouter("elasticTestItemCountFallback")
+
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/_bulk" {
+			return // ### return, health check ###
+		}
+
+		// One item is missing, so items cannot be mapped to messages
+		resp.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(resp, `{"took":1,"errors":true,"items":[
+			{"index":{"_index":"logs","status":201}},
+			{"index":{"_index":"logs","status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}
+		]}`)
+	}))
+	defer server.Close()
+
+	prod := newTestElasticSearch(t, map[string]interface{}{
+		"Servers":        []string{server.URL},
+		"FallbackStream": "elasticTestItemCountFallback",
+	})
+
+	logs := core.GetStreamID("logs")
+	prod.submitMessages([]*core.Message{
+		core.NewMessage(nil, []byte(`{"a":1}`), nil, logs),
+		core.NewMessage(nil, []byte(`{"a":2}`), nil, logs),
+		core.NewMessage(nil, []byte(`{"a":3}`), nil, logs),
+	})
+
+	// The whole request is treated as failed
+	expect.Equal([]string{`{"a":1}`, `{"a":2}`, `{"a":3}`}, fallback.payloads())
+	for _, reason := range fallback.errors() {
+		expect.Equal("Elasticsearch returned 2 items for 3 actions", reason)
+	}
+}
+
+func TestElasticSearchCreateIndexMapping(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	mappingRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPut {
+			return // ### return, health check or index exists ###
+		}
+
+		// The first mapping request fails
+		mappingRequests++
+		expect.Equal("/logs_2026-10-18/_mapping", req.URL.Path)
+		if mappingRequests == 1 {
+			resp.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(resp, `{"acknowledged":true}`)
+	}))
+	defer server.Close()
+
+	prod := newTestElasticSearch(t, map[string]interface{}{
+		"Servers": []string{server.URL},
+	})
+	settings := prod.indexMap[core.GetStreamID("logs")].settings
+
+	// Indexes are only known after their mappings have been created
+	expect.False(prod.createIndexIfRequired("logs_2026-10-18", settings))
+	_, isKnown := prod.knownIndexes.Load("logs_2026-10-18")
+	expect.False(isKnown)
+
+	expect.True(prod.createIndexIfRequired("logs_2026-10-18", settings))
+	_, isKnown = prod.knownIndexes.Load("logs_2026-10-18")
+	expect.True(isKnown)
+
+	expect.True(prod.createIndexIfRequired("logs_2026-10-18", settings))
+	expect.Equal(2, mappingRequests)
+}
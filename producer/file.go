@@ -18,8 +18,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/components"
@@ -36,8 +36,13 @@ import (
 //
 // Parameters
 //
-// - File: This value contains the path to the log file to write. The wildcard character "*"
-// can be used as a placeholder for the stream name.
+// - File: This value contains the path to the log file to write. The path may
+// contain the following placeholders which are resolved for each message:
+// "*" or "{stream}" for the stream name, "{meta.<key>}" for the value of a
+// metadata field and "{time:<layout>}" for the creation time of the message
+// formatted as a go time layout (e.g. "{time:2006/01/02}"). Path separators
+// are removed from metadata values and missing values are replaced by "_".
+// One file is opened for each resolved path.
 // By default this parameter is set to "/var/log/gollum.log".
 //
 // - FileOverwrite: This value causes the file to be overwritten instead of appending new data
@@ -52,6 +57,15 @@ import (
 // the folders as an octal number.
 // By default this paramater is set to "0755".
 //
+// - IdleTimeoutSec: Defines the number of seconds after which a file that did
+// not receive any messages is closed. This is required when using metadata or
+// time placeholders in "File" as every resolved path keeps a file open. Set
+// this parameter to "0" to keep files open until they are rotated, which is
+// not allowed for such placeholders. This parameter cannot be used together
+// with "FileOverwrite" as reopened files would be truncated.
+// By default this paramater is set to "600" if "File" contains metadata or
+// time placeholders and to "0" otherwise.
+//
 // Examples
 //
 // This example will write the messages from all streams to `/tmp/gollum.log`
@@ -66,26 +80,66 @@ import (
 //      FlushCount: 64
 //      TimeoutSec: 60
 //      FlushTimeoutSec: 3
+//
+// This example writes one file per host and day, using the "host" metadata
+// field. Files that did not receive messages for 10 minutes are closed.
+//
+//  fileOut:
+//    Type: producer.File
+//    Streams: "logs"
+//    File: "/data/{meta.host}/{time:2006/01/02}/{stream}.log"
+//    IdleTimeoutSec: 600
+//
+// This example writes JSON messages as parquet files that are rotated every
+// hour.
+//
+//  parquetOut:
+//    Type: producer.File
+//    Streams: "access"
+//    File: "/data/access.parquet"
+//    Rotation:
+//      Enable: true
+//      TimeoutMin: 60
+//    Parquet:
+//      Enable: true
+//      Schema:
+//        time: "timestamp"
+//        status: "int32"
+//        path: "string"
+//        host: "string"
+//      Sources:
+//        time: "time"
+//        path: "json:request.path"
+//        host: "meta:host"
 type File struct {
 	core.DirectProducer `gollumdoc:"embed_type"`
 
 	// Rotate is public to make Pruner.Configure() callable (bug in treflect package)
 	// Prune is public to make FileRotateConfig.Configure() callable (bug in treflect package)
 	// BatchConfig is public to make BatchedWriterConfig.Configure() callable (bug in treflect package)
+	// Parquet is public to make ParquetConfig.Configure() callable (bug in treflect package)
 	Rotate      components.RotateConfig        `gollumdoc:"embed_type"`
 	Pruner      file.Pruner                    `gollumdoc:"embed_type"`
 	BatchConfig components.BatchedWriterConfig `gollumdoc:"embed_type"`
+	Parquet     components.ParquetConfig       `gollumdoc:"embed_type"`
 
 	batchedFileGuard  *sync.RWMutex
-	filesByStream     map[core.MessageStreamID]*components.BatchedWriterAssembly // mapped files by stream
-	files             map[string]*components.BatchedWriterAssembly               // unique files by target path
-	fileDir           string
-	fileName          string
-	fileExt           string
-	filePermissions   os.FileMode `config:"Permissions" default:"0644"`
-	folderPermissions os.FileMode `config:"FolderPermissions" default:"0755"`
-	overwriteFile     bool        `config:"FileOverwrite"`
-	wildcardPath      bool
+	files             map[string]*fileTarget // unique files by target path
+	pathTemplate      components.PathTemplate
+	filePermissions   os.FileMode   `config:"Permissions" default:"0644"`
+	folderPermissions os.FileMode   `config:"FolderPermissions" default:"0755"`
+	overwriteFile     bool          `config:"FileOverwrite"`
+	idleTimeout       time.Duration `config:"IdleTimeoutSec" default:"0" metric:"sec"`
+}
+
+// fileDefaultIdleTimeout is used for paths with metadata or time placeholders
+// if IdleTimeoutSec is not set.
+const fileDefaultIdleTimeout = 10 * time.Minute
+
+// fileTarget stores the writer of a resolved path
+type fileTarget struct {
+	batchedFile *components.IdleBatchedWriter
+	targetFile  file.TargetFile
 }
 
 func init() {
@@ -99,16 +153,39 @@ func (prod *File) Configure(conf core.PluginConfigReader) {
 	prod.SetRollCallback(prod.rotateLog)
 	prod.SetStopCallback(prod.close)
 
-	prod.filesByStream = make(map[core.MessageStreamID]*components.BatchedWriterAssembly)
-	prod.files = make(map[string]*components.BatchedWriterAssembly)
+	prod.files = make(map[string]*fileTarget)
+
+	var err error
+	prod.pathTemplate, err = components.NewPathTemplate(conf.GetString("File", "/var/log/gollum.log"))
+	conf.Errors.Push(err)
+
+	if prod.pathTemplate.IsUnbounded() {
+		// Files of paths that are not resolved anymore would be kept open
+		// forever, e.g. the files of the last day.
+		switch {
+		case prod.overwriteFile:
+			conf.Errors.Pushf("FileOverwrite cannot be used with metadata or time placeholders in File")
+		case !conf.HasValue("IdleTimeoutSec"):
+			prod.idleTimeout = fileDefaultIdleTimeout
+		case prod.idleTimeout == 0:
+			conf.Errors.Pushf("IdleTimeoutSec must not be 0 if File contains metadata or time placeholders")
+		}
+	}
 
-	logFile := conf.GetString("File", "/var/log/gollum.log")
-	prod.wildcardPath = strings.IndexByte(logFile, '*') != -1
+	if prod.overwriteFile && prod.idleTimeout > 0 {
+		conf.Errors.Pushf("IdleTimeoutSec cannot be used with FileOverwrite")
+	}
 
-	prod.fileDir = filepath.Dir(logFile)
-	prod.fileExt = filepath.Ext(logFile)
-	prod.fileName = filepath.Base(logFile)
-	prod.fileName = prod.fileName[:len(prod.fileName)-len(prod.fileExt)]
+	if prod.Parquet.Enabled {
+		// Parquet files cannot be appended to or compressed as a whole, so
+		// every file opened has to be a new one.
+		if !prod.Rotate.Enabled {
+			conf.Errors.Pushf("Parquet output requires Rotation/Enable")
+		}
+		if prod.Rotate.Compress || prod.Rotate.Compression != "" {
+			conf.Errors.Pushf("Rotation/Compress and Rotation/Compression cannot be used with parquet output, use Parquet/Compression instead")
+		}
+	}
 
 	prod.batchedFileGuard = new(sync.RWMutex)
 }
@@ -119,14 +196,16 @@ func (prod *File) Produce(workers *sync.WaitGroup) {
 	prod.TickerMessageControlLoop(prod.writeMessage, prod.BatchConfig.BatchTimeout, prod.writeBatchOnTimeOut)
 }
 
-func (prod *File) getBatchedFile(streamID core.MessageStreamID) (*components.BatchedWriterAssembly, error) {
-	// get batchedFile from filesByStream[streamID] map
+func (prod *File) getBatchedFile(msg *core.Message) (*fileTarget, error) {
+	path := prod.pathTemplate.Resolve(msg)
+
+	// get target from files[path] map
 	prod.batchedFileGuard.RLock()
-	batchedFile, fileIsLinked := prod.filesByStream[streamID]
+	target, fileExists := prod.files[path]
 	prod.batchedFileGuard.RUnlock()
-	if fileIsLinked {
-		if rotate, err := batchedFile.NeedsRotate(prod.Rotate, false); !rotate {
-			return batchedFile, err // ### return, already open or error ###
+	if fileExists {
+		if rotate, err := target.batchedFile.NeedsRotate(prod.Rotate, false); !rotate {
+			return target, err // ### return, already open or error ###
 		}
 	}
 
@@ -134,39 +213,27 @@ func (prod *File) getBatchedFile(streamID core.MessageStreamID) (*components.Bat
 	defer prod.batchedFileGuard.Unlock()
 
 	// check again to avoid race conditions
-	batchedFile, fileIsLinked = prod.filesByStream[streamID]
-	if fileIsLinked {
-		if rotate, err := batchedFile.NeedsRotate(prod.Rotate, false); !rotate {
-			return batchedFile, err // ### return, already open or error ###
+	target, fileExists = prod.files[path]
+	if fileExists {
+		if rotate, err := target.batchedFile.NeedsRotate(prod.Rotate, false); !rotate {
+			return target, err // ### return, already open or error ###
 		}
-	}
-
-	streamTargetFile := prod.newStreamTargetFile(streamID)
-
-	// get batchedFile from files[path] and assure the file is correctly mapped
-	batchedFile, fileExists := prod.files[streamTargetFile.GetOriginalPath()]
-	if !fileExists {
-		batchedFile = components.NewBatchedWriterAssembly(
-			prod.BatchConfig,
-			prod,
-			prod.TryFallback,
-			prod.Logger,
-		)
-
-		prod.files[streamTargetFile.GetOriginalPath()] = batchedFile
-		prod.filesByStream[streamID] = batchedFile
-	} else if !fileIsLinked {
-		// in this case two streams target the same file
-		// need to link and check rotation again
-		prod.filesByStream[streamID] = batchedFile
-		if rotate, err := batchedFile.NeedsRotate(prod.Rotate, false); !rotate {
-			return batchedFile, err // ### return, already open or error ###
+	} else {
+		target = &fileTarget{
+			batchedFile: components.NewIdleBatchedWriter(components.NewBatchedWriterAssembly(
+				prod.BatchConfig,
+				prod,
+				prod.TryFallback,
+				prod.Logger,
+			)),
+			targetFile: prod.newTargetFile(path),
 		}
+		prod.files[path] = target
 	}
 
-	err := prod.rotateBatchedFile(batchedFile, streamTargetFile)
+	err := prod.rotateBatchedFile(target.batchedFile.BatchedWriterAssembly, target.targetFile)
 
-	return batchedFile, err
+	return target, err
 }
 
 func (prod *File) rotateBatchedFile(batchedFile *components.BatchedWriterAssembly, streamTargetFile file.TargetFile) error {
@@ -175,7 +242,7 @@ func (prod *File) rotateBatchedFile(batchedFile *components.BatchedWriterAssembl
 		return err // ### return, missing directory ###
 	}
 
-	finalPath := streamTargetFile.GetFinalPath(prod.Rotate)
+	finalPath := streamTargetFile.GetFinalPath(prod.Rotate) + prod.Rotate.GetCompressionExtension()
 
 	// Close existing batchedFile.writer
 	if batchedFile.HasWriter() {
@@ -195,7 +262,7 @@ func (prod *File) rotateBatchedFile(batchedFile *components.BatchedWriterAssembl
 
 	// Create "current" symlink
 	if prod.Rotate.Enabled {
-		prod.createCurrentSymlink(finalPath, streamTargetFile.GetSymlinkPath())
+		prod.createCurrentSymlink(finalPath, streamTargetFile.GetSymlinkPath()+prod.Rotate.GetCompressionExtension())
 	}
 
 	// Prune old logs if requested
@@ -211,7 +278,7 @@ func (prod *File) createCurrentSymlink(source, target string) {
 	os.Rename(symLinkNameTemporary, target)
 }
 
-func (prod *File) newFileStateWriterDisk(path string) (*file.BatchedFileWriter, error) {
+func (prod *File) newFileStateWriterDisk(path string) (components.BatchedWriter, error) {
 	openFlags := os.O_RDWR | os.O_CREATE | os.O_APPEND
 	if prod.overwriteFile {
 		openFlags |= os.O_TRUNC
@@ -225,31 +292,23 @@ func (prod *File) newFileStateWriterDisk(path string) (*file.BatchedFileWriter,
 	}
 
 	batchedFileWriter := file.NewBatchedFileWriter(fileHandler, prod.Rotate.Compress, prod.Logger)
-	return &batchedFileWriter, nil
-}
-
-func (prod *File) newStreamTargetFile(streamID core.MessageStreamID) file.TargetFile {
-	var fileDir, fileName, fileExt string
-
-	if prod.wildcardPath {
-		// Get state from filename (without timestamp, etc.)
-		var streamName string
-		switch streamID {
-		case core.WildcardStreamID:
-			streamName = "ALL"
-		default:
-			streamName = core.StreamRegistry.GetStreamName(streamID)
-		}
+	if prod.Parquet.Enabled {
+		return prod.Parquet.NewWriter(&batchedFileWriter), nil
+	}
 
-		fileDir = strings.Replace(prod.fileDir, "*", streamName, -1)
-		fileName = strings.Replace(prod.fileName, "*", streamName, -1)
-		fileExt = strings.Replace(prod.fileExt, "*", streamName, -1)
-	} else {
-		// Simple case: only one file used
-		fileDir = prod.fileDir
-		fileName = prod.fileName
-		fileExt = prod.fileExt
+	writer, err := prod.Rotate.NewWriter(&batchedFileWriter)
+	if err != nil {
+		fileHandler.Close()
+		return nil, err // ### return, invalid compression ###
 	}
+	return writer, nil
+}
+
+func (prod *File) newTargetFile(path string) file.TargetFile {
+	fileDir := filepath.Dir(path)
+	fileExt := filepath.Ext(path)
+	fileName := filepath.Base(path)
+	fileName = fileName[:len(fileName)-len(fileExt)]
 
 	return file.NewTargetFile(fileDir, fileName, fileExt, prod.folderPermissions)
 }
@@ -258,40 +317,58 @@ func (prod *File) rotateLog() {
 	prod.batchedFileGuard.Lock()
 	defer prod.batchedFileGuard.Unlock()
 
-	// create unique batchedFile map from prod.filesByStream
-	flushMap := map[file.TargetFile]*components.BatchedWriterAssembly{}
-	for streamID, batchedFile := range prod.filesByStream {
-		streamTargetFile := prod.newStreamTargetFile(streamID)
-		flushMap[streamTargetFile] = batchedFile
-	}
-
 	// rotate every unique batchedFile
-	for streamTargetFile, batchedFile := range flushMap {
-		prod.rotateBatchedFile(batchedFile, streamTargetFile)
+	for _, target := range prod.files {
+		prod.rotateBatchedFile(target.batchedFile.BatchedWriterAssembly, target.targetFile)
 	}
 }
 
 func (prod *File) writeBatchOnTimeOut() {
-	for _, batchedFile := range prod.files {
-		batchedFile.FlushOnTimeOut()
+	prod.batchedFileGuard.RLock()
+	for _, target := range prod.files {
+		target.batchedFile.FlushOnTimeOut()
+	}
+	prod.batchedFileGuard.RUnlock()
+
+	if prod.idleTimeout > 0 {
+		prod.closeIdleFiles()
+	}
+}
+
+// closeIdleFiles closes all files that did not receive messages for longer
+// than the idle timeout. They are reopened when the next message arrives.
+func (prod *File) closeIdleFiles() {
+	prod.batchedFileGuard.Lock()
+	defer prod.batchedFileGuard.Unlock()
+
+	for path, target := range prod.files {
+		if target.batchedFile.CloseIfIdle(prod.idleTimeout) {
+			prod.Logger.Debug("Closed idle file ", path)
+			delete(prod.files, path)
+		}
 	}
 }
 
 func (prod *File) writeMessage(msg *core.Message) {
-	batchedFile, err := prod.getBatchedFile(msg.GetStreamID())
-	if err != nil {
+	// Files closed for being idle are removed and reopened by getBatchedFile
+	getWriter := func() (*components.IdleBatchedWriter, error) {
+		target, err := prod.getBatchedFile(msg)
+		return target.batchedFile, err
+	}
+
+	if err := components.AppendToIdleBatchedWriter(msg, getWriter, prod.IsActiveOrStopping, prod.TryFallback); err != nil {
 		prod.Logger.Error("Write error: ", err)
 		prod.TryFallback(msg)
-		return // ### return, fallback ###
 	}
-
-	batchedFile.Batch.AppendOrFlush(msg, batchedFile.Flush, prod.IsActiveOrStopping, prod.TryFallback)
 }
 
 func (prod *File) close() {
 	defer prod.WorkerDone()
 
-	for _, batchedFile := range prod.files {
-		batchedFile.Close()
+	prod.batchedFileGuard.RLock()
+	defer prod.batchedFileGuard.RUnlock()
+
+	for _, target := range prod.files {
+		target.batchedFile.Close()
 	}
 }
@@ -21,6 +21,8 @@ import (
 	"github.com/trivago/gollum/core/components"
 	"github.com/trivago/tgo/tio"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
@@ -43,12 +45,16 @@ import (
 // Set this value to "0" to disable pruning by file size.
 // By default this parameter is set to "0".
 //
+// Pruning is applied to each directory separately. If "File" contains
+// placeholders, only the files of the same resolved path are considered.
+//
 type Pruner struct {
 	pruneCount int   `config:"Prune/Count" default:"0"`
 	pruneHours int   `config:"Prune/AfterHours" default:"0"`
 	pruneSize  int64 `config:"Prune/TotalSizeMB" default:"0" metric:"mb"`
 	rotate     components.RotateConfig
 	Logger     logrus.FieldLogger // Logger need to set
+	dirGuards  sync.Map           // one *sync.Mutex per directory
 }
 
 // Configure initializes this object with values from a plugin config.
@@ -64,6 +70,11 @@ func (pruner *Pruner) Configure(conf core.PluginConfigReader) {
 
 // Prune starts prune methods by hours, by count and by size
 func (pruner *Pruner) Prune(baseFilePath string) {
+	// Do not prune the same directory concurrently
+	guard, _ := pruner.dirGuards.LoadOrStore(filepath.Dir(baseFilePath), new(sync.Mutex))
+	guard.(*sync.Mutex).Lock()
+	defer guard.(*sync.Mutex).Unlock()
+
 	if pruner.pruneHours > 0 {
 		pruner.pruneByHour(baseFilePath, pruner.pruneHours)
 	}
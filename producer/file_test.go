@@ -0,0 +1,220 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func newTestFile(t *testing.T, settings map[string]interface{}) (*File, string) {
+	dir, err := ioutil.TempDir("", "gollum-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings["File"] = filepath.Join(dir, settings["File"].(string))
+	settings["Batch/TimeoutSec"] = 0
+	return newTestProducer(t, "producer.File", settings).(*File), dir
+}
+
+// newTestFileMessage creates a message for the given host that has been
+// created at the given time.
+func newTestFileMessage(payload, host string, created time.Time) *core.Message {
+	data, _ := proto.Marshal(&core.SerializedMessage{
+		StreamID:  proto.Uint64(uint64(core.GetStreamID("access"))),
+		Timestamp: proto.Int64(created.UnixNano()),
+		Data: &core.SerializedMessageData{
+			Data:     []byte(payload),
+			Metadata: core.Metadata{"host": []byte(host)},
+		},
+	})
+	msg, _ := core.DeserializeMessage(data)
+	return msg
+}
+
+// closeTestFiles closes all open files and waits for pending writes.
+func closeTestFiles(prod *File) {
+	prod.batchedFileGuard.Lock()
+	defer prod.batchedFileGuard.Unlock()
+
+	for path, target := range prod.files {
+		target.batchedFile.Close()
+		delete(prod.files, path)
+	}
+}
+
+// readTestFiles returns the content of all files below dir by relative path.
+func readTestFiles(t *testing.T, dir string) map[string]string {
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		relPath, _ := filepath.Rel(dir, path)
+		files[relPath] = string(content)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestFileTemplate(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	prod, dir := newTestFile(t, map[string]interface{}{
+		"File": "{meta.host}/{time:2006-01-02}/{stream}.log",
+	})
+	defer os.RemoveAll(dir)
+
+	// Files are closed after 10 minutes by default
+	expect.Equal(fileDefaultIdleTimeout, prod.idleTimeout)
+
+	today := time.Date(2026, 10, 18, 12, 0, 0, 0, time.Local)
+	yesterday := today.Add(-24 * time.Hour)
+
+	prod.writeMessage(newTestFileMessage("a", "web01", today))
+	prod.writeMessage(newTestFileMessage("b", "web02", today))
+	prod.writeMessage(newTestFileMessage("c", "web01", yesterday))
+	prod.writeMessage(newTestFileMessage("d", "web/01", today))
+	prod.writeMessage(newTestFileMessage("e", "web01", today))
+	closeTestFiles(prod)
+
+	expect.Equal(map[string]string{
+		filepath.Join("web01", "2026-10-18", "access.log"):  "ae",
+		filepath.Join("web02", "2026-10-18", "access.log"):  "b",
+		filepath.Join("web01", "2026-10-17", "access.log"):  "c",
+		filepath.Join("web_01", "2026-10-18", "access.log"): "d",
+	}, readTestFiles(t, dir))
+}
+
+func TestFileConfigErrors(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	// Files of metadata or time placeholders have to be closed eventually
+	testCases := []map[string]interface{}{
+		{"File": "/tmp/{meta.host}.log", "IdleTimeoutSec": 0},
+		{"File": "/tmp/{time}.log", "FileOverwrite": true},
+		{"File": "/tmp/*.log", "FileOverwrite": true, "IdleTimeoutSec": 60},
+	}
+
+	for idx, settings := range testCases {
+		conf := core.NewPluginConfig(fmt.Sprintf("fileTestConfigErrors%d", idx), "producer.File")
+		for key, value := range settings {
+			conf.Override(key, value)
+		}
+
+		if _, err := core.NewPluginWithConfig(conf); !expect.NotNil(err) {
+			t.Log(idx)
+		}
+	}
+}
+
+func TestFileIdleTimeout(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	prod, dir := newTestFile(t, map[string]interface{}{
+		"File":           "{meta.host}.log",
+		"IdleTimeoutSec": 1,
+	})
+	defer os.RemoveAll(dir)
+	prod.idleTimeout = 50 * time.Millisecond
+
+	now := time.Now()
+	prod.writeMessage(newTestFileMessage("a", "web01", now))
+	prod.writeMessage(newTestFileMessage("b", "web02", now))
+
+	time.Sleep(prod.idleTimeout)
+	prod.writeMessage(newTestFileMessage("c", "web02", now))
+	prod.closeIdleFiles()
+
+	// Only the file that did not receive messages has been closed
+	prod.batchedFileGuard.RLock()
+	paths := []string{}
+	for path := range prod.files {
+		paths = append(paths, path)
+	}
+	prod.batchedFileGuard.RUnlock()
+	expect.Equal([]string{filepath.Join(dir, "web02.log")}, paths)
+
+	// Idle files are closed in the background
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if readTestFiles(t, dir)["web01.log"] == "a" {
+			break
+		}
+	}
+
+	// Closed files are reopened and appended to
+	prod.writeMessage(newTestFileMessage("d", "web01", now))
+	closeTestFiles(prod)
+
+	expect.Equal(map[string]string{
+		"web01.log": "ad",
+		"web02.log": "bc",
+	}, readTestFiles(t, dir))
+}
+
+func TestFilePrunePerDirectory(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	prod, dir := newTestFile(t, map[string]interface{}{
+		"File":               "{meta.host}/access.log",
+		"Rotation/Enable":    true,
+		"Rotation/Timestamp": "2006",
+		"Prune/Count":        2,
+	})
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		prod.writeMessage(newTestFileMessage(fmt.Sprintf("a%d", i), "web01", now))
+		prod.writeMessage(newTestFileMessage(fmt.Sprintf("b%d", i), "web02", now))
+		prod.rotateLog()
+	}
+	closeTestFiles(prod)
+
+	// Each directory keeps its own two files
+	rotated := []string{}
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		rotated = rotated[:0]
+		for path := range readTestFiles(t, dir) {
+			if !strings.HasSuffix(path, "_current.log") {
+				rotated = append(rotated, path)
+			}
+		}
+		if len(rotated) <= 4 {
+			break
+		}
+	}
+
+	year := now.Format("2006")
+	sort.Strings(rotated)
+	expect.Equal([]string{
+		filepath.Join("web01", "access_"+year+"_3.log"),
+		filepath.Join("web01", "access_"+year+"_4.log"),
+		filepath.Join("web02", "access_"+year+"_3.log"),
+		filepath.Join("web02", "access_"+year+"_4.log"),
+	}, rotated)
+}
@@ -0,0 +1,495 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo/tmath"
+	"github.com/trivago/tgo/tnet"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	forwardModeMessage       = "message"
+	forwardModeForward       = "forward"
+	forwardModePackedForward = "packedforward"
+)
+
+// Forward producer plugin
+//
+// This producer implements the client side of the Fluentd Forward protocol
+// (version 1) and sends messages to fluentd, fluent-bit or any other server
+// supporting this protocol, e.g. consumer.Forward.
+// Messages are grouped by tag for each batch.
+//
+// Parameters
+//
+// - Address: Defines the address to connect to. This can either be any ip
+// address and port like "localhost:24224" or a file like
+// "unix:///var/run/fluentd.sock".
+// By default this parameter is set to "localhost:24224".
+//
+// - Mode: Defines the forward protocol mode used to send messages.
+// By default this parameter is set to "forward". The following options are available:
+//  - "message": Every message is sent separately.
+//  - "forward": All messages of a batch with the same tag are sent as an array.
+//  - "packedforward": All messages of a batch with the same tag are sent as a
+//  binary stream of events.
+//
+// - Compress: If set to true, the "packedforward" mode will compress events
+// using gzip (CompressedPackedForward mode).
+// By default this parameter is set to "false".
+//
+// - Tag: Defines the tag used for messages. If set to "", the name of the
+// stream the message has been routed to is used.
+// By default this parameter is set to "".
+//
+// - Metadata/Tag: Defines a metadata field that overrides the tag if it is
+// set for a message.
+// By default this parameter is set to "".
+//
+// - RecordField: Defines the record field the message payload is stored in.
+// If set to "", messages must contain a JSON object which is used as record.
+// Messages that are not a JSON object are sent to the fallback in that case.
+// By default this parameter is set to "message".
+//
+// - Metadata/Fields: Defines a mapping of metadata fields to record fields.
+// Metadata fields that are not set are not added to the record.
+// By default this parameter is set to an empty map.
+//
+// - RequireAck: If set to true, the server has to acknowledge each chunk
+// of events. Chunks that are not acknowledged within AckTimeoutMs are sent to
+// the fallback and the connection is reset.
+// By default this parameter is set to "false".
+//
+// - AckTimeoutMs: Defines the time in milliseconds to wait for a connection to
+// be established, for a handshake response or for an acknowledgement.
+// By default this parameter is set to "2000".
+//
+// - SharedKey: If set, the shared key handshake is performed after a
+// connection has been established.
+// By default this parameter is set to "".
+//
+// - SelfHostname: Defines the hostname sent to the server during the
+// handshake.
+// By default this parameter is set to the hostname of the machine.
+//
+// - Batch/MaxCount: This value defines the maximum number of messages that can be buffered
+// before a flush is mandatory. If the buffer is full and a flush is still
+// underway or cannot be triggered out of other reasons, the producer will block.
+// By default this parameter is set to "8192".
+//
+// - Batch/FlushCount: This value defines the number of messages to be buffered before they are
+// sent. This setting is clamped to BatchMaxCount.
+// By default this parameter is set to "Batch/MaxCount / 2".
+//
+// - Batch/TimeoutSec: This value defines the maximum number of seconds to wait after the last
+// message arrived before a batch is flushed automatically.
+// By default this parameter is set to "5".
+//
+// Examples
+//
+// This example sends all messages to a local fluent-bit, using the stream
+// name as tag and waiting for acknowledgements.
+//
+//  ForwardOut:
+//    Type: producer.Forward
+//    Streams: "*"
+//    Address: "localhost:24224"
+//    Mode: "packedforward"
+//    Compress: true
+//    RequireAck: true
+//    Metadata:
+//      Fields:
+//        "hostname": "host"
+//
+type Forward struct {
+	core.BufferedProducer `gollumdoc:"embed_type"`
+	connection            net.Conn
+	reader                *bufio.Reader
+	batch                 core.MessageBatch
+	protocol              string
+	address               string
+	mode                  string
+	hostname              string
+	fieldMetadata         map[string]string
+	compress              bool          `config:"Compress" default:"false"`
+	tag                   string        `config:"Tag"`
+	tagKey                string        `config:"Metadata/Tag"`
+	recordField           string        `config:"RecordField" default:"message"`
+	requireAck            bool          `config:"RequireAck" default:"false"`
+	ackTimeout            time.Duration `config:"AckTimeoutMs" default:"2000" metric:"ms"`
+	sharedKey             string        `config:"SharedKey"`
+	batchTimeout          time.Duration `config:"Batch/TimeoutSec" default:"5" metric:"sec"`
+	batchMaxCount         int           `config:"Batch/MaxCount" default:"8192"`
+	batchFlushCount       int           `config:"Batch/FlushCount" default:"4096"`
+}
+
+// forwardChunk holds all events of a batch sharing the same tag.
+type forwardChunk struct {
+	tag      string
+	records  []map[string]interface{}
+	times    []time.Time
+	messages []*core.Message
+}
+
+func init() {
+	core.TypeRegistry.Register(Forward{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *Forward) Configure(conf core.PluginConfigReader) {
+	prod.SetStopCallback(prod.close)
+
+	prod.protocol, prod.address = tnet.ParseAddress(conf.GetString("Address", "localhost:24224"), "tcp")
+	switch prod.protocol {
+	case "tcp", "unix":
+	default:
+		conf.Errors.Pushf("Unsupported protocol %s", prod.protocol)
+	}
+
+	prod.mode = strings.ToLower(conf.GetString("Mode", forwardModeForward))
+	switch prod.mode {
+	case forwardModeMessage, forwardModeForward, forwardModePackedForward:
+	default:
+		conf.Errors.Pushf("Unknown mode %s", prod.mode)
+	}
+
+	defaultHostname, _ := os.Hostname()
+	prod.hostname = conf.GetString("SelfHostname", defaultHostname)
+	prod.fieldMetadata = conf.GetStringMap("Metadata/Fields", map[string]string{})
+
+	prod.batchFlushCount = tmath.MinI(prod.batchFlushCount, prod.batchMaxCount)
+	prod.batch = core.NewMessageBatch(prod.batchMaxCount)
+}
+
+func (prod *Forward) tryConnect() bool {
+	if prod.connection != nil {
+		return true // ### return, connection active ###
+	}
+
+	conn, err := net.DialTimeout(prod.protocol, prod.address, prod.ackTimeout)
+	if err != nil {
+		prod.Logger.Error("Connection error: ", err)
+		return false // ### return, connection failed ###
+	}
+
+	prod.connection = conn
+	prod.reader = bufio.NewReader(conn)
+
+	if prod.sharedKey != "" {
+		if err := prod.handshake(); err != nil {
+			prod.Logger.Error("Handshake error: ", err)
+			prod.closeConnection()
+			return false // ### return, authentication failed ###
+		}
+	}
+	return true
+}
+
+// handshake performs the shared key authentication.
+func (prod *Forward) handshake() error {
+	decoder := msgpack.NewDecoder(prod.reader)
+	encoder := msgpack.NewEncoder(prod.connection)
+	prod.connection.SetDeadline(time.Now().Add(prod.ackTimeout))
+	defer prod.connection.SetDeadline(time.Time{})
+
+	helo := components.ForwardHelo{}
+	if err := decoder.Decode(&helo); err != nil {
+		return err
+	}
+	if helo.Type != "HELO" {
+		return fmt.Errorf("expected HELO, got %s", helo.Type)
+	}
+
+	salt := components.NewForwardNonce()
+	ping := components.ForwardPing{
+		Type:          "PING",
+		Hostname:      prod.hostname,
+		SharedKeySalt: salt,
+		SharedKeyHash: components.ForwardSharedKeyHash(salt, prod.hostname, helo.Options.Nonce, prod.sharedKey),
+	}
+	if err := encoder.Encode(&ping); err != nil {
+		return err
+	}
+
+	pong := components.ForwardPong{}
+	if err := decoder.Decode(&pong); err != nil {
+		return err
+	}
+	if pong.Type != "PONG" {
+		return fmt.Errorf("expected PONG, got %s", pong.Type)
+	}
+	if !pong.AuthResult {
+		return fmt.Errorf("authentication failed: %s", pong.Reason)
+	}
+
+	expected := components.ForwardSharedKeyHash(salt, pong.Hostname, helo.Options.Nonce, prod.sharedKey)
+	if expected != pong.SharedKeyHash {
+		return fmt.Errorf("server %s sent an invalid shared key", pong.Hostname)
+	}
+	return nil
+}
+
+func (prod *Forward) closeConnection() error {
+	if prod.connection != nil {
+		prod.connection.Close()
+		prod.connection = nil
+		prod.reader = nil
+	}
+	return nil
+}
+
+// getTag returns the tag used for a given message.
+func (prod *Forward) getTag(msg *core.Message) string {
+	if prod.tagKey != "" {
+		if metadata := msg.TryGetMetadata(); metadata != nil {
+			if tag := metadata.GetValueString(prod.tagKey); tag != "" {
+				return tag
+			}
+		}
+	}
+	if prod.tag != "" {
+		return prod.tag
+	}
+	return msg.GetStreamID().GetName()
+}
+
+// getRecord converts a message into a forward protocol record.
+func (prod *Forward) getRecord(msg *core.Message) (map[string]interface{}, error) {
+	record := make(map[string]interface{})
+	if prod.recordField == "" {
+		if err := json.Unmarshal(msg.GetPayload(), &record); err != nil {
+			return nil, err
+		}
+	} else {
+		record[prod.recordField] = string(msg.GetPayload())
+	}
+
+	if metadata := msg.TryGetMetadata(); metadata != nil {
+		for key, field := range prod.fieldMetadata {
+			if value, exists := metadata[key]; exists {
+				record[field] = string(value)
+			}
+		}
+	}
+	return record, nil
+}
+
+// groupMessages converts all messages into records and groups them by tag,
+// keeping the order of first appearance.
+func (prod *Forward) groupMessages(messages []*core.Message) []*forwardChunk {
+	chunks := []*forwardChunk{}
+	chunkByTag := make(map[string]*forwardChunk)
+
+	for _, msg := range messages {
+		record, err := prod.getRecord(msg)
+		if err != nil {
+			prod.Logger.WithError(err).Error("Message is not a valid JSON object")
+			prod.TryFallback(msg)
+			continue
+		}
+
+		tag := prod.getTag(msg)
+		chunk, exists := chunkByTag[tag]
+		if !exists || prod.mode == forwardModeMessage {
+			chunk = &forwardChunk{tag: tag}
+			chunkByTag[tag] = chunk
+			chunks = append(chunks, chunk)
+		}
+
+		chunk.records = append(chunk.records, record)
+		chunk.times = append(chunk.times, msg.GetCreationTime())
+		chunk.messages = append(chunk.messages, msg)
+	}
+	return chunks
+}
+
+// encodeChunk encodes a chunk according to the configured mode.
+func (prod *Forward) encodeChunk(chunk *forwardChunk, chunkID string) ([]byte, error) {
+	buffer := bytes.Buffer{}
+	encoder := msgpack.NewEncoder(&buffer)
+	option := components.ForwardOption{
+		Size:  len(chunk.records),
+		Chunk: chunkID,
+	}
+
+	switch prod.mode {
+	case forwardModeMessage:
+		encoder.EncodeArrayLen(4)
+		encoder.EncodeString(chunk.tag)
+		encoder.Encode(&components.ForwardEventTime{Time: chunk.times[0]})
+		encoder.Encode(chunk.records[0])
+
+	case forwardModeForward:
+		encoder.EncodeArrayLen(3)
+		encoder.EncodeString(chunk.tag)
+		encoder.EncodeArrayLen(len(chunk.records))
+		for idx, record := range chunk.records {
+			encoder.EncodeArrayLen(2)
+			encoder.Encode(&components.ForwardEventTime{Time: chunk.times[idx]})
+			encoder.Encode(record)
+		}
+
+	case forwardModePackedForward:
+		entries, err := prod.encodePackedEntries(chunk)
+		if err != nil {
+			return nil, err
+		}
+		if prod.compress {
+			option.Compressed = components.ForwardCompressionGzip
+		}
+		encoder.EncodeArrayLen(3)
+		encoder.EncodeString(chunk.tag)
+		encoder.EncodeBytes(entries)
+	}
+
+	if err := encoder.Encode(&option); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// encodePackedEntries encodes the events of a chunk as a stream of
+// [time, record] entries.
+func (prod *Forward) encodePackedEntries(chunk *forwardChunk) ([]byte, error) {
+	buffer := bytes.Buffer{}
+	var encoder *msgpack.Encoder
+	var gzipWriter *gzip.Writer
+
+	if prod.compress {
+		gzipWriter = gzip.NewWriter(&buffer)
+		encoder = msgpack.NewEncoder(gzipWriter)
+	} else {
+		encoder = msgpack.NewEncoder(&buffer)
+	}
+
+	for idx, record := range chunk.records {
+		encoder.EncodeArrayLen(2)
+		encoder.Encode(&components.ForwardEventTime{Time: chunk.times[idx]})
+		if err := encoder.Encode(record); err != nil {
+			return nil, err
+		}
+	}
+
+	if gzipWriter != nil {
+		if err := gzipWriter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+// sendChunk writes a chunk to the connection and waits for the
+// acknowledgement if required.
+func (prod *Forward) sendChunk(chunk *forwardChunk) error {
+	chunkID := ""
+	if prod.requireAck {
+		chunkID = components.NewForwardChunkID()
+	}
+
+	data, err := prod.encodeChunk(chunk, chunkID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := prod.connection.Write(data); err != nil {
+		return err
+	}
+
+	if !prod.requireAck {
+		return nil // ### return, no ack required ###
+	}
+
+	prod.connection.SetReadDeadline(time.Now().Add(prod.ackTimeout))
+	defer prod.connection.SetReadDeadline(time.Time{})
+
+	ack := components.ForwardAck{}
+	if err := msgpack.NewDecoder(prod.reader).Decode(&ack); err != nil {
+		return err
+	}
+	if ack.Ack != chunkID {
+		return fmt.Errorf("received ack %s, expected %s", ack.Ack, chunkID)
+	}
+	return nil
+}
+
+// assemble sends all messages of a batch. Messages that could not be sent
+// are passed to the fallback.
+func (prod *Forward) assemble(messages []*core.Message) {
+	chunks := prod.groupMessages(messages)
+	for idx, chunk := range chunks {
+		if !prod.tryConnect() {
+			for _, chunk := range chunks[idx:] {
+				prod.fallbackChunk(chunk)
+			}
+			return // ### return, not connected ###
+		}
+
+		if err := prod.sendChunk(chunk); err != nil {
+			prod.Logger.Error("Write error: ", err)
+			prod.closeConnection()
+			prod.fallbackChunk(chunk)
+		}
+	}
+}
+
+func (prod *Forward) fallbackChunk(chunk *forwardChunk) {
+	for _, msg := range chunk.messages {
+		prod.TryFallback(msg)
+	}
+}
+
+func (prod *Forward) sendMessage(msg *core.Message) {
+	prod.batch.AppendOrFlush(msg, prod.sendBatch, prod.IsActiveOrStopping, prod.TryFallback)
+}
+
+func (prod *Forward) sendBatch() {
+	prod.batch.Flush(prod.assemble)
+}
+
+func (prod *Forward) sendBatchOnTimeOut() {
+	if prod.batch.ReachedTimeThreshold(prod.batchTimeout) || prod.batch.ReachedSizeThreshold(prod.batchFlushCount) {
+		prod.sendBatch()
+	}
+}
+
+func (prod *Forward) close() {
+	defer func() {
+		prod.batch.AfterFlushDo(prod.closeConnection)
+		prod.WorkerDone()
+	}()
+
+	prod.DefaultClose()
+	prod.batch.Close(prod.assemble, prod.GetShutdownTimeout())
+}
+
+// Produce writes to a buffer that is sent to a forward protocol server.
+func (prod *Forward) Produce(workers *sync.WaitGroup) {
+	prod.AddMainWorker(workers)
+	prod.TickerMessageControlLoop(prod.sendMessage, prod.batchTimeout, prod.sendBatchOnTimeOut)
+}
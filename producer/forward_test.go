@@ -0,0 +1,194 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/trivago/gollum/consumer"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+// startTestForwardServer runs a consumer.Forward listening on a unix socket
+// in dir. Received messages are sent to the given stream.
+func startTestForwardServer(t *testing.T, dir, streamName string) (address string, stop func()) {
+	expect := ttesting.NewExpect(t)
+	address = "unix://" + filepath.Join(dir, streamName+".sock")
+
+	conf := core.NewPluginConfig(streamName+"Server", "consumer.Forward")
+	conf.Override("Streams", streamName)
+	conf.Override("Address", address)
+	conf.Override("SharedKey", "secret")
+	conf.Override("SelfHostname", "server")
+	conf.Override("PayloadField", "message")
+	conf.Override("Metadata/Fields", map[string]string{"host": "host"})
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+	cons := plugin.(core.Consumer)
+
+	workers := new(sync.WaitGroup)
+	go cons.Consume(workers)
+	for start := time.Now(); cons.GetState() != core.PluginStateActive; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Forward server did not start")
+		}
+	}
+
+	return address, func() {
+		cons.Control() <- core.PluginControlStopConsumer
+		workers.Wait()
+	}
+}
+
+func newTestForward(t *testing.T, settings map[string]interface{}) *Forward {
+	settings["SelfHostname"] = "client"
+	settings["RequireAck"] = true
+	settings["Metadata/Fields"] = map[string]string{"host": "host"}
+	return newTestProducer(t, "producer.Forward", settings).(*Forward)
+}
+
+func TestForwardRoundTrip(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum-forward")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	received := newTestFallbackRouter("forwardTestRoundTrip")
+	address, stop := startTestForwardServer(t, dir, "forwardTestRoundTrip")
+	defer stop()
+
+	fallback := newTestFallbackRouter("forwardTestRoundTripFallback")
+	testCases := []struct {
+		settings map[string]interface{}
+		expected []string
+	}{
+		// Every message is sent as a separate chunk
+		{map[string]interface{}{"Mode": "message"}, []string{"a", "b", "c"}},
+		// Messages are grouped by tag
+		{map[string]interface{}{"Mode": "forward"}, []string{"a", "c", "b"}},
+		{map[string]interface{}{"Mode": "packedforward"}, []string{"a", "c", "b"}},
+		{map[string]interface{}{"Mode": "packedforward", "Compress": true}, []string{"a", "c", "b"}},
+	}
+
+	for _, testCase := range testCases {
+		testCase.settings["Address"] = address
+		testCase.settings["SharedKey"] = "secret"
+		testCase.settings["Metadata/Tag"] = "tag"
+		testCase.settings["FallbackStream"] = "forwardTestRoundTripFallback"
+		prod := newTestForward(t, testCase.settings)
+
+		received.guard.Lock()
+		received.messages = nil
+		received.guard.Unlock()
+
+		prod.assemble([]*core.Message{
+			newTestMessage("a", map[string]string{"host": "web1"}),
+			newTestMessage("b", map[string]string{"host": "web2", "tag": "app.web"}),
+			newTestMessage("c", nil),
+		})
+		prod.closeConnection()
+
+		// Chunks are acknowledged after the consumer enqueued all events
+		expect.Equal(0, len(fallback.getMessages()))
+		expect.Equal(testCase.expected, received.payloads())
+
+		metadata := make(map[string]core.Metadata)
+		for _, msg := range received.getMessages() {
+			metadata[msg.String()] = msg.GetMetadata()
+		}
+		expect.Equal("access", metadata["a"].GetValueString("tag"))
+		expect.Equal("web1", metadata["a"].GetValueString("host"))
+		expect.Equal("app.web", metadata["b"].GetValueString("tag"))
+		expect.Equal("web2", metadata["b"].GetValueString("host"))
+		expect.Equal("access", metadata["c"].GetValueString("tag"))
+		expect.Equal("", metadata["c"].GetValueString("host"))
+	}
+}
+
+func TestForwardSharedKeyMismatch(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum-forward")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	received := newTestFallbackRouter("forwardTestSharedKey")
+	address, stop := startTestForwardServer(t, dir, "forwardTestSharedKey")
+	defer stop()
+
+	fallback := newTestFallbackRouter("forwardTestSharedKeyFallback")
+	prod := newTestForward(t, map[string]interface{}{
+		"Address":        address,
+		"SharedKey":      "wrong",
+		"FallbackStream": "forwardTestSharedKeyFallback",
+	})
+
+	prod.assemble([]*core.Message{newTestMessage("a", nil), newTestMessage("b", nil)})
+
+	// The connection is closed after the server rejected the handshake
+	expect.Nil(prod.connection)
+	expect.Equal([]string{"a", "b"}, fallback.payloads())
+	expect.Equal(0, len(received.getMessages()))
+}
+
+func TestForwardMissingAck(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	// The server reads all data but never acknowledges a chunk
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	expect.NoError(err)
+	defer listener.Close()
+
+	connections := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			connections <- conn
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	fallback := newTestFallbackRouter("forwardTestMissingAckFallback")
+	prod := newTestForward(t, map[string]interface{}{
+		"Address":        listener.Addr().String(),
+		"AckTimeoutMs":   50,
+		"Metadata/Tag":   "tag",
+		"FallbackStream": "forwardTestMissingAckFallback",
+	})
+
+	prod.assemble([]*core.Message{
+		newTestMessage("a", nil),
+		newTestMessage("b", map[string]string{"tag": "other"}),
+	})
+
+	// Each chunk waits for its own ack, the connection is reset after each
+	// missing ack.
+	expect.Nil(prod.connection)
+	expect.Equal([]string{"a", "b"}, fallback.payloads())
+	expect.Equal(2, len(connections))
+}
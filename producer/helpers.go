@@ -0,0 +1,115 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/tmath"
+)
+
+// getMetadataString returns the value of the given metadata field or an
+// empty string if key is empty or the field is not set.
+func getMetadataString(msg *core.Message, key string) string {
+	if key == "" {
+		return ""
+	}
+	value, _ := msg.TryGetMetadata().TryGetValue(key)
+	return string(value)
+}
+
+// isValidElasticAction returns true if action is a bulk action supported by
+// Elasticsearch and OpenSearch. "upsert" is an update creating missing
+// documents.
+func isValidElasticAction(action string) bool {
+	switch action {
+	case "index", "create", "update", "upsert", "delete":
+		return true
+	default:
+		return false
+	}
+}
+
+// newTLSClientConfig returns the TLS configuration of an HTTP client. caFile
+// replaces the system root CAs, certFile and keyFile are used for mutual TLS.
+func newTLSClientConfig(caFile, certFile, keyFile string, skipVerify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: skipVerify,
+	}
+
+	if caFile != "" {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("No certificates found in %s", caFile)
+		}
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("TlsCertificateLocation and TlsKeyLocation have to be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// getRetryAfter returns the delay requested by the Retry-After header of a
+// response or 0 if none was requested.
+func getRetryAfter(response *http.Response) time.Duration {
+	if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	return 0
+}
+
+// sendWithBackoff calls send until it succeeds, fails permanently, the number
+// of retries is reached or isActive returns false. The delay between two
+// attempts starts at minDelay and is doubled up to maxDelay. If send returns a
+// longer delay, e.g. requested via Retry-After, that delay is used instead.
+// The error of the last attempt is returned.
+func sendWithBackoff(url string, send func() (retry bool, retryAfter time.Duration, err error),
+	retryCount int, minDelay, maxDelay time.Duration, isActive func() bool, logger logrus.FieldLogger) error {
+	delay := minDelay
+	for attempt := 0; ; attempt++ {
+		retry, retryAfter, err := send()
+		if err == nil || !retry || attempt >= retryCount || !isActive() {
+			return err // ### return, done ###
+		}
+
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		logger.WithError(err).Warningf("Request to %s failed, retrying in %s", url, delay)
+		time.Sleep(delay)
+		delay = time.Duration(tmath.MinI(int(2*delay), int(maxDelay)))
+	}
+}
@@ -0,0 +1,455 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+)
+
+// HTTPBatch producer plugin
+//
+// This producer sends batches of messages to a webserver. The URL and the
+// headers of a request are templates that are resolved for each message. Messages resolving to the same URL and headers are sent in
+// one request. This allows to send data to services like Splunk HEC, Datadog
+// or custom webhooks.
+//
+// The response code of a request decides if the messages were sent
+// successfully, if the request is retried or if the messages are passed to
+// the fallback stream. Retries use an exponential backoff and respect the
+// Retry-After header. The reason of a failure is stored in the metadata field
+// "error" of messages passed to the fallback stream.
+//
+// Parameters
+//
+// - URL: Defines the URL of a request. The placeholder "{meta.<key>}" is
+// replaced by the value of the given metadata field, "{stream}" by the name of
+// the stream and "{time:<layout>}" by the creation time of the message
+// formatted as a go time layout, e.g. "http://hooks/{meta.tenant}/events".
+// Metadata values are URL encoded, missing values are replaced by "".
+// By default this parameter is set to "http://localhost:80/".
+//
+// - Method: Defines the HTTP method used for requests.
+// By default this parameter is set to "POST".
+//
+// - Headers: Defines a map of header name to value. Values can contain the
+// same placeholders as URL. Metadata values are not encoded. Messages whose
+// headers contain control characters like line breaks are passed to the
+// fallback stream.
+// By default this parameter is set to an empty map.
+//
+// - Framing: Defines how messages are combined into a request body.
+// "ndjson" sends one message per line, "array" sends a JSON array of all
+// messages and "single" sends one request per message. Messages that are not
+// valid JSON are passed to the fallback stream when using "array".
+// By default this parameter is set to "ndjson".
+//
+// - ContentType: Defines the Content-Type header. If empty, the content type
+// is chosen by Framing, i.e. "application/x-ndjson", "application/json" or
+// "text/plain; charset=utf-8".
+// By default this parameter is set to "".
+//
+// - SuccessCodes: Defines the response codes treated as success. Codes can
+// be given as number, as range ("200-204") or as class ("2xx").
+// By default this parameter is set to ["2xx"].
+//
+// - RetryCodes: Defines the response codes that cause a request to be retried.
+// All codes that are neither success nor retry codes pass the messages to the
+// fallback stream. Connection errors are always retried.
+// By default this parameter is set to ["429", "5xx"].
+//
+// - SetGzip: When set to true, request bodies are gzip compressed.
+// By default this parameter is set to "false".
+//
+// - TimeoutSec: Defines the number of seconds to wait for a request.
+// By default this parameter is set to "30".
+//
+// - Retry/Count: Defines the number of retries before a request is considered
+// failed.
+// By default this parameter is set to "3".
+//
+// - Retry/MinDelayMs: Defines the number of milliseconds to wait before the
+// first retry. The delay is doubled after each retry.
+// By default this parameter is set to "500".
+//
+// - Retry/MaxDelaySec: Defines the maximum number of seconds to wait between
+// two retries.
+// By default this parameter is set to "30".
+//
+// - TlsCaLocation: Defines the path to the CA certificate(s) used to verify
+// the server.
+// By default this parameter is set to "".
+//
+// - TlsCertificateLocation: Defines the path to a client certificate (PEM)
+// used for mutual TLS. TlsKeyLocation has to be set, too.
+// By default this parameter is set to "".
+//
+// - TlsKeyLocation: Defines the path to the private key of the client
+// certificate (PEM).
+// By default this parameter is set to "".
+//
+// - TlsInsecureSkipVerify: When set to true, server certificates are not
+// verified.
+// By default this parameter is set to "false".
+//
+// Examples
+//
+// This example sends events to the Splunk HTTP event collector:
+//
+//  SplunkOut:
+//    Type: producer.HTTPBatch
+//    Streams: events
+//    URL: "https://splunk:8088/services/collector/event"
+//    Headers:
+//      Authorization: "Splunk 6c3ad3a0-7a3d-4a3b-9c0e-8ad1b2a7e0f1"
+//
+// This example sends logs to Datadog, using the API key of each tenant:
+//
+//  DatadogOut:
+//    Type: producer.HTTPBatch
+//    Streams: logs
+//    URL: "https://http-intake.logs.datadoghq.com/api/v2/logs"
+//    Framing: array
+//    SetGzip: true
+//    Headers:
+//      DD-API-KEY: "{meta.dd_api_key}"
+//
+// This example calls a webhook for each alert. Unknown hooks are not retried:
+//
+//  WebhookOut:
+//    Type: producer.HTTPBatch
+//    Streams: alerts
+//    Method: PUT
+//    URL: "https://hooks.example.com/{meta.team}"
+//    Framing: single
+//    ContentType: application/json
+//    RetryCodes: ["408", "429", "502-504"]
+//
+type HTTPBatch struct {
+	core.BatchedProducer `gollumdoc:"embed_type"`
+	method               string        `config:"Method" default:"POST"`
+	contentType          string        `config:"ContentType"`
+	gzip                 bool          `config:"SetGzip" default:"false"`
+	timeout              time.Duration `config:"TimeoutSec" default:"30" metric:"sec"`
+	retryCount           int           `config:"Retry/Count" default:"3"`
+	retryMinDelay        time.Duration `config:"Retry/MinDelayMs" default:"500" metric:"ms"`
+	retryMaxDelay        time.Duration `config:"Retry/MaxDelaySec" default:"30" metric:"sec"`
+	tlsCaFile            string        `config:"TlsCaLocation"`
+	tlsCertFile          string        `config:"TlsCertificateLocation"`
+	tlsKeyFile           string        `config:"TlsKeyLocation"`
+	tlsSkipVerify        bool          `config:"TlsInsecureSkipVerify" default:"false"`
+	framing              string
+	urlTemplate          components.PathTemplate
+	headerTemplates      map[string]components.PathTemplate
+	successCodes         []httpStatusRange
+	retryCodes           []httpStatusRange
+	client               *http.Client
+}
+
+// httpStatusRange is an inclusive range of HTTP status codes
+type httpStatusRange struct {
+	min int
+	max int
+}
+
+// httpBatchRequest is a set of messages sent with the same URL and headers
+type httpBatchRequest struct {
+	url      string
+	headers  map[string]string
+	messages []*core.Message
+}
+
+func init() {
+	core.TypeRegistry.Register(HTTPBatch{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *HTTPBatch) Configure(conf core.PluginConfigReader) {
+	var err error
+	prod.method = strings.ToUpper(prod.method)
+
+	prod.urlTemplate, err = components.NewTemplate(conf.GetString("URL", "http://localhost:80/"), escapeURLValue)
+	conf.Errors.Push(err)
+
+	prod.headerTemplates = make(map[string]components.PathTemplate)
+	for name, value := range conf.GetStringMap("Headers", map[string]string{}) {
+		headerTemplate, err := components.NewTemplate(value, escapeHeaderValue)
+		if !conf.Errors.Push(err) {
+			prod.headerTemplates[http.CanonicalHeaderKey(name)] = headerTemplate
+		}
+	}
+
+	prod.framing = strings.ToLower(conf.GetString("Framing", "ndjson"))
+	switch prod.framing {
+	case "ndjson":
+		if prod.contentType == "" {
+			prod.contentType = "application/x-ndjson"
+		}
+	case "array":
+		if prod.contentType == "" {
+			prod.contentType = "application/json"
+		}
+	case "single":
+		if prod.contentType == "" {
+			prod.contentType = "text/plain; charset=utf-8"
+		}
+	default:
+		conf.Errors.Pushf("Unknown Framing %s", prod.framing)
+	}
+
+	prod.successCodes, err = parseHTTPStatusRanges(conf.GetStringArray("SuccessCodes", []string{"2xx"}))
+	conf.Errors.Push(err)
+	prod.retryCodes, err = parseHTTPStatusRanges(conf.GetStringArray("RetryCodes", []string{"429", "5xx"}))
+	conf.Errors.Push(err)
+
+	tlsConfig, err := newTLSClientConfig(prod.tlsCaFile, prod.tlsCertFile, prod.tlsKeyFile, prod.tlsSkipVerify)
+	conf.Errors.Push(err)
+
+	prod.client = &http.Client{
+		Timeout: prod.timeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+}
+
+// escapeURLValue encodes metadata values so that they can be used in the
+// path as well as in the query of a URL.
+func escapeURLValue(value string) string {
+	return strings.Replace(url.QueryEscape(value), "+", "%20", -1)
+}
+
+// escapeHeaderValue returns metadata values used in headers as they are.
+// Values containing control characters are rejected by isValidHeaderValue.
+func escapeHeaderValue(value string) string {
+	return value
+}
+
+// isValidHeaderValue returns false if value contains control characters
+// other than tab, e.g. line breaks, that cannot be sent in a header.
+func isValidHeaderValue(value string) bool {
+	for idx := 0; idx < len(value); idx++ {
+		if char := value[idx]; (char < ' ' && char != '\t') || char == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// parseHTTPStatusRanges parses status codes like "200", "200-204" or "2xx"
+func parseHTTPStatusRanges(codes []string) ([]httpStatusRange, error) {
+	ranges := make([]httpStatusRange, 0, len(codes))
+	for _, code := range codes {
+		code = strings.ToLower(strings.TrimSpace(code))
+
+		switch {
+		case len(code) == 3 && strings.HasSuffix(code, "xx"):
+			class, err := strconv.Atoi(code[:1])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid status code %s", code)
+			}
+			ranges = append(ranges, httpStatusRange{class * 100, class*100 + 99})
+
+		case strings.Contains(code, "-"):
+			bounds := strings.SplitN(code, "-", 2)
+			min, minErr := strconv.Atoi(bounds[0])
+			max, maxErr := strconv.Atoi(bounds[1])
+			if minErr != nil || maxErr != nil || min > max {
+				return nil, fmt.Errorf("Invalid status code range %s", code)
+			}
+			ranges = append(ranges, httpStatusRange{min, max})
+
+		default:
+			status, err := strconv.Atoi(code)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid status code %s", code)
+			}
+			ranges = append(ranges, httpStatusRange{status, status})
+		}
+	}
+	return ranges, nil
+}
+
+func matchesHTTPStatus(ranges []httpStatusRange, status int) bool {
+	for _, statusRange := range ranges {
+		if status >= statusRange.min && status <= statusRange.max {
+			return true
+		}
+	}
+	return false
+}
+
+// groupRequests resolves URL and headers of all messages and groups messages
+// with equal results.
+func (prod *HTTPBatch) groupRequests(messages []*core.Message) []*httpBatchRequest {
+	requests := []*httpBatchRequest{}
+	requestsByKey := make(map[string]*httpBatchRequest)
+
+	for _, msg := range messages {
+		if prod.framing == "array" && !json.Valid(msg.GetPayload()) {
+			prod.TryFallbackWithError(msg, "message is not valid JSON")
+			continue
+		}
+
+		requestURL := prod.urlTemplate.Resolve(msg)
+		headers := make(map[string]string, len(prod.headerTemplates))
+		headerNames := make([]string, 0, len(prod.headerTemplates))
+		invalidHeader := ""
+		for name, headerTemplate := range prod.headerTemplates {
+			headers[name] = headerTemplate.Resolve(msg)
+			headerNames = append(headerNames, name)
+			if !isValidHeaderValue(headers[name]) {
+				invalidHeader = name
+			}
+		}
+
+		// Such requests would fail on every retry
+		if invalidHeader != "" {
+			prod.TryFallbackWithError(msg, fmt.Sprintf("header %s contains control characters", invalidHeader))
+			continue
+		}
+
+		if prod.framing == "single" {
+			requests = append(requests, &httpBatchRequest{requestURL, headers, []*core.Message{msg}})
+			continue
+		}
+
+		sort.Strings(headerNames)
+		key := requestURL
+		for _, name := range headerNames {
+			key += "\n" + name + ": " + headers[name]
+		}
+
+		request, exists := requestsByKey[key]
+		if !exists {
+			request = &httpBatchRequest{url: requestURL, headers: headers}
+			requestsByKey[key] = request
+			requests = append(requests, request)
+		}
+		request.messages = append(request.messages, msg)
+	}
+	return requests
+}
+
+// getBody returns the framed request body
+func (prod *HTTPBatch) getBody(messages []*core.Message) []byte {
+	body := bytes.Buffer{}
+	switch prod.framing {
+	case "array":
+		body.WriteByte('[')
+		for idx, msg := range messages {
+			if idx > 0 {
+				body.WriteByte(',')
+			}
+			body.Write(msg.GetPayload())
+		}
+		body.WriteByte(']')
+
+	case "ndjson":
+		for _, msg := range messages {
+			body.Write(bytes.TrimRight(msg.GetPayload(), "\r\n"))
+			body.WriteByte('\n')
+		}
+
+	default:
+		body.Write(messages[0].GetPayload())
+	}
+
+	if !prod.gzip {
+		return body.Bytes()
+	}
+
+	compressed := bytes.Buffer{}
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(body.Bytes())
+	writer.Close()
+	return compressed.Bytes()
+}
+
+// send sends a request once. If the request may succeed later, the delay
+// requested by the server is returned (or 0 if none was requested).
+func (prod *HTTPBatch) send(request *httpBatchRequest, body []byte) (retry bool, retryAfter time.Duration, err error) {
+	httpRequest, err := http.NewRequest(prod.method, request.url, bytes.NewReader(body))
+	if err != nil {
+		return false, 0, err
+	}
+
+	httpRequest.Header.Set("Content-Type", prod.contentType)
+	if prod.gzip {
+		httpRequest.Header.Set("Content-Encoding", "gzip")
+	}
+	for name, value := range request.headers {
+		httpRequest.Header.Set(name, value)
+	}
+
+	response, err := prod.client.Do(httpRequest)
+	if err != nil {
+		return true, 0, err // ### return, connection error ###
+	}
+	defer response.Body.Close()
+	responseBody, _ := ioutil.ReadAll(response.Body)
+
+	if matchesHTTPStatus(prod.successCodes, response.StatusCode) {
+		return false, 0, nil // ### return, success ###
+	}
+
+	err = fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(responseBody)))
+	if !matchesHTTPStatus(prod.retryCodes, response.StatusCode) {
+		return false, 0, err // ### return, failed ###
+	}
+
+	return true, getRetryAfter(response), err
+}
+
+// sendWithRetry sends a request and retries it with backoff
+func (prod *HTTPBatch) sendWithRetry(request *httpBatchRequest) {
+	body := prod.getBody(request.messages)
+	send := func() (bool, time.Duration, error) {
+		return prod.send(request, body)
+	}
+
+	err := sendWithBackoff(request.url, send, prod.retryCount, prod.retryMinDelay, prod.retryMaxDelay, prod.IsActive, prod.Logger)
+	if err != nil {
+		prod.Logger.WithError(err).Errorf("Failed to send %d messages to %s", len(request.messages), request.url)
+		for _, msg := range request.messages {
+			prod.TryFallbackWithError(msg, err.Error())
+		}
+	}
+}
+
+func (prod *HTTPBatch) submitMessages(messages []*core.Message) {
+	for _, request := range prod.groupRequests(messages) {
+		prod.sendWithRetry(request)
+	}
+}
+
+// Produce starts the producer
+func (prod *HTTPBatch) Produce(workers *sync.WaitGroup) {
+	prod.BatchMessageLoop(workers, func() core.AssemblyFunc { return prod.submitMessages })
+}
@@ -0,0 +1,215 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func newTestHTTPBatch(t *testing.T, settings map[string]interface{}) *HTTPBatch {
+	settings["Retry/MinDelayMs"] = 0
+	return newTestProducer(t, "producer.HTTPBatch", settings).(*HTTPBatch)
+}
+
+func TestHTTPBatchGrouping(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	requests := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expect.Equal("PUT", r.Method)
+		expect.Equal("application/json", r.Header.Get("Content-Type"))
+		data, _ := ioutil.ReadAll(r.Body)
+		requests[r.URL.RequestURI()+" "+r.Header.Get("X-Key")] = string(data)
+	}))
+	defer srv.Close()
+
+	fallback := newTestFallbackRouter("httpBatchTestGroupingFallback")
+	prod := newTestHTTPBatch(t, map[string]interface{}{
+		"URL":            srv.URL + "/{stream}/{meta.tenant}?q={meta.query}",
+		"Method":         "put",
+		"Framing":        "array",
+		"Headers":        map[string]string{"x-key": "Key {meta.api-key}"},
+		"FallbackStream": "httpBatchTestGroupingFallback",
+	})
+
+	blue1 := newTestMessage(`{"a":1}`, map[string]string{"tenant": "blue", "api-key": "b/1"})
+	blue2 := newTestMessage(`{"a":2}`, map[string]string{"tenant": "blue", "api-key": "b/1"})
+	red := newTestMessage(`{"a":3}`, map[string]string{"tenant": "red/x", "api-key": "r", "query": "a b&c"})
+	invalid := newTestMessage(`not json`, map[string]string{"tenant": "red", "api-key": "r"})
+	prod.submitMessages([]*core.Message{blue1, red, blue2, invalid})
+
+	// Metadata values are encoded in URLs only
+	expect.Equal(2, len(requests))
+	expect.Equal(`[{"a":1},{"a":2}]`, requests["/access/blue?q= Key b/1"])
+	expect.Equal(`[{"a":3}]`, requests["/access/red%2Fx?q=a%20b%26c Key r"])
+	expect.Equal(map[string]string{`not json`: "message is not valid JSON"}, fallback.errors())
+}
+
+func TestHTTPBatchTemplateErrors(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	for idx, settings := range []map[string]interface{}{
+		{"URL": "http://localhost/{meta.tenant"},
+		{"URL": "http://localhost/{{.tenant}}"},
+		{"Headers": map[string]string{"x-key": "{key}"}},
+	} {
+		conf := core.NewPluginConfig(fmt.Sprintf("httpBatchTestTemplateErrors%d", idx), "producer.HTTPBatch")
+		for key, value := range settings {
+			conf.Override(key, value)
+		}
+
+		reader := core.NewPluginConfigReader(&conf)
+		if !expect.NotNil(reader.Configure(new(HTTPBatch))) {
+			t.Log(settings)
+		}
+	}
+}
+
+func TestHTTPBatchResponseCodes(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	numRequests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numRequests++
+		switch r.URL.Path {
+		case "/retry":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/fail":
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	defer srv.Close()
+
+	fallback := newTestFallbackRouter("httpBatchTestResponseCodesFallback")
+	prod := newTestHTTPBatch(t, map[string]interface{}{
+		"URL":            srv.URL + "/{meta.path}",
+		"Retry/Count":    2,
+		"FallbackStream": "httpBatchTestResponseCodesFallback",
+	})
+
+	ok := newTestMessage("a\n", map[string]string{"path": "ok"})
+	retry := newTestMessage("b", map[string]string{"path": "retry"})
+	fail := newTestMessage("c", map[string]string{"path": "fail"})
+
+	prod.submitMessages([]*core.Message{ok})
+	expect.Equal(1, numRequests)
+	expect.Equal(0, len(fallback.getMessages()))
+
+	prod.submitMessages([]*core.Message{retry})
+	expect.Equal(4, numRequests)
+	expect.True(strings.Contains(fallback.errors()["b"], "503"))
+
+	prod.submitMessages([]*core.Message{fail})
+	expect.Equal(5, numRequests)
+	expect.True(strings.Contains(fallback.errors()["c"], "400"))
+}
+func TestHTTPBatchInvalidHeader(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	requests := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Header.Get("X-Key"))
+	}))
+	defer srv.Close()
+
+	fallback := newTestFallbackRouter("httpBatchTestInvalidHeaderFallback")
+	prod := newTestHTTPBatch(t, map[string]interface{}{
+		"URL":            srv.URL,
+		"Headers":        map[string]string{"x-key": "{meta.api-key}"},
+		"Retry/Count":    2,
+		"FallbackStream": "httpBatchTestInvalidHeaderFallback",
+	})
+
+	prod.submitMessages([]*core.Message{
+		newTestMessage("a", map[string]string{"api-key": "a\r\nX-Injected: 1"}),
+		newTestMessage("b", map[string]string{"api-key": "b\tc"}),
+		newTestMessage("c", map[string]string{"api-key": "c\x00"}),
+	})
+
+	// Invalid values are not sent and not retried
+	expect.Equal([]string{"b\tc"}, requests)
+	expect.Equal(map[string]string{
+		"a": "header X-Key contains control characters",
+		"c": "header X-Key contains control characters",
+	}, fallback.errors())
+}
+
+func TestSendWithBackoff(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	logger := logrus.StandardLogger()
+	isActive := func() bool { return true }
+
+	// send fails with the given results and succeeds afterwards
+	attempts := []time.Time{}
+	newSend := func(retry bool, retryAfter time.Duration, failures int) func() (bool, time.Duration, error) {
+		attempts = attempts[:0]
+		return func() (bool, time.Duration, error) {
+			attempts = append(attempts, time.Now())
+			if len(attempts) > failures {
+				return false, 0, nil
+			}
+			return retry, retryAfter, errors.New("failed")
+		}
+	}
+
+	expect.NoError(sendWithBackoff("test", newSend(true, 0, 2), 2, time.Millisecond, time.Millisecond, isActive, logger))
+	expect.Equal(3, len(attempts))
+
+	expect.NotNil(sendWithBackoff("test", newSend(true, 0, 5), 2, time.Millisecond, time.Millisecond, isActive, logger))
+	expect.Equal(3, len(attempts))
+
+	expect.NotNil(sendWithBackoff("test", newSend(false, 0, 5), 2, time.Millisecond, time.Millisecond, isActive, logger))
+	expect.Equal(1, len(attempts))
+
+	expect.NotNil(sendWithBackoff("test", newSend(true, 0, 5), 2, time.Millisecond, time.Millisecond, func() bool { return false }, logger))
+	expect.Equal(1, len(attempts))
+
+	// Delays are doubled, longer delays requested by the server are used
+	// instead.
+	expect.NoError(sendWithBackoff("test", newSend(true, 0, 3), 3, 20*time.Millisecond, 40*time.Millisecond, isActive, logger))
+	expect.Equal(4, len(attempts))
+	expect.True(attempts[1].Sub(attempts[0]) >= 20*time.Millisecond)
+	expect.True(attempts[2].Sub(attempts[1]) >= 40*time.Millisecond)
+
+	expect.NoError(sendWithBackoff("test", newSend(true, 50*time.Millisecond, 1), 1, time.Millisecond, time.Millisecond, isActive, logger))
+	expect.True(attempts[1].Sub(attempts[0]) >= 50*time.Millisecond)
+}
+
+func TestHTTPBatchStatusRanges(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	ranges, err := parseHTTPStatusRanges([]string{"2xx", "404", "500-503"})
+	expect.NoError(err)
+	expect.True(matchesHTTPStatus(ranges, 204))
+	expect.True(matchesHTTPStatus(ranges, 404))
+	expect.True(matchesHTTPStatus(ranges, 502))
+	expect.False(matchesHTTPStatus(ranges, 504))
+
+	_, err = parseHTTPStatusRanges([]string{"5-"})
+	expect.NotNil(err)
+}
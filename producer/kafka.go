@@ -17,6 +17,7 @@ package producer
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"io/ioutil"
 	"strconv"
 	"strings"
@@ -26,6 +27,7 @@ import (
 	kafka "github.com/Shopify/sarama"
 	metrics "github.com/rcrowley/go-metrics"
 	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/tmath"
 )
 
 const (
@@ -179,6 +181,39 @@ const (
 // - SaslPassword: Sets the password used for SASL/PLAIN authentication.
 // By default this parameter is set to "".
 //
+// - Transactional: Enables exactly-once delivery by using an idempotent
+// producer and kafka transactions. Messages are collected into batches and each
+// batch is sent as one transaction. If a transaction fails, it is aborted and
+// all messages of the batch are sent to the fallback. Transactions require
+// Version to be set to at least 0.11. Enabling this setting forces
+// RequiredAcks to -1 and MaxOpenRequests to 1.
+// By default this parameter is set to false.
+//
+// - TransactionalId: Defines the transactional id used when Transactional is
+// enabled. This id must be unique for each producer instance writing to the
+// cluster. When set to an empty string, the plugin id is used.
+// By default this parameter is set to "".
+//
+// - Transaction/MaxCount: Defines the maximum number of messages per
+// transaction. If this limit is reached a transaction is always committed.
+// By default this parameter is set to 8192.
+//
+// - Transaction/FlushCount: Defines the minimum number of messages required to
+// commit a transaction. If this limit is reached a commit might be triggered.
+// By default this parameter is set to 4096.
+//
+// - Transaction/TimeoutSec: Defines the maximum time in seconds messages can
+// stay in the internal buffer before a transaction is committed.
+// By default this parameter is set to 5.
+//
+// - Transaction/CommitOffsets: When enabled, consumer offsets are committed as
+// part of each transaction. Offsets are read from the "topic", "partition",
+// "offset" and "group" metadata fields set by consumer.Kafka when SetMetadata
+// is enabled and GroupId is set. The consumer's CommitOffsets setting should
+// be set to false in this case. Messages without these fields are ignored
+// for offset commits.
+// By default this parameter is set to false.
+//
 // MessageBufferCount sets the internal channel size for the kafka client.
 // By default this is set to 8192.
 //
@@ -193,6 +228,33 @@ const (
 //      - "kafka02:9092"
 //      - "kafka03:9092"
 //      - "kafka04:9092"
+//
+// This config forwards messages read by a consumer group to another topic with
+// exactly-once semantics.
+//
+//  kafkaIn:
+//    Type: consumer.Kafka
+//    Streams: billing
+//    Topic: billing_raw
+//    GroupId: billing
+//    Version: "2.0.0"
+//    SetMetadata: true
+//    CommitOffsets: false
+//    Servers:
+//      - "kafka01:9092"
+//
+//  kafkaOut:
+//    Type: producer.Kafka
+//    Streams: billing
+//    Version: "2.0.0"
+//    Transactional: true
+//    TransactionalId: billing-forwarder
+//    Topics:
+//      billing: billing_processed
+//    Transaction:
+//      CommitOffsets: true
+//    Servers:
+//      - "kafka01:9092"
 type Kafka struct {
 	core.BufferedProducer `gollumdoc:"embed_type"`
 	topicGuard            *sync.RWMutex
@@ -208,6 +270,12 @@ type Kafka struct {
 	nilValueAllowed       bool   `config:"AllowNilValue" default:"false"`
 	keyField              string `config:"KeyFrom"`
 	metricsRegistry       metrics.Registry
+	txnBatch              core.MessageBatch
+	transactional         bool          `config:"Transactional" default:"false"`
+	txnCommitOffsets      bool          `config:"Transaction/CommitOffsets" default:"false"`
+	txnMaxCount           int           `config:"Transaction/MaxCount" default:"8192"`
+	txnFlushCount         int           `config:"Transaction/FlushCount" default:"4096"`
+	txnTimeout            time.Duration `config:"Transaction/TimeoutSec" default:"5" metric:"sec"`
 }
 
 type topicHandle struct {
@@ -252,7 +320,21 @@ func (prod *Kafka) Configure(conf core.PluginConfigReader) {
 		prod.config.Version = kafka.V0_9_0_1
 	case "0.10", "0.10.0", "0.10.0.0":
 		prod.config.Version = kafka.V0_10_0_0
+	case "0.10.0.1":
+		prod.config.Version = kafka.V0_10_0_1
+	case "0.10.1", "0.10.1.0":
+		prod.config.Version = kafka.V0_10_1_0
+	case "0.10.2", "0.10.2.0":
+		prod.config.Version = kafka.V0_10_2_0
+	case "0.11", "0.11.0", "0.11.0.0":
+		prod.config.Version = kafka.V0_11_0_0
+	case "1", "1.0", "1.0.0", "1.0.0.0":
+		prod.config.Version = kafka.V1_0_0_0
 	default:
+		if version, err := kafka.ParseKafkaVersion(ver); err == nil {
+			prod.config.Version = version
+			break
+		}
 		prod.Logger.Warning("Unknown kafka version given: ", ver)
 		parts := strings.Split(ver, ".")
 		if len(parts) < 2 {
@@ -342,6 +424,30 @@ func (prod *Kafka) Configure(conf core.PluginConfigReader) {
 	prod.config.Producer.Return.Errors = true
 	prod.config.Producer.Return.Successes = true
 
+	if prod.transactional {
+		if !prod.config.Version.IsAtLeast(kafka.V0_11_0_0) {
+			conf.Errors.Pushf("Transactional requires Version to be at least 0.11")
+		}
+
+		prod.config.Producer.Idempotent = true
+		prod.config.Producer.Transaction.ID = conf.GetString("TransactionalId", "")
+		if prod.config.Producer.Transaction.ID == "" {
+			prod.config.Producer.Transaction.ID = prod.GetID()
+		}
+		prod.config.Producer.RequiredAcks = kafka.WaitForAll
+		prod.config.Net.MaxOpenRequests = 1
+		if prod.config.Producer.Retry.Max < 1 {
+			prod.config.Producer.Retry.Max = 1
+		}
+
+		// Delivery is tracked per transaction, not per message
+		prod.config.Producer.Return.Successes = false
+		prod.config.Producer.Return.Errors = false
+
+		prod.txnFlushCount = tmath.MinI(prod.txnFlushCount, prod.txnMaxCount)
+		prod.txnBatch = core.NewMessageBatch(prod.txnMaxCount)
+	}
+
 	switch strings.ToLower(conf.GetString("Compression", compressNone)) {
 	default:
 		fallthrough
@@ -444,14 +550,7 @@ func (prod *Kafka) registerNewTopic(topicName string, streamID core.MessageStrea
 	return topic
 }
 
-func (prod *Kafka) produceMessage(msg *core.Message) {
-	if !prod.nilValueAllowed && len(msg.GetPayload()) == 0 {
-		streamName := core.StreamRegistry.GetStreamName(msg.GetStreamID())
-		prod.Logger.Errorf("0 byte message detected on %s. Discarded", streamName)
-		core.MetricMessagesDiscarded.Inc(1)
-		return // ### return, invalid data ###
-	}
-
+func (prod *Kafka) getTopic(msg *core.Message) *topicHandle {
 	prod.topicGuard.RLock()
 	topic, topicRegistered := prod.topic[msg.GetStreamID()]
 	prod.topicGuard.RUnlock()
@@ -467,15 +566,20 @@ func (prod *Kafka) produceMessage(msg *core.Message) {
 		topic = prod.registerNewTopic(topicName, msg.GetStreamID())
 	}
 
-	if isConnected, err := prod.isConnected(topic.name); !isConnected {
-		prod.TryFallback(msg)
-		if err != nil {
-			prod.Logger.WithError(err).Errorf("Topic %s is not connected", topic.name)
-		}
-		// TBD: health check? (ex-fuse breaker)
-		return // ### return, not connected ###
+	return topic
+}
+
+func (prod *Kafka) isValidMessage(msg *core.Message) bool {
+	if !prod.nilValueAllowed && len(msg.GetPayload()) == 0 {
+		streamName := core.StreamRegistry.GetStreamName(msg.GetStreamID())
+		prod.Logger.Errorf("0 byte message detected on %s. Discarded", streamName)
+		core.MetricMessagesDiscarded.Inc(1)
+		return false
 	}
+	return true
+}
 
+func (prod *Kafka) newKafkaMessage(msg *core.Message, topic *topicHandle) *kafka.ProducerMessage {
 	kafkaMsg := &kafka.ProducerMessage{
 		Topic:    topic.name,
 		Value:    kafka.ByteEncoder(msg.GetPayload()),
@@ -487,6 +591,26 @@ func (prod *Kafka) produceMessage(msg *core.Message) {
 		kafkaMsg.Key = kafka.ByteEncoder(kafkaKey)
 	}
 
+	return kafkaMsg
+}
+
+func (prod *Kafka) produceMessage(msg *core.Message) {
+	if !prod.isValidMessage(msg) {
+		return // ### return, invalid data ###
+	}
+
+	topic := prod.getTopic(msg)
+	if isConnected, err := prod.isConnected(topic.name); !isConnected {
+		prod.TryFallback(msg)
+		if err != nil {
+			prod.Logger.WithError(err).Errorf("Topic %s is not connected", topic.name)
+		}
+		// TBD: health check? (ex-fuse breaker)
+		return // ### return, not connected ###
+	}
+
+	kafkaMsg := prod.newKafkaMessage(msg, topic)
+
 	// Sarama can block on single messages if all buffers are full.
 	// So we stop trying after a few milliseconds
 	timeout := time.NewTimer(prod.gracePeriod)
@@ -502,6 +626,164 @@ func (prod *Kafka) produceMessage(msg *core.Message) {
 	}
 }
 
+// appendTransactionMessage collects messages for the next transaction.
+// The producer cannot embed core.BatchedProducer, as the non-transactional
+// mode sends each message on its own. Transactions therefore use a separate
+// MessageBatch that is flushed the same way core.BatchedProducer does.
+func (prod *Kafka) appendTransactionMessage(msg *core.Message) {
+	prod.txnBatch.AppendOrFlush(msg, prod.flushTransaction, prod.IsActiveOrStopping, prod.TryFallback)
+}
+
+func (prod *Kafka) flushTransaction() {
+	prod.txnBatch.Flush(prod.sendTransaction)
+}
+
+func (prod *Kafka) flushTransactionOnTimeOut() {
+	if prod.txnBatch.ReachedTimeThreshold(prod.txnTimeout) || prod.txnBatch.ReachedSizeThreshold(prod.txnFlushCount) {
+		prod.flushTransaction()
+	}
+}
+
+// sendTransaction sends all valid messages of a batch as one kafka
+// transaction. If the transaction fails it is aborted and all messages of the
+// transaction are sent to the fallback.
+func (prod *Kafka) sendTransaction(batch []*core.Message) {
+	groupOffsets := make(map[string]map[string][]*kafka.PartitionOffsetMetadata)
+	messages := make([]*core.Message, 0, len(batch))
+
+	for _, msg := range batch {
+		if prod.txnCommitOffsets {
+			addConsumerOffset(groupOffsets, msg)
+		}
+		if prod.isValidMessage(msg) {
+			messages = append(messages, msg)
+		}
+	}
+
+	if len(messages) == 0 {
+		return // ### return, nothing to do ###
+	}
+
+	if !prod.tryOpenConnection() {
+		for _, msg := range messages {
+			prod.TryFallback(msg)
+		}
+		return // ### return, not connected ###
+	}
+
+	if err := prod.producer.BeginTxn(); err != nil {
+		prod.abortTransaction(messages, err)
+		return // ### return, transaction failed ###
+	}
+
+	topics := make([]*topicHandle, 0, len(messages))
+	for _, msg := range messages {
+		// Sarama can block if all buffers are full. A message that cannot be
+		// queued fails the whole transaction.
+		topic := prod.getTopic(msg)
+		timeout := time.NewTimer(prod.gracePeriod)
+		select {
+		case prod.producer.Input() <- prod.newKafkaMessage(msg, topic):
+			timeout.Stop()
+			topic.metricsSent.Inc(1)
+
+		case <-timeout.C:
+			topic.metricsTimeout.Inc(1)
+			prod.abortTransaction(messages, fmt.Errorf("Timeout while sending to topic %s", topic.name))
+			return // ### return, transaction failed ###
+		}
+		topics = append(topics, topic)
+	}
+
+	for groupID, offsets := range groupOffsets {
+		if err := prod.producer.AddOffsetsToTxn(offsets, groupID); err != nil {
+			prod.abortTransaction(messages, err)
+			return // ### return, transaction failed ###
+		}
+	}
+
+	if err := prod.producer.CommitTxn(); err != nil {
+		prod.abortTransaction(messages, err)
+		return // ### return, transaction failed ###
+	}
+
+	for idx, topic := range topics {
+		topic.metricsRoundtrip.UpdateSince(messages[idx].GetCreationTime())
+		topic.metricsDelivered.Inc(1)
+	}
+}
+
+// abortTransaction aborts the currently running transaction and sends all
+// messages of that transaction to the fallback. If the producer cannot recover
+// from the error state it will be recreated on the next transaction.
+func (prod *Kafka) abortTransaction(messages []*core.Message, err error) {
+	prod.Logger.WithError(err).Errorf("Kafka transaction failed. Aborting %d messages", len(messages))
+
+	if prod.producer.TxnStatus()&kafka.ProducerTxnFlagInTransaction != 0 {
+		if abortErr := prod.producer.AbortTxn(); abortErr != nil {
+			prod.Logger.WithError(abortErr).Error("Failed to abort kafka transaction")
+		}
+	}
+
+	if prod.producer.TxnStatus()&kafka.ProducerTxnFlagFatalError != 0 {
+		prod.Logger.Warning("Kafka producer is in a fatal error state and will be recreated")
+		prod.producer.Close()
+		prod.producer = nil
+	}
+
+	for _, msg := range messages {
+		prod.TryFallback(msg)
+	}
+}
+
+// addConsumerOffset adds the consumer offset stored in the metadata of a
+// message to a group -> topic -> partition offsets map. Only the highest
+// offset per partition is kept.
+func addConsumerOffset(groupOffsets map[string]map[string][]*kafka.PartitionOffsetMetadata, msg *core.Message) {
+	metadata := msg.TryGetMetadata()
+	if metadata == nil {
+		return
+	}
+
+	groupID, hasGroup := metadata.TryGetValueString("group")
+	topic, hasTopic := metadata.TryGetValueString("topic")
+	partitionValue, hasPartition := metadata.TryGetValueString("partition")
+	offsetValue, hasOffset := metadata.TryGetValueString("offset")
+	if !hasGroup || !hasTopic || !hasPartition || !hasOffset {
+		return
+	}
+
+	partition, err := strconv.ParseInt(partitionValue, 10, 32)
+	if err != nil {
+		return
+	}
+	offset, err := strconv.ParseInt(offsetValue, 10, 64)
+	if err != nil {
+		return
+	}
+
+	offsets, groupKnown := groupOffsets[groupID]
+	if !groupKnown {
+		offsets = make(map[string][]*kafka.PartitionOffsetMetadata)
+		groupOffsets[groupID] = offsets
+	}
+
+	// The committed offset is the offset of the next message to read
+	for _, partitionOffset := range offsets[topic] {
+		if partitionOffset.Partition == int32(partition) {
+			if partitionOffset.Offset < offset+1 {
+				partitionOffset.Offset = offset + 1
+			}
+			return
+		}
+	}
+
+	offsets[topic] = append(offsets[topic], &kafka.PartitionOffsetMetadata{
+		Partition: int32(partition),
+		Offset:    offset + 1,
+	})
+}
+
 func (prod *Kafka) getKafkaMsgKey(msg *core.Message) []byte {
 	if len(prod.keyField) > 0 {
 		if metadata := msg.TryGetMetadata(); metadata != nil {
@@ -598,6 +880,9 @@ func (prod *Kafka) closeConnection() {
 func (prod *Kafka) close() {
 	defer prod.WorkerDone()
 	prod.DefaultClose()
+	if prod.transactional {
+		prod.txnBatch.Close(prod.sendTransaction, prod.GetShutdownTimeout())
+	}
 	prod.closeConnection()
 }
 
@@ -605,5 +890,9 @@ func (prod *Kafka) close() {
 func (prod *Kafka) Produce(workers *sync.WaitGroup) {
 	prod.AddMainWorker(workers)
 	prod.tryOpenConnection()
-	prod.TickerMessageControlLoop(prod.produceMessage, prod.config.Producer.Flush.Frequency, prod.pollResults)
+	if prod.transactional {
+		prod.TickerMessageControlLoop(prod.appendTransactionMessage, prod.txnTimeout, prod.flushTransactionOnTimeOut)
+	} else {
+		prod.TickerMessageControlLoop(prod.produceMessage, prod.config.Producer.Flush.Frequency, prod.pollResults)
+	}
 }
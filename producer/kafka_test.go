@@ -0,0 +1,171 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	kafka "github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+// kafkaTestClient satisfies the nil checks done before sending. None of its
+// methods are called by transactional sends.
+type kafkaTestClient struct {
+	kafka.Client
+}
+
+// kafkaTestTxnProducer wraps sarama's mock producer so that commits wait for
+// all expected messages and can be forced to fail.
+type kafkaTestTxnProducer struct {
+	*mocks.AsyncProducer
+	pending   sync.WaitGroup
+	commitErr error
+	offsets   map[string]map[string][]*kafka.PartitionOffsetMetadata
+}
+
+func newKafkaTestTxnProducer(t *testing.T, config *kafka.Config) *kafkaTestTxnProducer {
+	return &kafkaTestTxnProducer{
+		AsyncProducer: mocks.NewAsyncProducer(t, config),
+		offsets:       make(map[string]map[string][]*kafka.PartitionOffsetMetadata),
+	}
+}
+
+func (prod *kafkaTestTxnProducer) expectMessages(payloads ...string) {
+	for _, payload := range payloads {
+		expected := payload
+		prod.pending.Add(1)
+		prod.ExpectInputWithCheckerFunctionAndSucceed(func(value []byte) error {
+			defer prod.pending.Done()
+			if string(value) != expected {
+				return errors.New("unexpected payload " + string(value))
+			}
+			return nil
+		})
+	}
+}
+
+func (prod *kafkaTestTxnProducer) AddOffsetsToTxn(offsets map[string][]*kafka.PartitionOffsetMetadata, groupID string) error {
+	prod.offsets[groupID] = offsets
+	return prod.AsyncProducer.AddOffsetsToTxn(offsets, groupID)
+}
+
+func (prod *kafkaTestTxnProducer) CommitTxn() error {
+	prod.pending.Wait()
+	if prod.commitErr != nil {
+		return prod.commitErr
+	}
+	return prod.AsyncProducer.CommitTxn()
+}
+
+func newTestKafkaTransactional(t *testing.T, fallback string) (*Kafka, *kafkaTestTxnProducer) {
+	prod := newTestProducer(t, "producer.Kafka", map[string]interface{}{
+		"Version":                   "2.0.0",
+		"Transactional":             true,
+		"TransactionalId":           "test",
+		"Transaction/CommitOffsets": true,
+		"FallbackStream":            fallback,
+	}).(*Kafka)
+
+	mock := newKafkaTestTxnProducer(t, prod.config)
+	prod.client = kafkaTestClient{}
+	prod.producer = mock
+	return prod, mock
+}
+
+func TestKafkaTransactionalConfig(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	prod, mock := newTestKafkaTransactional(t, "kafkaTestConfigFallback")
+	defer mock.Close()
+
+	expect.True(prod.config.Producer.Idempotent)
+	expect.Equal("test", prod.config.Producer.Transaction.ID)
+	expect.Equal(kafka.WaitForAll, prod.config.Producer.RequiredAcks)
+	expect.Equal(1, prod.config.Net.MaxOpenRequests)
+
+	conf := core.NewPluginConfig("kafkaTestInvalidVersion", "producer.Kafka")
+	conf.Override("Version", "0.10")
+	conf.Override("Transactional", true)
+	_, err := core.NewPluginWithConfig(conf)
+	expect.NotNil(err)
+}
+
+func TestKafkaTransactionCommit(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	fallback := newTestFallbackRouter("kafkaTestCommitFallback")
+	prod, mock := newTestKafkaTransactional(t, "kafkaTestCommitFallback")
+
+	offset := map[string]string{"group": "g", "topic": "in", "partition": "0", "offset": "41"}
+	mock.expectMessages("a", "b")
+	prod.sendTransaction([]*core.Message{
+		newTestMessage("a", offset),
+		newTestMessage("", nil),
+		newTestMessage("b", nil),
+	})
+	expect.NoError(mock.Close())
+
+	expect.Equal(kafka.ProducerTxnFlagReady, mock.TxnStatus())
+	expect.Equal(0, len(fallback.payloads()))
+	expect.Equal(1, len(mock.offsets["g"]["in"]))
+	expect.Equal(int64(42), mock.offsets["g"]["in"][0].Offset)
+}
+
+func TestKafkaTransactionAbort(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	fallback := newTestFallbackRouter("kafkaTestAbortFallback")
+	prod, mock := newTestKafkaTransactional(t, "kafkaTestAbortFallback")
+
+	mock.commitErr = errors.New("commit failed")
+	mock.expectMessages("a", "b")
+	prod.sendTransaction([]*core.Message{
+		newTestMessage("a", nil),
+		newTestMessage("", nil),
+		newTestMessage("b", nil),
+	})
+	expect.NoError(mock.Close())
+
+	// The invalid message has been discarded and is not part of the
+	// transaction, so only the sent messages reach the fallback.
+	expect.Equal(kafka.ProducerTxnFlagReady, mock.TxnStatus())
+	expect.Equal([]string{"a", "b"}, fallback.payloads())
+	expect.NotNil(prod.producer)
+}
+
+func TestKafkaAddConsumerOffset(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	groupOffsets := make(map[string]map[string][]*kafka.PartitionOffsetMetadata)
+
+	addConsumerOffset(groupOffsets, newTestMessage("a", map[string]string{"group": "g", "topic": "t", "partition": "1", "offset": "10"}))
+	addConsumerOffset(groupOffsets, newTestMessage("b", map[string]string{"group": "g", "topic": "t", "partition": "1", "offset": "5"}))
+	addConsumerOffset(groupOffsets, newTestMessage("c", map[string]string{"group": "g", "topic": "t", "partition": "2", "offset": "3"}))
+	addConsumerOffset(groupOffsets, newTestMessage("d", map[string]string{"group": "h", "topic": "t", "partition": "1", "offset": "7"}))
+
+	// Incomplete or invalid metadata is ignored
+	addConsumerOffset(groupOffsets, newTestMessage("e", nil))
+	addConsumerOffset(groupOffsets, newTestMessage("f", map[string]string{"group": "i", "topic": "t", "partition": "1"}))
+	addConsumerOffset(groupOffsets, newTestMessage("g", map[string]string{"group": "i", "topic": "t", "partition": "x", "offset": "1"}))
+
+	expect.Equal(2, len(groupOffsets))
+	expect.Equal(2, len(groupOffsets["g"]["t"]))
+	expect.Equal(int32(1), groupOffsets["g"]["t"][0].Partition)
+	expect.Equal(int64(11), groupOffsets["g"]["t"][0].Offset)
+	expect.Equal(int32(2), groupOffsets["g"]["t"][1].Partition)
+	expect.Equal(int64(4), groupOffsets["g"]["t"][1].Offset)
+	expect.Equal(int64(8), groupOffsets["h"]["t"][0].Offset)
+}
@@ -0,0 +1,406 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/trivago/gollum/core"
+)
+
+const (
+	lokiWireVarint = 0
+	lokiWireBytes  = 2
+)
+
+// lokiLabelName is the format of valid Loki label names
+var lokiLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Loki producer plugin
+//
+// This producer sends messages to Grafana Loki using the push API. Messages
+// are grouped into Loki streams by a set of labels that are read from
+// metadata fields. Each batch is sent as one push request, either encoded as
+// snappy compressed protobuf or as JSON.
+//
+// Entries of a stream are sent in the order of their creation time. If
+// "FixOutOfOrder" is enabled, entries older than the last entry sent for
+// their stream use the timestamp of that entry, so that Loki does not reject
+// them. If Loki answers with status 429 or a server error, the request is
+// retried with an exponential backoff, respecting the Retry-After header.
+// Messages of requests that failed finally are passed to the fallback stream.
+// As Loki may reject parts of a request with status 400, this can include
+// messages that have been stored.
+//
+// Parameters
+//
+// - URL: Defines the URL of the push API.
+// By default this parameter is set to "http://localhost:3100/loki/api/v1/push".
+//
+// - Encoding: Defines the encoding of push requests. Valid values are
+// "protobuf" and "json".
+// By default this parameter is set to "protobuf".
+//
+// - Labels: Defines a map of label name to metadata field. Labels of messages
+// without or with an empty metadata field are omitted. Keep the number of
+// distinct values low, as every label combination creates a new Loki stream.
+// By default this parameter is set to an empty map.
+//
+// - StaticLabels: Defines a map of label name to value added to all messages.
+// By default this parameter is set to an empty map.
+//
+// - StreamLabel: Defines the label that contains the name of the gollum
+// stream of a message. Set this parameter to "" to disable this label.
+// By default this parameter is set to "stream".
+//
+// - TenantID: Defines the tenant sent in the "X-Scope-OrgID" header. Set this
+// parameter to "" if Loki does not use multi tenancy.
+// By default this parameter is set to "".
+//
+// - User: Defines the username used for basic authentication.
+// By default this parameter is set to "".
+//
+// - Password: Defines the password used for basic authentication.
+// By default this parameter is set to "".
+//
+// - FixOutOfOrder: When set to true, entries older than the last entry sent
+// for their stream are sent with the timestamp of that entry.
+// By default this parameter is set to "true".
+//
+// - TimeoutSec: Defines the number of seconds to wait for a push request.
+// By default this parameter is set to "10".
+//
+// - Retry/Count: Defines the number of retries before a request is considered
+// failed.
+// By default this parameter is set to "10".
+//
+// - Retry/MinDelayMs: Defines the number of milliseconds to wait before the
+// first retry. The delay is doubled after each retry.
+// By default this parameter is set to "500".
+//
+// - Retry/MaxDelaySec: Defines the maximum number of seconds to wait between
+// two retries.
+// By default this parameter is set to "30".
+//
+// Examples
+//
+// This example sends logs to Loki, labeled by application and host:
+//
+//  LokiOut:
+//    Type: producer.Loki
+//    Streams: logs
+//    URL: "http://loki:3100/loki/api/v1/push"
+//    TenantID: "team-a"
+//    Labels:
+//      app: "app"
+//      host: "hostname"
+//    StaticLabels:
+//      env: "production"
+//
+type Loki struct {
+	core.BatchedProducer `gollumdoc:"embed_type"`
+	url                  string        `config:"URL" default:"http://localhost:3100/loki/api/v1/push"`
+	streamLabel          string        `config:"StreamLabel" default:"stream"`
+	tenantID             string        `config:"TenantID"`
+	user                 string        `config:"User"`
+	password             string        `config:"Password"`
+	fixOutOfOrder        bool          `config:"FixOutOfOrder" default:"true"`
+	timeout              time.Duration `config:"TimeoutSec" default:"10" metric:"sec"`
+	retryCount           int           `config:"Retry/Count" default:"10"`
+	retryMinDelay        time.Duration `config:"Retry/MinDelayMs" default:"500" metric:"ms"`
+	retryMaxDelay        time.Duration `config:"Retry/MaxDelaySec" default:"30" metric:"sec"`
+	useJSON              bool
+	labels               map[string]string
+	staticLabels         map[string]string
+	lastTimestamps       map[string]time.Time
+	client               *http.Client
+}
+
+// lokiStream is a set of entries sharing the same labels
+type lokiStream struct {
+	key     string
+	labels  map[string]string
+	entries []lokiEntry
+}
+
+type lokiEntry struct {
+	timestamp time.Time
+	line      string
+}
+
+func init() {
+	core.TypeRegistry.Register(Loki{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *Loki) Configure(conf core.PluginConfigReader) {
+	switch strings.ToLower(conf.GetString("Encoding", "protobuf")) {
+	case "protobuf":
+	case "json":
+		prod.useJSON = true
+	default:
+		conf.Errors.Pushf("Unknown Encoding %s", conf.GetString("Encoding", "protobuf"))
+	}
+
+	prod.labels = conf.GetStringMap("Labels", map[string]string{})
+	prod.staticLabels = conf.GetStringMap("StaticLabels", map[string]string{})
+
+	for name := range prod.labels {
+		if !lokiLabelName.MatchString(name) {
+			conf.Errors.Pushf("Invalid label name %s", name)
+		}
+	}
+	for name := range prod.staticLabels {
+		if !lokiLabelName.MatchString(name) {
+			conf.Errors.Pushf("Invalid label name %s", name)
+		}
+	}
+	if prod.streamLabel != "" && !lokiLabelName.MatchString(prod.streamLabel) {
+		conf.Errors.Pushf("Invalid label name %s", prod.streamLabel)
+	}
+
+	prod.lastTimestamps = make(map[string]time.Time)
+	prod.client = &http.Client{
+		Timeout: prod.timeout,
+	}
+}
+
+// getLabels returns the labels of a message
+func (prod *Loki) getLabels(msg *core.Message) map[string]string {
+	labels := make(map[string]string, len(prod.staticLabels)+len(prod.labels)+1)
+	for name, value := range prod.staticLabels {
+		labels[name] = value
+	}
+	if prod.streamLabel != "" {
+		labels[prod.streamLabel] = core.StreamRegistry.GetStreamName(msg.GetStreamID())
+	}
+
+	metadata := msg.TryGetMetadata()
+	for name, key := range prod.labels {
+		if value := metadata.GetValueString(key); value != "" {
+			labels[name] = value
+		}
+	}
+	return labels
+}
+
+// formatLabels returns the labels in the Prometheus text format, e.g.
+// {app="web", host="a"}. Labels are sorted by name.
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+"="+strconv.Quote(labels[name]))
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// groupStreams groups messages into Loki streams and sorts the entries of
+// each stream by time.
+func (prod *Loki) groupStreams(messages []*core.Message) []*lokiStream {
+	streams := []*lokiStream{}
+	streamsByKey := make(map[string]*lokiStream)
+
+	for _, msg := range messages {
+		labels := prod.getLabels(msg)
+		key := formatLabels(labels)
+
+		stream, exists := streamsByKey[key]
+		if !exists {
+			stream = &lokiStream{key: key, labels: labels}
+			streamsByKey[key] = stream
+			streams = append(streams, stream)
+		}
+		stream.entries = append(stream.entries, lokiEntry{
+			timestamp: msg.GetCreationTime(),
+			line:      msg.String(),
+		})
+	}
+
+	for _, stream := range streams {
+		sort.SliceStable(stream.entries, func(i, j int) bool {
+			return stream.entries[i].timestamp.Before(stream.entries[j].timestamp)
+		})
+
+		if !prod.fixOutOfOrder {
+			continue
+		}
+		// Only one batch is flushed at a time, so no lock is required
+		if last, isSet := prod.lastTimestamps[stream.key]; isSet {
+			for idx := range stream.entries {
+				if !stream.entries[idx].timestamp.Before(last) {
+					break
+				}
+				stream.entries[idx].timestamp = last
+			}
+		}
+	}
+	return streams
+}
+
+func appendLokiKey(data []byte, field int, wireType int) []byte {
+	return binary.AppendUvarint(data, uint64(field<<3|wireType))
+}
+
+func appendProtoBytes(data []byte, field int, value []byte) []byte {
+	data = appendLokiKey(data, field, lokiWireBytes)
+	data = binary.AppendUvarint(data, uint64(len(value)))
+	return append(data, value...)
+}
+
+func appendProtoVarint(data []byte, field int, value uint64) []byte {
+	data = appendLokiKey(data, field, lokiWireVarint)
+	return binary.AppendUvarint(data, value)
+}
+
+// encodeProtobuf encodes streams as logproto.PushRequest
+// See https://github.com/grafana/loki/blob/main/pkg/push/push.proto
+func encodeProtobuf(streams []*lokiStream) []byte {
+	request := []byte{}
+	for _, stream := range streams {
+		streamData := appendProtoBytes(nil, 1, []byte(stream.key))
+		for _, entry := range stream.entries {
+			timestamp := appendProtoVarint(nil, 1, uint64(entry.timestamp.Unix()))
+			timestamp = appendProtoVarint(timestamp, 2, uint64(entry.timestamp.Nanosecond()))
+
+			entryData := appendProtoBytes(nil, 1, timestamp)
+			entryData = appendProtoBytes(entryData, 2, []byte(entry.line))
+			streamData = appendProtoBytes(streamData, 2, entryData)
+		}
+		request = appendProtoBytes(request, 1, streamData)
+	}
+	return snappy.Encode(nil, request)
+}
+
+// encodeJSON encodes streams as JSON push request
+func encodeJSON(streams []*lokiStream) ([]byte, error) {
+	type jsonStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+
+	request := struct {
+		Streams []jsonStream `json:"streams"`
+	}{
+		Streams: make([]jsonStream, 0, len(streams)),
+	}
+
+	for _, stream := range streams {
+		values := make([][2]string, 0, len(stream.entries))
+		for _, entry := range stream.entries {
+			values = append(values, [2]string{strconv.FormatInt(entry.timestamp.UnixNano(), 10), entry.line})
+		}
+		request.Streams = append(request.Streams, jsonStream{
+			Stream: stream.labels,
+			Values: values,
+		})
+	}
+	return json.Marshal(request)
+}
+
+// push sends a request to Loki. If the request may succeed later, the delay
+// requested by Loki is returned (or 0 if none was requested).
+func (prod *Loki) push(body []byte) (retry bool, retryAfter time.Duration, err error) {
+	request, err := http.NewRequest("POST", prod.url, bytes.NewReader(body))
+	if err != nil {
+		return false, 0, err
+	}
+
+	if prod.useJSON {
+		request.Header.Set("Content-Type", "application/json")
+	} else {
+		request.Header.Set("Content-Type", "application/x-protobuf")
+	}
+	if prod.tenantID != "" {
+		request.Header.Set("X-Scope-OrgID", prod.tenantID)
+	}
+	if prod.user != "" {
+		request.SetBasicAuth(prod.user, prod.password)
+	}
+
+	response, err := prod.client.Do(request)
+	if err != nil {
+		return true, 0, err // ### return, connection error ###
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode <= 299 {
+		return false, 0, nil // ### return, success ###
+	}
+
+	responseBody, _ := ioutil.ReadAll(response.Body)
+	err = fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(responseBody)))
+
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500 {
+		return true, getRetryAfter(response), err
+	}
+	return false, 0, err
+}
+
+func (prod *Loki) submitMessages(messages []*core.Message) {
+	streams := prod.groupStreams(messages)
+
+	var body []byte
+	if prod.useJSON {
+		var err error
+		if body, err = encodeJSON(streams); err != nil {
+			prod.Logger.WithError(err).Error("Failed to encode push request")
+			for _, msg := range messages {
+				prod.TryFallback(msg)
+			}
+			return // ### return, encoding failed ###
+		}
+	} else {
+		body = encodeProtobuf(streams)
+	}
+
+	push := func() (bool, time.Duration, error) {
+		return prod.push(body)
+	}
+	if err := sendWithBackoff(prod.url, push, prod.retryCount, prod.retryMinDelay, prod.retryMaxDelay, prod.IsActive, prod.Logger); err != nil {
+		prod.Logger.WithError(err).Errorf("Failed to push %d messages", len(messages))
+		for _, msg := range messages {
+			prod.TryFallback(msg)
+		}
+		return // ### return, failed ###
+	}
+
+	for _, stream := range streams {
+		prod.lastTimestamps[stream.key] = stream.entries[len(stream.entries)-1].timestamp
+	}
+	prod.Logger.Debugf("Pushed %d messages in %d streams", len(messages), len(streams))
+}
+
+// Produce starts the producer
+func (prod *Loki) Produce(workers *sync.WaitGroup) {
+	prod.BatchMessageLoop(workers, func() core.AssemblyFunc { return prod.submitMessages })
+}
@@ -0,0 +1,223 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+// decodeLokiFields splits a protobuf message into its fields. Varints are
+// returned as decimal strings.
+func decodeLokiFields(t *testing.T, data []byte) [][2]string {
+	fields := [][2]string{}
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		data = data[n:]
+
+		value, n := binary.Uvarint(data)
+		data = data[n:]
+
+		switch key & 7 {
+		case lokiWireVarint:
+			fields = append(fields, [2]string{fmt.Sprint(key >> 3), fmt.Sprint(value)})
+		case lokiWireBytes:
+			fields = append(fields, [2]string{fmt.Sprint(key >> 3), string(data[:value])})
+			data = data[value:]
+		default:
+			t.Fatalf("Unexpected wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+// decodeLokiRequest decodes a snappy compressed logproto.PushRequest into a
+// map of stream labels to "<seconds>.<nanoseconds> <line>" entries.
+func decodeLokiRequest(t *testing.T, body []byte) map[string][]string {
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streams := make(map[string][]string)
+	for _, stream := range decodeLokiFields(t, data) {
+		labels := ""
+		for _, field := range decodeLokiFields(t, []byte(stream[1])) {
+			if field[0] == "1" {
+				labels = field[1]
+				continue
+			}
+
+			entry := decodeLokiFields(t, []byte(field[1]))
+			timestamp := decodeLokiFields(t, []byte(entry[0][1]))
+			streams[labels] = append(streams[labels], fmt.Sprintf("%s.%s %s", timestamp[0][1], timestamp[1][1], entry[1][1]))
+		}
+	}
+	return streams
+}
+
+func formatLokiEntry(timestamp time.Time, line string) string {
+	return fmt.Sprintf("%d.%d %s", timestamp.Unix(), timestamp.Nanosecond(), line)
+}
+
+func newTestLoki(t *testing.T, settings map[string]interface{}) *Loki {
+	settings["Labels"] = map[string]string{"app": "app"}
+	settings["StaticLabels"] = map[string]string{"env": "test"}
+	settings["Retry/MinDelayMs"] = 1
+	return newTestProducer(t, "producer.Loki", settings).(*Loki)
+}
+
+func TestLokiEncodeProtobuf(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	timestamp := time.Unix(1714566600, 500)
+
+	body := encodeProtobuf([]*lokiStream{
+		{key: `{app="web"}`, entries: []lokiEntry{{timestamp, "a"}, {timestamp.Add(time.Second), "b"}}},
+		{key: `{app="db"}`, entries: []lokiEntry{{timestamp, "c"}}},
+	})
+
+	expect.Equal(map[string][]string{
+		`{app="web"}`: {"1714566600.500 a", "1714566601.500 b"},
+		`{app="db"}`:  {"1714566600.500 c"},
+	}, decodeLokiRequest(t, body))
+}
+
+func TestLokiGroupStreams(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	prod := newTestLoki(t, map[string]interface{}{})
+
+	// Messages are created in order, so their timestamps are ascending
+	messages := make([]*core.Message, 4)
+	apps := []string{"web", "db", "web", ""}
+	for idx, app := range apps {
+		messages[idx] = newTestMessage(fmt.Sprint(idx), map[string]string{"app": app})
+		time.Sleep(time.Millisecond)
+	}
+
+	streams := prod.groupStreams([]*core.Message{messages[2], messages[1], messages[0], messages[3]})
+	expect.Equal(3, len(streams))
+
+	expect.Equal(`{app="web", env="test", stream="access"}`, streams[0].key)
+	expect.Equal(map[string]string{"app": "web", "env": "test", "stream": "access"}, streams[0].labels)
+	expect.Equal(2, len(streams[0].entries))
+	expect.Equal("0", streams[0].entries[0].line)
+	expect.Equal("2", streams[0].entries[1].line)
+
+	expect.Equal(`{app="db", env="test", stream="access"}`, streams[1].key)
+	expect.Equal(`{env="test", stream="access"}`, streams[2].key)
+}
+
+func TestLokiFixOutOfOrder(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	prod := newTestLoki(t, map[string]interface{}{})
+
+	old := newTestMessage("old", map[string]string{"app": "web"})
+	time.Sleep(2 * time.Millisecond)
+	last := time.Now()
+	time.Sleep(2 * time.Millisecond)
+	recent := newTestMessage("recent", map[string]string{"app": "web"})
+
+	key := `{app="web", env="test", stream="access"}`
+	prod.lastTimestamps[key] = last
+
+	// Entries older than the last entry sent use its timestamp
+	streams := prod.groupStreams([]*core.Message{recent, old})
+	expect.Equal(1, len(streams))
+	expect.Equal(last, streams[0].entries[0].timestamp)
+	expect.Equal(recent.GetCreationTime(), streams[0].entries[1].timestamp)
+
+	prod.fixOutOfOrder = false
+	streams = prod.groupStreams([]*core.Message{recent, old})
+	expect.Equal(old.GetCreationTime(), streams[0].entries[0].timestamp)
+}
+
+func TestLokiPush(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	guard := new(sync.Mutex)
+	requests := []map[string][]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		expect.Equal("application/x-protobuf", req.Header.Get("Content-Type"))
+		expect.Equal("team-a", req.Header.Get("X-Scope-OrgID"))
+
+		body, _ := ioutil.ReadAll(req.Body)
+		guard.Lock()
+		requests = append(requests, decodeLokiRequest(t, body))
+		numRequests := len(requests)
+		guard.Unlock()
+
+		if numRequests == 1 {
+			resp.Header().Set("Retry-After", "1")
+			resp.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		resp.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	fallback := newTestFallbackRouter("lokiTestPushFallback")
+	prod := newTestLoki(t, map[string]interface{}{
+		"URL":            server.URL,
+		"TenantID":       "team-a",
+		"FallbackStream": "lokiTestPushFallback",
+	})
+
+	msg := newTestMessage("hello", map[string]string{"app": "web"})
+	start := time.Now()
+	prod.submitMessages([]*core.Message{msg})
+
+	// Rate limited requests are retried after the requested delay
+	expect.True(time.Since(start) >= time.Second)
+	expect.Equal(0, len(fallback.getMessages()))
+	expect.Equal(2, len(requests))
+
+	key := `{app="web", env="test", stream="access"}`
+	expect.Equal(map[string][]string{key: {formatLokiEntry(msg.GetCreationTime(), "hello")}}, requests[1])
+	expect.Equal(msg.GetCreationTime(), prod.lastTimestamps[key])
+}
+
+func TestLokiPushRejected(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	numRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		numRequests++
+		resp.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	fallback := newTestFallbackRouter("lokiTestPushRejectedFallback")
+	prod := newTestLoki(t, map[string]interface{}{
+		"URL":            server.URL,
+		"FallbackStream": "lokiTestPushRejectedFallback",
+	})
+
+	prod.submitMessages([]*core.Message{newTestMessage("a", nil), newTestMessage("b", nil)})
+
+	// Rejected requests are not retried
+	expect.Equal(1, numRequests)
+	expect.Equal([]string{"a", "b"}, fallback.payloads())
+	expect.Equal(0, len(prod.lastTimestamps))
+}
@@ -0,0 +1,215 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+)
+
+// MQTT producer plugin
+//
+// This producer publishes messages to an MQTT broker. Messages are published
+// without waiting for the acknowledgement of the previous message. If the
+// broker or the client reports an error for a message, e.g. because the
+// connection was lost before a QoS 1 message was acknowledged, the message is
+// sent to the fallback stream.
+//
+// Parameters
+//
+// - Topics: Defines a stream to topic mapping. If a stream is not mapped the
+// stream name is used as topic. You can define the wildcard stream (*) here,
+// too. If set, all streams that do not have a specific mapping will go to
+// this topic.
+// By default this parameter is set to an empty list.
+//
+// - TopicTemplate: Defines a template to generate the topic from, e.g.
+// "devices/{meta.device}/commands". Supported placeholders are "{stream}" for
+// the stream name, "{meta.<key>}" for metadata values and "{time:<layout>}"
+// for the creation time of a message. Missing metadata values are replaced by
+// "_". The characters "/", "+" and "#" are replaced by "_" in metadata values.
+// If set, Topics is ignored.
+// By default this parameter is set to "".
+//
+// - QoS: Defines the QoS level to publish with. Valid values are 0 (at most
+// once) and 1 (at least once).
+// By default this parameter is set to "0".
+//
+// - Retained: When set to true, messages are published with the retained
+// flag, i.e. the broker keeps the last message of each topic for new
+// subscribers.
+// By default this parameter is set to "false".
+//
+// - MaxInFlight: Defines the maximum number of messages that have been
+// published but not yet been sent (QoS 0) or acknowledged (QoS 1). Publishing
+// blocks while this limit is reached.
+// By default this parameter is set to "1024".
+//
+// - PublishTimeoutMs: Defines the number of milliseconds after which a warning
+// is logged for a message that has not been sent or acknowledged. Such
+// messages are not sent to the fallback stream, as the client keeps trying to
+// deliver them.
+// By default this parameter is set to "5000".
+//
+// Examples
+//
+// This example sends commands to the device named in the "device" metadata
+// field.
+//
+//  MqttOut:
+//    Type: producer.MQTT
+//    Streams: "commands"
+//    Address: "tcp://broker:1883"
+//    TopicTemplate: "devices/{meta.device}/commands"
+//    QoS: 1
+//
+type MQTT struct {
+	core.BufferedProducer `gollumdoc:"embed_type"`
+	// MQTTClient is public to make MQTTClient.Configure() callable
+	MQTTClient     components.MQTTClient `gollumdoc:"embed_type"`
+	qos            int                   `config:"QoS" default:"0"`
+	retained       bool                  `config:"Retained" default:"false"`
+	maxInFlight    int                   `config:"MaxInFlight" default:"1024"`
+	publishTimeout time.Duration         `config:"PublishTimeoutMs" default:"5000" metric:"ms"`
+	streamToTopic  map[core.MessageStreamID]string
+	topicTemplate  *components.PathTemplate
+	client         mqtt.Client
+	inFlight       chan mqttInFlight
+	inFlightDone   chan struct{}
+}
+
+// mqttInFlight is a published message waiting for its token to complete.
+type mqttInFlight struct {
+	msg   *core.Message
+	topic string
+	token mqtt.Token
+}
+
+// mqttTopicReplacer removes the topic wildcards that are not allowed when
+// publishing.
+var mqttTopicReplacer = strings.NewReplacer("+", "_", "#", "_")
+
+func init() {
+	core.TypeRegistry.Register(MQTT{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *MQTT) Configure(conf core.PluginConfigReader) {
+	prod.SetStopCallback(prod.close)
+	prod.streamToTopic = conf.GetStreamMap("Topics", "")
+
+	if topicTemplate := conf.GetString("TopicTemplate", ""); topicTemplate != "" {
+		template, err := components.NewPathTemplate(topicTemplate)
+		if !conf.Errors.Push(err) {
+			prod.topicTemplate = &template
+		}
+	}
+
+	if prod.qos < 0 || prod.qos > 1 {
+		conf.Errors.Pushf("QoS must be 0 or 1")
+	}
+	if prod.maxInFlight < 1 {
+		conf.Errors.Pushf("MaxInFlight must be at least 1")
+	}
+}
+
+// getTopic returns the topic a message is published to.
+func (prod *MQTT) getTopic(msg *core.Message) string {
+	if prod.topicTemplate != nil {
+		return mqttTopicReplacer.Replace(prod.topicTemplate.Resolve(msg))
+	}
+
+	if topic, isMapped := prod.streamToTopic[msg.GetStreamID()]; isMapped {
+		return topic
+	}
+	if topic, wildcardSet := prod.streamToTopic[core.WildcardStreamID]; wildcardSet {
+		return topic
+	}
+	return core.StreamRegistry.GetStreamName(msg.GetStreamID())
+}
+
+// publish sends a message without waiting for it to be acknowledged. The
+// token is checked by waitForTokens.
+func (prod *MQTT) publish(msg *core.Message) {
+	topic := prod.getTopic(msg)
+	if topic == "" {
+		prod.Logger.Warning("Message has an empty topic")
+		prod.TryFallback(msg)
+		return // ### return, invalid topic ###
+	}
+
+	token := prod.client.Publish(topic, byte(prod.qos), prod.retained, msg.GetPayload())
+	prod.inFlight <- mqttInFlight{msg: msg, topic: topic, token: token}
+}
+
+// waitForTokens checks the result of all published messages in the order
+// they have been published. Messages are only sent to the fallback stream if
+// publishing failed, not if it takes longer than expected.
+func (prod *MQTT) waitForTokens() {
+	defer close(prod.inFlightDone)
+
+	for published := range prod.inFlight {
+		if !published.token.WaitTimeout(prod.publishTimeout) {
+			prod.Logger.Warningf("Message to %s has not been acknowledged after %s", published.topic, prod.publishTimeout)
+			published.token.Wait()
+		}
+		if err := published.token.Error(); err != nil {
+			prod.Logger.WithError(err).Errorf("Failed to publish to %s", published.topic)
+			prod.TryFallback(published.msg)
+		}
+	}
+}
+
+func (prod *MQTT) close() {
+	defer prod.WorkerDone()
+	prod.DefaultClose()
+
+	// Give in-flight messages time to complete. Disconnecting fails all
+	// remaining QoS 1 messages so that they are sent to the fallback.
+	close(prod.inFlight)
+	select {
+	case <-prod.inFlightDone:
+	case <-time.After(prod.GetShutdownTimeout()):
+		prod.Logger.Warning("Timeout while waiting for messages to be acknowledged")
+	}
+
+	prod.client.Disconnect(uint(prod.GetShutdownTimeout() / time.Millisecond))
+
+	select {
+	case <-prod.inFlightDone:
+	case <-time.After(prod.GetShutdownTimeout()):
+		prod.Logger.Error("Messages that have not been acknowledged are lost")
+	}
+}
+
+// Produce writes to an MQTT broker.
+func (prod *MQTT) Produce(workers *sync.WaitGroup) {
+	prod.client = prod.MQTTClient.NewClient(prod.Logger, nil)
+	prod.inFlight = make(chan mqttInFlight, prod.maxInFlight)
+	prod.inFlightDone = make(chan struct{})
+
+	// Connect retries until it succeeds or Disconnect is called. Messages
+	// published in the meantime are queued by the client.
+	prod.client.Connect()
+
+	prod.AddMainWorker(workers)
+	go prod.waitForTokens()
+	prod.MessageControlLoop(prod.publish)
+}
@@ -0,0 +1,128 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+// mqttTestToken completes after the given delay with the given error.
+type mqttTestToken struct {
+	done chan struct{}
+	err  error
+}
+
+func newMQTTTestToken(delay time.Duration, err error) *mqttTestToken {
+	token := &mqttTestToken{done: make(chan struct{}), err: err}
+	time.AfterFunc(delay, func() { close(token.done) })
+	return token
+}
+
+func (token *mqttTestToken) Wait() bool {
+	<-token.done
+	return true
+}
+
+func (token *mqttTestToken) WaitTimeout(timeout time.Duration) bool {
+	select {
+	case <-token.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (token *mqttTestToken) Done() <-chan struct{} {
+	return token.done
+}
+
+func (token *mqttTestToken) Error() error {
+	<-token.done
+	return token.err
+}
+
+// mqttTestClient returns the tokens registered for a payload.
+type mqttTestClient struct {
+	mqtt.Client
+	guard  sync.Mutex
+	tokens map[string]mqtt.Token
+	topics []string
+}
+
+func (client *mqttTestClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	client.guard.Lock()
+	defer client.guard.Unlock()
+	client.topics = append(client.topics, topic)
+	return client.tokens[string(payload.([]byte))]
+}
+
+func newTestMQTT(t *testing.T, settings map[string]interface{}) *MQTT {
+	settings["PublishTimeoutMs"] = 10
+	return newTestProducer(t, "producer.MQTT", settings).(*MQTT)
+}
+
+func TestMQTTFallbackOnTokenError(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	fallback := newTestFallbackRouter("mqttTestFallbackFallback")
+	prod := newTestMQTT(t, map[string]interface{}{
+		"FallbackStream": "mqttTestFallbackFallback",
+	})
+
+	// Messages taking longer than PublishTimeoutMs are not sent to the
+	// fallback, only messages that failed.
+	client := &mqttTestClient{tokens: map[string]mqtt.Token{
+		"ok":     newMQTTTestToken(0, nil),
+		"failed": newMQTTTestToken(0, errors.New("connection lost")),
+		"slow":   newMQTTTestToken(100*time.Millisecond, nil),
+	}}
+	prod.client = client
+	prod.inFlight = make(chan mqttInFlight, prod.maxInFlight)
+	prod.inFlightDone = make(chan struct{})
+	go prod.waitForTokens()
+
+	for _, payload := range []string{"slow", "failed", "ok"} {
+		prod.publish(core.NewMessage(nil, []byte(payload), nil, core.GetStreamID("mqttTest")))
+	}
+	close(prod.inFlight)
+	<-prod.inFlightDone
+
+	expect.Equal([]string{"failed"}, fallback.payloads())
+	expect.Equal([]string{"mqttTest", "mqttTest", "mqttTest"}, client.topics)
+}
+
+func TestMQTTTopicTemplate(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	prod := newTestMQTT(t, map[string]interface{}{
+		"TopicTemplate": "devices/{meta.device}/{stream}",
+	})
+
+	msg := core.NewMessage(nil, []byte("test"), core.Metadata{"device": []byte("a/+/#")}, core.GetStreamID("commands"))
+	expect.Equal("devices/a____/commands", prod.getTopic(msg))
+
+	msg = core.NewMessage(nil, []byte("test"), nil, core.GetStreamID("commands"))
+	expect.Equal("devices/_/commands", prod.getTopic(msg))
+
+	conf := core.NewPluginConfig("mqttTestTopicInvalid", "producer.MQTT")
+	conf.Override("TopicTemplate", "devices/{{.device}}")
+	_, err := core.NewPluginWithConfig(conf)
+	expect.NotNil(err)
+}
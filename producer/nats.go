@@ -0,0 +1,207 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+)
+
+// NATS producer plugin
+//
+// This producer publishes messages to subjects of a NATS server. If JetStream
+// is enabled, the server has to acknowledge that each message was stored.
+// Messages that could not be published or were not acknowledged are passed
+// to the fallback stream.
+//
+// Parameters
+//
+// - Subjects: Defines a stream to subject mapping. If a stream is not mapped
+// the stream name is used as subject. You can define the wildcard stream (*)
+// here, too. If set, all streams that do not have a specific mapping will go
+// to this subject.
+// By default this parameter is set to an empty list.
+//
+// - JetStream: When set to true, messages are published to JetStream and
+// acknowledgements are awaited. The subjects must be bound to a JetStream
+// stream. Up to Batch/MaxCount messages are published before waiting for
+// acknowledgements.
+// By default this parameter is set to "false".
+//
+// - AckTimeoutMs: Defines the number of milliseconds to wait for the
+// JetStream acknowledgements of a batch.
+// By default this parameter is set to "5000".
+//
+// Examples
+//
+// This example fans out all log streams to other Gollum instances.
+//
+//  NatsOut:
+//    Type: producer.NATS
+//    Streams: ["access", "error"]
+//    Address: "nats://nats1:4222,nats://nats2:4222"
+//    Subjects:
+//      "access": "logs.access"
+//      "error": "logs.error"
+//
+type NATS struct {
+	core.BatchedProducer `gollumdoc:"embed_type"`
+	// NATSClient is public to make NATSClient.Configure() callable
+	NATSClient      components.NATSClient `gollumdoc:"embed_type"`
+	jetStream       bool                  `config:"JetStream" default:"false"`
+	ackTimeout      time.Duration         `config:"AckTimeoutMs" default:"5000" metric:"ms"`
+	maxPending      int
+	streamToSubject map[core.MessageStreamID]string
+	connection      *nats.Conn
+	jetStreamCtx    nats.JetStreamContext
+}
+
+func init() {
+	core.TypeRegistry.Register(NATS{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *NATS) Configure(conf core.PluginConfigReader) {
+	prod.SetStopCallback(prod.close)
+	prod.streamToSubject = conf.GetStreamMap("Subjects", "")
+
+	// A whole batch is published before waiting for acknowledgements, so
+	// PublishAsync must not stall before the batch has been sent.
+	prod.maxPending = int(conf.GetInt("Batch/MaxCount", 8192))
+}
+
+// getSubject returns the subject a message is published to.
+func (prod *NATS) getSubject(msg *core.Message) string {
+	if subject, isMapped := prod.streamToSubject[msg.GetStreamID()]; isMapped {
+		return subject
+	}
+	if subject, wildcardSet := prod.streamToSubject[core.WildcardStreamID]; wildcardSet {
+		return subject
+	}
+	return core.StreamRegistry.GetStreamName(msg.GetStreamID())
+}
+
+// assemblePublish sends all messages of a batch using core NATS.
+func (prod *NATS) assemblePublish(messages []*core.Message) {
+	for _, msg := range messages {
+		if err := prod.connection.Publish(prod.getSubject(msg), msg.GetPayload()); err != nil {
+			prod.Logger.WithError(err).Error("Failed to publish")
+			prod.TryFallback(msg)
+		}
+	}
+
+	// Make sure the messages left the client buffer
+	if err := prod.connection.FlushTimeout(prod.ackTimeout); err != nil {
+		prod.Logger.WithError(err).Warning("Failed to flush")
+	}
+}
+
+// assembleJetStream publishes all messages of a batch to JetStream and waits
+// for their acknowledgements.
+func (prod *NATS) assembleJetStream(messages []*core.Message) {
+	futures := make([]nats.PubAckFuture, len(messages))
+	for idx, msg := range messages {
+		future, err := prod.jetStreamCtx.PublishAsync(prod.getSubject(msg), msg.GetPayload())
+		if err != nil {
+			prod.Logger.WithError(err).Error("Failed to publish")
+			prod.TryFallback(msg)
+			continue
+		}
+		futures[idx] = future
+	}
+
+	// All futures share one deadline. Once it has expired, futures that are
+	// still unresolved fail immediately.
+	deadline := time.NewTimer(prod.ackTimeout)
+	timedOut := false
+	numFailed := 0
+	for idx, future := range futures {
+		if future == nil {
+			continue // ### continue, already sent to fallback ###
+		}
+
+		if timedOut {
+			select {
+			case <-future.Ok():
+				continue
+			default:
+			}
+		} else {
+			select {
+			case <-future.Ok():
+				continue
+			case err := <-future.Err():
+				prod.Logger.WithError(err).Debug("Message was not acknowledged")
+			case <-deadline.C:
+				timedOut = true
+			}
+		}
+		numFailed++
+		prod.TryFallback(messages[idx])
+	}
+	deadline.Stop()
+
+	if numFailed > 0 {
+		prod.Logger.Errorf("%d messages were not acknowledged by JetStream", numFailed)
+	}
+}
+
+func (prod *NATS) assemble(messages []*core.Message) {
+	if prod.jetStream {
+		prod.assembleJetStream(messages)
+	} else {
+		prod.assemblePublish(messages)
+	}
+}
+
+func (prod *NATS) sendBatch() core.AssemblyFunc {
+	return prod.assemble
+}
+
+func (prod *NATS) closeConnection() error {
+	if prod.connection != nil {
+		return prod.connection.Drain()
+	}
+	return nil
+}
+
+func (prod *NATS) close() {
+	defer prod.Batch.AfterFlushDo(prod.closeConnection)
+	prod.DefaultClose()
+}
+
+// Produce writes to a buffer that is published to NATS.
+func (prod *NATS) Produce(workers *sync.WaitGroup) {
+	connection, err := prod.NATSClient.Connect(prod.Logger)
+	if err != nil {
+		prod.Logger.WithError(err).Errorf("Failed to connect to %s", prod.NATSClient.GetAddress())
+		return // ### return, could not connect ###
+	}
+	prod.connection = connection
+
+	if prod.jetStream {
+		if prod.jetStreamCtx, err = connection.JetStream(nats.PublishAsyncMaxPending(prod.maxPending)); err != nil {
+			prod.Logger.WithError(err).Error("Failed to initialize JetStream")
+			connection.Close()
+			return // ### return, no JetStream ###
+		}
+	}
+
+	prod.BatchMessageLoop(workers, prod.sendBatch)
+}
@@ -0,0 +1,198 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+// newNATSTestServer starts a NATS server with JetStream enabled on a random
+// port. The returned function shuts the server down.
+func newNATSTestServer(t *testing.T) (*server.Server, func()) {
+	storeDir, err := ioutil.TempDir("", "gollum-nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = storeDir
+	srv := natsserver.RunServer(&opts)
+
+	return srv, func() {
+		srv.Shutdown()
+		os.RemoveAll(storeDir)
+	}
+}
+
+// newTestNATS creates a connected NATS producer. Messages of the streams
+// natsOrders and natsSlow are published to "orders.new" and "slow.new".
+func newTestNATS(t *testing.T, srv *server.Server, settings map[string]interface{}) *NATS {
+	expect := ttesting.NewExpect(t)
+
+	settings["Address"] = srv.ClientURL()
+	settings["Subjects"] = map[string]string{
+		"natsOrders": "orders.new",
+		"natsSlow":   "slow.new",
+	}
+	prod := newTestProducer(t, "producer.NATS", settings).(*NATS)
+
+	var err error
+	prod.connection, err = prod.NATSClient.Connect(prod.Logger)
+	expect.NoError(err)
+	if prod.jetStream {
+		prod.jetStreamCtx, err = prod.connection.JetStream(nats.PublishAsyncMaxPending(prod.maxPending))
+		expect.NoError(err)
+	}
+	return prod
+}
+
+func newTestNATSMessage(payload string, streamName string) *core.Message {
+	return core.NewMessage(nil, []byte(payload), nil, core.GetStreamID(streamName))
+}
+
+// assembleWithTimeout fails the test if assemble does not return in time.
+func assembleWithTimeout(t *testing.T, prod *NATS, messages []*core.Message) time.Duration {
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		prod.assemble(messages)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return time.Since(start)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Batch was not sent within 5 seconds")
+		return 0
+	}
+}
+
+func TestNATSPublish(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	srv, shutdown := newNATSTestServer(t)
+	defer shutdown()
+
+	client, err := nats.Connect(srv.ClientURL())
+	expect.NoError(err)
+	defer client.Close()
+
+	subscription, err := client.SubscribeSync(">")
+	expect.NoError(err)
+	expect.NoError(client.Flush())
+
+	prod := newTestNATS(t, srv, map[string]interface{}{})
+	defer prod.connection.Close()
+
+	prod.assemble([]*core.Message{
+		newTestNATSMessage("a", "natsOrders"),
+		newTestNATSMessage("b", "natsUnmapped"),
+	})
+
+	// Unmapped streams are published to the subject named like the stream
+	received := map[string]string{}
+	for i := 0; i < 2; i++ {
+		msg, err := subscription.NextMsg(time.Second)
+		expect.NoError(err)
+		received[string(msg.Data)] = msg.Subject
+	}
+	expect.Equal(map[string]string{"a": "orders.new", "b": "natsUnmapped"}, received)
+}
+
+func TestNATSJetStreamAck(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	srv, shutdown := newNATSTestServer(t)
+	defer shutdown()
+
+	client, err := nats.Connect(srv.ClientURL())
+	expect.NoError(err)
+	defer client.Close()
+
+	jetStream, err := client.JetStream()
+	expect.NoError(err)
+	_, err = jetStream.AddStream(&nats.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.*"}})
+	expect.NoError(err)
+
+	fallback := newTestFallbackRouter("natsTestJetStreamAckFallback")
+	prod := newTestNATS(t, srv, map[string]interface{}{
+		"JetStream":      true,
+		"FallbackStream": "natsTestJetStreamAckFallback",
+	})
+	defer prod.connection.Close()
+
+	// Subjects that are not bound to a JetStream stream have no responders
+	assembleWithTimeout(t, prod, []*core.Message{
+		newTestNATSMessage("a", "natsOrders"),
+		newTestNATSMessage("b", "natsUnmapped"),
+		newTestNATSMessage("c", "natsOrders"),
+	})
+
+	expect.Equal([]string{"b"}, fallback.payloads())
+
+	info, err := jetStream.StreamInfo("ORDERS")
+	expect.NoError(err)
+	expect.Equal(uint64(2), info.State.Msgs)
+}
+
+func TestNATSJetStreamAckTimeout(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	srv, shutdown := newNATSTestServer(t)
+	defer shutdown()
+
+	client, err := nats.Connect(srv.ClientURL())
+	expect.NoError(err)
+	defer client.Close()
+
+	jetStream, err := client.JetStream()
+	expect.NoError(err)
+	_, err = jetStream.AddStream(&nats.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.*"}})
+	expect.NoError(err)
+
+	// A core subscriber that never replies keeps the acks from arriving
+	_, err = client.Subscribe("slow.new", func(*nats.Msg) {})
+	expect.NoError(err)
+	expect.NoError(client.Flush())
+
+	fallback := newTestFallbackRouter("natsTestJetStreamAckTimeoutFallback")
+	prod := newTestNATS(t, srv, map[string]interface{}{
+		"JetStream":      true,
+		"AckTimeoutMs":   200,
+		"FallbackStream": "natsTestJetStreamAckTimeoutFallback",
+	})
+	defer prod.connection.Close()
+
+	// All futures share one deadline, acknowledged messages following a
+	// timed out one are not passed to the fallback.
+	duration := assembleWithTimeout(t, prod, []*core.Message{
+		newTestNATSMessage("a", "natsSlow"),
+		newTestNATSMessage("b", "natsOrders"),
+		newTestNATSMessage("c", "natsSlow"),
+		newTestNATSMessage("d", "natsSlow"),
+	})
+
+	expect.True(duration < time.Second)
+	expect.Equal([]string{"a", "c", "d"}, fallback.payloads())
+}
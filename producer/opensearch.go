@@ -0,0 +1,436 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+)
+
+// OpenSearch producer plugin
+//
+// This producer sends messages to OpenSearch or Elasticsearch 7.x and newer
+// using the bulk http API. It does not use document types and expects a json
+// payload. The bulk action as well as the document id, routing and ingest
+// pipeline can be set per message using metadata fields.
+//
+// If a request fails or the cluster is overloaded, the request is retried on
+// the next server. Items rejected with status 429 are retried, too. All other
+// rejected items are passed to the fallback stream one by one. The error reason
+// is stored in the metadata field "error" of these messages.
+//
+// Parameters
+//
+// - Servers: This value defines a list of servers to send requests to. The
+// servers are used round robin.
+// By default this parameter is set to ["http://127.0.0.1:9200"].
+//
+// - User: This value is used as the username for basic authentication.
+// By default this parameter is set to "".
+//
+// - Password: This value is used as the password for basic authentication.
+// By default this parameter is set to "".
+//
+// - APIKey: This value defines a base64 encoded API key ("id:key") sent in the
+// "Authorization" header. If set, User and Password are ignored.
+// By default this parameter is set to "".
+//
+// - TlsCaLocation: Defines the path to the CA certificate(s) used to verify
+// the servers.
+// By default this parameter is set to "".
+//
+// - TlsCertificateLocation: Defines the path to a client certificate (PEM)
+// used for mutual TLS. TlsKeyLocation has to be set, too.
+// By default this parameter is set to "".
+//
+// - TlsKeyLocation: Defines the path to the private key of the client
+// certificate (PEM).
+// By default this parameter is set to "".
+//
+// - TlsInsecureSkipVerify: When set to true, server certificates are not
+// verified.
+// By default this parameter is set to "false".
+//
+// - SetGzip: When set to true, request bodies are gzip compressed.
+// By default this parameter is set to "false".
+//
+// - TimeoutSec: Defines the number of seconds to wait for a bulk request.
+// By default this parameter is set to "30".
+//
+// - Retry/Count: Defines the number of retries before a request or an item
+// is considered failed.
+// By default this parameter is set to "3".
+//
+// - Retry/TimeToWaitSec: Defines the number of seconds to wait between two
+// retries.
+// By default this parameter is set to "3".
+//
+// - Indices: Defines a stream to index mapping. If a stream is not mapped the
+// stream name is used as index. You can define the wildcard stream (*) here,
+// too. Index names may contain the placeholders "{stream}", "{meta.<key>}" and
+// "{time:<layout>}" which are resolved for each message, e.g.
+// "logs-{time:2006.01.02}".
+// By default this parameter is set to an empty list.
+//
+// - Action: This value defines the bulk action used for all messages. Valid
+// actions are "index", "create", "update", "upsert" and "delete". Use
+// "create" to write to data streams.
+// By default this parameter is set to "index".
+//
+// - Pipeline: This value defines the ingest pipeline used for all messages.
+// By default this parameter is set to "".
+//
+// - ActionFrom: Defines the metadata field that contains the bulk action of a
+// message. If the field is not set or empty, Action is used.
+// By default this parameter is set to "".
+//
+// - IDFrom: Defines the metadata field that contains the document id. If the
+// field is not set or empty, an id is generated. The actions "update",
+// "upsert" and "delete" require an id.
+// By default this parameter is set to "".
+//
+// - RoutingFrom: Defines the metadata field that contains the routing value of
+// a document. If the field is not set or empty, no routing is used.
+// By default this parameter is set to "".
+//
+// - PipelineFrom: Defines the metadata field that contains the ingest pipeline
+// of a document. If the field is not set or empty, Pipeline is used.
+// By default this parameter is set to "".
+//
+// Examples
+//
+// This example writes access logs to daily indices of a secured cluster:
+//
+//  OpenSearchOut:
+//    Type: producer.OpenSearch
+//    Streams: access
+//    Servers:
+//      - https://search1:9200
+//      - https://search2:9200
+//    APIKey: "VnVhQ2ZHY0JDZGJrUW0tZTVhT3g6dWkybHAyYXhUTm1zeWFrdzl0dk5udw=="
+//    TlsCaLocation: /etc/gollum/ca.pem
+//    SetGzip: true
+//    Indices:
+//      access: "access-{time:2006.01.02}"
+//
+type OpenSearch struct {
+	core.BatchedProducer `gollumdoc:"embed_type"`
+	servers              []string
+	user                 string        `config:"User"`
+	password             string        `config:"Password"`
+	apiKey               string        `config:"APIKey"`
+	tlsCaFile            string        `config:"TlsCaLocation"`
+	tlsCertFile          string        `config:"TlsCertificateLocation"`
+	tlsKeyFile           string        `config:"TlsKeyLocation"`
+	tlsSkipVerify        bool          `config:"TlsInsecureSkipVerify" default:"false"`
+	gzip                 bool          `config:"SetGzip" default:"false"`
+	timeout              time.Duration `config:"TimeoutSec" default:"30" metric:"sec"`
+	retryCount           int           `config:"Retry/Count" default:"3"`
+	retryDelay           time.Duration `config:"Retry/TimeToWaitSec" default:"3" metric:"sec"`
+	action               string        `config:"Action" default:"index"`
+	pipeline             string        `config:"Pipeline"`
+	actionFrom           string        `config:"ActionFrom"`
+	idFrom               string        `config:"IDFrom"`
+	routingFrom          string        `config:"RoutingFrom"`
+	pipelineFrom         string        `config:"PipelineFrom"`
+	indices              map[core.MessageStreamID]components.PathTemplate
+	client               *http.Client
+	nextServer           uint32
+}
+
+// bulkItem is a message converted to bulk request lines
+type bulkItem struct {
+	msg  *core.Message
+	data []byte
+}
+
+// bulkResponse is the part of a bulk response required to map errors to
+// items
+type bulkResponse struct {
+	Errors bool                                 `json:"errors"`
+	Items  []map[string]bulkResponseItemDetails `json:"items"`
+}
+
+type bulkResponseItemDetails struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// getReason returns a human readable error reason
+func (details bulkResponseItemDetails) getReason() string {
+	reason := struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	}{}
+	if err := json.Unmarshal(details.Error, &reason); err == nil && reason.Type != "" {
+		return fmt.Sprintf("%s: %s", reason.Type, reason.Reason)
+	}
+	return string(details.Error)
+}
+
+func init() {
+	core.TypeRegistry.Register(OpenSearch{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *OpenSearch) Configure(conf core.PluginConfigReader) {
+	prod.servers = conf.GetStringArray("Servers", []string{"http://127.0.0.1:9200"})
+	if len(prod.servers) == 0 {
+		conf.Errors.Pushf("At least one server is required")
+	}
+	for idx, server := range prod.servers {
+		prod.servers[idx] = strings.TrimRight(server, "/")
+	}
+
+	prod.action = strings.ToLower(prod.action)
+	if !isValidElasticAction(prod.action) {
+		conf.Errors.Pushf("Unknown action %s", prod.action)
+	}
+
+	prod.indices = make(map[core.MessageStreamID]components.PathTemplate)
+	for streamID, index := range conf.GetStreamMap("Indices", "") {
+		template, err := components.NewPathTemplate(index)
+		if !conf.Errors.Push(err) {
+			prod.indices[streamID] = template
+		}
+	}
+
+	tlsConfig, err := newTLSClientConfig(prod.tlsCaFile, prod.tlsCertFile, prod.tlsKeyFile, prod.tlsSkipVerify)
+	conf.Errors.Push(err)
+
+	prod.client = &http.Client{
+		Timeout: prod.timeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+}
+
+// getIndex returns the index a message is written to.
+func (prod *OpenSearch) getIndex(msg *core.Message) string {
+	if index, isMapped := prod.indices[msg.GetStreamID()]; isMapped {
+		return index.Resolve(msg)
+	}
+	if index, wildcardSet := prod.indices[core.WildcardStreamID]; wildcardSet {
+		return index.Resolve(msg)
+	}
+	return core.StreamRegistry.GetStreamName(msg.GetStreamID())
+}
+
+// newBulkItem converts a message to the lines of a bulk request
+func (prod *OpenSearch) newBulkItem(msg *core.Message) (bulkItem, error) {
+	action := prod.action
+	if value := getMetadataString(msg, prod.actionFrom); value != "" {
+		action = strings.ToLower(value)
+	}
+	pipeline := prod.pipeline
+	if value := getMetadataString(msg, prod.pipelineFrom); value != "" {
+		pipeline = value
+	}
+	id := getMetadataString(msg, prod.idFrom)
+	routing := getMetadataString(msg, prod.routingFrom)
+
+	if !isValidElasticAction(action) {
+		return bulkItem{}, fmt.Errorf("unknown action %s", action)
+	}
+
+	command := map[string]string{"_index": prod.getIndex(msg)}
+	if id != "" {
+		command["_id"] = id
+	}
+	if routing != "" {
+		command["routing"] = routing
+	}
+
+	var doc bytes.Buffer
+	switch action {
+	case "index", "create":
+		if pipeline != "" {
+			command["pipeline"] = pipeline
+		}
+		if err := json.Compact(&doc, msg.GetPayload()); err != nil {
+			return bulkItem{}, err
+		}
+
+	case "update", "upsert":
+		if id == "" {
+			return bulkItem{}, fmt.Errorf("action %s requires a document id", action)
+		}
+		doc.WriteString(`{"doc":`)
+		if err := json.Compact(&doc, msg.GetPayload()); err != nil {
+			return bulkItem{}, err
+		}
+		if action == "upsert" {
+			doc.WriteString(`,"doc_as_upsert":true`)
+		}
+		doc.WriteString("}")
+		action = "update"
+
+	case "delete":
+		if id == "" {
+			return bulkItem{}, fmt.Errorf("action %s requires a document id", action)
+		}
+	}
+
+	header, err := json.Marshal(map[string]map[string]string{action: command})
+	if err != nil {
+		return bulkItem{}, err
+	}
+
+	data := append(header, '\n')
+	if doc.Len() > 0 {
+		data = append(data, doc.Bytes()...)
+		data = append(data, '\n')
+	}
+	return bulkItem{msg: msg, data: data}, nil
+}
+
+// sendBulk sends the given items to the next server. The returned bool is
+// true if the request may succeed when retried.
+func (prod *OpenSearch) sendBulk(items []bulkItem) (*bulkResponse, bool, error) {
+	body := bytes.Buffer{}
+	if prod.gzip {
+		writer := gzip.NewWriter(&body)
+		for _, item := range items {
+			writer.Write(item.data)
+		}
+		writer.Close()
+	} else {
+		for _, item := range items {
+			body.Write(item.data)
+		}
+	}
+
+	server := prod.servers[atomic.AddUint32(&prod.nextServer, 1)%uint32(len(prod.servers))]
+	request, err := http.NewRequest("POST", server+"/_bulk", &body)
+	if err != nil {
+		return nil, false, err
+	}
+
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	if prod.gzip {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+	switch {
+	case prod.apiKey != "":
+		request.Header.Set("Authorization", "ApiKey "+prod.apiKey)
+	case prod.user != "":
+		request.SetBasicAuth(prod.user, prod.password)
+	}
+
+	response, err := prod.client.Do(request)
+	if err != nil {
+		return nil, true, err // ### return, connection error ###
+	}
+	defer response.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, true, err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		retry := response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500
+		return nil, retry, fmt.Errorf("%s returned %s: %s", server, response.Status, responseBody)
+	}
+
+	result := &bulkResponse{}
+	if err := json.Unmarshal(responseBody, result); err != nil {
+		return nil, false, err
+	}
+	if len(result.Items) != len(items) {
+		return nil, false, fmt.Errorf("%s returned %d items for %d actions", server, len(result.Items), len(items))
+	}
+	return result, false, nil
+}
+
+func (prod *OpenSearch) submitMessages(messages []*core.Message) {
+	items := make([]bulkItem, 0, len(messages))
+	for _, msg := range messages {
+		item, err := prod.newBulkItem(msg)
+		if err != nil {
+			prod.Logger.WithError(err).Warning("Invalid bulk request")
+			prod.TryFallbackWithError(msg, err.Error())
+			continue
+		}
+		items = append(items, item)
+	}
+
+	for attempt := 0; len(items) > 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(prod.retryDelay)
+		}
+		canRetry := attempt < prod.retryCount
+
+		response, retry, err := prod.sendBulk(items)
+		if err != nil {
+			if retry && canRetry {
+				prod.Logger.WithError(err).Warning("Bulk request failed, retrying")
+				continue // ### continue, retry all items ###
+			}
+			prod.Logger.WithError(err).Errorf("Could not send '%d' messages", len(items))
+			for _, item := range items {
+				prod.TryFallbackWithError(item.msg, err.Error())
+			}
+			return // ### return, request failed ###
+		}
+
+		if !response.Errors {
+			prod.Logger.Debugf("%d messages sent successfully", len(items))
+			return // ### return, all items succeeded ###
+		}
+
+		// Items are returned in the order of the requests
+		retryItems := []bulkItem{}
+		numFailed := 0
+		for idx, result := range response.Items {
+			for _, details := range result {
+				switch {
+				case len(details.Error) == 0 || string(details.Error) == "null":
+				case details.Status == http.StatusTooManyRequests && canRetry:
+					retryItems = append(retryItems, items[idx])
+				default:
+					numFailed++
+					prod.TryFallbackWithError(items[idx].msg, details.getReason())
+				}
+			}
+		}
+
+		if numFailed > 0 {
+			prod.Logger.Errorf("%d messages were rejected", numFailed)
+		}
+		if len(retryItems) > 0 {
+			prod.Logger.Warningf("%d messages were rejected due to load, retrying", len(retryItems))
+		}
+		items = retryItems
+	}
+}
+
+// Produce starts the producer
+func (prod *OpenSearch) Produce(workers *sync.WaitGroup) {
+	prod.BatchMessageLoop(workers, func() core.AssemblyFunc { return prod.submitMessages })
+}
@@ -0,0 +1,183 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"compress/gzip"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func newTestOpenSearch(t *testing.T, settings map[string]interface{}) *OpenSearch {
+	settings["Retry/TimeToWaitSec"] = 0
+	return newTestProducer(t, "producer.OpenSearch", settings).(*OpenSearch)
+}
+
+func TestOpenSearchBulkRequest(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	var body, auth, encoding string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expect.Equal("/_bulk", r.URL.Path)
+		expect.Equal("application/x-ndjson", r.Header.Get("Content-Type"))
+		auth = r.Header.Get("Authorization")
+		encoding = r.Header.Get("Content-Encoding")
+
+		reader, err := gzip.NewReader(r.Body)
+		expect.NoError(err)
+		data, _ := ioutil.ReadAll(reader)
+		body = string(data)
+
+		io.WriteString(w, `{"errors":false,"items":[{"index":{"status":201}},{"update":{"status":200}},{"delete":{"status":200}}]}`)
+	}))
+	defer srv.Close()
+
+	prod := newTestOpenSearch(t, map[string]interface{}{
+		"Servers":    []string{srv.URL + "/"},
+		"APIKey":     "secret",
+		"SetGzip":    true,
+		"Indices":    map[string]string{"*": "logs-{meta.tenant}"},
+		"Pipeline":   "geoip",
+		"ActionFrom": "action",
+		"IDFrom":     "id",
+	})
+
+	msg := newTestMessage("{\n\"a\": 1\n}", map[string]string{"tenant": "blue"})
+	upsert := newTestMessage(`{"b":2}`, map[string]string{"tenant": "blue", "action": "upsert", "id": "42"})
+	remove := newTestMessage(`{}`, map[string]string{"tenant": "red", "action": "delete", "id": "7"})
+	prod.submitMessages([]*core.Message{msg, upsert, remove})
+
+	expect.Equal("ApiKey secret", auth)
+	expect.Equal("gzip", encoding)
+	expect.Equal(strings.Join([]string{
+		`{"index":{"_index":"logs-blue","pipeline":"geoip"}}`,
+		`{"a":1}`,
+		`{"update":{"_id":"42","_index":"logs-blue"}}`,
+		`{"doc":{"b":2},"doc_as_upsert":true}`,
+		`{"delete":{"_id":"7","_index":"logs-red"}}`,
+		``,
+	}, "\n"), body)
+}
+
+func TestOpenSearchItemErrors(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	requests := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, string(data))
+
+		if len(requests) == 1 {
+			io.WriteString(w, `{"errors":true,"items":[`+
+				`{"index":{"status":201}},`+
+				`{"index":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}},`+
+				`{"index":{"status":429,"error":{"type":"es_rejected_execution_exception","reason":"queue full"}}}]}`)
+			return
+		}
+		io.WriteString(w, `{"errors":false,"items":[{"index":{"status":201}}]}`)
+	}))
+	defer srv.Close()
+
+	fallback := newTestFallbackRouter("openSearchTestItemErrorsFallback")
+	prod := newTestOpenSearch(t, map[string]interface{}{
+		"Servers":        []string{srv.URL},
+		"FallbackStream": "openSearchTestItemErrorsFallback",
+	})
+
+	ok := newTestMessage(`{"a":1}`, nil)
+	invalid := newTestMessage(`{"a":"x"}`, nil)
+	overloaded := newTestMessage(`{"a":3}`, nil)
+	notJSON := newTestMessage(`not json`, nil)
+	prod.submitMessages([]*core.Message{ok, invalid, overloaded, notJSON})
+
+	expect.Equal(2, len(requests))
+	expect.Equal("{\"index\":{\"_index\":\"access\"}}\n{\"a\":3}\n", requests[1])
+
+	// Rejected items are passed to the fallback, overloaded ones are retried
+	errors := fallback.errors()
+	expect.Equal(2, len(errors))
+	expect.Equal("mapper_parsing_exception: failed to parse", errors[`{"a":"x"}`])
+	expect.Neq("", errors[`not json`])
+}
+
+func TestOpenSearchRetry(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	numRequests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numRequests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	fallback := newTestFallbackRouter("openSearchTestRetryFallback")
+	prod := newTestOpenSearch(t, map[string]interface{}{
+		"Servers":        []string{srv.URL},
+		"Retry/Count":    2,
+		"FallbackStream": "openSearchTestRetryFallback",
+	})
+
+	prod.submitMessages([]*core.Message{newTestMessage(`{"a":1}`, nil)})
+
+	expect.Equal(3, numRequests)
+	expect.True(strings.Contains(fallback.errors()[`{"a":1}`], "503"))
+}
+
+func TestOpenSearchTLS(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"errors":false,"items":[{"index":{"status":201}}]}`)
+	}))
+	defer srv.Close()
+
+	caFile, err := ioutil.TempFile("", "gollum-opensearch-ca")
+	expect.NoError(err)
+	defer os.Remove(caFile.Name())
+
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	caFile.Close()
+
+	fallback := newTestFallbackRouter("openSearchTestTLSFallback")
+	prod := newTestOpenSearch(t, map[string]interface{}{
+		"Servers":        []string{srv.URL},
+		"TlsCaLocation":  caFile.Name(),
+		"Retry/Count":    0,
+		"FallbackStream": "openSearchTestTLSFallback",
+	})
+
+	prod.submitMessages([]*core.Message{newTestMessage(`{"a":1}`, nil)})
+	expect.Equal(0, len(fallback.getMessages()))
+
+	// Without the CA the server certificate cannot be verified
+	prod = newTestOpenSearch(t, map[string]interface{}{
+		"Servers":        []string{srv.URL},
+		"Retry/Count":    0,
+		"FallbackStream": "openSearchTestTLSFallback",
+	})
+
+	prod.submitMessages([]*core.Message{newTestMessage(`{"a":1}`, nil)})
+	expect.Equal(1, len(fallback.getMessages()))
+	expect.Neq("", fallback.errors()[`{"a":1}`])
+}
@@ -17,14 +17,106 @@ package producer
 import (
 	"fmt"
 	"runtime/debug"
+	"sync"
 	"testing"
 
 	"github.com/trivago/gollum/core"
 	_ "github.com/trivago/gollum/filter"
 	_ "github.com/trivago/gollum/format"
 	_ "github.com/trivago/gollum/router"
+	"github.com/trivago/tgo/ttesting"
 )
 
+// testFallbackRouter collects all messages routed to it. It is registered as
+// the fallback stream of a producer to check which messages have been passed
+// to the fallback.
+type testFallbackRouter struct {
+	core.Router
+	streamID core.MessageStreamID
+	guard    sync.Mutex
+	messages []*core.Message
+}
+
+func newTestFallbackRouter(streamName string) *testFallbackRouter {
+	router := &testFallbackRouter{
+		streamID: core.StreamRegistry.GetStreamID(streamName),
+	}
+	core.StreamRegistry.Register(router, router.streamID)
+	return router
+}
+
+func (router *testFallbackRouter) Modulate(msg *core.Message) core.ModulateResult {
+	return core.ModulateResultContinue
+}
+
+func (router *testFallbackRouter) GetID() string {
+	return router.streamID.GetName()
+}
+
+func (router *testFallbackRouter) GetStreamID() core.MessageStreamID {
+	return router.streamID
+}
+
+func (router *testFallbackRouter) Enqueue(msg *core.Message) error {
+	router.guard.Lock()
+	defer router.guard.Unlock()
+	router.messages = append(router.messages, msg)
+	return nil
+}
+
+func (router *testFallbackRouter) getMessages() []*core.Message {
+	router.guard.Lock()
+	defer router.guard.Unlock()
+	return append([]*core.Message{}, router.messages...)
+}
+
+// errors returns the "error" metadata field of all messages by payload.
+func (router *testFallbackRouter) errors() map[string]string {
+	errors := make(map[string]string)
+	for _, msg := range router.getMessages() {
+		errors[msg.String()] = msg.GetMetadata().GetValueString("error")
+	}
+	return errors
+}
+
+func (router *testFallbackRouter) payloads() []string {
+	router.guard.Lock()
+	defer router.guard.Unlock()
+	payloads := make([]string, 0, len(router.messages))
+	for _, msg := range router.messages {
+		payloads = append(payloads, msg.String())
+	}
+	return payloads
+}
+
+var testProducerCount = 0
+
+func newTestProducer(t *testing.T, typename string, settings map[string]interface{}) core.Producer {
+	expect := ttesting.NewExpect(t)
+
+	// Plugin IDs have to be unique
+	testProducerCount++
+	conf := core.NewPluginConfig(fmt.Sprintf("testprod%d", testProducerCount), typename)
+	for key, value := range settings {
+		conf.Override(key, value)
+	}
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+
+	prod, casted := plugin.(core.Producer)
+	expect.True(casted)
+	return prod
+}
+
+func newTestMessage(payload string, metadata map[string]string) *core.Message {
+	msg := core.NewMessage(nil, []byte(payload), nil, core.GetStreamID("access"))
+	for key, value := range metadata {
+		msg.GetMetadata().SetValue(key, []byte(value))
+	}
+	return msg
+}
+
 func TestProducerInterface(t *testing.T) {
 	producers := core.TypeRegistry.GetRegistered("producer.")
 	if len(producers) == 0 {
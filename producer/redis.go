@@ -43,7 +43,7 @@ import (
 // By default this is set to "default".
 //
 // - Storage: Defines the type of the storage to use. Valid values are: "hash",
-// "list", "set", "sortedset", "string". By default this is set to "hash".
+// "list", "set", "sortedset", "stream", "string". By default this is set to "hash".
 //
 // - KeyFrom: Defines the name of the metadata field used as a key for messages
 // sent to redis. If the name is an empty string no key is sent. By default
@@ -53,6 +53,14 @@ import (
 // sent to redis. If the name is an empty string no key is sent. By default
 // this value is set to an empty string.
 //
+// - StreamField: Defines the field of a stream entry the message is stored in.
+// This setting is only used if Storage is set to "stream". By default this is
+// set to "message".
+//
+// - StreamMaxLen: Defines the approximate maximum number of entries of a
+// stream. Older entries are trimmed when new entries are added. If set to 0,
+// streams are not trimmed. By default this is set to 0.
+//
 // Examples
 //
 // .
@@ -71,6 +79,8 @@ type Redis struct {
 	database              int    `config:"Database" default:"0"`
 	key                   string `config:"KeyFrom"`
 	field                 string `config:"FieldFrom"`
+	streamField           string `config:"StreamField" default:"message"`
+	streamMaxLen          int64  `config:"StreamMaxLen" default:"0"`
 	client                *redis.Client
 	store                 func(msg *core.Message)
 }
@@ -94,6 +104,8 @@ func (prod *Redis) Configure(conf core.PluginConfigReader) {
 		prod.store = prod.storeSet
 	case "sortedset":
 		prod.store = prod.storeSortedSet
+	case "stream":
+		prod.store = prod.storeStream
 	default:
 		fallthrough
 	case "string":
@@ -165,6 +177,20 @@ func (prod *Redis) storeSortedSet(msg *core.Message) {
 	}
 }
 
+func (prod *Redis) storeStream(msg *core.Message) {
+	value, key := prod.getValueAndKey(msg)
+
+	result := prod.client.XAdd(&redis.XAddArgs{
+		Stream:       string(key),
+		MaxLenApprox: prod.streamMaxLen,
+		Values:       map[string]interface{}{prod.streamField: string(value)},
+	})
+	if result.Err() != nil {
+		prod.Logger.Error("Redis: ", result.Err())
+		prod.TryFallback(msg)
+	}
+}
+
 func (prod *Redis) storeString(msg *core.Message) {
 	value, key := prod.getValueAndKey(msg)
 
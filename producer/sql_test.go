@@ -0,0 +1,198 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+// sqlTestDriver is a database/sql driver that stores the values of all
+// committed statements by data source name. Statements containing the value
+// "fail" return an error.
+type sqlTestDriver struct {
+	guard  sync.Mutex
+	tables map[string][]string
+}
+
+type sqlTestConn struct {
+	driver *sqlTestDriver
+	name   string
+	values []string
+}
+
+type sqlTestStmt struct {
+	conn *sqlTestConn
+}
+
+var testSQLDriver = &sqlTestDriver{tables: make(map[string][]string)}
+
+func init() {
+	sql.Register("sqltest", testSQLDriver)
+}
+
+func (d *sqlTestDriver) Open(name string) (driver.Conn, error) {
+	return &sqlTestConn{driver: d, name: name}, nil
+}
+
+func (d *sqlTestDriver) getTable(name string) []string {
+	d.guard.Lock()
+	defer d.guard.Unlock()
+	return d.tables[name]
+}
+
+func (conn *sqlTestConn) Prepare(query string) (driver.Stmt, error) {
+	return &sqlTestStmt{conn}, nil
+}
+
+func (conn *sqlTestConn) Close() error {
+	return nil
+}
+
+func (conn *sqlTestConn) Begin() (driver.Tx, error) {
+	conn.values = nil
+	return conn, nil
+}
+
+func (conn *sqlTestConn) Commit() error {
+	conn.driver.guard.Lock()
+	defer conn.driver.guard.Unlock()
+	conn.driver.tables[conn.name] = append(conn.driver.tables[conn.name], conn.values...)
+	return nil
+}
+
+func (conn *sqlTestConn) Rollback() error {
+	conn.values = nil
+	return nil
+}
+
+func (stmt *sqlTestStmt) Close() error {
+	return nil
+}
+
+func (stmt *sqlTestStmt) NumInput() int {
+	return -1
+}
+
+func (stmt *sqlTestStmt) Exec(args []driver.Value) (driver.Result, error) {
+	for _, arg := range args {
+		if arg == "fail" {
+			return nil, fmt.Errorf("row rejected")
+		}
+	}
+	for _, arg := range args {
+		stmt.conn.values = append(stmt.conn.values, fmt.Sprint(arg))
+	}
+	return driver.RowsAffected(len(args)), nil
+}
+
+func (stmt *sqlTestStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func newTestSQL(t *testing.T, settings map[string]interface{}) *SQL {
+	return newTestProducer(t, "producer.SQL", settings).(*SQL)
+}
+
+func TestSQLInsertStatement(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	prod := newTestSQL(t, map[string]interface{}{
+		"Table":   "public.events",
+		"Columns": map[string]string{"id": "json:id", "name": "json:user.name"},
+	})
+	expect.Equal(`INSERT INTO "public"."events" ("id", "name") VALUES ($1, $2), ($3, $4)`, prod.getInsertStatement(2))
+
+	prod = newTestSQL(t, map[string]interface{}{
+		"Placeholder":  "?",
+		"Columns":      map[string]string{"id": "json:id", "name": "json:user.name", "source": "meta:source"},
+		"ConflictKeys": []string{"id"},
+	})
+	expect.Equal(`INSERT INTO "gollum" ("id", "name", "source") VALUES (?, ?, ?) `+
+		`ON CONFLICT ("id") DO UPDATE SET "name" = EXCLUDED."name", "source" = EXCLUDED."source"`, prod.getInsertStatement(1))
+}
+
+func TestSQLRow(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	prod := newTestSQL(t, map[string]interface{}{
+		"Columns": map[string]string{
+			"count":  "json:count",
+			"ratio":  "json:ratio",
+			"tags":   "json:tags",
+			"name":   "json:user.name",
+			"source": "meta:source",
+			"region": "meta:region",
+		},
+	})
+
+	msg := newTestMessage(`{"count":3,"ratio":0.5,"tags":["a"],"user":{"name":"x"}}`, map[string]string{"source": "web"})
+	row, err := prod.newRow(msg)
+	expect.NoError(err)
+
+	// Columns are sorted by name
+	expect.Equal([]interface{}{int64(3), "x", 0.5, nil, "web", `["a"]`}, row.values)
+
+	_, err = prod.newRow(newTestMessage(`not json`, nil))
+	expect.NotNil(err)
+}
+
+func TestSQLQuoteIdentifier(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	prod := newTestSQL(t, map[string]interface{}{
+		"Driver":          "sqltest",
+		"IdentifierQuote": "`",
+	})
+	expect.Equal("`public`.`a``b`", prod.quoteIdentifier("public.a`b"))
+	expect.Equal("INSERT INTO `gollum` (`payload`) VALUES (?)", prod.getInsertStatement(1))
+
+	prod = newTestSQL(t, map[string]interface{}{
+		"Driver":          "sqltest",
+		"IdentifierQuote": "none",
+	})
+	expect.Equal("public.events", prod.quoteIdentifier("public.events"))
+}
+
+func TestSQLWriteOrSplit(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	fallback := newTestFallbackRouter("sqlTestWriteOrSplitFallback")
+	prod := newTestSQL(t, map[string]interface{}{
+		"Driver":           "sqltest",
+		"Connection":       "writeOrSplit",
+		"RowsPerStatement": 2,
+		"FallbackStream":   "sqlTestWriteOrSplitFallback",
+	})
+
+	messages := []*core.Message{}
+	for _, payload := range []string{"a", "b", "fail", "c", "d", "e", "fail", "f"} {
+		messages = append(messages, newTestMessage(payload, nil))
+	}
+	prod.submitMessages(messages)
+
+	// Only the failing rows are passed to the fallback
+	expect.Equal([]string{"fail", "fail"}, fallback.payloads())
+	for _, msg := range fallback.getMessages() {
+		expect.Equal("row rejected", msg.GetMetadata().GetValueString("error"))
+	}
+	expect.Equal([]string{"a", "b", "c", "d", "e", "f"}, testSQLDriver.getTable("writeOrSplit"))
+}